@@ -0,0 +1,34 @@
+package main
+
+// fakes3 runs the in-memory S3 stand-in of internal/storage/s3test as a
+// server, for trying out the forum's S3 upload storage without an
+// account anywhere. It checks Signature Version 4 signatures against a
+// single access key, so signing mistakes show up just as they would
+// against the real thing. Run it next to the forum with
+//
+//   go run ./cmd/fakes3 -addr :9001
+//
+// and start the forum with
+//
+//   FORUM_S3_SECRET_KEY=secret forum -s3-endpoint http://localhost:9001 \
+//     -s3-bucket forum -s3-access-key forum -s3-path-style
+
+import (
+    "flag"
+    "log"
+    "net/http"
+
+    "forum/internal/storage/s3test"
+)
+
+func main() {
+    addr := flag.String("addr", ":9001", "HTTP listen address")
+    accessKey := flag.String("access-key", "forum", "accepted access key")
+    secretKey := flag.String("secret-key", "secret", "secret key of the access key")
+    region := flag.String("region", "us-east-1", "signing region")
+    flag.Parse()
+    fake := s3test.New(*accessKey, *secretKey, *region)
+    fake.Logf = log.Printf
+    log.Printf("fake S3 listening on %s", *addr)
+    log.Fatal(http.ListenAndServe(*addr, fake))
+}
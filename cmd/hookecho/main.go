@@ -0,0 +1,90 @@
+package main
+
+// hookecho is a webhook receiver for trying out and testing the forum's
+// webhooks without a chat or ticketing service. It checks the signature
+// of every request with the webhook's secret, prints the event and its
+// JSON payload, and ignores repeated deliveries. To see retries it can
+// fail the first requests it gets. Run it next to the forum with
+//
+//   go run ./cmd/hookecho -addr :9002 -secret <secret>
+//
+// add a webhook for http://localhost:9002/ at /admin/webhooks and copy
+// its secret into -secret.
+
+import (
+    "bytes"
+    "encoding/json"
+    "flag"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "sync"
+    "time"
+
+    "forum/internal/webhook"
+)
+
+// receiver handles the webhook requests.
+type receiver struct {
+    secret string
+
+    mu   sync.Mutex
+    fail int
+    seen map[string]bool
+}
+
+func main() {
+    addr := flag.String("addr", ":9002", "HTTP listen address")
+    secret := flag.String("secret", "", "secret of the webhook (required)")
+    fail := flag.Int("fail", 0, "answer the first N valid requests with 500 to exercise retries")
+    flag.Parse()
+    if *secret == "" {
+        log.Fatal("-secret is required")
+    }
+    rc := &receiver{secret: *secret, fail: *fail, seen: make(map[string]bool)}
+    log.Printf("webhook receiver listening on %s", *addr)
+    log.Fatal(http.ListenAndServe(*addr, rc))
+}
+
+// ServeHTTP checks and prints one delivery.
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    event := r.Header.Get(webhook.HeaderEvent)
+    delivery := r.Header.Get(webhook.HeaderDelivery)
+    if err := webhook.Verify(rc.secret, r.Header, body, time.Now()); err != nil {
+        log.Printf("rejected %s delivery %s: %v", event, delivery, err)
+        http.Error(w, err.Error(), http.StatusUnauthorized)
+        return
+    }
+    rc.mu.Lock()
+    defer rc.mu.Unlock()
+    if rc.fail > 0 {
+        rc.fail--
+        log.Printf("failing %s delivery %s on purpose (%d more to fail)", event, delivery, rc.fail)
+        http.Error(w, "failing on purpose", http.StatusInternalServerError)
+        return
+    }
+    if rc.seen[delivery] {
+        log.Printf("%s delivery %s again, ignored", event, delivery)
+        fmt.Fprintln(w, "already received")
+        return
+    }
+    rc.seen[delivery] = true
+    var pretty bytes.Buffer
+    if err := json.Indent(&pretty, body, "", "  "); err != nil {
+        log.Printf("%s delivery %s is not valid JSON: %v", event, delivery, err)
+        http.Error(w, "invalid JSON", http.StatusBadRequest)
+        return
+    }
+    log.Printf("%s delivery %s:\n%s", event, delivery, pretty.String())
+    fmt.Fprintln(w, "ok")
+}
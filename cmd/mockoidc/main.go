@@ -0,0 +1,39 @@
+package main
+
+// mockoidc runs the fake OpenID Connect provider of
+// internal/oauth/oauthtest as a server, for trying out the forum's
+// "log in with ..." support without registering an application
+// anywhere. It is NOT secure: anyone can log in as any email address.
+// Run it next to the forum with
+//
+//   go run ./cmd/mockoidc -addr :9000
+//
+// and point an "oidc" provider at it:
+//
+//   {"providers": [{"name": "mock", "title": "Mock", "type": "oidc",
+//     "issuer": "http://localhost:9000", "client_id": "forum",
+//     "client_secret": "secret"}]}
+
+import (
+    "flag"
+    "log"
+    "net/http"
+    "strings"
+
+    "forum/internal/oauth/oauthtest"
+)
+
+func main() {
+    addr := flag.String("addr", ":9000", "HTTP listen address")
+    issuer := flag.String("issuer", "", "issuer URL (defaults to http://localhost<addr>)")
+    clientID := flag.String("client-id", "forum", "accepted client ID")
+    clientSecret := flag.String("client-secret", "secret", "accepted client secret")
+    flag.Parse()
+    if *issuer == "" {
+        *issuer = "http://localhost" + *addr
+    }
+    p := oauthtest.New(*clientID, *clientSecret)
+    p.Issuer = strings.TrimSuffix(*issuer, "/")
+    log.Printf("mock OpenID provider %s listening on %s", p.Issuer, *addr)
+    log.Fatal(http.ListenAndServe(*addr, p))
+}
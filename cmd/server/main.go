@@ -5,20 +5,31 @@ package main
 // emphasize how the application is composed from smaller packages.
 
 import (
+    "context"
     "database/sql"
     "flag"
     "fmt"
     "log"
+    "net"
     "net/http"
+    "net/url"
     "os"
     "path/filepath"
+    "strings"
+    "sync"
     "time"
 
     // Import our internal packages.  Note that the module name declared in
     // go.mod is `forum`, so any packages inside the repository can be
     // referenced as `forum/internal/...`.
     "forum/internal/app"
+    forumdb "forum/internal/db"
+    "forum/internal/live"
+    "forum/internal/mail"
+    "forum/internal/oauth"
     "forum/internal/server"
+    "forum/internal/storage"
+    "forum/internal/web"
 
     // Register the sqlite3 driver. Without the blank import the driver
     // doesn't register itself and sql.Open would fail.
@@ -31,19 +42,84 @@ main configures the application and starts the HTTP server.
 It parses a few flags that allow the caller to customise the HTTP
 listen address, the location where the SQLite database file is
 created and the directory containing our HTML templates. Next it
-ensures the data directory exists, opens the database and runs our
-schema creation script. Finally it loads the HTML templates, wires
-together the HTTP handlers and starts the web server.
+ensures the data directory exists, opens the database and applies any
+pending schema migrations. Finally it loads the HTML templates, wires
+together the HTTP handlers and starts the web server, which runs until
+SIGINT or SIGTERM and then shuts down gracefully.
+
+When invoked as `forum migrate up|down|status` the server is not
+started; the migration command runs against the database and exits.
+Likewise `forum role <username> <role>` assigns a role and exits.
 */
 func main() {
     // Define command‑line flags. These allow the developer to override
     // defaults without changing code. The `addr` flag controls the
     // listening address, `data` controls where the SQLite file is
-    // stored and `templates` points at the directory containing our
-    // template files.
+    // stored. Templates and static files are built into the binary;
+    // `templates` and `static` point at directories to use instead,
+    // and `dev` reads internal/web from disk and picks up template
+    // edits without a restart.
     addr := flag.String("addr", ":8080", "http listen address")
     dataDir := flag.String("data", "./data", "data directory for sqlite")
-    tplDir := flag.String("templates", "./internal/web/templates", "templates dir")
+    tplDir := flag.String("templates", "", "templates dir to use instead of the built-in templates")
+    staticDir := flag.String("static", "", "static files dir to use instead of the built-in files")
+    dev := flag.Bool("dev", false, "read templates and static files from disk (default ./internal/web/...) and reload edited templates")
+    commentDepth := flag.Int("comment-depth", 5, "reply levels shown on a post page before \"continue this thread\" links")
+    // Outgoing mail such as password reset links goes through an SMTP
+    // server when `smtp-addr` is set. The SMTP password is read from
+    // the FORUM_SMTP_PASSWORD environment variable so it does not show
+    // up in the process list. Without a server, messages are written
+    // to `mail-dir` or, if that is empty too, to the log.
+    smtpAddr := flag.String("smtp-addr", "", "SMTP server host:port for outgoing mail")
+    smtpFrom := flag.String("smtp-from", "forum@localhost", "sender address of outgoing mail")
+    smtpUser := flag.String("smtp-user", "", "SMTP username (password from $FORUM_SMTP_PASSWORD)")
+    mailDir := flag.String("mail-dir", "", "directory to write mail to when no SMTP server is set")
+    // Accounts that do not confirm their email address within
+    // `unverified-ttl` are deleted by a background job.
+    unverifiedTTL := flag.Duration("unverified-ttl", 7*24*time.Hour, "delete accounts not verified within this time (0 keeps them)")
+    // Behind a reverse proxy the client address is taken from the
+    // X-Forwarded-For header, which is only trustworthy when the proxy
+    // sets it.
+    trustProxy := flag.Bool("trust-proxy", false, "take client IPs from X-Forwarded-For (only behind a reverse proxy)")
+    // Posting, commenting and reacting are rate limited per user, or
+    // per IP address for anonymous API clients. The flag overrides
+    // individual routes of server.DefaultRateRules.
+    rateLimits := flag.String("rate-limits", "", "override rate limits, e.g. \"post=10/1h,comment=30/10m,reaction=off\"")
+    // External identity providers for "log in with ..." are described
+    // in a JSON file; see internal/oauth for the format.
+    oauthConfig := flag.String("oauth-config", "", "JSON file configuring OAuth/OpenID Connect login providers")
+    // Uploaded images are stored below `upload-dir`, by default inside
+    // the data directory, or in an S3-compatible bucket when
+    // `s3-bucket` is set. The S3 secret key is read from the
+    // FORUM_S3_SECRET_KEY environment variable, like the SMTP password.
+    uploadDir := flag.String("upload-dir", "", "directory for uploaded images (default <data>/uploads)")
+    maxUpload := flag.Int64("max-upload", app.DefaultMaxUploadSize, "largest accepted image upload in bytes")
+    s3Endpoint := flag.String("s3-endpoint", "https://s3.amazonaws.com", "S3-compatible endpoint URL")
+    s3Bucket := flag.String("s3-bucket", "", "store uploads in this S3 bucket instead of on disk")
+    s3Region := flag.String("s3-region", "us-east-1", "S3 signing region")
+    s3AccessKey := flag.String("s3-access-key", "", "S3 access key (secret from $FORUM_S3_SECRET_KEY)")
+    s3PathStyle := flag.Bool("s3-path-style", false, "address the bucket as endpoint/bucket (needed by most self-hosted services)")
+    // Links in email and feeds need the public address of the forum.
+    // Mail links are never built from the request's Host header, which
+    // the client chooses, so `base-url` is required with `smtp-addr`.
+    // When mail is only written locally it defaults to the listen
+    // address on localhost.
+    baseURL := flag.String("base-url", "", "public URL of the forum for links in email and feeds, e.g. https://forum.example.com (required with -smtp-addr)")
+    // Every open post page holds a live update stream, and with it a
+    // connection. The limits keep a flood of streams from using up the
+    // server's connections and memory.
+    maxLive := flag.Int("max-live", 1000, "most live update streams open at once (0 for no limit)")
+    maxLivePerIP := flag.Int("max-live-per-ip", 20, "most live update streams open from one IP address (0 for no limit)")
+    // The timeouts stop slow or stuck clients from holding connections
+    // open. Reading covers the whole request including uploads, writing
+    // runs from the end of the request headers to the end of the
+    // response; live update streams lift both. On SIGINT or SIGTERM
+    // the server drains: see serve.go.
+    readTimeout := flag.Duration("read-timeout", 30*time.Second, "longest time to read a request, including its body (0 for no limit)")
+    writeTimeout := flag.Duration("write-timeout", time.Minute, "longest time to handle a request and write the response (0 for no limit)")
+    idleTimeout := flag.Duration("idle-timeout", 2*time.Minute, "how long idle keep-alive connections are kept open")
+    drainDelay := flag.Duration("drain-delay", 0, "on shutdown, keep serving this long after /readyz fails so load balancers can notice")
+    shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "on shutdown, how long to wait for requests in flight")
     flag.Parse()
 
     // Create the data directory if it doesn't already exist. The
@@ -56,76 +132,309 @@ func main() {
 
     // Open (or create) the SQLite database. The `database/sql` package
     // handles connection pooling for us. Note the driver name `sqlite3`
-    // comes from the blank import above.
+    // comes from the blank import above. SQLite ignores foreign keys
+    // unless asked, so we enable them to make ON DELETE CASCADE remove
+    // comments and category links when a post is deleted.
     dbPath := filepath.Join(*dataDir, "forum.db")
-    db, err := sql.Open("sqlite3", dbPath)
+    db, err := sql.Open("sqlite3", dbPath+"?_foreign_keys=on")
     if err != nil {
         log.Fatalf("unable to open database: %v", err)
     }
     defer db.Close()
 
-    // Read the schema SQL from our embedded file and execute it. The
-    // schema contains `CREATE TABLE` statements wrapped in IF NOT
-    // EXISTS clauses so it's safe to run on every startup.
-    schema, err := os.ReadFile("internal/db/schema.sql")
+    // The migrate subcommand manages the schema by hand and exits
+    // without starting the web server, e.g. `forum migrate status`.
+    if flag.Arg(0) == "migrate" {
+        if err := runMigrate(db, flag.Args()[1:]); err != nil {
+            log.Fatalf("migrate: %v", err)
+        }
+        return
+    }
+
+    // Bring the schema up to date. Pending migrations embedded in the
+    // binary are applied in order; migrations that already ran are
+    // skipped, so existing data is preserved across upgrades.
+    applied, err := forumdb.Up(db)
     if err != nil {
-        log.Fatalf("failed reading schema: %v", err)
+        // The search migration needs FTS5, which the sqlite3 driver
+        // only compiles in when asked to.
+        if strings.Contains(err.Error(), "fts5") {
+            log.Fatalf("failed migrating database: %v (build with -tags sqlite_fts5)", err)
+        }
+        log.Fatalf("failed migrating database: %v", err)
+    }
+    for _, m := range applied {
+        fmt.Printf("applied migration %04d_%s\n", m.Version, m.Name)
     }
-    if _, err := db.Exec(string(schema)); err != nil {
-        log.Fatalf("failed executing schema: %v", err)
+
+    // The role subcommand runs against the migrated schema, e.g.
+    // `forum role alice admin`, and exits.
+    if flag.Arg(0) == "role" {
+        if err := runRole(db, flag.Args()[1:]); err != nil {
+            log.Fatalf("role: %v", err)
+        }
+        return
     }
 
-    // Parse all templates in the provided directory. The server
-    // package walks the directory, loads the shared layout and parses
-    // each page into a single Template object. The returned map is
-    // keyed by filename (e.g. index.html).
-    tpls, err := server.LoadTemplates(*tplDir)
+    // Parse all templates. The server package loads the shared layout
+    // and parses each page into a single Template object, keyed by
+    // filename (e.g. index.html). They come from the binary unless a
+    // directory is given; in dev mode they are read from disk and
+    // parsed again whenever a file changes.
+    if *dev {
+        if *tplDir == "" {
+            *tplDir = "./internal/web/templates"
+        }
+        if *staticDir == "" {
+            *staticDir = "./internal/web/static"
+        }
+    }
+    var tpls app.TemplateSet
+    switch {
+    case *dev:
+        tpls, err = server.NewReloadingTemplates(*tplDir)
+    case *tplDir != "":
+        tpls, err = server.LoadTemplates(os.DirFS(*tplDir))
+    default:
+        tpls, err = server.LoadTemplates(web.Templates())
+    }
+    if err != nil && *tplDir != "" {
+        log.Fatalf("failed loading templates from %s: %v", *tplDir, err)
+    }
     if err != nil {
         log.Fatalf("failed loading templates: %v", err)
     }
 
+    // Static files are served from the binary too, or read from
+    // static on every request.
+    static := web.Static()
+    if *staticDir != "" {
+        if fi, err := os.Stat(*staticDir); err != nil || !fi.IsDir() {
+            log.Fatalf("invalid static files dir %s: not a directory", *staticDir)
+        }
+        static = os.DirFS(*staticDir)
+    }
+
+    // Pick the mail transport.
+    var mailer mail.Mailer
+    if *smtpAddr != "" {
+        mailer = &mail.SMTPMailer{
+            Addr:     *smtpAddr,
+            From:     *smtpFrom,
+            Username: *smtpUser,
+            Password: os.Getenv("FORUM_SMTP_PASSWORD"),
+        }
+    } else {
+        mailer = &mail.LogMailer{Dir: *mailDir, From: *smtpFrom}
+    }
+
+    // Load the identity providers, if any.
+    var providers []*oauth.Provider
+    if *oauthConfig != "" {
+        providers, err = oauth.LoadConfig(*oauthConfig)
+        if err != nil {
+            log.Fatalf("failed loading oauth config: %v", err)
+        }
+    }
+
+    if *baseURL == "" {
+        if *smtpAddr != "" {
+            log.Fatalf("-smtp-addr needs -base-url: links in email are only built from the configured address")
+        }
+        host, port, err := net.SplitHostPort(*addr)
+        if err != nil {
+            log.Fatalf("invalid -addr %q: %v", *addr, err)
+        }
+        if host == "" {
+            host = "localhost"
+        }
+        *baseURL = "http://" + net.JoinHostPort(host, port)
+        log.Printf("no -base-url given; links in email and feeds point to %s", *baseURL)
+    } else {
+        u, err := url.Parse(*baseURL)
+        if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+            log.Fatalf("invalid -base-url %q: want an http or https URL such as https://forum.example.com", *baseURL)
+        }
+    }
+
+    // Pick the upload storage.
+    var store storage.Storage
+    if *s3Bucket != "" {
+        store = &storage.S3{
+            Endpoint:  *s3Endpoint,
+            Region:    *s3Region,
+            Bucket:    *s3Bucket,
+            AccessKey: *s3AccessKey,
+            SecretKey: os.Getenv("FORUM_S3_SECRET_KEY"),
+            PathStyle: *s3PathStyle,
+        }
+    } else {
+        if *uploadDir == "" {
+            *uploadDir = filepath.Join(*dataDir, "uploads")
+        }
+        store = &storage.Local{Dir: *uploadDir}
+    }
+
+    rules, err := server.ParseRateLimits(*rateLimits, server.DefaultRateRules)
+    if err != nil {
+        log.Fatalf("invalid -rate-limits: %v", err)
+    }
+
     // Build the application context. All HTTP handlers receive a
     // pointer to this struct so they can access the shared database,
     // templates and session configuration. CookieName is the name of
     // the session cookie and SessionTTL determines how long a login
-    // session should live.
+    // session should live. MaxCommentDepth limits how deeply reply
+    // threads are nested on a post page, Mailer sends account email
+    // and TrustProxy decides where client IPs are read from.
+    // OAuthProviders lists the external identity providers and Storage
+    // keeps uploaded images of up to MaxUploadSize bytes. BaseURL is
+    // the public address used in email and feeds. Live carries new
+    // comments and reactions to the browsers showing a post.
     appCtx := &app.App{
-        DB:         db,
-        Templates:  tpls,
-        CookieName: "forum_session",
-        SessionTTL: 7 * 24 * time.Hour, // one week
+        DB:              db,
+        Templates:       tpls,
+        CookieName:      "forum_session",
+        SessionTTL:      7 * 24 * time.Hour, // one week
+        MaxCommentDepth: *commentDepth,
+        Mailer:          mailer,
+        TrustProxy:      *trustProxy,
+        OAuthProviders:  providers,
+        Storage:         store,
+        MaxUploadSize:   *maxUpload,
+        BaseURL:         *baseURL,
+        Live:            &live.Hub{MaxSubscribers: *maxLive, MaxPerClient: *maxLivePerIP},
     }
 
+    // Background workers run until the server has shut down. Cancelling
+    // workers stops them and the WaitGroup tells when they are done.
+    workers, stopWorkers := context.WithCancel(context.Background())
+    var wg sync.WaitGroup
+
+    // Purge expired tokens, sessions and old delivery logs, and remove
+    // accounts that were never verified, once an hour.
+    wg.Add(1)
+    go func() {
+        defer wg.Done()
+        appCtx.RunPurge(workers, time.Hour, *unverifiedTTL)
+    }()
+
+    // Send queued webhook deliveries, including those left over from
+    // before a restart. A delivery cut off by the shutdown is sent
+    // again after the next start.
+    wg.Add(1)
+    go func() {
+        defer wg.Done()
+        appCtx.RunWebhooks(workers)
+    }()
+
     // Set up the HTTP routes. We use a ServeMux rather than
     // http.DefaultServeMux so that no third party packages can insert
     // handlers without us noticing. Some routes are wrapped in the
     // RequireAuth middleware to ensure the user is logged in before
-    // proceeding.
+    // proceeding, or in RequireRole for pages limited to moderators
+    // and admins.
     mux := http.NewServeMux()
     mux.HandleFunc("/", appCtx.HandleIndex)
     mux.HandleFunc("/register", appCtx.HandleRegister)
     mux.HandleFunc("/login", appCtx.HandleLogin)
+    mux.HandleFunc("/login/2fa", appCtx.HandleLogin2FA)
     mux.HandleFunc("/logout", appCtx.HandleLogout)
+    mux.HandleFunc("/password/forgot", appCtx.HandleForgotPassword)
+    mux.HandleFunc("/password/reset", appCtx.HandleResetPassword)
     mux.HandleFunc("/post", appCtx.HandleShowPost)
-    mux.HandleFunc("/post/new", appCtx.RequireAuth(appCtx.HandleNewPost))
-    mux.HandleFunc("/comment/new", appCtx.RequireAuth(appCtx.HandleNewComment))
+    // Atom and RSS feeds of new posts and of the comments on a post.
+    mux.HandleFunc("/feed.atom", appCtx.HandleFeed)
+    mux.HandleFunc("/feed.rss", appCtx.HandleFeed)
+    mux.HandleFunc("/post/feed.atom", appCtx.HandlePostFeed)
+    mux.HandleFunc("/post/feed.rss", appCtx.HandlePostFeed)
+    mux.HandleFunc("/post/events", appCtx.HandlePostEvents)
+    mux.HandleFunc("/verify", appCtx.HandleVerify)
+    mux.HandleFunc("/verify/resend", appCtx.RequireAuth(appCtx.HandleResendVerification))
+    mux.HandleFunc("/user/", appCtx.HandleUserProfile)
+    mux.HandleFunc("/account/settings", appCtx.RequireAuth(appCtx.HandleAccountSettings))
+    mux.HandleFunc("/account/email", appCtx.HandleConfirmEmailChange)
+    mux.HandleFunc("/account/2fa", appCtx.RequireAuth(appCtx.HandleTwoFactor))
+    mux.HandleFunc("/account/sessions", appCtx.RequireAuth(appCtx.HandleAccountSessions))
+    mux.HandleFunc("/account/identities", appCtx.RequireAuth(appCtx.HandleAccountIdentities))
+    mux.HandleFunc("/notifications", appCtx.RequireAuth(appCtx.HandleNotifications))
+    mux.HandleFunc("/uploads/", appCtx.HandleUpload)
+    mux.HandleFunc("/oauth/start", appCtx.HandleOAuthStart)
+    mux.HandleFunc("/oauth/callback/", appCtx.HandleOAuthCallback)
+    // Creating content additionally needs a verified email address.
+    mux.HandleFunc("/post/new", appCtx.RequireVerified(appCtx.HandleNewPost))
+    mux.HandleFunc("/post/edit", appCtx.RequireAuth(appCtx.HandleEditPost))
+    mux.HandleFunc("/post/delete", appCtx.RequireAuth(appCtx.HandleDeletePost))
+    mux.HandleFunc("/comment/new", appCtx.RequireVerified(appCtx.HandleNewComment))
+    mux.HandleFunc("/account/uploads", appCtx.RequireVerified(appCtx.HandleAccountUploads))
+    mux.HandleFunc("/account/avatar", appCtx.RequireVerified(appCtx.HandleAccountAvatar))
+    mux.HandleFunc("/comment/edit", appCtx.RequireAuth(appCtx.HandleEditComment))
+    mux.HandleFunc("/comment/delete", appCtx.RequireAuth(appCtx.HandleDeleteComment))
+    mux.HandleFunc("/revisions", appCtx.HandleRevisions)
+    mux.HandleFunc("/search", appCtx.HandleSearch)
+    // The JSON API routes its own sub-paths and reports errors as
+    // JSON, so it is mounted as a single subtree.
+    mux.HandleFunc("/api/v1/", appCtx.HandleAPI)
     mux.HandleFunc("/like", appCtx.RequireAuth(appCtx.HandleLike))
-    // Serve static assets such as CSS and images from the
-    // internal/web/static directory. The files are served under the
-    // /static/ prefix.
-    mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("./internal/web/static"))))
-
-    // Wrap the mux in our middleware. WithCustomErrors will trap
-    // panics (500) and intercept 404 responses, rendering the
-    // appropriate error pages. LogRequest records each request in the
-    // terminal along with the duration.
-    handler := server.LogRequest(server.WithCustomErrors(mux, appCtx))
-
-    // Start the HTTP server. ListenAndServe returns only when the
-    // server shuts down or fails to bind. We print a friendly message
-    // letting the user know where to point their browser.
+    // The admin area is restricted to users with the admin role.
+    mux.HandleFunc("/admin/users", appCtx.RequireRole(app.RoleAdmin, appCtx.HandleAdminUsers))
+    mux.HandleFunc("/admin/categories", appCtx.RequireRole(app.RoleAdmin, appCtx.HandleAdminCategories))
+    mux.HandleFunc("/admin/settings", appCtx.RequireRole(app.RoleAdmin, appCtx.HandleAdminSettings))
+    mux.HandleFunc("/admin/lockouts", appCtx.RequireRole(app.RoleAdmin, appCtx.HandleAdminLockouts))
+    mux.HandleFunc("/admin/webhooks", appCtx.RequireRole(app.RoleAdmin, appCtx.HandleAdminWebhooks))
+    // Serve static assets such as CSS and images, from the binary or
+    // the static directory. The files are served under the /static/
+    // prefix.
+    mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.FS(static))))
+
+    // Wrap the mux in our middleware. WithRateLimit answers clients
+    // that create content too quickly with 429. WithCSRF issues CSRF
+    // tokens and rejects state-changing requests without a valid one;
+    // it runs first so that forged requests cannot use up a victim's
+    // rate limit. WithBodyLimit caps request bodies before WithCSRF
+    // parses them, leaving 1 MiB beyond the largest upload for the
+    // rest of the form. WithCustomErrors will trap panics (500) and
+    // intercept 404, 400, 413 and 429 responses, rendering the
+    // appropriate error pages, including for requests rejected by
+    // WithCSRF. LogRequest records each request in the terminal along
+    // with the duration.
+    limited := server.WithRateLimit(mux, appCtx, server.NewRateLimiter(rules))
+    protected := server.WithBodyLimit(server.WithCSRF(limited, appCtx), *maxUpload+1<<20)
+    handler := server.LogRequest(server.WithCustomErrors(protected, appCtx))
+
+    // The health probes sit in front of everything else; see
+    // server.Health. ReadHeaderTimeout is kept short whatever
+    // read-timeout says, so that connections that never finish their
+    // headers are dropped quickly.
+    health := &server.Health{DB: db}
+    srv := &http.Server{
+        Addr:              *addr,
+        Handler:           health.Handler(handler),
+        ReadHeaderTimeout: 10 * time.Second,
+        ReadTimeout:       *readTimeout,
+        WriteTimeout:      *writeTimeout,
+        IdleTimeout:       *idleTimeout,
+    }
+    // Live update streams never finish by themselves. Closing the hub
+    // ends them when the shutdown starts, and browsers reconnect to
+    // the next server.
+    srv.RegisterOnShutdown(appCtx.Live.Close)
+
+    // Start the HTTP server. serve returns once the server has shut
+    // down after a signal, or fails to bind. We print a friendly
+    // message letting the user know where to point their browser.
     fmt.Printf("listening on %s\n", *addr)
-    if err := http.ListenAndServe(*addr, handler); err != nil {
+    if err := serve(srv, health, *drainDelay, *shutdownTimeout); err != nil {
         log.Fatalf("server error: %v", err)
     }
+
+    // No requests are running any more. Stop the workers, let mail
+    // that is being sent go out and close the database.
+    stopWorkers()
+    wg.Wait()
+    appCtx.WaitBackground()
+    if err := db.Close(); err != nil {
+        log.Fatalf("closing database: %v", err)
+    }
+    fmt.Println("stopped")
 }
\ No newline at end of file
@@ -0,0 +1,61 @@
+package main
+
+// This file implements the `migrate` subcommand which lets operators
+// inspect and move the database schema without starting the server.
+
+import (
+    "database/sql"
+    "errors"
+    "fmt"
+
+    forumdb "forum/internal/db"
+)
+
+// runMigrate executes one of the migration actions:
+//   up     – apply every pending migration
+//   down   – revert the most recently applied migration
+//   status – list all migrations and whether they have been applied
+// Any other action results in a usage error.
+func runMigrate(db *sql.DB, args []string) error {
+    if len(args) != 1 {
+        return errors.New("usage: forum migrate up|down|status")
+    }
+    switch args[0] {
+    case "up":
+        applied, err := forumdb.Up(db)
+        for _, m := range applied {
+            fmt.Printf("applied %04d_%s\n", m.Version, m.Name)
+        }
+        if err != nil {
+            return err
+        }
+        if len(applied) == 0 {
+            fmt.Println("database is up to date")
+        }
+    case "down":
+        m, err := forumdb.Down(db)
+        if err != nil {
+            return err
+        }
+        if m == nil {
+            fmt.Println("no migrations to revert")
+            return nil
+        }
+        fmt.Printf("reverted %04d_%s\n", m.Version, m.Name)
+    case "status":
+        statuses, err := forumdb.Status(db)
+        if err != nil {
+            return err
+        }
+        for _, s := range statuses {
+            state := "pending"
+            if s.Applied {
+                state = "applied " + s.AppliedAt.Format("2006-01-02 15:04:05")
+            }
+            fmt.Printf("%04d_%-30s %s\n", s.Version, s.Name, state)
+        }
+    default:
+        return fmt.Errorf("unknown action %q (want up, down or status)", args[0])
+    }
+    return nil
+}
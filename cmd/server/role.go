@@ -0,0 +1,34 @@
+package main
+
+// This file implements the `role` subcommand which assigns a role to a
+// user from the command line. It exists mainly to bootstrap the first
+// admin, since only admins can change roles from the web interface.
+
+import (
+    "database/sql"
+    "errors"
+    "fmt"
+
+    "forum/internal/app"
+)
+
+// runRole sets the role of the named user:
+//   forum role <username> user|moderator|admin
+func runRole(db *sql.DB, args []string) error {
+    if len(args) != 2 {
+        return errors.New("usage: forum role <username> user|moderator|admin")
+    }
+    username, role := args[0], args[1]
+    if !app.ValidRole(role) {
+        return fmt.Errorf("unknown role %q (want user, moderator or admin)", role)
+    }
+    res, err := db.Exec(`UPDATE users SET role = ? WHERE username = ?`, role, username)
+    if err != nil {
+        return err
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        return fmt.Errorf("no user named %q", username)
+    }
+    fmt.Printf("%s is now %s\n", username, role)
+    return nil
+}
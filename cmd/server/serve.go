@@ -0,0 +1,58 @@
+package main
+
+// This file runs the HTTP server until the process is asked to stop and
+// then shuts it down gracefully, so that a deploy or a Ctrl-C does not
+// cut off requests halfway. On SIGINT or SIGTERM the server first
+// reports itself unready at /readyz and, for the drain delay, keeps
+// serving as usual while load balancers notice. It then stops
+// accepting connections and waits for the requests in flight to
+// finish, up to the shutdown timeout, after which the rest are closed.
+// A second signal during all this ends the process at once.
+
+import (
+    "context"
+    "fmt"
+    "net/http"
+    "os"
+    "os/signal"
+    "syscall"
+    "time"
+
+    "forum/internal/server"
+)
+
+// serve runs srv until a signal arrives and the shutdown is done. It
+// returns an error only when the server cannot start, for example
+// because the address is in use.
+func serve(srv *http.Server, health *server.Health, drainDelay, timeout time.Duration) error {
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+    defer stop()
+
+    // ListenAndServe returns ErrServerClosed as soon as Shutdown is
+    // called, so its result only matters before a signal.
+    errc := make(chan error, 1)
+    go func() {
+        errc <- srv.ListenAndServe()
+    }()
+    select {
+    case err := <-errc:
+        return err
+    case <-ctx.Done():
+    }
+    // Restore the default handling, which exits, for the next signal.
+    stop()
+
+    health.Drain()
+    if drainDelay > 0 {
+        fmt.Printf("shutting down: unready, serving for another %s\n", drainDelay)
+        time.Sleep(drainDelay)
+    }
+    fmt.Printf("shutting down: waiting up to %s for requests in flight\n", timeout)
+    sctx, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+    if err := srv.Shutdown(sctx); err != nil {
+        fmt.Printf("shutting down: requests still running after %s are cut off\n", timeout)
+        srv.Close()
+    }
+    return nil
+}
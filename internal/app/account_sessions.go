@@ -0,0 +1,173 @@
+package app
+
+// This file implements /account/sessions, where users see every
+// browser or device they are logged in on and can log any of them
+// out. The page also lists the account's API tokens, which do not
+// expire, so that they can be revoked as well. Sessions are addressed
+// by their rowid in forms so that session IDs, which work like
+// passwords, never appear in a page.
+
+import (
+    "database/sql"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// accountSession is a row on the sessions page.
+type accountSession struct {
+    RowID     int64
+    Device    string
+    UserAgent string
+    IP        string
+    CreatedAt time.Time
+    LastSeen  time.Time
+    Current   bool
+}
+
+// HandleAccountSessions lists the sessions and API tokens of the
+// logged-in user on GET. On POST the `action` field selects what to
+// revoke:
+//
+//   revoke        the session whose rowid is given in `id`
+//   revoke-token  the API token whose ID is given in `id`
+//   others        every session except the current one
+//   all           every session and API token, which also logs out
+//                 this browser
+func (a *App) HandleAccountSessions(w http.ResponseWriter, r *http.Request) {
+    uid, _, _ := a.CurrentUser(r)
+    current := ""
+    if c, err := r.Cookie(a.CookieName); err == nil {
+        current = c.Value
+    }
+    switch r.Method {
+    case http.MethodGet:
+        rows, err := a.DB.Query(`SELECT rowid, id, user_agent, ip, created_at, last_seen_at FROM sessions WHERE user_id = ? AND expires_at > ? ORDER BY last_seen_at DESC`, uid, time.Now().Unix())
+        if err != nil {
+            http.Error(w, "database error", http.StatusInternalServerError)
+            return
+        }
+        defer rows.Close()
+        var sessions []accountSession
+        for rows.Next() {
+            var s accountSession
+            var sid string
+            var seen sql.NullTime
+            if err := rows.Scan(&s.RowID, &sid, &s.UserAgent, &s.IP, &s.CreatedAt, &seen); err != nil {
+                http.Error(w, "database error", http.StatusInternalServerError)
+                return
+            }
+            // Sessions from before last-seen tracking have no value.
+            s.LastSeen = s.CreatedAt
+            if seen.Valid {
+                s.LastSeen = seen.Time
+            }
+            s.Current = sid == current
+            s.Device = describeUserAgent(s.UserAgent)
+            sessions = append(sessions, s)
+        }
+        tokens, err := a.userAPITokens(uid)
+        if err != nil {
+            http.Error(w, "database error", http.StatusInternalServerError)
+            return
+        }
+        data := a.baseData(r)
+        data["Sessions"] = sessions
+        data["Tokens"] = tokens
+        tmpl := a.Templates.Lookup("account_sessions.html")
+        tmpl.ExecuteTemplate(w, "account_sessions.html", data)
+    case http.MethodPost:
+        var err error
+        switch r.FormValue("action") {
+        case "revoke":
+            id, perr := strconv.ParseInt(r.FormValue("id"), 10, 64)
+            if perr != nil || id <= 0 {
+                http.Error(w, "invalid session id", http.StatusBadRequest)
+                return
+            }
+            // The user_id condition keeps users from ending sessions
+            // that are not theirs.
+            _, err = a.DB.Exec(`DELETE FROM sessions WHERE rowid = ? AND user_id = ?`, id, uid)
+        case "revoke-token":
+            id, perr := strconv.ParseInt(r.FormValue("id"), 10, 64)
+            if perr != nil || id <= 0 {
+                http.Error(w, "invalid token id", http.StatusBadRequest)
+                return
+            }
+            _, err = a.DB.Exec(`DELETE FROM api_tokens WHERE id = ? AND user_id = ?`, id, uid)
+        case "others":
+            _, err = a.DB.Exec(`DELETE FROM sessions WHERE user_id = ? AND id <> ?`, uid, current)
+        case "all":
+            // Tokens go too: after a compromise, one created by the
+            // intruder would otherwise keep working.
+            err := a.inTx(func(tx *sql.Tx) error {
+                if _, err := tx.Exec(`DELETE FROM sessions WHERE user_id = ?`, uid); err != nil {
+                    return err
+                }
+                _, err := tx.Exec(`DELETE FROM api_tokens WHERE user_id = ?`, uid)
+                return err
+            })
+            if err != nil {
+                http.Error(w, "database error", http.StatusInternalServerError)
+                return
+            }
+            a.ClearSession(w, r)
+            http.Redirect(w, r, "/login?notice="+url.QueryEscape("You have been logged out everywhere and your API tokens have been revoked."), http.StatusSeeOther)
+            return
+        default:
+            http.Error(w, "unknown action", http.StatusBadRequest)
+            return
+        }
+        if err != nil {
+            http.Error(w, "database error", http.StatusInternalServerError)
+            return
+        }
+        http.Redirect(w, r, "/account/sessions", http.StatusSeeOther)
+    default:
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+// describeUserAgent turns a user agent string into a short label such
+// as "Firefox on Linux". It only knows the common browsers and systems
+// and falls back to "Unknown browser"; the full string is shown next
+// to it anyway.
+func describeUserAgent(ua string) string {
+    browser := "Unknown browser"
+    // Order matters: Edge and Opera also claim to be Chrome, and
+    // Chrome claims to be Safari.
+    for _, b := range []struct{ token, name string }{
+        {"Edg/", "Edge"},
+        {"OPR/", "Opera"},
+        {"Firefox/", "Firefox"},
+        {"Chrome/", "Chrome"},
+        {"Safari/", "Safari"},
+        {"curl/", "curl"},
+    } {
+        if strings.Contains(ua, b.token) {
+            browser = b.name
+            break
+        }
+    }
+    system := ""
+    for _, s := range []struct{ token, name string }{
+        {"Android", "Android"},
+        {"iPhone", "iOS"},
+        {"iPad", "iPadOS"},
+        {"Windows", "Windows"},
+        {"Mac OS X", "macOS"},
+        {"CrOS", "ChromeOS"},
+        {"Linux", "Linux"},
+    } {
+        if strings.Contains(ua, s.token) {
+            system = s.name
+            break
+        }
+    }
+    if system == "" {
+        return browser
+    }
+    return browser + " on " + system
+}
@@ -0,0 +1,89 @@
+package app
+
+// Tests of revoking sessions and API tokens from /account/sessions.
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "strconv"
+    "strings"
+    "testing"
+)
+
+// postSessions sends a form to HandleAccountSessions from the browser
+// holding session sid and returns the response.
+func postSessions(a *App, sid string, form url.Values) *httptest.ResponseRecorder {
+    req := httptest.NewRequest(http.MethodPost, "/account/sessions", strings.NewReader(form.Encode()))
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    req.AddCookie(&http.Cookie{Name: a.CookieName, Value: sid})
+    rec := httptest.NewRecorder()
+    a.HandleAccountSessions(rec, req)
+    return rec
+}
+
+func TestRevokeAPIToken(t *testing.T) {
+    a := newTestApp(t)
+    alice := createTestUser(t, a, "alice")
+    bob := createTestUser(t, a, "bob")
+    addAccess(t, a, alice, "alice")
+    addAccess(t, a, bob, "bob")
+    var aliceToken, bobToken int64
+    a.DB.QueryRow(`SELECT id FROM api_tokens WHERE user_id = ?`, alice).Scan(&aliceToken)
+    a.DB.QueryRow(`SELECT id FROM api_tokens WHERE user_id = ?`, bob).Scan(&bobToken)
+
+    // Someone else's token is out of reach.
+    rec := postSessions(a, "session-alice", url.Values{"action": {"revoke-token"}, "id": {strconv.FormatInt(bobToken, 10)}})
+    if rec.Code != http.StatusSeeOther {
+        t.Fatalf("status %d", rec.Code)
+    }
+    if _, _, ok := a.tokenUser("token-bob"); !ok {
+        t.Fatal("alice revoked bob's token")
+    }
+
+    postSessions(a, "session-alice", url.Values{"action": {"revoke-token"}, "id": {strconv.FormatInt(aliceToken, 10)}})
+    if _, _, ok := a.tokenUser("token-alice"); ok {
+        t.Fatal("the revoked token still authenticates")
+    }
+    if n := count(t, a, `SELECT COUNT(*) FROM sessions WHERE user_id = ?`, alice); n != 1 {
+        t.Fatalf("%d sessions after revoking a token, want 1", n)
+    }
+
+    if rec := postSessions(a, "session-alice", url.Values{"action": {"revoke-token"}, "id": {"x"}}); rec.Code != http.StatusBadRequest {
+        t.Fatalf("invalid id: status %d", rec.Code)
+    }
+}
+
+func TestLogOutEverywhereRevokesTokens(t *testing.T) {
+    a := newTestApp(t)
+    alice := createTestUser(t, a, "alice")
+    bob := createTestUser(t, a, "bob")
+    addAccess(t, a, alice, "alice")
+    addAccess(t, a, alice, "laptop")
+    addAccess(t, a, bob, "bob")
+
+    // Logging out the other sessions leaves the tokens alone.
+    postSessions(a, "session-alice", url.Values{"action": {"others"}})
+    if n := count(t, a, `SELECT COUNT(*) FROM sessions WHERE user_id = ?`, alice); n != 1 {
+        t.Fatalf("%d sessions left, want only the current one", n)
+    }
+    if n := count(t, a, `SELECT COUNT(*) FROM api_tokens WHERE user_id = ?`, alice); n != 2 {
+        t.Fatalf("%d tokens left, want 2", n)
+    }
+
+    rec := postSessions(a, "session-alice", url.Values{"action": {"all"}})
+    if loc := rec.Header().Get("Location"); !strings.HasPrefix(loc, "/login?notice=") {
+        t.Fatalf("redirected to %q", loc)
+    }
+    if n := count(t, a, `SELECT COUNT(*) FROM sessions WHERE user_id = ?`, alice); n != 0 {
+        t.Errorf("%d sessions survived", n)
+    }
+    for _, token := range []string{"token-alice", "token-laptop"} {
+        if _, _, ok := a.tokenUser(token); ok {
+            t.Errorf("%s still authenticates", token)
+        }
+    }
+    if _, _, ok := a.tokenUser("token-bob"); !ok {
+        t.Error("another account's token was revoked")
+    }
+}
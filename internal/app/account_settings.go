@@ -0,0 +1,253 @@
+package app
+
+// This file implements /account/settings, where users edit their
+// public profile and change their email address. A new address only
+// takes effect once the user follows a link mailed to it, so a typo
+// cannot lock anyone out of their account, and the old address is told
+// about the change. Changing the address requires the current password
+// because whoever controls the address can reset the password.
+
+import (
+    "database/sql"
+    "errors"
+    "net/http"
+    "net/url"
+    "strings"
+    "time"
+    "unicode"
+    "unicode/utf8"
+
+    "forum/internal/mail"
+
+    "golang.org/x/crypto/bcrypt"
+)
+
+// Limits on profile fields, in characters.
+const (
+    maxDisplayName = 50
+    maxBio         = 2000
+)
+
+// errEmailChangeToken is returned for unknown or expired email change
+// links.
+var errEmailChangeToken = errors.New("invalid or expired email change link")
+
+// HandleAccountSettings shows the settings of the logged-in user on
+// GET. On POST the `action` field selects the form:
+//
+//   profile  save `display_name` and `bio`
+//   email    mail a confirmation link to `email`, checked with `password`
+func (a *App) HandleAccountSettings(w http.ResponseWriter, r *http.Request) {
+    uid, _, _ := a.CurrentUser(r)
+    fail := func(msg string) {
+        http.Redirect(w, r, "/account/settings?error="+url.QueryEscape(msg), http.StatusSeeOther)
+    }
+    switch r.Method {
+    case http.MethodGet:
+        var username, email, displayName, bio, hash string
+        err := a.DB.QueryRow(`SELECT username, email, display_name, bio, password_hash FROM users WHERE id = ?`, uid).Scan(&username, &email, &displayName, &bio, &hash)
+        if err != nil {
+            http.Error(w, "database error", http.StatusInternalServerError)
+            return
+        }
+        var pending string
+        err = a.DB.QueryRow(`SELECT new_email FROM email_changes WHERE user_id = ? AND expires_at > ?`, uid, time.Now().UTC()).Scan(&pending)
+        if err != nil && err != sql.ErrNoRows {
+            http.Error(w, "database error", http.StatusInternalServerError)
+            return
+        }
+        data := a.baseData(r)
+        data["Email"] = email
+        data["DisplayName"] = displayName
+        data["Bio"] = bio
+        data["PendingEmail"] = pending
+        data["HasPassword"] = hash != ""
+        data["CurrentAvatar"], _ = a.avatarURLs(uid)
+        data["Avatar"] = newAvatar(username, displayName)
+        data["MaxUploadSize"] = formatBytes(a.maxUploadSize())
+        if msg := r.URL.Query().Get("error"); msg != "" {
+            data["Error"] = msg
+        }
+        if msg := r.URL.Query().Get("notice"); msg != "" {
+            data["Notice"] = msg
+        }
+        tmpl := a.Templates.Lookup("account_settings.html")
+        tmpl.ExecuteTemplate(w, "account_settings.html", data)
+    case http.MethodPost:
+        switch r.FormValue("action") {
+        case "profile":
+            displayName := strings.TrimSpace(r.FormValue("display_name"))
+            bio := strings.TrimSpace(r.FormValue("bio"))
+            if utf8.RuneCountInString(displayName) > maxDisplayName {
+                fail("Display names are limited to 50 characters.")
+                return
+            }
+            if strings.IndexFunc(displayName, unicode.IsControl) >= 0 {
+                fail("Display names cannot contain control characters.")
+                return
+            }
+            if utf8.RuneCountInString(bio) > maxBio {
+                fail("Bios are limited to 2000 characters.")
+                return
+            }
+            if _, err := a.DB.Exec(`UPDATE users SET display_name = ?, bio = ? WHERE id = ?`, displayName, bio, uid); err != nil {
+                http.Error(w, "database error", http.StatusInternalServerError)
+                return
+            }
+            http.Redirect(w, r, "/account/settings?notice="+url.QueryEscape("Your profile has been saved."), http.StatusSeeOther)
+        case "email":
+            a.requestEmailChange(w, r, uid, fail)
+        default:
+            http.Error(w, "unknown action", http.StatusBadRequest)
+        }
+    default:
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+// requestEmailChange checks the password of user uid and mails a
+// confirmation link to the requested address. Wrong passwords count
+// as failed logins (see lockout.go), since this form could otherwise
+// be used to guess the password of an account left logged in.
+func (a *App) requestEmailChange(w http.ResponseWriter, r *http.Request, uid int64, fail func(string)) {
+    newEmail := strings.TrimSpace(r.FormValue("email"))
+    var email, username, hash string
+    if err := a.DB.QueryRow(`SELECT email, username, password_hash FROM users WHERE id = ?`, uid).Scan(&email, &username, &hash); err != nil {
+        http.Error(w, "database error", http.StatusInternalServerError)
+        return
+    }
+    if hash == "" {
+        fail("Your account has no password yet. Set one with \"Forgot your password?\" on the login page first.")
+        return
+    }
+    if !strings.Contains(newEmail, "@") || strings.ContainsAny(newEmail, " \t\r\n") {
+        fail("Please enter a valid email address.")
+        return
+    }
+    if strings.EqualFold(newEmail, email) {
+        fail("That is already your email address.")
+        return
+    }
+    base, err := a.mailBase()
+    if err != nil {
+        fail("This forum is not set up to send email, so the address cannot be changed.")
+        return
+    }
+    wait, err := a.reserveLoginAttempt(r, email)
+    if err != nil {
+        http.Error(w, "database error", http.StatusInternalServerError)
+        return
+    }
+    if wait > 0 {
+        fail(throttledMessage(wait))
+        return
+    }
+    if bcrypt.CompareHashAndPassword([]byte(hash), []byte(r.FormValue("password"))) != nil {
+        if err := a.recordLoginFailure(r, email); err != nil {
+            http.Error(w, "database error", http.StatusInternalServerError)
+            return
+        }
+        fail("Your password is incorrect.")
+        return
+    }
+    if err := a.releaseLoginAttempt(r, email); err != nil {
+        http.Error(w, "database error", http.StatusInternalServerError)
+        return
+    }
+    var taken int
+    if err := a.DB.QueryRow(`SELECT COUNT(*) FROM users WHERE email = ?`, newEmail).Scan(&taken); err != nil {
+        http.Error(w, "database error", http.StatusInternalServerError)
+        return
+    }
+    if taken > 0 {
+        fail("That email address belongs to another account.")
+        return
+    }
+    token, err := newToken()
+    if err != nil {
+        http.Error(w, "token generation failed", http.StatusInternalServerError)
+        return
+    }
+    // Only the latest request counts.
+    err = a.inTx(func(tx *sql.Tx) error {
+        if _, err := tx.Exec(`DELETE FROM email_changes WHERE user_id = ?`, uid); err != nil {
+            return err
+        }
+        _, err := tx.Exec(`INSERT INTO email_changes(token_hash, user_id, new_email, expires_at) VALUES(?,?,?,?)`,
+            hashToken(token), uid, newEmail, time.Now().Add(verifyTokenTTL).UTC())
+        return err
+    })
+    if err != nil {
+        http.Error(w, "database error", http.StatusInternalServerError)
+        return
+    }
+    a.sendMail(mail.Message{
+        To:      newEmail,
+        Subject: "Confirm your new forum email address",
+        Body: "Hello " + username + ",\n\n" +
+            "please confirm that you want to use this address for your forum\n" +
+            "account by opening the link below within 48 hours:\n\n" +
+            base + "/account/email?token=" + url.QueryEscape(token) + "\n\n" +
+            "If you did not ask for this, you can ignore this message.\n",
+    })
+    a.sendMail(mail.Message{
+        To:      email,
+        Subject: "Your forum email address is being changed",
+        Body: "Hello " + username + ",\n\n" +
+            "someone logged in to your forum account asked to change its email\n" +
+            "address to " + newEmail + ". The change takes effect once it is\n" +
+            "confirmed from that address.\n\n" +
+            "If this was not you, change your password and log out your other\n" +
+            "sessions at " + base + "/account/sessions.\n",
+    })
+    http.Redirect(w, r, "/account/settings?notice="+url.QueryEscape("We sent a confirmation link to "+newEmail+"."), http.StatusSeeOther)
+}
+
+// HandleConfirmEmailChange applies the email change whose token is in
+// the `token` query parameter, as in the mailed link. Following the
+// link also proves the new address works, so it counts as verified.
+func (a *App) HandleConfirmEmailChange(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    target := "/login"
+    if _, _, ok := a.CurrentUser(r); ok {
+        target = "/account/settings"
+    }
+    err := a.inTx(func(tx *sql.Tx) error {
+        var uid int64
+        var newEmail string
+        var expires time.Time
+        err := tx.QueryRow(`SELECT user_id, new_email, expires_at FROM email_changes WHERE token_hash = ?`, hashToken(r.URL.Query().Get("token"))).Scan(&uid, &newEmail, &expires)
+        if err == sql.ErrNoRows || (err == nil && time.Now().After(expires)) {
+            return errEmailChangeToken
+        }
+        if err != nil {
+            return err
+        }
+        // The address may have been registered since the link was
+        // sent; the UNIQUE constraint then rejects the update.
+        if _, err := tx.Exec(`UPDATE users SET email = ?, email_verified_at = ? WHERE id = ?`, newEmail, time.Now().UTC(), uid); err != nil {
+            if strings.Contains(err.Error(), "UNIQUE") {
+                return errEmailTaken
+            }
+            return err
+        }
+        if _, err := tx.Exec(`DELETE FROM email_verifications WHERE user_id = ?`, uid); err != nil {
+            return err
+        }
+        _, err = tx.Exec(`DELETE FROM email_changes WHERE user_id = ?`, uid)
+        return err
+    })
+    switch err {
+    case nil:
+        http.Redirect(w, r, target+"?notice="+url.QueryEscape("Your email address has been changed."), http.StatusSeeOther)
+    case errEmailChangeToken:
+        http.Redirect(w, r, target+"?error="+url.QueryEscape("This link is invalid or has expired."), http.StatusSeeOther)
+    case errEmailTaken:
+        http.Redirect(w, r, target+"?error="+url.QueryEscape("That email address now belongs to another account."), http.StatusSeeOther)
+    default:
+        http.Error(w, "database error", http.StatusInternalServerError)
+    }
+}
@@ -0,0 +1,116 @@
+package app
+
+// This file implements the user management page of the admin area,
+// where admins change roles and help users with email verification
+// and lost two-factor devices.
+// Every admin handler is wrapped in RequireRole(RoleAdmin) in main.go,
+// so the handlers themselves can assume the current user is an admin.
+
+import (
+    "database/sql"
+    "net/http"
+    "strconv"
+    "time"
+)
+
+// adminUser is a row on the user management page.
+type adminUser struct {
+    ID        int64
+    Username  string
+    Email     string
+    Role      string
+    Verified  bool
+    TwoFactor bool
+    CreatedAt time.Time
+}
+
+// HandleAdminUsers lists all users with their roles on GET. On POST
+// the form fields `id` and `action` select a change to one user:
+//
+//   role    set the role given in `role`
+//   verify  mark the email address as verified
+//   resend  mail a new verification link
+//   reset2fa  turn off two-factor authentication, for users who lost
+//             their authenticator and recovery codes
+//
+// A missing action means "role". Admins cannot change their own role
+// so that the forum never loses its last admin by accident.
+func (a *App) HandleAdminUsers(w http.ResponseWriter, r *http.Request) {
+    switch r.Method {
+    case http.MethodGet:
+        rows, err := a.DB.Query(`SELECT id, username, email, role, email_verified_at IS NOT NULL, totp_enabled_at IS NOT NULL, created_at FROM users ORDER BY username`)
+        if err != nil {
+            http.Error(w, "database error", http.StatusInternalServerError)
+            return
+        }
+        defer rows.Close()
+        var users []adminUser
+        for rows.Next() {
+            var u adminUser
+            if err := rows.Scan(&u.ID, &u.Username, &u.Email, &u.Role, &u.Verified, &u.TwoFactor, &u.CreatedAt); err != nil {
+                http.Error(w, "database error", http.StatusInternalServerError)
+                return
+            }
+            users = append(users, u)
+        }
+        data := a.baseData(r)
+        data["Users"] = users
+        data["Roles"] = []string{RoleUser, RoleModerator, RoleAdmin}
+        tmpl := a.Templates.Lookup("admin_users.html")
+        tmpl.ExecuteTemplate(w, "admin_users.html", data)
+    case http.MethodPost:
+        uid, _, _ := a.CurrentUser(r)
+        id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+        if err != nil || id <= 0 {
+            http.Error(w, "invalid user id", http.StatusBadRequest)
+            return
+        }
+        switch r.FormValue("action") {
+        case "", "role":
+            role := r.FormValue("role")
+            if !ValidRole(role) {
+                http.Error(w, "invalid role", http.StatusBadRequest)
+                return
+            }
+            if id == uid {
+                http.Error(w, "you cannot change your own role", http.StatusBadRequest)
+                return
+            }
+            _, err = a.DB.Exec(`UPDATE users SET role = ? WHERE id = ?`, role, id)
+        case "verify":
+            err = a.inTx(func(tx *sql.Tx) error {
+                return a.markVerified(tx, id)
+            })
+        case "resend":
+            if a.isVerified(id) {
+                http.Error(w, "the user is already verified", http.StatusBadRequest)
+                return
+            }
+            err = a.sendVerification(id)
+            if err == sql.ErrNoRows {
+                http.Error(w, "user not found", http.StatusNotFound)
+                return
+            }
+            if err == errNoBaseURL {
+                http.Error(w, "this forum is not set up to send email", http.StatusServiceUnavailable)
+                return
+            }
+        case "reset2fa":
+            if id == uid {
+                http.Error(w, "use the account page to change your own two-factor settings", http.StatusBadRequest)
+                return
+            }
+            err = a.disableTwoFactor(id)
+        default:
+            http.Error(w, "unknown action", http.StatusBadRequest)
+            return
+        }
+        if err != nil {
+            http.Error(w, "database error", http.StatusInternalServerError)
+            return
+        }
+        http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+    default:
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    }
+}
@@ -0,0 +1,106 @@
+package app
+
+// This file implements the category management page of the admin
+// area. Admins can create, rename, describe, reorder, archive, merge
+// and delete categories without touching SQL.
+
+import (
+    "database/sql"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+)
+
+// HandleAdminCategories lists the categories on GET. On POST it
+// performs the change named by the `action` form field:
+//
+//   create  – add a category (`name`, `description`)
+//   update  – rename and describe category `id` (`name`, `description`)
+//   up/down – move category `id` one place in the display order
+//   archive/restore – hide category `id` from new posts or show it again
+//   merge   – move the posts of category `id` into category `into` and
+//             remove `id`
+//   delete  – remove category `id`; its posts stay uncategorised
+//
+// Problems the admin can fix, such as a duplicate name, are shown on
+// the page after the redirect instead of as an error page.
+func (a *App) HandleAdminCategories(w http.ResponseWriter, r *http.Request) {
+    switch r.Method {
+    case http.MethodGet:
+        cats, err := a.categoriesWithCounts()
+        if err != nil {
+            http.Error(w, "database error", http.StatusInternalServerError)
+            return
+        }
+        data := a.baseData(r)
+        data["AdminCategories"] = cats
+        if msg := r.URL.Query().Get("error"); msg != "" {
+            data["Error"] = msg
+        }
+        tmpl := a.Templates.Lookup("admin_categories.html")
+        tmpl.ExecuteTemplate(w, "admin_categories.html", data)
+    case http.MethodPost:
+        action := r.FormValue("action")
+        name := strings.TrimSpace(r.FormValue("name"))
+        description := strings.TrimSpace(r.FormValue("description"))
+        var id int64
+        if action != "create" {
+            var err error
+            id, err = strconv.ParseInt(r.FormValue("id"), 10, 64)
+            if err != nil || id <= 0 {
+                http.Error(w, "invalid category id", http.StatusBadRequest)
+                return
+            }
+        }
+        if (action == "create" || action == "update") && name == "" {
+            adminCategoriesError(w, r, "Category name is required")
+            return
+        }
+        var err error
+        switch action {
+        case "create":
+            err = a.createCategory(name, description)
+        case "update":
+            err = a.updateCategory(id, name, description)
+        case "up":
+            err = a.moveCategory(id, -1)
+        case "down":
+            err = a.moveCategory(id, 1)
+        case "archive", "restore":
+            err = a.setCategoryArchived(id, action == "archive")
+        case "merge":
+            into, perr := strconv.ParseInt(r.FormValue("into"), 10, 64)
+            if perr != nil || into == id {
+                adminCategoriesError(w, r, "Choose a different category to merge into")
+                return
+            }
+            err = a.mergeCategory(id, into)
+        case "delete":
+            err = a.deleteCategory(id)
+        default:
+            http.Error(w, "unknown action", http.StatusBadRequest)
+            return
+        }
+        switch {
+        case err == errCategoryExists:
+            adminCategoriesError(w, r, "A category with that name already exists")
+            return
+        case err == sql.ErrNoRows:
+            http.Error(w, "category not found", http.StatusNotFound)
+            return
+        case err != nil:
+            http.Error(w, "database error", http.StatusInternalServerError)
+            return
+        }
+        http.Redirect(w, r, "/admin/categories", http.StatusSeeOther)
+    default:
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+// adminCategoriesError redirects back to the category page with a
+// message to display above the list.
+func adminCategoriesError(w http.ResponseWriter, r *http.Request, msg string) {
+    http.Redirect(w, r, "/admin/categories?error="+url.QueryEscape(msg), http.StatusSeeOther)
+}
@@ -0,0 +1,439 @@
+package app
+
+// This file implements the webhook pages of the admin area.
+// /admin/webhooks lists the webhooks and adds new ones;
+// /admin/webhooks?id=<id> edits one webhook and shows its delivery
+// log, where failed deliveries can be sent again. Secrets are
+// generated by the forum and shown to admins, who copy them into the
+// receiving service to check signatures.
+
+import (
+    "database/sql"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// webhookLogSize is the number of deliveries shown on a webhook's page.
+const webhookLogSize = 50
+
+// adminWebhook is a webhook as shown on the admin pages.
+type adminWebhook struct {
+    ID          int64
+    URL         string
+    Secret      string
+    Description string
+    Active      bool
+    CreatedAt   time.Time
+    Events      map[string]bool
+    Categories  map[int64]bool
+    Pending     int
+    Failed      int
+}
+
+// webhookDelivery is a row of the delivery log.
+type webhookDelivery struct {
+    ID          int64
+    Event       string
+    Payload     string
+    Status      string
+    Attempts    int
+    CreatedAt   time.Time
+    NextAttempt time.Time
+    LastAttempt *time.Time
+    LastStatus  int
+    LastError   string
+    Response    string
+    DurationMS  int64
+    // History lists every attempt, oldest first.
+    History []webhookAttempt
+}
+
+// webhookAttempt is one attempt to send a delivery. Status is zero
+// when no response arrived.
+type webhookAttempt struct {
+    At         time.Time
+    Status     int
+    Error      string
+    DurationMS int64
+}
+
+// HandleAdminWebhooks shows the webhook list, or with `id` one webhook
+// and its deliveries, on GET. On POST the `action` field selects the
+// change:
+//
+//   create     add a webhook for `url` with `description`, the events
+//              listed in `event` and the categories in `category`
+//   update     change webhook `id` in the same way; `active` turns it
+//              on or off
+//   rotate     give webhook `id` a new secret
+//   test       send a ping event to webhook `id`
+//   redeliver  send delivery `delivery` of webhook `id` again
+//   delete     remove webhook `id` and its delivery log
+func (a *App) HandleAdminWebhooks(w http.ResponseWriter, r *http.Request) {
+    switch r.Method {
+    case http.MethodGet:
+        data := a.baseData(r)
+        data["WebhookEvents"] = webhookEvents
+        if msg := r.URL.Query().Get("error"); msg != "" {
+            data["Error"] = msg
+        }
+        if msg := r.URL.Query().Get("notice"); msg != "" {
+            data["Notice"] = msg
+        }
+        if v := r.URL.Query().Get("id"); v != "" {
+            id, err := strconv.ParseInt(v, 10, 64)
+            if err != nil || id <= 0 {
+                http.NotFound(w, r)
+                return
+            }
+            hooks, err := a.adminWebhooks(id)
+            if err != nil {
+                http.Error(w, "database error", http.StatusInternalServerError)
+                return
+            }
+            if len(hooks) == 0 {
+                http.NotFound(w, r)
+                return
+            }
+            deliveries, err := a.webhookDeliveries(id)
+            if err != nil {
+                http.Error(w, "database error", http.StatusInternalServerError)
+                return
+            }
+            data["Webhook"] = hooks[0]
+            data["Deliveries"] = deliveries
+            tmpl := a.Templates.Lookup("admin_webhooks.html")
+            tmpl.ExecuteTemplate(w, "admin_webhooks.html", data)
+            return
+        }
+        hooks, err := a.adminWebhooks(0)
+        if err != nil {
+            http.Error(w, "database error", http.StatusInternalServerError)
+            return
+        }
+        data["Webhooks"] = hooks
+        tmpl := a.Templates.Lookup("admin_webhooks.html")
+        tmpl.ExecuteTemplate(w, "admin_webhooks.html", data)
+    case http.MethodPost:
+        action := r.FormValue("action")
+        var id int64
+        if action != "create" {
+            var err error
+            id, err = strconv.ParseInt(r.FormValue("id"), 10, 64)
+            if err != nil || id <= 0 {
+                http.Error(w, "invalid webhook id", http.StatusBadRequest)
+                return
+            }
+        }
+        back := "/admin/webhooks?id=" + strconv.FormatInt(id, 10)
+        fail := func(msg string) {
+            target := "/admin/webhooks"
+            if id != 0 {
+                target = back
+            }
+            sep := "?"
+            if strings.Contains(target, "?") {
+                sep = "&"
+            }
+            http.Redirect(w, r, target+sep+"error="+url.QueryEscape(msg), http.StatusSeeOther)
+        }
+        done := func(msg string) {
+            http.Redirect(w, r, back+"&notice="+url.QueryEscape(msg), http.StatusSeeOther)
+        }
+        var err error
+        switch action {
+        case "create", "update":
+            target := strings.TrimSpace(r.FormValue("url"))
+            if !validWebhookURL(target) {
+                fail("The URL must be an http or https address, such as https://chat.example.com/hooks/forum.")
+                return
+            }
+            events := r.PostForm["event"]
+            if len(events) == 0 {
+                fail("Choose at least one event.")
+                return
+            }
+            var cats []int64
+            for _, v := range r.PostForm["category"] {
+                c, perr := strconv.ParseInt(v, 10, 64)
+                if perr != nil {
+                    http.Error(w, "invalid category id", http.StatusBadRequest)
+                    return
+                }
+                cats = append(cats, c)
+            }
+            description := strings.TrimSpace(r.FormValue("description"))
+            if action == "create" {
+                id, err = a.createWebhook(target, description, events, cats)
+                back = "/admin/webhooks?id=" + strconv.FormatInt(id, 10)
+            } else {
+                err = a.updateWebhook(id, target, description, r.FormValue("active") != "", events, cats)
+            }
+            if err == nil {
+                if action == "create" {
+                    done("The webhook has been added. Configure the receiver with the secret below.")
+                } else {
+                    done("The webhook has been saved.")
+                }
+                return
+            }
+        case "rotate":
+            var secret string
+            if secret, err = newToken(); err == nil {
+                err = a.execOne(`UPDATE webhooks SET secret = ? WHERE id = ?`, secret, id)
+            }
+            if err == nil {
+                done("The webhook has a new secret. Update the receiver, or it will reject the next deliveries.")
+                return
+            }
+        case "test":
+            var exists int
+            if err = a.DB.QueryRow(`SELECT 1 FROM webhooks WHERE id = ?`, id).Scan(&exists); err == nil {
+                err = a.queueWebhook(EventPing, &webhookPayload{Webhook: &webhookRef{ID: id}}, id)
+            }
+            if err == nil {
+                done("A ping has been queued. It appears in the log below once it has been sent.")
+                return
+            }
+        case "redeliver":
+            delivery, perr := strconv.ParseInt(r.FormValue("delivery"), 10, 64)
+            if perr != nil || delivery <= 0 {
+                http.Error(w, "invalid delivery id", http.StatusBadRequest)
+                return
+            }
+            // A fresh start: the delivery gets all its attempts again.
+            err = a.execOne(`UPDATE webhook_deliveries SET status = 'pending', attempts = 0, next_attempt_at = ? WHERE id = ? AND webhook_id = ?`,
+                time.Now().Unix(), delivery, id)
+            if err == nil {
+                a.wakeWebhooks()
+                done("The delivery has been queued again.")
+                return
+            }
+        case "delete":
+            if err = a.execOne(`DELETE FROM webhooks WHERE id = ?`, id); err == nil {
+                http.Redirect(w, r, "/admin/webhooks?notice="+url.QueryEscape("The webhook has been deleted."), http.StatusSeeOther)
+                return
+            }
+        default:
+            http.Error(w, "unknown action", http.StatusBadRequest)
+            return
+        }
+        if err == sql.ErrNoRows {
+            http.NotFound(w, r)
+            return
+        }
+        http.Error(w, "database error", http.StatusInternalServerError)
+    default:
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+// validWebhookURL reports whether s is an absolute http or https URL.
+func validWebhookURL(s string) bool {
+    u, err := url.Parse(s)
+    return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" && u.Fragment == ""
+}
+
+// execOne runs a statement that must change exactly one row and
+// returns sql.ErrNoRows when it changed none.
+func (a *App) execOne(query string, args ...any) error {
+    res, err := a.DB.Exec(query, args...)
+    if err != nil {
+        return err
+    }
+    if n, err := res.RowsAffected(); err != nil || n == 0 {
+        if err == nil {
+            err = sql.ErrNoRows
+        }
+        return err
+    }
+    return nil
+}
+
+// createWebhook adds a webhook with a new secret and returns its ID.
+func (a *App) createWebhook(target, description string, events []string, cats []int64) (int64, error) {
+    secret, err := newToken()
+    if err != nil {
+        return 0, err
+    }
+    var id int64
+    err = a.inTx(func(tx *sql.Tx) error {
+        if err := tx.QueryRow(`INSERT INTO webhooks(url, secret, description) VALUES(?,?,?) RETURNING id`, target, secret, description).Scan(&id); err != nil {
+            return err
+        }
+        return setWebhookFilters(tx, id, events, cats)
+    })
+    return id, err
+}
+
+// updateWebhook changes the settings of webhook id. It returns
+// sql.ErrNoRows when there is no such webhook.
+func (a *App) updateWebhook(id int64, target, description string, active bool, events []string, cats []int64) error {
+    return a.inTx(func(tx *sql.Tx) error {
+        res, err := tx.Exec(`UPDATE webhooks SET url = ?, description = ?, active = ? WHERE id = ?`, target, description, active, id)
+        if err != nil {
+            return err
+        }
+        if n, _ := res.RowsAffected(); n == 0 {
+            return sql.ErrNoRows
+        }
+        return setWebhookFilters(tx, id, events, cats)
+    })
+}
+
+// setWebhookFilters replaces the events and categories of webhook id.
+// Unknown event names and category IDs are ignored.
+func setWebhookFilters(tx *sql.Tx, id int64, events []string, cats []int64) error {
+    if _, err := tx.Exec(`DELETE FROM webhook_events WHERE webhook_id = ?`, id); err != nil {
+        return err
+    }
+    if _, err := tx.Exec(`DELETE FROM webhook_categories WHERE webhook_id = ?`, id); err != nil {
+        return err
+    }
+    for _, name := range events {
+        for _, e := range webhookEvents {
+            if e.Name != name {
+                continue
+            }
+            if _, err := tx.Exec(`INSERT OR IGNORE INTO webhook_events(webhook_id, event) VALUES(?,?)`, id, name); err != nil {
+                return err
+            }
+        }
+    }
+    for _, c := range cats {
+        if _, err := tx.Exec(`INSERT OR IGNORE INTO webhook_categories(webhook_id, category_id) SELECT ?, id FROM categories WHERE id = ?`, id, c); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// adminWebhooks returns every webhook, oldest first, or only webhook
+// id when it is not zero.
+func (a *App) adminWebhooks(id int64) ([]*adminWebhook, error) {
+    rows, err := a.DB.Query(`SELECT w.id, w.url, w.secret, w.description, w.active, w.created_at,
+        (SELECT COUNT(*) FROM webhook_deliveries d WHERE d.webhook_id = w.id AND d.status = 'pending'),
+        (SELECT COUNT(*) FROM webhook_deliveries d WHERE d.webhook_id = w.id AND d.status = 'failed')
+        FROM webhooks w WHERE ?1 = 0 OR w.id = ?1 ORDER BY w.id`, id)
+    if err != nil {
+        return nil, err
+    }
+    var hooks []*adminWebhook
+    byID := make(map[int64]*adminWebhook)
+    for rows.Next() {
+        h := &adminWebhook{Events: map[string]bool{}, Categories: map[int64]bool{}}
+        if err := rows.Scan(&h.ID, &h.URL, &h.Secret, &h.Description, &h.Active, &h.CreatedAt, &h.Pending, &h.Failed); err != nil {
+            rows.Close()
+            return nil, err
+        }
+        hooks = append(hooks, h)
+        byID[h.ID] = h
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return nil, err
+    }
+    rows, err = a.DB.Query(`SELECT webhook_id, event FROM webhook_events`)
+    if err != nil {
+        return nil, err
+    }
+    for rows.Next() {
+        var hid int64
+        var event string
+        if err := rows.Scan(&hid, &event); err != nil {
+            rows.Close()
+            return nil, err
+        }
+        if h := byID[hid]; h != nil {
+            h.Events[event] = true
+        }
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return nil, err
+    }
+    rows, err = a.DB.Query(`SELECT webhook_id, category_id FROM webhook_categories`)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var hid, cid int64
+        if err := rows.Scan(&hid, &cid); err != nil {
+            return nil, err
+        }
+        if h := byID[hid]; h != nil {
+            h.Categories[cid] = true
+        }
+    }
+    return hooks, rows.Err()
+}
+
+// webhookDeliveries returns the newest deliveries of webhook id.
+func (a *App) webhookDeliveries(id int64) ([]webhookDelivery, error) {
+    rows, err := a.DB.Query(`SELECT id, event, payload, status, attempts, created_at, next_attempt_at,
+        last_attempt_at, last_status, last_error, last_response, last_duration_ms
+        FROM webhook_deliveries WHERE webhook_id = ? ORDER BY id DESC LIMIT ?`, id, webhookLogSize)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    var list []webhookDelivery
+    for rows.Next() {
+        var d webhookDelivery
+        var next int64
+        var last, code, duration sql.NullInt64
+        if err := rows.Scan(&d.ID, &d.Event, &d.Payload, &d.Status, &d.Attempts, &d.CreatedAt, &next,
+            &last, &code, &d.LastError, &d.Response, &duration); err != nil {
+            return nil, err
+        }
+        d.NextAttempt = time.Unix(next, 0).UTC()
+        if last.Valid {
+            t := time.Unix(last.Int64, 0).UTC()
+            d.LastAttempt = &t
+        }
+        d.LastStatus = int(code.Int64)
+        d.DurationMS = duration.Int64
+        list = append(list, d)
+    }
+    if err := rows.Err(); err != nil {
+        return nil, err
+    }
+    return list, a.attachWebhookAttempts(id, list)
+}
+
+// attachWebhookAttempts fills in the History of the deliveries in list,
+// which are the newest of webhook id, newest first.
+func (a *App) attachWebhookAttempts(id int64, list []webhookDelivery) error {
+    if len(list) == 0 {
+        return nil
+    }
+    byID := make(map[int64]*webhookDelivery, len(list))
+    for i := range list {
+        byID[list[i].ID] = &list[i]
+    }
+    rows, err := a.DB.Query(`SELECT a.delivery_id, a.attempted_at, a.status, a.error, a.duration_ms
+        FROM webhook_attempts a JOIN webhook_deliveries d ON d.id = a.delivery_id
+        WHERE d.webhook_id = ? AND d.id >= ? ORDER BY a.id`, id, list[len(list)-1].ID)
+    if err != nil {
+        return err
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var delivery, at int64
+        var code sql.NullInt64
+        var att webhookAttempt
+        if err := rows.Scan(&delivery, &at, &code, &att.Error, &att.DurationMS); err != nil {
+            return err
+        }
+        att.At = time.Unix(at, 0).UTC()
+        att.Status = int(code.Int64)
+        if d := byID[delivery]; d != nil {
+            d.History = append(d.History, att)
+        }
+    }
+    return rows.Err()
+}
@@ -0,0 +1,157 @@
+package app
+
+// This file implements the entry point of the versioned JSON API that
+// lives under /api/v1. The API exposes the same data as the HTML pages
+// (postListing, postView and commentView) so that scripts and mobile
+// clients can use the forum. Every response, including errors, is a
+// JSON document. Errors share a single shape:
+//
+//   {"error": {"code": "not_found", "message": "post not found"}}
+//
+// Clients authenticate either with the regular session cookie or with
+// an `Authorization: Bearer <token>` header (see api_tokens.go).
+
+import (
+    "encoding/json"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// maxAPIBody limits the size of JSON request bodies.
+const maxAPIBody = 1 << 20
+
+// apiErrorDetail is the payload of every API error response.
+type apiErrorDetail struct {
+    Code    string `json:"code"`
+    Message string `json:"message"`
+}
+
+// HandleAPI routes a request below /api/v1/ to the matching endpoint.
+// The standard ServeMux cannot match path parameters, so the path is
+// split into segments here. Supported endpoints:
+//
+//   GET    /api/v1/me                    current user
+//   GET    /api/v1/tokens                list the user's API tokens
+//   POST   /api/v1/tokens                exchange email/password for a token
+//   DELETE /api/v1/tokens                revoke the token used for the request
+//   GET    /api/v1/categories            categories in display order
+//   GET    /api/v1/posts                 list posts (category, filter, sort, after, before)
+//   POST   /api/v1/posts                 create a post
+//   GET    /api/v1/posts/{id}            post with comments
+//   PATCH  /api/v1/posts/{id}            edit a post (author only)
+//   DELETE /api/v1/posts/{id}            delete a post (author or moderator)
+//   GET    /api/v1/posts/{id}/comments   comments of a post
+//   POST   /api/v1/posts/{id}/comments   add a comment
+//   PATCH  /api/v1/comments/{id}         edit a comment (author only)
+//   DELETE /api/v1/comments/{id}         delete a comment (author or moderator)
+//   POST   /api/v1/reactions             like or dislike a post or comment
+//   POST   /api/v1/uploads               upload an image for use in posts
+func (a *App) HandleAPI(w http.ResponseWriter, r *http.Request) {
+    path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1"), "/")
+    parts := strings.Split(path, "/")
+    switch {
+    case path == "me":
+        a.apiMe(w, r)
+    case path == "tokens":
+        a.apiTokens(w, r)
+    case path == "categories":
+        a.apiCategories(w, r)
+    case path == "posts":
+        a.apiPosts(w, r)
+    case len(parts) == 2 && parts[0] == "posts":
+        if id, ok := apiID(w, parts[1]); ok {
+            a.apiPost(w, r, id)
+        }
+    case len(parts) == 3 && parts[0] == "posts" && parts[2] == "comments":
+        if id, ok := apiID(w, parts[1]); ok {
+            a.apiPostComments(w, r, id)
+        }
+    case len(parts) == 2 && parts[0] == "comments":
+        if id, ok := apiID(w, parts[1]); ok {
+            a.apiComment(w, r, id)
+        }
+    case path == "reactions":
+        a.apiReactions(w, r)
+    case path == "uploads":
+        a.apiUploads(w, r)
+    default:
+        apiError(w, http.StatusNotFound, "not_found", "no such endpoint")
+    }
+}
+
+// writeJSON encodes v as the JSON response body with the given status.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+    w.Header().Set("Content-Type", "application/json; charset=utf-8")
+    w.Header().Set("Cache-Control", "no-store")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(v)
+}
+
+// apiError writes an error response in the shared JSON error shape.
+// code is a short machine readable identifier and msg a human
+// readable explanation.
+func apiError(w http.ResponseWriter, status int, code, msg string) {
+    writeJSON(w, status, map[string]apiErrorDetail{"error": {Code: code, Message: msg}})
+}
+
+// apiMethodNotAllowed reports an unsupported method and lists the
+// allowed ones in the Allow header.
+func apiMethodNotAllowed(w http.ResponseWriter, allowed ...string) {
+    w.Header().Set("Allow", strings.Join(allowed, ", "))
+    apiError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+}
+
+// apiTooManyRequests tells the client to come back after wait, both in
+// the Retry-After header and in the error message.
+func apiTooManyRequests(w http.ResponseWriter, wait time.Duration, code, msg string) {
+    w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+    apiError(w, http.StatusTooManyRequests, code, msg)
+}
+
+// apiID parses a numeric path segment. Invalid IDs produce a 404
+// because no resource can exist under such a path.
+func apiID(w http.ResponseWriter, s string) (int64, bool) {
+    id, err := strconv.ParseInt(s, 10, 64)
+    if err != nil || id <= 0 {
+        apiError(w, http.StatusNotFound, "not_found", "resource not found")
+        return 0, false
+    }
+    return id, true
+}
+
+// apiUser returns the authenticated user or writes a 401 response.
+// Unlike RequireAuth it never redirects, since API clients cannot
+// follow a login page.
+func (a *App) apiUser(w http.ResponseWriter, r *http.Request) (int64, string, bool) {
+    uid, uname, ok := a.CurrentUser(r)
+    if !ok {
+        w.Header().Set("WWW-Authenticate", `Bearer realm="forum"`)
+        apiError(w, http.StatusUnauthorized, "unauthorized", "authentication required")
+    }
+    return uid, uname, ok
+}
+
+// apiVerifiedUser is apiUser for endpoints that create content: users
+// who have not verified their email address get a 403 response.
+func (a *App) apiVerifiedUser(w http.ResponseWriter, r *http.Request) (int64, string, bool) {
+    uid, uname, ok := a.apiUser(w, r)
+    if ok && !a.isVerified(uid) {
+        apiError(w, http.StatusForbidden, "unverified", "verify your email address before posting")
+        return 0, "", false
+    }
+    return uid, uname, ok
+}
+
+// decodeJSON reads a JSON request body into v. On failure a 400
+// response is written and false is returned.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+    dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAPIBody))
+    dec.DisallowUnknownFields()
+    if err := dec.Decode(v); err != nil {
+        apiError(w, http.StatusBadRequest, "invalid_json", "request body must be valid JSON: "+err.Error())
+        return false
+    }
+    return true
+}
@@ -0,0 +1,378 @@
+package app
+
+// This file implements the API endpoints for posts, comments,
+// categories and reactions. The handlers reuse the same queries and
+// write paths as the HTML handlers so both interfaces always agree.
+
+import (
+    "database/sql"
+    "net/http"
+    "strings"
+)
+
+// apiCategories lists the categories in display order, including
+// archived ones.
+func (a *App) apiCategories(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        apiMethodNotAllowed(w, http.MethodGet)
+        return
+    }
+    cats, err := a.AllCategories()
+    if err != nil {
+        apiError(w, http.StatusInternalServerError, "internal", "database error")
+        return
+    }
+    if cats == nil {
+        cats = []Category{}
+    }
+    writeJSON(w, http.StatusOK, map[string]any{"categories": cats})
+}
+
+// apiPosts lists one page of posts on GET, accepting the same
+// `category`, `filter`, `sort`, `after` and `before` query parameters
+// as the index page, and creates a post on POST from a body such as:
+//
+//   {"title": "...", "body": "...", "categories": ["General"]}
+func (a *App) apiPosts(w http.ResponseWriter, r *http.Request) {
+    switch r.Method {
+    case http.MethodGet:
+        uid, _, logged := a.CurrentUser(r)
+        q := r.URL.Query()
+        filter := q.Get("filter")
+        sortMode := q.Get("sort")
+        if sortMode == "" {
+            sortMode = "new"
+        }
+        if _, ok := postSorts[sortMode]; !ok {
+            apiError(w, http.StatusBadRequest, "invalid_sort", "sort must be one of new, old, top, comments or hot")
+            return
+        }
+        page, err := a.listPosts(uid, postFilter{
+            Category: q.Get("category"),
+            Mine:     filter == "mine" && logged,
+            Liked:    filter == "liked" && logged,
+        }, pageRequest{Sort: sortMode, After: q.Get("after"), Before: q.Get("before")})
+        if err == errBadCursor {
+            apiError(w, http.StatusBadRequest, "invalid_cursor", "invalid page cursor")
+            return
+        }
+        if err != nil {
+            apiError(w, http.StatusInternalServerError, "internal", "database error")
+            return
+        }
+        if page.Posts == nil {
+            page.Posts = []postListing{}
+        }
+        writeJSON(w, http.StatusOK, page)
+    case http.MethodPost:
+        uid, _, ok := a.apiVerifiedUser(w, r)
+        if !ok {
+            return
+        }
+        var req struct {
+            Title      string   `json:"title"`
+            Body       string   `json:"body"`
+            Categories []string `json:"categories"`
+        }
+        if !decodeJSON(w, r, &req) {
+            return
+        }
+        title := strings.TrimSpace(req.Title)
+        body := strings.TrimSpace(req.Body)
+        if title == "" || body == "" || len(req.Categories) == 0 {
+            apiError(w, http.StatusBadRequest, "invalid_post", "title, body and at least one category are required")
+            return
+        }
+        pid, err := a.createPost(uid, title, body, req.Categories)
+        if err == errNoCategory || err == errBodyTooLong {
+            apiError(w, http.StatusBadRequest, "invalid_post", err.Error())
+            return
+        }
+        if err != nil {
+            apiError(w, http.StatusInternalServerError, "internal", "database error")
+            return
+        }
+        a.apiWritePost(w, http.StatusCreated, pid, uid)
+    default:
+        apiMethodNotAllowed(w, http.MethodGet, http.MethodPost)
+    }
+}
+
+// apiWritePost loads a post as seen by uid and writes it as JSON.
+func (a *App) apiWritePost(w http.ResponseWriter, status int, pid, uid int64) {
+    p, err := a.loadPost(pid, uid)
+    if err == sql.ErrNoRows {
+        apiError(w, http.StatusNotFound, "not_found", "post not found")
+        return
+    }
+    if err != nil {
+        apiError(w, http.StatusInternalServerError, "internal", "database error")
+        return
+    }
+    if p.Comments == nil {
+        p.Comments = []commentView{}
+    }
+    writeJSON(w, status, p)
+}
+
+// apiPost returns, edits or deletes a single post. PATCH accepts any
+// subset of `title`, `body` and `categories`; omitted fields keep
+// their current value.
+func (a *App) apiPost(w http.ResponseWriter, r *http.Request, pid int64) {
+    if r.Method == http.MethodGet {
+        uid, _, _ := a.CurrentUser(r)
+        a.apiWritePost(w, http.StatusOK, pid, uid)
+        return
+    }
+    if r.Method != http.MethodPatch && r.Method != http.MethodDelete {
+        apiMethodNotAllowed(w, http.MethodGet, http.MethodPatch, http.MethodDelete)
+        return
+    }
+    uid, _, ok := a.apiUser(w, r)
+    if !ok {
+        return
+    }
+    var p editablePost
+    err := a.DB.QueryRow(`SELECT id, user_id, title, body FROM posts WHERE id = ?`, pid).Scan(&p.ID, &p.UserID, &p.Title, &p.Body)
+    if err == sql.ErrNoRows {
+        apiError(w, http.StatusNotFound, "not_found", "post not found")
+        return
+    }
+    if err != nil {
+        apiError(w, http.StatusInternalServerError, "internal", "database error")
+        return
+    }
+    // Moderators may remove anything but only authors may edit.
+    if p.UserID != uid && !(r.Method == http.MethodDelete && hasRole(a.userRole(uid), RoleModerator)) {
+        apiError(w, http.StatusForbidden, "forbidden", "only the author may change this post")
+        return
+    }
+    if r.Method == http.MethodDelete {
+        if err := a.inTx(func(tx *sql.Tx) error { return deletePost(tx, p.ID) }); err != nil {
+            apiError(w, http.StatusInternalServerError, "internal", "database error")
+            return
+        }
+        w.WriteHeader(http.StatusNoContent)
+        return
+    }
+    var req struct {
+        Title      *string   `json:"title"`
+        Body       *string   `json:"body"`
+        Categories *[]string `json:"categories"`
+    }
+    if !decodeJSON(w, r, &req) {
+        return
+    }
+    title, body := p.Title, p.Body
+    if req.Title != nil {
+        title = strings.TrimSpace(*req.Title)
+    }
+    if req.Body != nil {
+        body = strings.TrimSpace(*req.Body)
+    }
+    var cats []string
+    if req.Categories != nil {
+        cats = *req.Categories
+    } else if cats, err = a.postCategoryNames(p.ID); err != nil {
+        apiError(w, http.StatusInternalServerError, "internal", "database error")
+        return
+    }
+    if title == "" || body == "" || len(cats) == 0 {
+        apiError(w, http.StatusBadRequest, "invalid_post", "title, body and at least one category are required")
+        return
+    }
+    err = a.updatePost(uid, p, title, body, cats)
+    if err == errNoCategory || err == errBodyTooLong {
+        apiError(w, http.StatusBadRequest, "invalid_post", err.Error())
+        return
+    }
+    if err != nil {
+        apiError(w, http.StatusInternalServerError, "internal", "database error")
+        return
+    }
+    a.apiWritePost(w, http.StatusOK, p.ID, uid)
+}
+
+// apiPostComments lists the comments of a post on GET and adds a
+// comment on POST from a body such as {"body": "..."}. Replies add
+// the ID of the comment they answer: {"body": "...", "parent_id": 3}.
+// Comments are listed flat in creation order; parent_id links them
+// into threads.
+func (a *App) apiPostComments(w http.ResponseWriter, r *http.Request, pid int64) {
+    switch r.Method {
+    case http.MethodGet:
+        uid, _, _ := a.CurrentUser(r)
+        p, err := a.loadPost(pid, uid)
+        if err == sql.ErrNoRows {
+            apiError(w, http.StatusNotFound, "not_found", "post not found")
+            return
+        }
+        if err != nil {
+            apiError(w, http.StatusInternalServerError, "internal", "database error")
+            return
+        }
+        if p.Comments == nil {
+            p.Comments = []commentView{}
+        }
+        writeJSON(w, http.StatusOK, map[string]any{"comments": p.Comments})
+    case http.MethodPost:
+        uid, _, ok := a.apiVerifiedUser(w, r)
+        if !ok {
+            return
+        }
+        var req struct {
+            Body     string `json:"body"`
+            ParentID int64  `json:"parent_id"`
+        }
+        if !decodeJSON(w, r, &req) {
+            return
+        }
+        body := strings.TrimSpace(req.Body)
+        if body == "" {
+            apiError(w, http.StatusBadRequest, "invalid_comment", "body is required")
+            return
+        }
+        cid, err := a.createComment(uid, pid, req.ParentID, body)
+        if err == errBadParent {
+            apiError(w, http.StatusBadRequest, "invalid_parent", err.Error())
+            return
+        }
+        if err == errBodyTooLong {
+            apiError(w, http.StatusBadRequest, "invalid_comment", err.Error())
+            return
+        }
+        if err == sql.ErrNoRows {
+            apiError(w, http.StatusNotFound, "not_found", "post not found")
+            return
+        }
+        if err != nil {
+            apiError(w, http.StatusInternalServerError, "internal", "database error")
+            return
+        }
+        a.apiWriteComment(w, http.StatusCreated, pid, cid, uid)
+    default:
+        apiMethodNotAllowed(w, http.MethodGet, http.MethodPost)
+    }
+}
+
+// apiWriteComment writes a single comment of post pid as JSON.
+func (a *App) apiWriteComment(w http.ResponseWriter, status int, pid, cid, uid int64) {
+    p, err := a.loadPost(pid, uid)
+    if err != nil {
+        apiError(w, http.StatusInternalServerError, "internal", "database error")
+        return
+    }
+    for _, c := range p.Comments {
+        if c.ID == cid {
+            writeJSON(w, status, c)
+            return
+        }
+    }
+    apiError(w, http.StatusNotFound, "not_found", "comment not found")
+}
+
+// apiComment edits (PATCH with {"body": "..."}) or deletes a comment.
+// Only the author may edit; moderators may also delete.
+func (a *App) apiComment(w http.ResponseWriter, r *http.Request, cid int64) {
+    if r.Method != http.MethodPatch && r.Method != http.MethodDelete {
+        apiMethodNotAllowed(w, http.MethodPatch, http.MethodDelete)
+        return
+    }
+    uid, _, ok := a.apiUser(w, r)
+    if !ok {
+        return
+    }
+    var c editableComment
+    err := a.DB.QueryRow(`SELECT id, post_id, user_id, body FROM comments WHERE id = ?`, cid).Scan(&c.ID, &c.PostID, &c.UserID, &c.Body)
+    if err == sql.ErrNoRows {
+        apiError(w, http.StatusNotFound, "not_found", "comment not found")
+        return
+    }
+    if err != nil {
+        apiError(w, http.StatusInternalServerError, "internal", "database error")
+        return
+    }
+    // Moderators may remove anything but only authors may edit.
+    if c.UserID != uid && !(r.Method == http.MethodDelete && hasRole(a.userRole(uid), RoleModerator)) {
+        apiError(w, http.StatusForbidden, "forbidden", "only the author may change this comment")
+        return
+    }
+    if r.Method == http.MethodDelete {
+        if err := a.inTx(func(tx *sql.Tx) error { return deleteComment(tx, c.ID) }); err != nil {
+            apiError(w, http.StatusInternalServerError, "internal", "database error")
+            return
+        }
+        w.WriteHeader(http.StatusNoContent)
+        return
+    }
+    var req struct {
+        Body string `json:"body"`
+    }
+    if !decodeJSON(w, r, &req) {
+        return
+    }
+    body := strings.TrimSpace(req.Body)
+    if body == "" {
+        apiError(w, http.StatusBadRequest, "invalid_comment", "body is required")
+        return
+    }
+    err = a.updateComment(uid, c, body)
+    if err == errBodyTooLong {
+        apiError(w, http.StatusBadRequest, "invalid_comment", err.Error())
+        return
+    }
+    if err != nil {
+        apiError(w, http.StatusInternalServerError, "internal", "database error")
+        return
+    }
+    a.apiWriteComment(w, http.StatusOK, c.PostID, c.ID, uid)
+}
+
+// apiReactions toggles a like or dislike, using the same semantics as
+// the HTML reaction buttons. The body looks like:
+//
+//   {"type": "post", "id": 12, "value": 1}
+//
+// The response contains the updated counts for the target.
+func (a *App) apiReactions(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        apiMethodNotAllowed(w, http.MethodPost)
+        return
+    }
+    uid, _, ok := a.apiUser(w, r)
+    if !ok {
+        return
+    }
+    var req struct {
+        Type  string `json:"type"`
+        ID    int64  `json:"id"`
+        Value int    `json:"value"`
+    }
+    if !decodeJSON(w, r, &req) {
+        return
+    }
+    if (req.Type != "post" && req.Type != "comment") || req.ID <= 0 || (req.Value != 1 && req.Value != -1) {
+        apiError(w, http.StatusBadRequest, "invalid_reaction", "type must be post or comment, id positive and value 1 or -1")
+        return
+    }
+    if err := a.react(uid, req.Type, req.ID, req.Value); err != nil {
+        if err == sql.ErrNoRows {
+            apiError(w, http.StatusNotFound, "not_found", req.Type+" not found")
+            return
+        }
+        apiError(w, http.StatusInternalServerError, "internal", "database error")
+        return
+    }
+    likes, dislikes, mine, err := a.reactionCounts(uid, req.Type, req.ID)
+    if err != nil {
+        apiError(w, http.StatusInternalServerError, "internal", "database error")
+        return
+    }
+    writeJSON(w, http.StatusOK, map[string]any{
+        "type":          req.Type,
+        "id":            req.ID,
+        "like_count":    likes,
+        "dislike_count": dislikes,
+        "my_reaction":   mine,
+    })
+}
@@ -0,0 +1,213 @@
+package app
+
+// This file implements bearer-token authentication for the JSON API
+// along with the endpoints for issuing and revoking tokens and for
+// describing the current user.
+
+import (
+    "database/sql"
+    "net/http"
+    "strings"
+    "time"
+)
+
+// apiTokenInfo describes a token without revealing its secret.
+type apiTokenInfo struct {
+    ID         int64      `json:"id"`
+    Name       string     `json:"name"`
+    CreatedAt  time.Time  `json:"created_at"`
+    LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// bearerToken extracts the token from an `Authorization: Bearer`
+// header. The boolean is false when the header is absent or uses a
+// different scheme.
+func bearerToken(r *http.Request) (string, bool) {
+    h := r.Header.Get("Authorization")
+    const prefix = "bearer "
+    if len(h) <= len(prefix) || !strings.EqualFold(h[:len(prefix)], prefix) {
+        return "", false
+    }
+    return strings.TrimSpace(h[len(prefix):]), true
+}
+
+// tokenUser resolves an API token to its user and records when the
+// token was last used.
+func (a *App) tokenUser(token string) (int64, string, bool) {
+    var tokenID, userID int64
+    var username string
+    row := a.DB.QueryRow(`SELECT t.id, u.id, u.username FROM api_tokens t JOIN users u ON t.user_id = u.id WHERE t.token_hash = ?`, hashToken(token))
+    if err := row.Scan(&tokenID, &userID, &username); err != nil {
+        return 0, "", false
+    }
+    _, _ = a.DB.Exec(`UPDATE api_tokens SET last_used_at = CURRENT_TIMESTAMP WHERE id = ?`, tokenID)
+    return userID, username, true
+}
+
+// userAPITokens returns the API tokens of user uid, oldest first. The
+// list is empty rather than nil when there are none, so that it
+// encodes as a JSON array.
+func (a *App) userAPITokens(uid int64) ([]apiTokenInfo, error) {
+    rows, err := a.DB.Query(`SELECT id, name, created_at, last_used_at FROM api_tokens WHERE user_id = ? ORDER BY id`, uid)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    tokens := []apiTokenInfo{}
+    for rows.Next() {
+        var t apiTokenInfo
+        var used sql.NullTime
+        if err := rows.Scan(&t.ID, &t.Name, &t.CreatedAt, &used); err != nil {
+            return nil, err
+        }
+        if used.Valid {
+            t.LastUsedAt = &used.Time
+        }
+        tokens = append(tokens, t)
+    }
+    return tokens, rows.Err()
+}
+
+// apiMe returns the profile of the authenticated user.
+func (a *App) apiMe(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        apiMethodNotAllowed(w, http.MethodGet)
+        return
+    }
+    uid, _, ok := a.apiUser(w, r)
+    if !ok {
+        return
+    }
+    var me struct {
+        ID        int64     `json:"id"`
+        Username  string    `json:"username"`
+        Email     string    `json:"email"`
+        Role      string    `json:"role"`
+        CreatedAt time.Time `json:"created_at"`
+    }
+    err := a.DB.QueryRow(`SELECT id, username, email, role, created_at FROM users WHERE id = ?`, uid).Scan(&me.ID, &me.Username, &me.Email, &me.Role, &me.CreatedAt)
+    if err != nil {
+        apiError(w, http.StatusInternalServerError, "internal", "database error")
+        return
+    }
+    writeJSON(w, http.StatusOK, me)
+}
+
+// apiTokens lists, issues and revokes API tokens. Issuing a token
+// requires the account's email and password in the JSON body:
+//
+//   {"email": "...", "password": "...", "name": "my laptop"}
+//
+// The plain token is only ever returned by this call. DELETE revokes
+// the token that authenticated the request.
+func (a *App) apiTokens(w http.ResponseWriter, r *http.Request) {
+    switch r.Method {
+    case http.MethodGet:
+        uid, _, ok := a.apiUser(w, r)
+        if !ok {
+            return
+        }
+        tokens, err := a.userAPITokens(uid)
+        if err != nil {
+            apiError(w, http.StatusInternalServerError, "internal", "database error")
+            return
+        }
+        writeJSON(w, http.StatusOK, map[string]any{"tokens": tokens})
+    case http.MethodPost:
+        var req struct {
+            Email    string `json:"email"`
+            Password string `json:"password"`
+            Name     string `json:"name"`
+            // OTP is the TOTP or recovery code of accounts with
+            // two-factor authentication.
+            OTP string `json:"otp"`
+        }
+        if !decodeJSON(w, r, &req) {
+            return
+        }
+        // Token requests are throttled together with the login form.
+        wait, err := a.reserveLoginAttempt(r, req.Email)
+        if err != nil {
+            apiError(w, http.StatusInternalServerError, "internal", "database error")
+            return
+        }
+        if wait > 0 {
+            apiTooManyRequests(w, wait, "too_many_attempts", "too many failed login attempts; try again in "+formatWait(wait))
+            return
+        }
+        uid, err := a.authenticate(req.Email, req.Password)
+        if err == errInvalidCredentials {
+            if err := a.recordLoginFailure(r, req.Email); err != nil {
+                apiError(w, http.StatusInternalServerError, "internal", "database error")
+                return
+            }
+            apiError(w, http.StatusUnauthorized, "invalid_credentials", "invalid email or password")
+            return
+        }
+        if err != nil {
+            _ = a.releaseLoginAttempt(r, req.Email)
+            apiError(w, http.StatusInternalServerError, "internal", "database error")
+            return
+        }
+        if a.twoFactorEnabled(uid) {
+            if req.OTP == "" {
+                // Not a failed guess: the password was right.
+                if err := a.releaseLoginAttempt(r, req.Email); err != nil {
+                    apiError(w, http.StatusInternalServerError, "internal", "database error")
+                    return
+                }
+                apiError(w, http.StatusUnauthorized, "otp_required", "this account uses two-factor authentication; send the code as \"otp\"")
+                return
+            }
+            ok, _, err := a.checkSecondFactor(uid, req.OTP)
+            if err != nil {
+                _ = a.releaseLoginAttempt(r, req.Email)
+                apiError(w, http.StatusInternalServerError, "internal", "database error")
+                return
+            }
+            if !ok {
+                if err := a.recordLoginFailure(r, req.Email); err != nil {
+                    apiError(w, http.StatusInternalServerError, "internal", "database error")
+                    return
+                }
+                apiError(w, http.StatusUnauthorized, "invalid_otp", "invalid two-factor code")
+                return
+            }
+        }
+        _ = a.releaseLoginAttempt(r, req.Email)
+        _ = a.clearLoginFailures(uid)
+        if req.Name == "" {
+            req.Name = "api"
+        }
+        token, err := newToken()
+        if err != nil {
+            apiError(w, http.StatusInternalServerError, "internal", "token generation failed")
+            return
+        }
+        res, err := a.DB.Exec(`INSERT INTO api_tokens(user_id, name, token_hash) VALUES(?,?,?)`, uid, req.Name, hashToken(token))
+        if err != nil {
+            apiError(w, http.StatusInternalServerError, "internal", "database error")
+            return
+        }
+        id, _ := res.LastInsertId()
+        writeJSON(w, http.StatusCreated, map[string]any{"id": id, "name": req.Name, "token": token})
+    case http.MethodDelete:
+        token, ok := bearerToken(r)
+        if !ok {
+            apiError(w, http.StatusBadRequest, "bearer_required", "authenticate with the token to revoke")
+            return
+        }
+        res, err := a.DB.Exec(`DELETE FROM api_tokens WHERE token_hash = ?`, hashToken(token))
+        if err != nil {
+            apiError(w, http.StatusInternalServerError, "internal", "database error")
+            return
+        }
+        if n, _ := res.RowsAffected(); n == 0 {
+            apiError(w, http.StatusUnauthorized, "unauthorized", "unknown token")
+            return
+        }
+        w.WriteHeader(http.StatusNoContent)
+    default:
+        apiMethodNotAllowed(w, http.MethodGet, http.MethodPost, http.MethodDelete)
+    }
+}
@@ -2,11 +2,28 @@ package app
 
 import (
 	"database/sql"
+	"errors"
 	"html/template"
+	"net"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
+
+	"forum/internal/live"
+	"forum/internal/mail"
+	"forum/internal/oauth"
+	"forum/internal/storage"
 )
 
+// TemplateSet gives the parsed page templates by filename, such as
+// "index.html". Lookup returns nil for names that are not a page.
+// server.LoadTemplates parses them once; server.ReloadingTemplates
+// parses pages again when their files change.
+type TemplateSet interface {
+    Lookup(name string) *template.Template
+}
+
 // App bundles together the shared dependencies used by HTTP handlers.
 //
 // Rather than passing the database, parsed templates and session
@@ -18,26 +35,162 @@ type App struct {
     // by multiple goroutines.
     DB *sql.DB
     // Templates holds all parsed HTML templates keyed by filename.
-    Templates map[string]*template.Template
+    Templates TemplateSet
     // CookieName is the name of the session cookie we set on login.
     CookieName string
     // SessionTTL controls how long a session remains valid before
     // expiring. A zero or negative duration effectively disables
     // sessions.
     SessionTTL time.Duration
+    // MaxCommentDepth is the number of reply levels shown on a post
+    // page before deeper replies move behind a "continue this thread"
+    // link. Zero selects a default of 5.
+    MaxCommentDepth int
+    // Mailer delivers account email such as password reset links.
+    Mailer mail.Mailer
+    // TrustProxy makes ClientIP take the client address from the
+    // X-Forwarded-For header set by a reverse proxy. Enable it only
+    // behind a proxy that sets the header, since clients can forge it.
+    TrustProxy bool
+    // OAuthProviders are the external identity providers users can
+    // log in with. Empty disables the feature.
+    OAuthProviders []*oauth.Provider
+    // Storage keeps uploaded images.
+    Storage storage.Storage
+    // BaseURL is the public address of the forum, such as
+    // "https://forum.example.com", used for links that leave the
+    // browser: in email and in feeds. Feeds derive it from each
+    // request when it is empty, but no mail with a link is sent
+    // without it.
+    BaseURL string
+    // MaxUploadSize is the largest image file users may upload, in
+    // bytes. Zero selects DefaultMaxUploadSize.
+    MaxUploadSize int64
+    // Live passes new comments and reactions to the browsers showing
+    // a post. Nil turns live updates off.
+    Live *live.Hub
+
+    // webhookSignal wakes RunWebhooks when deliveries are queued; see
+    // webhookWake.
+    webhookOnce   sync.Once
+    webhookSignal chan struct{}
+    // background counts the goroutines handlers start; see
+    // WaitBackground.
+    background sync.WaitGroup
 }
 
-// baseData returns the common template data used on every page.
-// It includes whether the user is logged in, their ID and username
-// and the list of available categories. Any errors retrieving the
-// categories are ignored and result in an empty slice.
+// baseData returns the common template data used on every page:
+//
+//   LoggedIn, UserID, Username, Role   who is asking
+//   IsModerator, IsAdmin               whether to show moderation controls
+//   Unverified                         the email address is not confirmed
+//   Needs2FA                           the role requires 2FA not set up yet
+//   AvatarURL                          small avatar, empty without one
+//   UnreadNotifications                number of unread notifications
+//   Categories                         every category, as Category records
+//   CSRFToken                          must be included in every form
+//                                      that changes state
+//   OAuth                              the configured login providers
+//
+// Errors retrieving the categories are ignored and leave the list
+// empty.
 func (a *App) baseData(r *http.Request) map[string]any {
     uid, uname, logged := a.CurrentUser(r)
+    role := a.userRole(uid)
     cats, _ := a.AllCategories()
+    var avatarURL string
+    var unread int
+    if logged {
+        _, avatarURL = a.avatarURLs(uid)
+        unread = a.unreadNotifications(uid)
+    }
     return map[string]any{
-        "LoggedIn":   logged,
-        "UserID":     uid,
-        "Username":   uname,
-        "Categories": cats,
+        "LoggedIn":            logged,
+        "UserID":              uid,
+        "Username":            uname,
+        "Role":                role,
+        "IsModerator":         hasRole(role, RoleModerator),
+        "IsAdmin":             hasRole(role, RoleAdmin),
+        "Unverified":          logged && !a.isVerified(uid),
+        "Needs2FA":            logged && a.needsTwoFactor(uid),
+        "AvatarURL":           avatarURL,
+        "UnreadNotifications": unread,
+        "Categories":          cats,
+        "CSRFToken":           CSRFToken(r),
+        "OAuth":               a.OAuthProviders,
+    }
+}
+
+// BaseData exposes baseData to other packages, such as the error page
+// middleware, so that every page is rendered with the same context.
+func (a *App) BaseData(r *http.Request) map[string]any {
+    return a.baseData(r)
+}
+
+// absoluteURL turns a path into an absolute URL on this server, for
+// links in feeds and other responses to the request r. The configured
+// BaseURL is used when set. Otherwise the URL is derived from the
+// request; behind a trusted proxy the scheme honours X-Forwarded-Proto
+// so that links are correct when the proxy terminates TLS. Links in
+// email are built with mailBase instead.
+func (a *App) absoluteURL(r *http.Request, path string) string {
+    if a.BaseURL != "" {
+        return strings.TrimSuffix(a.BaseURL, "/") + path
+    }
+    scheme := "http"
+    if r.TLS != nil || (a.TrustProxy && r.Header.Get("X-Forwarded-Proto") == "https") {
+        scheme = "https"
     }
-}
\ No newline at end of file
+    return scheme + "://" + r.Host + path
+}
+
+// errNoBaseURL is returned by mailBase when BaseURL is not set.
+var errNoBaseURL = errors.New("email with links is not sent unless -base-url is set")
+
+// mailBase returns the address that links in email start with, BaseURL
+// without a trailing slash. It never looks at the request: the Host
+// header is whatever the client sent, and a password reset link built
+// from it would take the token to a server of the attacker's choosing.
+// Without a configured BaseURL it returns errNoBaseURL and the mail
+// must not be sent.
+func (a *App) mailBase() (string, error) {
+    if a.BaseURL == "" {
+        return "", errNoBaseURL
+    }
+    return strings.TrimSuffix(a.BaseURL, "/"), nil
+}
+
+// ClientIP returns the IP address of the client that sent r. Behind a
+// trusted proxy this is the last address in X-Forwarded-For, the one
+// the proxy itself added; otherwise it is the address of the
+// connection.
+func (a *App) ClientIP(r *http.Request) string {
+    if a.TrustProxy {
+        if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+            parts := strings.Split(xff, ",")
+            if ip := strings.TrimSpace(parts[len(parts)-1]); ip != "" {
+                return ip
+            }
+        }
+    }
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        return r.RemoteAddr
+    }
+    return host
+}
+
+// inTx runs fn inside a database transaction. The transaction is
+// committed when fn succeeds and rolled back when it returns an
+// error, so multi-step changes are applied all at once or not at all.
+func (a *App) inTx(fn func(tx *sql.Tx) error) error {
+    tx, err := a.DB.Begin()
+    if err != nil {
+        return err
+    }
+    if err := fn(tx); err != nil {
+        tx.Rollback()
+        return err
+    }
+    return tx.Commit()
+}
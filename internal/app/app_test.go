@@ -0,0 +1,109 @@
+package app
+
+// Tests of the absolute links the forum hands out. Links in email come
+// only from the configured base URL, never from the request, and mail
+// that would need one is not sent without it.
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "strings"
+    "testing"
+    "time"
+
+    "golang.org/x/crypto/bcrypt"
+)
+
+func TestAbsoluteURLTrustsProxyOnlyWhenTold(t *testing.T) {
+    a := &App{}
+    req := httptest.NewRequest(http.MethodGet, "/feed.atom", nil)
+    req.Host = "forum.example.com"
+    req.Header.Set("X-Forwarded-Proto", "https")
+    if got := a.absoluteURL(req, "/"); got != "http://forum.example.com/" {
+        t.Errorf("without TrustProxy: %q", got)
+    }
+    a.TrustProxy = true
+    if got := a.absoluteURL(req, "/"); got != "https://forum.example.com/" {
+        t.Errorf("with TrustProxy: %q", got)
+    }
+    a.BaseURL = "https://forum.example.org/"
+    if got := a.absoluteURL(req, "/"); got != "https://forum.example.org/" {
+        t.Errorf("with BaseURL: %q", got)
+    }
+}
+
+func TestMailLinksUseBaseURL(t *testing.T) {
+    a := newTestApp(t)
+    mailer := &recordingMailer{}
+    a.Mailer = mailer
+    alice := createTestUser(t, a, "alice")
+    hash, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := a.DB.Exec(`UPDATE users SET password_hash = ?, email_verified_at = NULL WHERE id = ?`, hash, alice); err != nil {
+        t.Fatal(err)
+    }
+
+    forgot := func() {
+        form := url.Values{"email": {"alice@example.com"}}
+        req := httptest.NewRequest(http.MethodPost, "/password/forgot", strings.NewReader(form.Encode()))
+        req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+        req.Host = "evil.example"
+        rec := httptest.NewRecorder()
+        a.HandleForgotPassword(rec, req)
+        if loc := rec.Header().Get("Location"); loc != "/password/forgot?sent=1" {
+            t.Fatalf("forgot password: %d to %q", rec.Code, loc)
+        }
+    }
+    changeEmail := func() string {
+        form := url.Values{"email": {"new@example.com"}, "password": {"correct horse"}}
+        req := httptest.NewRequest(http.MethodPost, "/account/settings", strings.NewReader(form.Encode()))
+        req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+        req.Host = "evil.example"
+        var failed string
+        a.requestEmailChange(httptest.NewRecorder(), req, alice, func(msg string) { failed = msg })
+        return failed
+    }
+
+    // Without a base URL nothing with a link is sent, and no token is
+    // stored, whatever the Host header says.
+    forgot()
+    if err := a.sendVerification(alice); err != errNoBaseURL {
+        t.Fatalf("sendVerification returned %v, want errNoBaseURL", err)
+    }
+    if msg := changeEmail(); msg == "" {
+        t.Fatal("email change accepted without a base URL")
+    }
+    a.notifyLockout(httptest.NewRequest(http.MethodPost, "/login", nil), "alice@example.com", time.Minute)
+    a.WaitBackground()
+    if len(mailer.sent) != 0 {
+        t.Fatalf("%d mails sent without a base URL", len(mailer.sent))
+    }
+    for _, table := range []string{"password_resets", "email_verifications", "email_changes"} {
+        if n := count(t, a, `SELECT COUNT(*) FROM `+table); n != 0 {
+            t.Fatalf("%d rows stored in %s", n, table)
+        }
+    }
+
+    // With one, every link starts with it.
+    a.BaseURL = "https://forum.example.com/"
+    forgot()
+    if err := a.sendVerification(alice); err != nil {
+        t.Fatal(err)
+    }
+    if msg := changeEmail(); msg != "" {
+        t.Fatalf("email change failed: %s", msg)
+    }
+    a.notifyLockout(httptest.NewRequest(http.MethodPost, "/login", nil), "alice@example.com", time.Minute)
+    a.WaitBackground()
+    if len(mailer.sent) != 5 {
+        t.Fatalf("%d mails sent, want 5", len(mailer.sent))
+    }
+    for _, msg := range mailer.sent {
+        if strings.Contains(msg.Body, "evil.example") || !strings.Contains(msg.Body, "https://forum.example.com/") || strings.Contains(msg.Body, "example.com//") {
+            t.Errorf("%q has the wrong links:\n%s", msg.Subject, msg.Body)
+        }
+    }
+}
@@ -1,22 +1,193 @@
 package app
 
-// AllCategories returns the names of all categories sorted
-// alphabetically. Categories are stored in their own table and can be
-// attached to posts. If the query fails the error is returned to
-// the caller.
-func (a *App) AllCategories() ([]string, error) {
-    rows, err := a.DB.Query(`SELECT name FROM categories ORDER BY name`)
+// This file defines the category model and the queries that manage
+// categories. Categories are listed in the order chosen by admins
+// (see admin_categories.go). Archived categories stay attached to
+// their posts and can still be used as filters, but new posts can no
+// longer be filed under them.
+
+import (
+    "database/sql"
+    "errors"
+)
+
+// Category is a single category as shown in filters, forms, the admin
+// area and the JSON API. PostCount is only filled in by
+// categoriesWithCounts.
+type Category struct {
+    ID          int64  `json:"id"`
+    Name        string `json:"name"`
+    Description string `json:"description"`
+    Position    int    `json:"position"`
+    Archived    bool   `json:"archived"`
+    PostCount   int    `json:"-"`
+}
+
+// errCategoryExists is returned when a category would be created or
+// renamed to a name that is already taken.
+var errCategoryExists = errors.New("category already exists")
+
+// AllCategories returns every category, including archived ones, in
+// display order. Categories are stored in their own table and can be
+// attached to posts. If the query fails the error is returned to the
+// caller.
+func (a *App) AllCategories() ([]Category, error) {
+    rows, err := a.DB.Query(`SELECT id, name, description, position, archived FROM categories ORDER BY position, name`)
     if err != nil {
         return nil, err
     }
     defer rows.Close()
-    var out []string
+    var out []Category
     for rows.Next() {
-        var name string
-        if err := rows.Scan(&name); err != nil {
+        var c Category
+        if err := rows.Scan(&c.ID, &c.Name, &c.Description, &c.Position, &c.Archived); err != nil {
             return nil, err
         }
-        out = append(out, name)
+        out = append(out, c)
+    }
+    return out, rows.Err()
+}
+
+// categoriesWithCounts is like AllCategories but also counts the posts
+// filed under each category, for the admin overview.
+func (a *App) categoriesWithCounts() ([]Category, error) {
+    rows, err := a.DB.Query(`SELECT c.id, c.name, c.description, c.position, c.archived, COUNT(pc.post_id)
+        FROM categories c LEFT JOIN post_categories pc ON pc.category_id = c.id
+        GROUP BY c.id ORDER BY c.position, c.name`)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    var out []Category
+    for rows.Next() {
+        var c Category
+        if err := rows.Scan(&c.ID, &c.Name, &c.Description, &c.Position, &c.Archived, &c.PostCount); err != nil {
+            return nil, err
+        }
+        out = append(out, c)
+    }
+    return out, rows.Err()
+}
+
+// isUniqueViolation reports whether err was caused by a UNIQUE
+// constraint.
+func isUniqueViolation(err error) bool {
+    return err != nil && contains(err.Error(), "UNIQUE")
+}
+
+// createCategory adds a category at the end of the display order.
+func (a *App) createCategory(name, description string) error {
+    _, err := a.DB.Exec(`INSERT INTO categories(name, description, position) SELECT ?, ?, COALESCE(MAX(position), 0) + 1 FROM categories`, name, description)
+    if isUniqueViolation(err) {
+        return errCategoryExists
+    }
+    return err
+}
+
+// updateCategory renames a category and replaces its description.
+// Posts reference categories by ID, so they follow the new name.
+func (a *App) updateCategory(id int64, name, description string) error {
+    res, err := a.DB.Exec(`UPDATE categories SET name = ?, description = ? WHERE id = ?`, name, description, id)
+    if isUniqueViolation(err) {
+        return errCategoryExists
+    }
+    if err != nil {
+        return err
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        return sql.ErrNoRows
+    }
+    return nil
+}
+
+// moveCategory moves a category one place up (delta -1) or down
+// (delta 1) in the display order. Positions are renumbered from 1 on
+// every move so that gaps and ties left by older data disappear.
+func (a *App) moveCategory(id int64, delta int) error {
+    return a.inTx(func(tx *sql.Tx) error {
+        rows, err := tx.Query(`SELECT id FROM categories ORDER BY position, name`)
+        if err != nil {
+            return err
+        }
+        var ids []int64
+        for rows.Next() {
+            var cid int64
+            if err := rows.Scan(&cid); err != nil {
+                rows.Close()
+                return err
+            }
+            ids = append(ids, cid)
+        }
+        rows.Close()
+        if err := rows.Err(); err != nil {
+            return err
+        }
+        from := -1
+        for i, cid := range ids {
+            if cid == id {
+                from = i
+            }
+        }
+        if from < 0 {
+            return sql.ErrNoRows
+        }
+        to := from + delta
+        if to >= 0 && to < len(ids) {
+            ids[from], ids[to] = ids[to], ids[from]
+        }
+        for i, cid := range ids {
+            if _, err := tx.Exec(`UPDATE categories SET position = ? WHERE id = ?`, i+1, cid); err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+}
+
+// setCategoryArchived archives or restores a category.
+func (a *App) setCategoryArchived(id int64, archived bool) error {
+    res, err := a.DB.Exec(`UPDATE categories SET archived = ? WHERE id = ?`, archived, id)
+    if err != nil {
+        return err
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        return sql.ErrNoRows
+    }
+    return nil
+}
+
+// mergeCategory moves every post of category src into dst and then
+// removes src. Posts already filed under both keep a single link to
+// dst.
+func (a *App) mergeCategory(src, dst int64) error {
+    if src == dst {
+        return errors.New("cannot merge a category into itself")
+    }
+    return a.inTx(func(tx *sql.Tx) error {
+        var n int
+        if err := tx.QueryRow(`SELECT COUNT(*) FROM categories WHERE id IN (?, ?)`, src, dst).Scan(&n); err != nil {
+            return err
+        }
+        if n != 2 {
+            return sql.ErrNoRows
+        }
+        if _, err := tx.Exec(`INSERT OR IGNORE INTO post_categories(post_id, category_id) SELECT post_id, ? FROM post_categories WHERE category_id = ?`, dst, src); err != nil {
+            return err
+        }
+        // ON DELETE CASCADE removes the remaining links to src.
+        _, err := tx.Exec(`DELETE FROM categories WHERE id = ?`, src)
+        return err
+    })
+}
+
+// deleteCategory removes a category. Its posts stay but lose the link.
+func (a *App) deleteCategory(id int64) error {
+    res, err := a.DB.Exec(`DELETE FROM categories WHERE id = ?`, id)
+    if err != nil {
+        return err
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        return sql.ErrNoRows
     }
-    return out, nil
-}
\ No newline at end of file
+    return nil
+}
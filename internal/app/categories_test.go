@@ -0,0 +1,37 @@
+package app
+
+// Tests of category administration: every operation on a category
+// that does not exist reports it the same way.
+
+import (
+    "database/sql"
+    "testing"
+)
+
+func TestCategoryNotFound(t *testing.T) {
+    a := newTestApp(t)
+    var help int64
+    if err := a.DB.QueryRow(`SELECT id FROM categories WHERE name = 'Help'`).Scan(&help); err != nil {
+        t.Fatal(err)
+    }
+    const missing = 999999
+    for name, op := range map[string]func() error{
+        "update":  func() error { return a.updateCategory(missing, "x", "") },
+        "move":    func() error { return a.moveCategory(missing, 1) },
+        "archive": func() error { return a.setCategoryArchived(missing, true) },
+        "merge":   func() error { return a.mergeCategory(missing, help) },
+        "delete":  func() error { return a.deleteCategory(missing) },
+    } {
+        if err := op(); err != sql.ErrNoRows {
+            t.Errorf("%s: %v, want sql.ErrNoRows", name, err)
+        }
+    }
+
+    // Deleting one that exists works once.
+    if err := a.deleteCategory(help); err != nil {
+        t.Fatal(err)
+    }
+    if err := a.deleteCategory(help); err != sql.ErrNoRows {
+        t.Fatalf("second delete: %v, want sql.ErrNoRows", err)
+    }
+}
@@ -1,14 +1,24 @@
 package app
 
-import "net/http"
+import (
+    "database/sql"
+    "errors"
+    "net/http"
+    "strconv"
+    "strings"
+    "unicode/utf8"
+)
 
 // HandleNewComment processes a form submission to create a new comment.
 //
 // Only authenticated users may comment on posts. The form must include
 // both a `post_id` identifying the parent post and a `body` with the
-// comment text. Comments with an empty body are rejected with a
-// Bad Request error. After inserting the comment into the database the
-// user is redirected back to the post page.
+// comment text. Replies also carry the `parent_id` of the comment they
+// answer. Comments with an empty body are rejected with a Bad Request
+// error. After inserting the comment into the database the user is
+// redirected back to the new comment: on the post page, or in the
+// thread view of its parent when it is nested deeper than the post
+// page shows.
 func (a *App) HandleNewComment(w http.ResponseWriter, r *http.Request) {
     uid, _, ok := a.CurrentUser(r)
     if !ok {
@@ -20,15 +30,82 @@ func (a *App) HandleNewComment(w http.ResponseWriter, r *http.Request) {
         http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
         return
     }
-    postID := r.FormValue("post_id")
-    body := r.FormValue("body")
+    postID, err := strconv.ParseInt(r.FormValue("post_id"), 10, 64)
+    if err != nil || postID <= 0 {
+        http.Error(w, "invalid post id", http.StatusBadRequest)
+        return
+    }
+    body := strings.TrimSpace(r.FormValue("body"))
     if body == "" {
         http.Error(w, "empty comment", http.StatusBadRequest)
         return
     }
-    if _, err := a.DB.Exec(`INSERT INTO comments(post_id, user_id, body) VALUES(?,?,?)`, postID, uid, body); err != nil {
-        http.Error(w, err.Error(), http.StatusInternalServerError)
+    var parentID int64
+    if v := r.FormValue("parent_id"); v != "" {
+        parentID, err = strconv.ParseInt(v, 10, 64)
+        if err != nil || parentID <= 0 {
+            http.Error(w, "invalid parent comment id", http.StatusBadRequest)
+            return
+        }
+    }
+    cid, err := a.createComment(uid, postID, parentID, body)
+    if err == errBadParent || err == errBodyTooLong {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    if err != nil {
+        if err == sql.ErrNoRows {
+            http.NotFound(w, r)
+            return
+        }
+        http.Error(w, "database error", http.StatusInternalServerError)
         return
     }
-    http.Redirect(w, r, "/post?id="+postID, http.StatusSeeOther)
-}
\ No newline at end of file
+    http.Redirect(w, r, a.commentURL(postID, cid), http.StatusSeeOther)
+}
+
+// errBadParent is returned when a reply names a comment that does not
+// belong to the same post.
+var errBadParent = errors.New("parent comment not found on this post")
+
+// createComment adds a comment by uid to the given post and returns
+// the new comment ID. A non-zero parentID makes the comment a reply to
+// that comment, which must belong to the same post. It returns
+// sql.ErrNoRows when the post does not exist, errBadParent when the
+// parent is not a comment on the post and errBodyTooLong for bodies
+// longer than maxBody. Control characters are removed from the body as
+// in createPost. The authors of the post and of the parent comment are
+// notified, open pages of the post updated and webhooks queued.
+func (a *App) createComment(uid, postID, parentID int64, body string) (int64, error) {
+    body = stripControl(body)
+    if utf8.RuneCountInString(body) > maxBody {
+        return 0, errBodyTooLong
+    }
+    var exists int
+    if err := a.DB.QueryRow(`SELECT 1 FROM posts WHERE id = ?`, postID).Scan(&exists); err != nil {
+        return 0, err
+    }
+    var parent sql.NullInt64
+    if parentID != 0 {
+        err := a.DB.QueryRow(`SELECT 1 FROM comments WHERE id = ? AND post_id = ?`, parentID, postID).Scan(&exists)
+        if err == sql.ErrNoRows {
+            return 0, errBadParent
+        }
+        if err != nil {
+            return 0, err
+        }
+        parent = sql.NullInt64{Int64: parentID, Valid: true}
+    }
+    res, err := a.DB.Exec(`INSERT INTO comments(post_id, user_id, body, parent_id) VALUES(?,?,?,?)`, postID, uid, body, parent)
+    if err != nil {
+        return 0, err
+    }
+    cid, err := res.LastInsertId()
+    if err != nil {
+        return 0, err
+    }
+    a.notifyComment(uid, postID, parentID, cid)
+    a.publishComment(postID)
+    a.webhookCommentCreated(postID, cid)
+    return cid, nil
+}
@@ -0,0 +1,180 @@
+package app
+
+// This file defines the handlers for editing and deleting comments.
+// As with posts, only the author may edit a comment, moderators may
+// remove it and every edit keeps the previous body in the revisions
+// table.
+
+import (
+    "database/sql"
+    "net/http"
+    "strconv"
+    "strings"
+    "unicode/utf8"
+)
+
+// editableComment holds the fields shown on the comment edit form.
+type editableComment struct {
+    ID     int64
+    PostID int64
+    UserID int64
+    Body   string
+}
+
+// loadEditableComment fetches the comment identified by the `id` form
+// or query value and verifies that the current user wrote it, or with
+// allowModerator set, that they are a moderator. On failure an error
+// response has already been written.
+func (a *App) loadEditableComment(w http.ResponseWriter, r *http.Request, uid int64, allowModerator bool) (editableComment, bool) {
+    var c editableComment
+    cid, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+    if err != nil || cid <= 0 {
+        http.NotFound(w, r)
+        return c, false
+    }
+    err = a.DB.QueryRow(`SELECT id, post_id, user_id, body FROM comments WHERE id = ?`, cid).Scan(&c.ID, &c.PostID, &c.UserID, &c.Body)
+    if err == sql.ErrNoRows {
+        http.NotFound(w, r)
+        return c, false
+    }
+    if err != nil {
+        http.Error(w, "database error", http.StatusInternalServerError)
+        return c, false
+    }
+    if c.UserID != uid && !(allowModerator && hasRole(a.userRole(uid), RoleModerator)) {
+        http.Error(w, "only the author may change this comment", http.StatusForbidden)
+        return c, false
+    }
+    return c, true
+}
+
+// HandleEditComment displays the edit form on GET and saves the new
+// body on POST. The form must include the comment `id` and the new
+// `body`. The user is redirected back to the post afterwards.
+func (a *App) HandleEditComment(w http.ResponseWriter, r *http.Request) {
+    uid, _, ok := a.CurrentUser(r)
+    if !ok {
+        http.Redirect(w, r, "/login", http.StatusSeeOther)
+        return
+    }
+    switch r.Method {
+    case http.MethodGet:
+        c, ok := a.loadEditableComment(w, r, uid, false)
+        if !ok {
+            return
+        }
+        data := a.baseData(r)
+        data["Comment"] = c
+        tmpl := a.Templates.Lookup("comment_edit.html")
+        tmpl.ExecuteTemplate(w, "comment_edit.html", data)
+    case http.MethodPost:
+        c, ok := a.loadEditableComment(w, r, uid, false)
+        if !ok {
+            return
+        }
+        body := strings.TrimSpace(r.FormValue("body"))
+        if body == "" {
+            http.Error(w, "empty comment", http.StatusBadRequest)
+            return
+        }
+        err := a.updateComment(uid, c, body)
+        if err == errBodyTooLong {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        if err != nil {
+            http.Error(w, "database error", http.StatusInternalServerError)
+            return
+        }
+        http.Redirect(w, r, "/post?id="+strconv.FormatInt(c.PostID, 10), http.StatusSeeOther)
+    default:
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+// updateComment replaces the body of comment c, first storing the
+// previous body as a revision. Submitting an unchanged body is a
+// no-op so the history only records real edits. Bodies longer than
+// maxBody are refused with errBodyTooLong; control characters are
+// removed as in createPost.
+func (a *App) updateComment(uid int64, c editableComment, body string) error {
+    body = stripControl(body)
+    if utf8.RuneCountInString(body) > maxBody {
+        return errBodyTooLong
+    }
+    if body == c.Body {
+        return nil
+    }
+    return a.inTx(func(tx *sql.Tx) error {
+        if _, err := tx.Exec(`INSERT INTO revisions(target_type, target_id, user_id, body) VALUES('comment',?,?,?)`, c.ID, uid, c.Body); err != nil {
+            return err
+        }
+        _, err := tx.Exec(`UPDATE comments SET body = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`, body, c.ID)
+        return err
+    })
+}
+
+// HandleDeleteComment removes a comment along with its reactions and
+// revision history. Authors may delete their own comments and
+// moderators may remove any comment. Only POST is accepted.
+func (a *App) HandleDeleteComment(w http.ResponseWriter, r *http.Request) {
+    uid, _, ok := a.CurrentUser(r)
+    if !ok {
+        http.Redirect(w, r, "/login", http.StatusSeeOther)
+        return
+    }
+    if r.Method != http.MethodPost {
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    c, ok := a.loadEditableComment(w, r, uid, true)
+    if !ok {
+        return
+    }
+    if err := a.inTx(func(tx *sql.Tx) error { return deleteComment(tx, c.ID) }); err != nil {
+        http.Error(w, "database error", http.StatusInternalServerError)
+        return
+    }
+    http.Redirect(w, r, "/post?id="+strconv.FormatInt(c.PostID, 10), http.StatusSeeOther)
+}
+
+// deleteComment removes a comment and all replies below it, together
+// with the likes and revisions that refer to any of them.
+func deleteComment(tx *sql.Tx, cid int64) error {
+    // Collect the whole subtree first so that deleting rows cannot
+    // affect which replies are found.
+    rows, err := tx.Query(`WITH RECURSIVE subtree(id) AS (
+        SELECT ?
+        UNION ALL
+        SELECT c.id FROM comments c JOIN subtree s ON c.parent_id = s.id
+    ) SELECT id FROM subtree`, cid)
+    if err != nil {
+        return err
+    }
+    var ids []int64
+    for rows.Next() {
+        var id int64
+        if err := rows.Scan(&id); err != nil {
+            rows.Close()
+            return err
+        }
+        ids = append(ids, id)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return err
+    }
+    stmts := []string{
+        `DELETE FROM likes WHERE target_type='comment' AND target_id = ?`,
+        `DELETE FROM revisions WHERE target_type='comment' AND target_id = ?`,
+        `DELETE FROM comments WHERE id = ?`,
+    }
+    for _, id := range ids {
+        for _, stmt := range stmts {
+            if _, err := tx.Exec(stmt, id); err != nil {
+                return err
+            }
+        }
+    }
+    return nil
+}
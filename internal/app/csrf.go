@@ -0,0 +1,26 @@
+package app
+
+// This file carries the CSRF token chosen by the server middleware
+// through the request context so that baseData can hand it to the
+// templates. The tokens themselves are issued and verified in
+// internal/server.
+
+import (
+    "context"
+    "net/http"
+)
+
+// csrfContextKey is the context key under which the token is stored.
+type csrfContextKey struct{}
+
+// WithCSRFToken returns a copy of ctx carrying token.
+func WithCSRFToken(ctx context.Context, token string) context.Context {
+    return context.WithValue(ctx, csrfContextKey{}, token)
+}
+
+// CSRFToken returns the CSRF token attached to the request, or an
+// empty string when the request did not pass through the middleware.
+func CSRFToken(r *http.Request) string {
+    token, _ := r.Context().Value(csrfContextKey{}).(string)
+    return token
+}
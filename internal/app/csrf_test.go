@@ -0,0 +1,19 @@
+package app
+
+// Tests of carrying the CSRF token through the request context.
+
+import (
+    "net/http/httptest"
+    "testing"
+)
+
+func TestCSRFToken(t *testing.T) {
+    r := httptest.NewRequest("GET", "/", nil)
+    if got := CSRFToken(r); got != "" {
+        t.Fatalf("token %q without the middleware", got)
+    }
+    r = r.WithContext(WithCSRFToken(r.Context(), "abc"))
+    if got := CSRFToken(r); got != "abc" {
+        t.Fatalf("token %q, want abc", got)
+    }
+}
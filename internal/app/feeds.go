@@ -0,0 +1,364 @@
+package app
+
+// This file serves Atom and RSS feeds for feed readers:
+//
+//   /feed.atom, /feed.rss                   newest posts
+//   /feed.atom?category=Help                newest posts in a category
+//   /post/feed.atom?id=12, /post/feed.rss   newest comments on a post
+//
+// The feeds of posts list the same posts as the index, through
+// listPosts, but with their full rendered bodies. Every feed is
+// rendered in full and then handed to http.ServeContent with an ETag
+// derived from its bytes and a Last-Modified time taken from its
+// newest entry, so readers polling with If-None-Match or
+// If-Modified-Since get 304 Not Modified until something changes.
+// Links in feeds must be absolute; they are built with absoluteURL,
+// which prefers the configured App.BaseURL.
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "database/sql"
+    "encoding/hex"
+    "encoding/xml"
+    "net/http"
+    "net/url"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+
+    "forum/internal/markdown"
+)
+
+// feedComments is the number of comments in a post's comment feed.
+const feedComments = 50
+
+// feedMaxAge is how long readers and proxies may reuse a feed without
+// asking again.
+const feedMaxAge = 5 * time.Minute
+
+// feed is a feed independent of its format.
+type feed struct {
+    Title       string
+    Description string
+    // Link is the HTML page the feed belongs to and Self the feed
+    // itself, both absolute. Self also serves as the Atom feed ID.
+    Link    string
+    Self    string
+    Updated time.Time
+    Entries []feedEntry
+}
+
+// feedEntry is one post or comment in a feed. Link doubles as its
+// permanent ID.
+type feedEntry struct {
+    Title      string
+    Link       string
+    Author     string
+    Categories []string
+    Published  time.Time
+    Updated    time.Time
+    HTML       string
+}
+
+// HandleFeed serves the newest posts, optionally limited to the
+// category named in the `category` query parameter, as Atom or RSS
+// depending on the path.
+func (a *App) HandleFeed(w http.ResponseWriter, r *http.Request) {
+    category := r.URL.Query().Get("category")
+    f := feed{
+        Title:       "Forum",
+        Description: "New posts on the forum",
+        Link:        a.absoluteURL(r, "/"),
+        Self:        a.absoluteURL(r, r.URL.Path),
+    }
+    if category != "" {
+        cats, err := a.AllCategories()
+        if err != nil {
+            http.Error(w, "database error", http.StatusInternalServerError)
+            return
+        }
+        found := false
+        for _, c := range cats {
+            found = found || c.Name == category
+        }
+        if !found {
+            http.NotFound(w, r)
+            return
+        }
+        f.Title = "Forum: " + category
+        f.Description = "New posts in " + category
+        f.Link = a.absoluteURL(r, "/?category="+url.QueryEscape(category))
+        f.Self = a.absoluteURL(r, r.URL.Path+"?category="+url.QueryEscape(category))
+    }
+    page, err := a.listPosts(0, postFilter{Category: category}, pageRequest{Sort: "new"})
+    if err != nil {
+        http.Error(w, "database error", http.StatusInternalServerError)
+        return
+    }
+    for _, p := range page.Posts {
+        e := feedEntry{
+            Title:     p.Title,
+            Link:      a.absoluteURL(r, "/post?id="+strconv.FormatInt(p.ID, 10)),
+            Author:    p.Author,
+            Published: p.CreatedAt,
+            Updated:   p.CreatedAt,
+            HTML:      a.absoluteLinks(r, string(markdown.Render(p.source))),
+        }
+        if p.Categories != "" {
+            e.Categories = strings.Split(p.Categories, ",")
+            sort.Strings(e.Categories)
+        }
+        if p.updatedAt.Valid {
+            e.Updated = p.updatedAt.Time
+        }
+        f.Entries = append(f.Entries, e)
+    }
+    a.serveFeed(w, r, f)
+}
+
+// HandlePostFeed serves the newest comments on the post given by the
+// `id` query parameter as Atom or RSS depending on the path.
+func (a *App) HandlePostFeed(w http.ResponseWriter, r *http.Request) {
+    pid, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+    if err != nil || pid <= 0 {
+        http.NotFound(w, r)
+        return
+    }
+    p, err := a.loadPost(pid, 0)
+    if err == sql.ErrNoRows {
+        http.NotFound(w, r)
+        return
+    }
+    if err != nil {
+        http.Error(w, "database error", http.StatusInternalServerError)
+        return
+    }
+    postURL := "/post?id=" + strconv.FormatInt(p.ID, 10)
+    f := feed{
+        Title:       "Comments on " + p.Title,
+        Description: "New comments on \"" + p.Title + "\" by " + p.Author,
+        Link:        a.absoluteURL(r, postURL),
+        Self:        a.absoluteURL(r, r.URL.Path+"?id="+strconv.FormatInt(p.ID, 10)),
+        // An edit of the post changes the feed's title too.
+        Updated: p.CreatedAt,
+    }
+    if p.UpdatedAt != nil {
+        f.Updated = *p.UpdatedAt
+    }
+    // Comments come oldest first; the feed wants the newest.
+    for i := len(p.Comments) - 1; i >= 0 && len(f.Entries) < feedComments; i-- {
+        c := p.Comments[i]
+        e := feedEntry{
+            Title:     "Comment by " + c.Author + " on " + p.Title,
+            Link:      a.absoluteURL(r, postURL+"#c"+strconv.FormatInt(c.ID, 10)),
+            Author:    c.Author,
+            Published: c.CreatedAt,
+            Updated:   c.CreatedAt,
+            HTML:      a.absoluteLinks(r, string(c.BodyHTML)),
+        }
+        if c.UpdatedAt != nil {
+            e.Updated = *c.UpdatedAt
+        }
+        f.Entries = append(f.Entries, e)
+    }
+    a.serveFeed(w, r, f)
+}
+
+// serveFeed renders f in the format named by the path's extension and
+// sends it with caching headers. The feed's Updated time is raised to
+// that of its newest entry.
+func (a *App) serveFeed(w http.ResponseWriter, r *http.Request, f feed) {
+    if r.Method != http.MethodGet && r.Method != http.MethodHead {
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    for _, e := range f.Entries {
+        if e.Updated.After(f.Updated) {
+            f.Updated = e.Updated
+        }
+    }
+    var buf bytes.Buffer
+    buf.WriteString(xml.Header)
+    var err error
+    name := "feed.atom"
+    if strings.HasSuffix(r.URL.Path, ".rss") {
+        name = "feed.rss"
+        w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+        err = writeRSS(&buf, f)
+    } else {
+        w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+        err = writeAtom(&buf, f)
+    }
+    if err != nil {
+        http.Error(w, "feed error", http.StatusInternalServerError)
+        return
+    }
+    sum := sha256.Sum256(buf.Bytes())
+    w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+    w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(feedMaxAge/time.Second)))
+    http.ServeContent(w, r, name, f.Updated, bytes.NewReader(buf.Bytes()))
+}
+
+// absoluteLinks rewrites the root-relative link and image URLs in
+// rendered Markdown, such as those of uploaded images, into absolute
+// ones, since feed readers show the HTML away from the forum.
+func (a *App) absoluteLinks(r *http.Request, html string) string {
+    base := a.absoluteURL(r, "")
+    for _, attr := range []string{`href="/`, `src="/`} {
+        var b strings.Builder
+        rest := html
+        for {
+            i := strings.Index(rest, attr)
+            if i < 0 {
+                break
+            }
+            end := i + len(attr)
+            b.WriteString(rest[:end-1])
+            // "//host/..." is already absolute apart from the scheme.
+            if !strings.HasPrefix(rest[end:], "/") {
+                b.WriteString(base)
+            }
+            b.WriteString("/")
+            rest = rest[end:]
+        }
+        b.WriteString(rest)
+        html = b.String()
+    }
+    return html
+}
+
+// Atom 1.0 (RFC 4287) elements.
+type (
+    atomFeed struct {
+        XMLName  xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+        Title    string      `xml:"title"`
+        Subtitle string      `xml:"subtitle,omitempty"`
+        ID       string      `xml:"id"`
+        Updated  string      `xml:"updated"`
+        Links    []atomLink  `xml:"link"`
+        Entries  []atomEntry `xml:"entry"`
+    }
+    atomLink struct {
+        Rel  string `xml:"rel,attr,omitempty"`
+        Type string `xml:"type,attr,omitempty"`
+        Href string `xml:"href,attr"`
+    }
+    atomEntry struct {
+        Title      string         `xml:"title"`
+        ID         string         `xml:"id"`
+        Link       atomLink       `xml:"link"`
+        Published  string         `xml:"published"`
+        Updated    string         `xml:"updated"`
+        Author     atomPerson     `xml:"author"`
+        Categories []atomCategory `xml:"category"`
+        Content    atomContent    `xml:"content"`
+    }
+    atomPerson struct {
+        Name string `xml:"name"`
+    }
+    atomCategory struct {
+        Term string `xml:"term,attr"`
+    }
+    atomContent struct {
+        Type string `xml:"type,attr"`
+        Body string `xml:",chardata"`
+    }
+)
+
+// writeAtom writes f as an Atom feed.
+func writeAtom(buf *bytes.Buffer, f feed) error {
+    out := atomFeed{
+        Title:    f.Title,
+        Subtitle: f.Description,
+        ID:       f.Self,
+        Updated:  f.Updated.UTC().Format(time.RFC3339),
+        Links: []atomLink{
+            {Rel: "alternate", Type: "text/html", Href: f.Link},
+            {Rel: "self", Type: "application/atom+xml", Href: f.Self},
+        },
+    }
+    for _, e := range f.Entries {
+        ae := atomEntry{
+            Title:     e.Title,
+            ID:        e.Link,
+            Link:      atomLink{Rel: "alternate", Type: "text/html", Href: e.Link},
+            Published: e.Published.UTC().Format(time.RFC3339),
+            Updated:   e.Updated.UTC().Format(time.RFC3339),
+            Author:    atomPerson{Name: e.Author},
+            Content:   atomContent{Type: "html", Body: e.HTML},
+        }
+        for _, c := range e.Categories {
+            ae.Categories = append(ae.Categories, atomCategory{Term: c})
+        }
+        out.Entries = append(out.Entries, ae)
+    }
+    enc := xml.NewEncoder(buf)
+    enc.Indent("", "  ")
+    return enc.Encode(out)
+}
+
+// RSS 2.0 elements. RSS has no author field without an email address,
+// so authors go into Dublin Core's dc:creator, and the feed's own URL
+// into atom:link as feed validators recommend.
+type (
+    rssFeed struct {
+        XMLName xml.Name   `xml:"rss"`
+        Version string     `xml:"version,attr"`
+        AtomNS  string     `xml:"xmlns:atom,attr"`
+        DCNS    string     `xml:"xmlns:dc,attr"`
+        Channel rssChannel `xml:"channel"`
+    }
+    rssChannel struct {
+        Title         string    `xml:"title"`
+        Link          string    `xml:"link"`
+        Description   string    `xml:"description"`
+        LastBuildDate string    `xml:"lastBuildDate"`
+        Self          atomLink  `xml:"atom:link"`
+        Items         []rssItem `xml:"item"`
+    }
+    rssItem struct {
+        Title       string   `xml:"title"`
+        Link        string   `xml:"link"`
+        GUID        rssGUID  `xml:"guid"`
+        PubDate     string   `xml:"pubDate"`
+        Creator     string   `xml:"dc:creator"`
+        Categories  []string `xml:"category"`
+        Description string   `xml:"description"`
+    }
+    rssGUID struct {
+        IsPermaLink bool   `xml:"isPermaLink,attr"`
+        Value       string `xml:",chardata"`
+    }
+)
+
+// writeRSS writes f as an RSS 2.0 feed.
+func writeRSS(buf *bytes.Buffer, f feed) error {
+    out := rssFeed{
+        Version: "2.0",
+        AtomNS:  "http://www.w3.org/2005/Atom",
+        DCNS:    "http://purl.org/dc/elements/1.1/",
+        Channel: rssChannel{
+            Title:         f.Title,
+            Link:          f.Link,
+            Description:   f.Description,
+            LastBuildDate: f.Updated.UTC().Format(time.RFC1123Z),
+            Self:          atomLink{Rel: "self", Type: "application/rss+xml", Href: f.Self},
+        },
+    }
+    for _, e := range f.Entries {
+        out.Channel.Items = append(out.Channel.Items, rssItem{
+            Title:       e.Title,
+            Link:        e.Link,
+            GUID:        rssGUID{IsPermaLink: true, Value: e.Link},
+            PubDate:     e.Published.UTC().Format(time.RFC1123Z),
+            Creator:     e.Author,
+            Categories:  e.Categories,
+            Description: e.HTML,
+        })
+    }
+    enc := xml.NewEncoder(buf)
+    enc.Indent("", "  ")
+    return enc.Encode(out)
+}
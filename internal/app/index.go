@@ -1,110 +1,271 @@
 package app
 
 // This file implements the handler for the forum home page. The
-// index lists all posts ordered by creation time and provides
-// optional filtering by category, posts authored by the current
-// user and posts liked by the current user. Anonymous visitors can
-// see all posts but cannot access the "mine" or "liked" filters.
+// index lists posts one page at a time in one of several sort modes
+// (see pagination.go) and provides optional filtering by category,
+// posts authored by the current user and posts liked by the current
+// user. Anonymous visitors can see all posts but cannot access the
+// "mine" or "liked" filters.
 
 import (
     "database/sql"
+    "errors"
     "net/http"
+    "net/url"
     "strings"
     "time"
+
+    "forum/internal/markdown"
 )
 
 // postListing holds the data necessary to render a post in the
 // index. Categories is a comma‑separated string rather than a
-// slice to simplify template rendering without range loops.
+// slice to simplify template rendering without range loops. Body is a
+// plain-text excerpt of the rendered Markdown, not the source. The
+// JSON tags define how the struct is exposed by the API.
 type postListing struct {
-    ID           int64
-    Title        string
-    Body         string
-    Author       string
-    Categories   string
-    LikeCount    int
-    DislikeCount int
-    MyReaction   int
-    CreatedAt    time.Time
+    ID           int64     `json:"id"`
+    Title        string    `json:"title"`
+    Body         string    `json:"body"`
+    Author       string    `json:"author"`
+    Categories   string    `json:"categories"`
+    LikeCount    int       `json:"like_count"`
+    DislikeCount int       `json:"dislike_count"`
+    MyReaction   int       `json:"my_reaction"`
+    CommentCount int       `json:"comment_count"`
+    CreatedAt    time.Time `json:"created_at"`
+
+    // source is the full Markdown body and updatedAt the time of the
+    // last edit, for the feeds, which show whole posts.
+    source    string
+    updatedAt sql.NullTime
+}
+
+// postFilter describes which posts the index should list. Mine and
+// Liked restrict the list to posts authored or liked by the current
+// user and are only honoured for logged-in users.
+type postFilter struct {
+    Category string
+    Mine     bool
+    Liked    bool
 }
 
-// HandleIndex renders the list of posts with optional filters. The
+// HandleIndex renders one page of posts with optional filters. The
 // query parameters recognised are:
 //   category=<name>  – only posts containing this category
 //   filter=mine      – only posts authored by the logged‑in user
 //   filter=liked     – only posts liked by the logged‑in user
+//   sort=<mode>      – new (default), old, top, comments or hot
+//   after=<cursor>   – the page following a previous page
+//   before=<cursor>  – the page preceding a previous page
 // Filters "mine" and "liked" are ignored when the user is not
-// authenticated.
+// authenticated. Next/previous links keep the filters and sort mode.
 func (a *App) HandleIndex(w http.ResponseWriter, r *http.Request) {
+    // The index is registered on "/" which the ServeMux also uses as
+    // the fallback for unknown paths, so anything else is a 404.
+    if r.URL.Path != "/" {
+        http.NotFound(w, r)
+        return
+    }
     // Read filter parameters from the query string.
-    category := r.URL.Query().Get("category")
-    filter := r.URL.Query().Get("filter")
+    q := r.URL.Query()
+    category := q.Get("category")
+    filter := q.Get("filter")
+    sortMode := q.Get("sort")
+    if _, ok := postSorts[sortMode]; !ok {
+        sortMode = "new"
+    }
     // Determine current user. uid is zero when anonymous.
     uid, _, logged := a.CurrentUser(r)
+    page, err := a.listPosts(uid, postFilter{
+        Category: category,
+        Mine:     filter == "mine" && logged,
+        Liked:    filter == "liked" && logged,
+    }, pageRequest{Sort: sortMode, After: q.Get("after"), Before: q.Get("before")})
+    if err == errBadCursor {
+        http.Error(w, "invalid page cursor", http.StatusBadRequest)
+        return
+    }
+    if err != nil {
+        http.Error(w, "database error", http.StatusInternalServerError)
+        return
+    }
+    // Build the pagination links from the current filters so that
+    // moving between pages keeps the same view.
+    pageLink := func(key, cursor string) string {
+        v := url.Values{}
+        if category != "" {
+            v.Set("category", category)
+        }
+        if filter != "" {
+            v.Set("filter", filter)
+        }
+        if sortMode != "new" {
+            v.Set("sort", sortMode)
+        }
+        v.Set(key, cursor)
+        return "/?" + v.Encode()
+    }
+    data := a.baseData(r)
+    data["Posts"] = page.Posts
+    data["SelectedCategory"] = category
+    data["SelectedFilter"] = filter
+    data["SelectedSort"] = sortMode
+    data["SortOptions"] = sortOptions()
+    if page.Next != "" {
+        data["NextURL"] = pageLink("after", page.Next)
+    }
+    if page.Prev != "" {
+        data["PrevURL"] = pageLink("before", page.Prev)
+    }
+    tmpl := a.Templates.Lookup("index.html")
+    tmpl.ExecuteTemplate(w, "index.html", data)
+}
+
+// errBadCursor is returned by listPosts when a page cursor cannot be
+// decoded.
+var errBadCursor = errors.New("invalid page cursor")
+
+// listPosts returns one page of the posts matching the filter, with
+// reaction and comment counts and the reaction of user uid (zero when
+// anonymous). Bodies are truncated to a short preview. It is shared
+// by the HTML index and the JSON API. The date sorts select the page
+// before counting anything; the others have to compute their key for
+// every matching post.
+func (a *App) listPosts(uid int64, f postFilter, pr pageRequest) (postPage, error) {
+    var page postPage
+    sortMode, ok := postSorts[pr.Sort]
+    if !ok {
+        sortMode = postSorts["new"]
+    }
+    // Decode the cursor, if any. A cursor pins the reference time so
+    // that the "hot" order does not drift between pages.
+    var cursor *pageCursor
+    backward := false
+    if pr.After != "" || pr.Before != "" {
+        raw := pr.After
+        if raw == "" {
+            raw = pr.Before
+            backward = true
+        }
+        c, err := decodeCursor(raw)
+        if err != nil {
+            return page, errBadCursor
+        }
+        cursor = &c
+    }
+    now := time.Now().Unix()
+    if cursor != nil {
+        now = cursor.Now
+    }
     // Build the SQL query incrementally. We'll assemble WHERE
     // clauses and arguments based on the requested filters.
     var where []string
     var args []any
-    // When a category is specified we join through post_categories
-    // below. We'll add a WHERE clause after the join.
-    if category != "" {
-        where = append(where, "c.name = ?")
-        args = append(args, category)
-    }
-    // If the user requests the "mine" filter and is logged in we
-    // restrict posts to those authored by them.
-    if filter == "mine" && logged {
+    // When a category is specified only posts linked to it are kept.
+    // An EXISTS test leaves the category join untouched so the post
+    // still lists all of its categories.
+    if f.Category != "" {
+        where = append(where, "EXISTS (SELECT 1 FROM post_categories fpc JOIN categories fc ON fc.id = fpc.category_id WHERE fpc.post_id = p.id AND fc.name = ?)")
+        args = append(args, f.Category)
+    }
+    // If the user requests the "mine" filter we restrict posts to
+    // those authored by them.
+    if f.Mine {
         where = append(where, "p.user_id = ?")
         args = append(args, uid)
     }
-    // If the user requests the "liked" filter and is logged in we
-    // join the likes table to find posts the user has liked. We
-    // implement this as an inner join on likes with value=1.
+    // If the user requests the "liked" filter we join the likes table
+    // to find posts the user has liked. We implement this as an inner
+    // join on likes with value=1.
     likedJoin := ""
-    if filter == "liked" && logged {
+    if f.Liked {
         likedJoin = "JOIN likes l2 ON l2.target_type='post' AND l2.target_id=p.id AND l2.user_id=? AND l2.value=1"
-        args = append(args, uid)
+        args = append([]any{uid}, args...)
+    }
+    // Reading forwards in descending order means "smaller than the
+    // cursor"; reading backwards or in ascending order flips it.
+    asc := sortMode.Asc != backward
+    cmp, dir := "<", "DESC"
+    if asc {
+        cmp, dir = ">", "ASC"
+    }
+    // The date sorts choose the page from the posts table alone,
+    // walking the index on (created_at, id) from the cursor, so that
+    // only the posts shown are grouped and counted below. The row
+    // value comparison is what lets SQLite start the walk at the
+    // cursor.
+    if sortMode.ByDate {
+        sel := "SELECT p.id FROM posts p " + likedJoin + " "
+        if cursor != nil {
+            where = append(where, "(p.created_at, p.id) "+cmp+" (datetime(?, 'unixepoch'), ?)")
+            args = append(args, int64(cursor.Key), cursor.ID)
+        }
+        if len(where) > 0 {
+            sel += "WHERE " + strings.Join(where, " AND ") + " "
+        }
+        sel += "ORDER BY p.created_at " + dir + ", p.id " + dir + " LIMIT ?"
+        args = append(args, postsPerPage+1)
+        where, likedJoin = []string{"p.id IN (" + sel + ")"}, ""
     }
     // Build the base query. We join users and categories via
     // post_categories. We use GROUP_CONCAT to aggregate category names
     // into a single string.
-    query := `SELECT
-        p.id, p.title, p.body, p.created_at,
+    inner := `SELECT
+        p.id, p.title, p.body, p.created_at, p.updated_at,
         u.username,
         GROUP_CONCAT(DISTINCT c.name) as categories,
         (SELECT COUNT(*) FROM likes WHERE target_type='post' AND target_id=p.id AND value=1) as like_count,
         (SELECT COUNT(*) FROM likes WHERE target_type='post' AND target_id=p.id AND value=-1) as dislike_count,
-        COALESCE((SELECT value FROM likes WHERE target_type='post' AND target_id=p.id AND user_id=?), 0) as my_reaction
+        COALESCE((SELECT value FROM likes WHERE target_type='post' AND target_id=p.id AND user_id=?), 0) as my_reaction,
+        (SELECT COUNT(*) FROM comments WHERE post_id=p.id) as comment_count
     FROM posts p
     JOIN users u ON p.user_id = u.id
     LEFT JOIN post_categories pc ON p.id = pc.post_id
     LEFT JOIN categories c ON pc.category_id = c.id `
     // Insert the liked join if necessary.
     if likedJoin != "" {
-        query += likedJoin + " "
+        inner += likedJoin + " "
     }
     // Add WHERE clauses if any.
     if len(where) > 0 {
-        query += "WHERE " + strings.Join(where, " AND ") + " "
+        inner += "WHERE " + strings.Join(where, " AND ") + " "
     }
-    query += "GROUP BY p.id ORDER BY p.created_at DESC"
+    inner += "GROUP BY p.id"
     // The first argument for my_reaction is the user ID. When not logged
     // in we pass zero which yields no reaction.
     args = append([]any{uid}, args...)
+    // Wrap the listing so the sort key can be computed from its
+    // columns and compared against the cursor. The hot expression
+    // needs the reference time twice.
+    var keyArgs []any
+    if sortMode.Expr == hotExpr {
+        jd := julianDay(now)
+        keyArgs = []any{jd, jd}
+    }
+    query := `SELECT * FROM (SELECT t.*, ` + sortMode.Expr + ` AS sort_key FROM (` + inner + `) t)`
+    args = append(keyArgs, args...)
+    if cursor != nil && !sortMode.ByDate {
+        query += ` WHERE (sort_key ` + cmp + ` ? OR (sort_key = ? AND id ` + cmp + ` ?))`
+        args = append(args, cursor.Key, cursor.Key, cursor.ID)
+    }
+    // Fetch one extra row to learn whether another page follows.
+    query += ` ORDER BY sort_key ` + dir + `, id ` + dir + ` LIMIT ?`
+    args = append(args, postsPerPage+1)
     rows, err := a.DB.Query(query, args...)
     if err != nil {
-        http.Error(w, "database error", http.StatusInternalServerError)
-        return
+        return page, err
     }
     defer rows.Close()
     var posts []postListing
+    var keys []float64
     for rows.Next() {
         var p postListing
         var cats sql.NullString
         var myReact sql.NullInt64
-        if err := rows.Scan(&p.ID, &p.Title, &p.Body, &p.CreatedAt, &p.Author, &cats, &p.LikeCount, &p.DislikeCount, &myReact); err != nil {
-            http.Error(w, "database error", http.StatusInternalServerError)
-            return
+        var key float64
+        if err := rows.Scan(&p.ID, &p.Title, &p.Body, &p.CreatedAt, &p.updatedAt, &p.Author, &cats, &p.LikeCount, &p.DislikeCount, &myReact, &p.CommentCount, &key); err != nil {
+            return page, err
         }
         if cats.Valid {
             p.Categories = cats.String
@@ -112,19 +273,50 @@ func (a *App) HandleIndex(w http.ResponseWriter, r *http.Request) {
         if myReact.Valid {
             p.MyReaction = int(myReact.Int64)
         }
-        // Truncate the body for preview. If the body is longer than
-        // 200 runes slice it and append ellipsis.
+        // Replace the body with a short plain-text preview. The
+        // Markdown is rendered first so that the preview shows what
+        // readers see rather than asterisks and link syntax.
         const maxPreview = 200
-        if len([]rune(p.Body)) > maxPreview {
-            runes := []rune(p.Body)
-            p.Body = string(runes[:maxPreview]) + "..."
-        }
+        p.source = p.Body
+        p.Body = markdown.Excerpt(p.Body, maxPreview)
         posts = append(posts, p)
+        keys = append(keys, key)
     }
-    data := a.baseData(r)
-    data["Posts"] = posts
-    data["SelectedCategory"] = category
-    data["SelectedFilter"] = filter
-    tmpl := a.Templates["index.html"]
-    tmpl.ExecuteTemplate(w, "index.html", data)
-}
\ No newline at end of file
+    if err := rows.Err(); err != nil {
+        return page, err
+    }
+    more := len(posts) > postsPerPage
+    if more {
+        posts, keys = posts[:postsPerPage], keys[:postsPerPage]
+    }
+    // A backward read returns the rows nearest the cursor first; put
+    // them back into display order.
+    if backward {
+        for i, j := 0, len(posts)-1; i < j; i, j = i+1, j-1 {
+            posts[i], posts[j] = posts[j], posts[i]
+            keys[i], keys[j] = keys[j], keys[i]
+        }
+    }
+    page.Posts = posts
+    if len(posts) == 0 {
+        return page, nil
+    }
+    first := pageCursor{Key: keys[0], ID: posts[0].ID, Now: now}
+    last := pageCursor{Key: keys[len(keys)-1], ID: posts[len(posts)-1].ID, Now: now}
+    // Moving forwards there is a previous page whenever we started
+    // from a cursor; moving backwards there is always a next page.
+    if backward {
+        page.Next = last.encode()
+        if more {
+            page.Prev = first.encode()
+        }
+    } else {
+        if more {
+            page.Next = last.encode()
+        }
+        if cursor != nil {
+            page.Prev = first.encode()
+        }
+    }
+    return page, nil
+}
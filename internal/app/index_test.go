@@ -0,0 +1,163 @@
+package app
+
+// Tests of paging through the index: every post appears exactly once
+// and in order, forwards and backwards, in each sort mode and with
+// filters, including posts written in the same second.
+
+import (
+    "testing"
+)
+
+// pageThrough follows the Next cursors from the first page and then
+// the Prev cursors back again, returning the IDs seen in each
+// direction.
+func pageThrough(t *testing.T, a *App, uid int64, f postFilter, sort string) (forward, backward []int64) {
+    t.Helper()
+    page, err := a.listPosts(uid, f, pageRequest{Sort: sort})
+    if err != nil {
+        t.Fatal(err)
+    }
+    var pages []postPage
+    for {
+        pages = append(pages, page)
+        for _, p := range page.Posts {
+            forward = append(forward, p.ID)
+        }
+        if page.Next == "" {
+            break
+        }
+        if page, err = a.listPosts(uid, f, pageRequest{Sort: sort, After: page.Next}); err != nil {
+            t.Fatal(err)
+        }
+    }
+    // Back from the last page, prepending each page read.
+    for page.Prev != "" {
+        if page, err = a.listPosts(uid, f, pageRequest{Sort: sort, Before: page.Prev}); err != nil {
+            t.Fatal(err)
+        }
+        ids := make([]int64, 0, len(page.Posts))
+        for _, p := range page.Posts {
+            ids = append(ids, p.ID)
+        }
+        backward = append(ids, backward...)
+    }
+    backward = append(backward, idsOf(pages[len(pages)-1])...)
+    return forward, backward
+}
+
+func idsOf(page postPage) []int64 {
+    var ids []int64
+    for _, p := range page.Posts {
+        ids = append(ids, p.ID)
+    }
+    return ids
+}
+
+func TestListPostsPages(t *testing.T) {
+    a := newTestApp(t)
+    alice := createTestUser(t, a, "alice")
+    bob := createTestUser(t, a, "bob")
+    // 50 posts, three to a second, alternately in Help and General.
+    // bob likes every fifth and writes a comment on every seventh.
+    var ids []int64
+    for i := 0; i < 50; i++ {
+        cat := "Help"
+        if i%2 == 1 {
+            cat = "General"
+        }
+        pid, err := a.createPost(alice, "Post", "body", []string{cat})
+        if err != nil {
+            t.Fatal(err)
+        }
+        if _, err := a.DB.Exec(`UPDATE posts SET created_at = datetime('2024-01-01', ? || ' seconds') WHERE id = ?`, i/3, pid); err != nil {
+            t.Fatal(err)
+        }
+        if i%5 == 0 {
+            if _, err := a.DB.Exec(`INSERT INTO likes(user_id, target_type, target_id, value) VALUES(?, 'post', ?, 1)`, bob, pid); err != nil {
+                t.Fatal(err)
+            }
+        }
+        if i%7 == 0 {
+            if _, err := a.createComment(bob, pid, 0, "comment"); err != nil {
+                t.Fatal(err)
+            }
+        }
+        ids = append(ids, pid)
+    }
+    reversed := func(in []int64) []int64 {
+        out := make([]int64, len(in))
+        for i, id := range in {
+            out[len(in)-1-i] = id
+        }
+        return out
+    }
+    same := func(name string, got, want []int64) {
+        t.Helper()
+        if len(got) != len(want) {
+            t.Errorf("%s: %d posts, want %d\n got %v\nwant %v", name, len(got), len(want), got, want)
+            return
+        }
+        for i := range got {
+            if got[i] != want[i] {
+                t.Errorf("%s: post %d is %d, want %d\n got %v\nwant %v", name, i, got[i], want[i], got, want)
+                return
+            }
+        }
+    }
+    keep := func(pick func(i int) bool) []int64 {
+        var out []int64
+        for i, id := range ids {
+            if pick(i) {
+                out = append(out, id)
+            }
+        }
+        return out
+    }
+
+    for _, tt := range []struct {
+        name string
+        f    postFilter
+        sort string
+        want []int64
+    }{
+        {"new", postFilter{}, "new", reversed(ids)},
+        {"old", postFilter{}, "old", ids},
+        {"new in Help", postFilter{Category: "Help"}, "new", reversed(keep(func(i int) bool { return i%2 == 0 }))},
+        {"old liked", postFilter{Liked: true}, "old", keep(func(i int) bool { return i%5 == 0 })},
+    } {
+        forward, backward := pageThrough(t, a, bob, tt.f, tt.sort)
+        same(tt.name+" forwards", forward, tt.want)
+        same(tt.name+" backwards", backward, tt.want)
+    }
+
+    // The counting sorts list every post once as well.
+    for _, sort := range []string{"top", "comments", "hot"} {
+        forward, backward := pageThrough(t, a, bob, postFilter{}, sort)
+        seen := map[int64]bool{}
+        for _, id := range forward {
+            seen[id] = true
+        }
+        if len(forward) != len(ids) || len(seen) != len(ids) {
+            t.Errorf("%s: %d posts, %d different, want %d", sort, len(forward), len(seen), len(ids))
+        }
+        same(sort+" backwards", backward, forward)
+    }
+
+    // The counts are those of each post.
+    page, err := a.listPosts(bob, postFilter{}, pageRequest{Sort: "old"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    for i, p := range page.Posts {
+        likes, comments := 0, 0
+        if i%5 == 0 {
+            likes = 1
+        }
+        if i%7 == 0 {
+            comments = 1
+        }
+        if p.LikeCount != likes || p.MyReaction != likes || p.CommentCount != comments {
+            t.Errorf("post %d: %d likes, reaction %d, %d comments", i, p.LikeCount, p.MyReaction, p.CommentCount)
+        }
+    }
+}
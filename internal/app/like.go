@@ -1,7 +1,7 @@
 package app
 
 // This file defines the handler for liking and disliking posts or
-// comments. The handler expects query parameters specifying the
+// comments. The handler expects POST form fields specifying the
 // target type (either `post` or `comment`), the target ID and the
 // value (1 for like, -1 for dislike). Submitting the same value
 // twice removes the existing reaction, effectively toggling it off.
@@ -17,21 +17,24 @@ import (
 // completion it redirects back to the post page containing the
 // target so that the user sees the updated reaction counts.
 func (a *App) HandleLike(w http.ResponseWriter, r *http.Request) {
-    // Only allow POST or GET for likes. Using GET simplifies
-    // template links but in a real application you may prefer POST
-    // for CSRF protection.
-    targetType := r.URL.Query().Get("type")
+    // Reactions change state, so they must be submitted with POST
+    // and a CSRF token. A GET link could be embedded by any page.
+    if r.Method != http.MethodPost {
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    targetType := r.PostFormValue("type")
     if targetType != "post" && targetType != "comment" {
         http.Error(w, "invalid target type", http.StatusBadRequest)
         return
     }
-    idStr := r.URL.Query().Get("id")
+    idStr := r.PostFormValue("id")
     targetID, err := strconv.ParseInt(idStr, 10, 64)
     if err != nil || targetID <= 0 {
         http.Error(w, "invalid target id", http.StatusBadRequest)
         return
     }
-    valStr := r.URL.Query().Get("value")
+    valStr := r.PostFormValue("value")
     v, err := strconv.Atoi(valStr)
     if err != nil || (v != 1 && v != -1) {
         http.Error(w, "invalid reaction value", http.StatusBadRequest)
@@ -43,23 +46,11 @@ func (a *App) HandleLike(w http.ResponseWriter, r *http.Request) {
         http.Redirect(w, r, "/login", http.StatusSeeOther)
         return
     }
-    // Check for existing like on this target by this user.
-    var existingID int64
-    var existingValue int
-    row := a.DB.QueryRow(`SELECT id, value FROM likes WHERE user_id=? AND target_type=? AND target_id=?`, uid, targetType, targetID)
-    switch err := row.Scan(&existingID, &existingValue); err {
-    case nil:
-        // Already exists. If the same value is being sent, remove the
-        // like (toggle off). Otherwise update the value.
-        if existingValue == v {
-            _, _ = a.DB.Exec(`DELETE FROM likes WHERE id = ?`, existingID)
-        } else {
-            _, _ = a.DB.Exec(`UPDATE likes SET value = ? WHERE id = ?`, v, existingID)
+    if err := a.react(uid, targetType, targetID, v); err != nil {
+        if err == sql.ErrNoRows {
+            http.Error(w, "target not found", http.StatusBadRequest)
+            return
         }
-    case sql.ErrNoRows:
-        // No existing record; insert a new like.
-        _, _ = a.DB.Exec(`INSERT INTO likes(user_id, target_type, target_id, value) VALUES(?,?,?,?)`, uid, targetType, targetID, v)
-    default:
         http.Error(w, "database error", http.StatusInternalServerError)
         return
     }
@@ -71,7 +62,7 @@ func (a *App) HandleLike(w http.ResponseWriter, r *http.Request) {
     if targetType == "post" {
         postID = targetID
     } else {
-        if pidStr := r.URL.Query().Get("post_id"); pidStr != "" {
+        if pidStr := r.PostFormValue("post_id"); pidStr != "" {
             postID, _ = strconv.ParseInt(pidStr, 10, 64)
         } else {
             // Query comments table for the parent post ID.
@@ -83,4 +74,70 @@ func (a *App) HandleLike(w http.ResponseWriter, r *http.Request) {
         }
     }
     http.Redirect(w, r, "/post?id="+strconv.FormatInt(postID, 10), http.StatusSeeOther)
-}
\ No newline at end of file
+}
+
+// react applies reaction v (1 or -1) by uid to the target. Sending
+// the same value twice removes the reaction; sending the opposite
+// value flips it. It returns sql.ErrNoRows when the target does not
+// exist. Likes notify the author of the target (see notifyLike) and
+// the new counts go to open pages of the post (see publishReactions)
+// and to webhooks.
+func (a *App) react(uid int64, targetType string, targetID int64, v int) error {
+    // Make sure the target exists so we never store dangling likes.
+    table := "posts"
+    if targetType == "comment" {
+        table = "comments"
+    }
+    var exists int
+    if err := a.DB.QueryRow(`SELECT 1 FROM `+table+` WHERE id = ?`, targetID).Scan(&exists); err != nil {
+        return err
+    }
+    // Check for existing like on this target by this user.
+    var existingID int64
+    var existingValue int
+    row := a.DB.QueryRow(`SELECT id, value FROM likes WHERE user_id=? AND target_type=? AND target_id=?`, uid, targetType, targetID)
+    switch err := row.Scan(&existingID, &existingValue); err {
+    case nil:
+        // Already exists. If the same value is being sent, remove the
+        // like (toggle off). Otherwise update the value.
+        if existingValue == v {
+            _, err = a.DB.Exec(`DELETE FROM likes WHERE id = ?`, existingID)
+            v = 0
+        } else {
+            _, err = a.DB.Exec(`UPDATE likes SET value = ? WHERE id = ?`, v, existingID)
+        }
+        if err != nil {
+            return err
+        }
+        if existingValue == 1 {
+            a.notifyLike(uid, targetType, targetID, false)
+        } else if v == 1 {
+            a.notifyLike(uid, targetType, targetID, true)
+        }
+    case sql.ErrNoRows:
+        // No existing record; insert a new like.
+        _, err = a.DB.Exec(`INSERT INTO likes(user_id, target_type, target_id, value) VALUES(?,?,?,?)`, uid, targetType, targetID, v)
+        if err != nil {
+            return err
+        }
+        if v == 1 {
+            a.notifyLike(uid, targetType, targetID, true)
+        }
+    default:
+        return err
+    }
+    a.publishReactions(targetType, targetID)
+    a.webhookReactionChanged(uid, targetType, targetID, v)
+    return nil
+}
+
+// reactionCounts returns the number of likes and dislikes on a target
+// together with the reaction of user uid (zero when none).
+func (a *App) reactionCounts(uid int64, targetType string, targetID int64) (likes, dislikes, mine int, err error) {
+    err = a.DB.QueryRow(`SELECT
+        COALESCE(SUM(value = 1), 0),
+        COALESCE(SUM(value = -1), 0),
+        COALESCE(MAX(CASE WHEN user_id = ? THEN value END), 0)
+    FROM likes WHERE target_type = ? AND target_id = ?`, uid, targetType, targetID).Scan(&likes, &dislikes, &mine)
+    return
+}
@@ -0,0 +1,246 @@
+package app
+
+// This file streams changes to a post to the browsers showing it, as
+// Server-Sent Events from /post/events?id=<post>. createComment and
+// react publish to the post's topic on the live hub; every open stream
+// then sends its browser the new comments, rendered with the same
+// template as the post page and for that browser's user, and the new
+// reaction counts. static/live.js puts them into the page. Without
+// JavaScript nothing listens and the page simply needs reloading, as
+// before.
+//
+// Comment events carry the comment ID as the event ID, which the
+// browser sends back as Last-Event-ID when it reconnects. The stream
+// then starts by sending the comments it missed, so nothing is lost
+// when a connection drops or the hub drops a stream that fell behind.
+
+import (
+    "bytes"
+    "database/sql"
+    "encoding/json"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "strconv"
+    "time"
+
+    "forum/internal/live"
+)
+
+// liveHeartbeat is how often an idle stream sends a comment line. It
+// keeps proxies from closing the connection and notices browsers that
+// went away without saying so.
+const liveHeartbeat = 30 * time.Second
+
+// liveRetry is the reconnection delay suggested to browsers, in
+// milliseconds.
+const liveRetry = 5000
+
+// liveComment is the data of a comment event. HTML is the comment as
+// the post page renders it, without replies.
+type liveComment struct {
+    ID       int64  `json:"id"`
+    ParentID *int64 `json:"parent_id"`
+    HTML     string `json:"html"`
+}
+
+// liveReactions is the data of a reactions event.
+type liveReactions struct {
+    Type     string `json:"type"`
+    ID       int64  `json:"id"`
+    Likes    int    `json:"likes"`
+    Dislikes int    `json:"dislikes"`
+}
+
+// postTopic returns the live hub topic of post pid.
+func postTopic(pid int64) string {
+    return "post:" + strconv.FormatInt(pid, 10)
+}
+
+// HandlePostEvents streams the changes to the post given by `id` as
+// Server-Sent Events:
+//
+//   comment    a new comment, as liveComment
+//   reactions  new reaction counts of the post or one of its
+//              comments, as liveReactions
+//
+// Comments newer than the one named by the Last-Event-ID header, or
+// else the `after` parameter, are sent first; without either the
+// stream starts with the next new comment. When the hub's connection
+// limits are reached, or the server is shutting down, the request
+// fails with 503 Service Unavailable.
+func (a *App) HandlePostEvents(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    pid, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+    if err != nil || pid <= 0 || a.Live == nil {
+        http.NotFound(w, r)
+        return
+    }
+    after := int64(-1)
+    v := r.Header.Get("Last-Event-ID")
+    if v == "" {
+        v = r.URL.Query().Get("after")
+    }
+    if v != "" {
+        after, err = strconv.ParseInt(v, 10, 64)
+        if err != nil || after < 0 {
+            http.Error(w, "invalid event id", http.StatusBadRequest)
+            return
+        }
+    }
+    uid, _, logged := a.CurrentUser(r)
+    var exists int
+    err = a.DB.QueryRow(`SELECT 1 FROM posts WHERE id = ?`, pid).Scan(&exists)
+    if err == nil && after < 0 {
+        err = a.DB.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM comments WHERE post_id = ?`, pid).Scan(&after)
+    }
+    if err == sql.ErrNoRows {
+        http.NotFound(w, r)
+        return
+    }
+    if err != nil {
+        http.Error(w, "database error", http.StatusInternalServerError)
+        return
+    }
+    sub, err := a.Live.Subscribe(postTopic(pid), a.ClientIP(r))
+    if err == live.ErrClosed {
+        // The server is shutting down; the browser retries and
+        // reaches the next one.
+        http.Error(w, "shutting down", http.StatusServiceUnavailable)
+        return
+    }
+    if err != nil {
+        w.Header().Set("Retry-After", "60")
+        http.Error(w, "too many live connections", http.StatusServiceUnavailable)
+        return
+    }
+    defer sub.Close()
+
+    page := &threadPage{
+        PostID:      pid,
+        LoggedIn:    logged,
+        UserID:      uid,
+        IsModerator: hasRole(a.userRole(uid), RoleModerator),
+        CSRFToken:   CSRFToken(r),
+    }
+    h := w.Header()
+    h.Set("Content-Type", "text/event-stream")
+    h.Set("Cache-Control", "no-store")
+    // Ask nginx and similar proxies not to buffer the stream.
+    h.Set("X-Accel-Buffering", "no")
+    w.WriteHeader(http.StatusOK)
+    // A stream stays open far longer than the server's read and write
+    // timeouts allow ordinary requests. The read deadline is lifted;
+    // the write deadline is moved forward before every write instead,
+    // so that a client that stops reading is still let go of.
+    rc := http.NewResponseController(w)
+    rc.SetReadDeadline(time.Time{})
+    extend := func() {
+        rc.SetWriteDeadline(time.Now().Add(liveHeartbeat))
+    }
+    extend()
+    _, err = fmt.Fprintf(w, "retry: %d\n\n", liveRetry)
+    if err == nil {
+        after, err = a.sendComments(w, pid, uid, page, after)
+    }
+    ticker := time.NewTicker(liveHeartbeat)
+    defer ticker.Stop()
+    for err == nil {
+        if err = rc.Flush(); err != nil {
+            break
+        }
+        select {
+        case <-r.Context().Done():
+            return
+        case ev, ok := <-sub.C:
+            if !ok {
+                // Dropped for falling behind, or the server is
+                // shutting down. The browser reconnects and catches up.
+                return
+            }
+            extend()
+            if ev.Name == "comment" {
+                // The event only says that there are new comments;
+                // load them as this user sees them.
+                after, err = a.sendComments(w, pid, uid, page, after)
+            } else {
+                err = writeEvent(w, ev.Name, "", ev.Data)
+            }
+        case <-ticker.C:
+            extend()
+            _, err = io.WriteString(w, ": ping\n\n")
+        }
+    }
+}
+
+// sendComments writes a comment event for every comment of post pid
+// newer than after, as seen by user uid, and returns the ID of the
+// newest comment sent. Only those comments are loaded.
+func (a *App) sendComments(w io.Writer, pid, uid int64, page *threadPage, after int64) (int64, error) {
+    comments, err := a.loadComments(pid, uid, after)
+    if err != nil {
+        return after, err
+    }
+    tmpl := a.Templates.Lookup("post_show.html")
+    for _, c := range comments {
+        var buf bytes.Buffer
+        if err := tmpl.ExecuteTemplate(&buf, "comment", &commentThread{Comment: c, Page: page}); err != nil {
+            return after, err
+        }
+        data, err := json.Marshal(liveComment{ID: c.ID, ParentID: c.ParentID, HTML: buf.String()})
+        if err != nil {
+            return after, err
+        }
+        if err := writeEvent(w, "comment", strconv.FormatInt(c.ID, 10), data); err != nil {
+            return after, err
+        }
+        after = c.ID
+    }
+    return after, nil
+}
+
+// writeEvent writes one Server-Sent Event. data must not contain line
+// breaks, which JSON encoding guarantees.
+func writeEvent(w io.Writer, name, id string, data []byte) error {
+    var buf bytes.Buffer
+    if id != "" {
+        fmt.Fprintf(&buf, "id: %s\n", id)
+    }
+    fmt.Fprintf(&buf, "event: %s\ndata: %s\n\n", name, data)
+    _, err := w.Write(buf.Bytes())
+    return err
+}
+
+// publishComment tells the streams of post pid that it has a new
+// comment.
+func (a *App) publishComment(pid int64) {
+    if a.Live != nil {
+        a.Live.Publish(postTopic(pid), live.Event{Name: "comment"})
+    }
+}
+
+// publishReactions sends the current reaction counts of the target to
+// the streams of the post it belongs to.
+func (a *App) publishReactions(targetType string, targetID int64) {
+    if a.Live == nil {
+        return
+    }
+    pid := targetID
+    if targetType == "comment" {
+        if err := a.DB.QueryRow(`SELECT post_id FROM comments WHERE id = ?`, targetID).Scan(&pid); err != nil {
+            log.Printf("publishing reactions of comment %d: %v", targetID, err)
+            return
+        }
+    }
+    likes, dislikes, _, err := a.reactionCounts(0, targetType, targetID)
+    if err != nil {
+        log.Printf("publishing reactions of %s %d: %v", targetType, targetID, err)
+        return
+    }
+    data, _ := json.Marshal(liveReactions{Type: targetType, ID: targetID, Likes: likes, Dislikes: dislikes})
+    a.Live.Publish(postTopic(pid), live.Event{Name: "reactions", Data: data})
+}
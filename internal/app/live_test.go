@@ -0,0 +1,131 @@
+package app
+
+// Tests of the live update stream of a post: missed comments are sent
+// first, and each new comment is sent once, as the subscriber sees it.
+
+import (
+    "bufio"
+    "html/template"
+    "net/http"
+    "net/http/httptest"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+
+    "forum/internal/live"
+)
+
+// readEvent returns the name, id and data of the next event on the
+// stream, skipping comment lines.
+func readEvent(t *testing.T, sc *bufio.Scanner) (name, id, data string) {
+    t.Helper()
+    for sc.Scan() {
+        line := sc.Text()
+        switch {
+        case line == "":
+            if name != "" {
+                return name, id, data
+            }
+        case strings.HasPrefix(line, "event: "):
+            name = strings.TrimPrefix(line, "event: ")
+        case strings.HasPrefix(line, "id: "):
+            id = strings.TrimPrefix(line, "id: ")
+        case strings.HasPrefix(line, "data: "):
+            data = strings.TrimPrefix(line, "data: ")
+        }
+    }
+    t.Fatalf("stream ended: %v", sc.Err())
+    return
+}
+
+func TestPostEvents(t *testing.T) {
+    a := newTestApp(t)
+    a.Live = &live.Hub{}
+    t.Cleanup(a.Live.Close)
+    // Only the comment template is needed; it shows the reaction of the
+    // user the stream belongs to.
+    a.Templates = template.Must(template.New("post_show.html").Parse(`{{define "comment"}}c{{.Comment.ID}} r{{.Comment.MyReaction}}{{end}}`))
+    alice := createTestUser(t, a, "alice")
+    bob := createTestUser(t, a, "bob")
+    addAccess(t, a, bob, "bob")
+    pid, err := a.createPost(alice, "Hello", "body", []string{"Help"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    first, err := a.createComment(alice, pid, 0, "one")
+    if err != nil {
+        t.Fatal(err)
+    }
+    second, err := a.createComment(alice, pid, 0, "two")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := a.DB.Exec(`INSERT INTO likes(user_id, target_type, target_id, value) VALUES(?, 'comment', ?, 1)`, bob, second); err != nil {
+        t.Fatal(err)
+    }
+
+    // Cleanups run last first: the streams are closed before the
+    // server waits for its handlers to return.
+    srv := httptest.NewServer(http.HandlerFunc(a.HandlePostEvents))
+    t.Cleanup(srv.Close)
+    open := func(query string) *bufio.Scanner {
+        req, _ := http.NewRequest(http.MethodGet, srv.URL+"/post/events?id="+strconv.FormatInt(pid, 10)+query, nil)
+        req.AddCookie(&http.Cookie{Name: a.CookieName, Value: "session-bob"})
+        resp, err := http.DefaultClient.Do(req)
+        if err != nil {
+            t.Fatal(err)
+        }
+        t.Cleanup(func() { resp.Body.Close() })
+        if resp.StatusCode != http.StatusOK {
+            t.Fatalf("status %d", resp.StatusCode)
+        }
+        return bufio.NewScanner(resp.Body)
+    }
+
+    // Catching up after the first comment sends only the second.
+    sc := open("&after=" + strconv.FormatInt(first, 10))
+    if name, id, data := readEvent(t, sc); name != "comment" || id != strconv.FormatInt(second, 10) || !strings.Contains(data, "r1") {
+        t.Fatalf("first event %s %s %s", name, id, data)
+    }
+    // A stream without a position waits for new comments.
+    fresh := open("")
+    waitFor(t, func() bool { return a.Live.Count() == 2 })
+
+    third, err := a.createComment(alice, pid, 0, "three")
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, s := range []*bufio.Scanner{sc, fresh} {
+        if name, id, _ := readEvent(t, s); name != "comment" || id != strconv.FormatInt(third, 10) {
+            t.Fatalf("after a new comment: %s %s, want comment %d", name, id, third)
+        }
+    }
+
+    // Unknown posts and bad positions are refused.
+    for query, want := range map[string]int{
+        "?id=999999": http.StatusNotFound,
+        "?id=" + strconv.FormatInt(pid, 10) + "&after=x": http.StatusBadRequest,
+    } {
+        resp, err := http.Get(srv.URL + "/post/events" + query)
+        if err != nil {
+            t.Fatal(err)
+        }
+        resp.Body.Close()
+        if resp.StatusCode != want {
+            t.Errorf("%s: status %d, want %d", query, resp.StatusCode, want)
+        }
+    }
+}
+
+// waitFor polls cond for up to a second.
+func waitFor(t *testing.T, cond func() bool) {
+    t.Helper()
+    for i := 0; i < 100; i++ {
+        if cond() {
+            return
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+    t.Fatal("timed out")
+}
@@ -0,0 +1,367 @@
+package app
+
+// This file protects logins against password guessing. Every wrong
+// password or two-factor code counts against the account and against
+// the client's IP address. After a few free attempts each further try
+// has to wait longer than the one before, and too many failures lock
+// the account or address out for a while. Counters live in the
+// login_failures table so that restarting the server does not reset
+// them, and admins can review and clear them at /admin/lockouts.
+//
+// Accounts are keyed by their normalised email address rather than by
+// user ID, so guessing at an address that has no account is throttled
+// exactly like guessing at one that does and the responses do not
+// reveal which addresses are registered.
+
+import (
+    "database/sql"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "net/url"
+    "strings"
+    "time"
+
+    "forum/internal/mail"
+)
+
+// Scopes of the login_failures table.
+const (
+    scopeAccount = "account"
+    scopeIP      = "ip"
+)
+
+// lockoutPolicy describes how failures within one scope are punished.
+type lockoutPolicy struct {
+    // Free is the number of failures allowed without any delay.
+    Free int
+    // Limit is the number of failures that locks the key out.
+    Limit int
+    // Lockout is how long a lockout lasts.
+    Lockout time.Duration
+}
+
+// lockoutPolicies holds the policy of each scope. Addresses get more
+// room than accounts because many people may share one, for example
+// behind an office NAT.
+var lockoutPolicies = map[string]lockoutPolicy{
+    scopeAccount: {Free: 3, Limit: 10, Lockout: 15 * time.Minute},
+    scopeIP:      {Free: 10, Limit: 50, Lockout: 30 * time.Minute},
+}
+
+const (
+    // failureWindow is how long a failure is remembered. A key without
+    // failures for this long starts counting from zero again.
+    failureWindow = time.Hour
+    // maxLoginDelay caps the growing delay between attempts.
+    maxLoginDelay = time.Minute
+)
+
+// delay returns how long a client has to wait after the n-th failure:
+// nothing during the free attempts, then one second, doubling with
+// every further failure up to maxLoginDelay.
+func (p lockoutPolicy) delay(n int) time.Duration {
+    if n < p.Free {
+        return 0
+    }
+    // Shifting further would overflow long before it matters.
+    if n-p.Free >= 10 {
+        return maxLoginDelay
+    }
+    d := time.Second << uint(n-p.Free)
+    if d > maxLoginDelay {
+        d = maxLoginDelay
+    }
+    return d
+}
+
+// loginKey is one row of the login_failures table.
+type loginKey struct {
+    Scope string
+    Key   string
+}
+
+// loginKeys returns the keys an attempt to log in as email from r
+// counts against. The account key is left out when email is empty.
+func (a *App) loginKeys(r *http.Request, email string) []loginKey {
+    keys := []loginKey{{scopeIP, a.ClientIP(r)}}
+    if e := accountKey(email); e != "" {
+        keys = append(keys, loginKey{scopeAccount, e})
+    }
+    return keys
+}
+
+// accountKey normalises an email address into the key of its account
+// scope.
+func accountKey(email string) string {
+    return strings.ToLower(strings.TrimSpace(email))
+}
+
+// delaySQL returns p.delay as an SQL expression of the failures
+// column, in seconds, so that reserveAttempt can compare it with
+// last_failure_at in the same statement that counts the attempt.
+func (p lockoutPolicy) delaySQL() string {
+    var b strings.Builder
+    b.WriteString("(CASE")
+    n := 0
+    for ; p.delay(n) < maxLoginDelay; n++ {
+        fmt.Fprintf(&b, " WHEN failures <= %d THEN %d", n, p.delay(n)/time.Second)
+    }
+    fmt.Fprintf(&b, " ELSE %d END)", maxLoginDelay/time.Second)
+    return b.String()
+}
+
+// errLoginWait rolls back a reservation when one of the keys has to
+// wait.
+var errLoginWait = errors.New("login attempt has to wait")
+
+// reserveLoginAttempt decides whether the client may try to log in as
+// email now. If it may, the attempt is counted as a failure straight
+// away and zero is returned; the caller then checks the password or
+// code and settles the attempt with recordLoginFailure or
+// releaseLoginAttempt. Otherwise nothing is counted, the password must
+// not be checked, and the client is told how long to wait.
+func (a *App) reserveLoginAttempt(r *http.Request, email string) (time.Duration, error) {
+    return a.reserveAttempt(a.loginKeys(r, email), time.Now())
+}
+
+// reserveAttempt does the work of reserveLoginAttempt at the time now.
+// Checking the delay and counting the attempt is one statement per
+// key, so parallel attempts cannot all pass the check before any of
+// them is counted, and the keys are reserved together or not at all.
+func (a *App) reserveAttempt(keys []loginKey, now time.Time) (time.Duration, error) {
+    err := a.inTx(func(tx *sql.Tx) error {
+        for _, k := range keys {
+            res, err := tx.Exec(`INSERT INTO login_failures(scope, key, failures, last_failure_at) VALUES(?,?,1,?)
+                ON CONFLICT(scope, key) DO UPDATE SET
+                    failures = CASE WHEN last_failure_at < ? THEN 1 ELSE failures + 1 END,
+                    last_failure_at = excluded.last_failure_at
+                WHERE locked_until <= excluded.last_failure_at
+                    AND last_failure_at + `+lockoutPolicies[k.Scope].delaySQL()+` <= excluded.last_failure_at`,
+                k.Scope, k.Key, now.Unix(), now.Add(-failureWindow).Unix())
+            if err != nil {
+                return err
+            }
+            if n, err := res.RowsAffected(); err != nil {
+                return err
+            } else if n == 0 {
+                return errLoginWait
+            }
+        }
+        return nil
+    })
+    if err != errLoginWait {
+        return 0, err
+    }
+    wait, err := a.loginWait(keys, now)
+    // The refusal stands even if the wait has just run out.
+    if err == nil && wait < time.Second {
+        wait = time.Second
+    }
+    return wait, err
+}
+
+// loginWait reports how long the client has to wait at the time now
+// before it may try the keys again.
+func (a *App) loginWait(keys []loginKey, now time.Time) (time.Duration, error) {
+    var wait time.Duration
+    for _, k := range keys {
+        var failures int
+        var last, locked int64
+        err := a.DB.QueryRow(`SELECT failures, last_failure_at, locked_until FROM login_failures WHERE scope = ? AND key = ?`, k.Scope, k.Key).Scan(&failures, &last, &locked)
+        if err == sql.ErrNoRows {
+            continue
+        }
+        if err != nil {
+            return 0, err
+        }
+        until := time.Unix(locked, 0)
+        if !until.After(now) {
+            until = time.Unix(last, 0).Add(lockoutPolicies[k.Scope].delay(failures))
+        }
+        if d := until.Sub(now); d > wait {
+            wait = d
+        }
+    }
+    return wait, nil
+}
+
+// recordLoginFailure settles a reserved attempt to log in as email
+// that failed. The failure was counted by reserveLoginAttempt; what is
+// left is to lock the keys that have reached their limit. When the
+// account is locked its owner, if the address belongs to one, gets an
+// email about it.
+func (a *App) recordLoginFailure(r *http.Request, email string) error {
+    locked, err := a.lockExhausted(a.loginKeys(r, email), time.Now())
+    if err == nil && locked {
+        a.notifyLockout(r, accountKey(email), lockoutPolicies[scopeAccount].Lockout)
+    }
+    return err
+}
+
+// lockExhausted locks the keys whose failures have reached the limit
+// of their scope, starting the count over for when the lockout ends.
+// It reports whether the account key was among them.
+func (a *App) lockExhausted(keys []loginKey, now time.Time) (bool, error) {
+    account := false
+    for _, k := range keys {
+        p := lockoutPolicies[k.Scope]
+        res, err := a.DB.Exec(`UPDATE login_failures SET failures = 0, locked_until = ? WHERE scope = ? AND key = ? AND failures >= ?`,
+            now.Add(p.Lockout).Unix(), k.Scope, k.Key, p.Limit)
+        if err != nil {
+            return account, err
+        }
+        if n, _ := res.RowsAffected(); n > 0 && k.Scope == scopeAccount {
+            account = true
+        }
+    }
+    return account, nil
+}
+
+// releaseLoginAttempt settles a reserved attempt to log in as email
+// that did not fail, taking back the failure reserveLoginAttempt
+// counted.
+func (a *App) releaseLoginAttempt(r *http.Request, email string) error {
+    for _, k := range a.loginKeys(r, email) {
+        if _, err := a.DB.Exec(`UPDATE login_failures SET failures = MAX(failures - 1, 0) WHERE scope = ? AND key = ?`, k.Scope, k.Key); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// clearLoginFailures forgets the failures of user uid's account after
+// a complete login. Failures of the client address are kept, otherwise
+// logging in to one's own account would reset the counter for guesses
+// at others.
+func (a *App) clearLoginFailures(uid int64) error {
+    email, err := a.userEmail(uid)
+    if err != nil {
+        return err
+    }
+    _, err = a.DB.Exec(`DELETE FROM login_failures WHERE scope = ? AND key = ?`, scopeAccount, accountKey(email))
+    return err
+}
+
+// userEmail returns the email address of user uid, which the code step
+// of two-factor logins needs to count failures against the account.
+func (a *App) userEmail(uid int64) (string, error) {
+    var email string
+    err := a.DB.QueryRow(`SELECT email FROM users WHERE id = ?`, uid).Scan(&email)
+    return email, err
+}
+
+// notifyLockout tells the owner of the account with the given email,
+// if there is one, that it has been locked. The message links to the
+// password reset page, so it is only sent with a configured base URL.
+func (a *App) notifyLockout(r *http.Request, email string, d time.Duration) {
+    base, err := a.mailBase()
+    if err != nil {
+        log.Printf("not sending a lockout notice: %v", err)
+        return
+    }
+    var username, address string
+    if err := a.DB.QueryRow(`SELECT username, email FROM users WHERE email = ? COLLATE NOCASE`, email).Scan(&username, &address); err != nil {
+        return
+    }
+    a.sendMail(mail.Message{
+        To:      address,
+        Subject: "Your forum account has been locked",
+        Body: "Hello " + username + ",\n\n" +
+            "there were too many failed attempts to log in to your forum account,\n" +
+            "most recently from " + a.ClientIP(r) + ". To protect it, logging in is\n" +
+            "blocked for the next " + formatWait(d) + ".\n\n" +
+            "If this was not you, someone may be guessing your password. You can\n" +
+            "choose a new one here, which also lifts the lock:\n\n" +
+            base + "/password/forgot\n",
+    })
+}
+
+// formatWait renders d for humans, rounded up to whole seconds below a
+// minute and to whole minutes above.
+func formatWait(d time.Duration) string {
+    if d <= time.Minute {
+        s := int((d + time.Second - 1) / time.Second)
+        if s == 1 {
+            return "1 second"
+        }
+        return fmt.Sprintf("%d seconds", s)
+    }
+    return fmt.Sprintf("%d minutes", int((d+time.Minute-1)/time.Minute))
+}
+
+// throttledMessage is shown to clients that have to wait for d.
+func throttledMessage(d time.Duration) string {
+    return "Too many failed login attempts. Please try again in " + formatWait(d) + "."
+}
+
+// lockoutEntry is a row on the admin lockouts page.
+type lockoutEntry struct {
+    Scope       string
+    Key         string
+    Failures    int
+    LastFailure time.Time
+    LockedUntil time.Time
+    Locked      bool
+}
+
+// HandleAdminLockouts lists the accounts and addresses with recent
+// failures or an active lockout on GET. POST with action=clear and
+// `scope` and `key` forgets one of them; action=clear_all forgets all.
+func (a *App) HandleAdminLockouts(w http.ResponseWriter, r *http.Request) {
+    switch r.Method {
+    case http.MethodGet:
+        now := time.Now()
+        rows, err := a.DB.Query(`SELECT scope, key, failures, last_failure_at, locked_until FROM login_failures
+            WHERE locked_until > ? OR (failures > 0 AND last_failure_at > ?)
+            ORDER BY locked_until DESC, last_failure_at DESC`, now.Unix(), now.Add(-failureWindow).Unix())
+        if err != nil {
+            http.Error(w, "database error", http.StatusInternalServerError)
+            return
+        }
+        defer rows.Close()
+        var entries []lockoutEntry
+        for rows.Next() {
+            var e lockoutEntry
+            var last, locked int64
+            if err := rows.Scan(&e.Scope, &e.Key, &e.Failures, &last, &locked); err != nil {
+                http.Error(w, "database error", http.StatusInternalServerError)
+                return
+            }
+            e.LastFailure = time.Unix(last, 0)
+            e.LockedUntil = time.Unix(locked, 0)
+            e.Locked = e.LockedUntil.After(now)
+            entries = append(entries, e)
+        }
+        data := a.baseData(r)
+        data["Lockouts"] = entries
+        if msg := r.URL.Query().Get("notice"); msg != "" {
+            data["Notice"] = msg
+        }
+        tmpl := a.Templates.Lookup("admin_lockouts.html")
+        tmpl.ExecuteTemplate(w, "admin_lockouts.html", data)
+    case http.MethodPost:
+        var err error
+        var msg string
+        switch r.FormValue("action") {
+        case "clear":
+            scope, key := r.FormValue("scope"), r.FormValue("key")
+            _, err = a.DB.Exec(`DELETE FROM login_failures WHERE scope = ? AND key = ?`, scope, key)
+            msg = "Cleared " + key + "."
+        case "clear_all":
+            _, err = a.DB.Exec(`DELETE FROM login_failures`)
+            msg = "Cleared all lockouts."
+        default:
+            http.Error(w, "unknown action", http.StatusBadRequest)
+            return
+        }
+        if err != nil {
+            http.Error(w, "database error", http.StatusInternalServerError)
+            return
+        }
+        http.Redirect(w, r, "/admin/lockouts?notice="+url.QueryEscape(msg), http.StatusSeeOther)
+    default:
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    }
+}
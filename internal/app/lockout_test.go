@@ -0,0 +1,187 @@
+package app
+
+// Tests of the login throttle: the delay schedule, the lockout after
+// too many failures, forgetting failures after a login, and that
+// parallel guesses cannot slip past the delay together.
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "sync"
+    "testing"
+    "time"
+)
+
+func TestLoginDelaySchedule(t *testing.T) {
+    p := lockoutPolicies[scopeAccount]
+    want := []time.Duration{0, 0, 0, time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second,
+        16 * time.Second, 32 * time.Second, time.Minute, time.Minute}
+    for n, d := range want {
+        if got := p.delay(n); got != d {
+            t.Errorf("delay(%d) = %v, want %v", n, got, d)
+        }
+    }
+    if got := p.delay(1000); got != maxLoginDelay {
+        t.Errorf("delay(1000) = %v, want %v", got, maxLoginDelay)
+    }
+
+    // The SQL version agrees, in every scope.
+    a := newTestApp(t)
+    for scope, p := range lockoutPolicies {
+        for n := 0; n <= 70; n++ {
+            var secs int64
+            if err := a.DB.QueryRow(`SELECT `+p.delaySQL()+` FROM (SELECT ? AS failures)`, n).Scan(&secs); err != nil {
+                t.Fatal(err)
+            }
+            if d := time.Duration(secs) * time.Second; d != p.delay(n) {
+                t.Errorf("%s: SQL delay after %d failures is %v, want %v", scope, n, d, p.delay(n))
+            }
+        }
+    }
+}
+
+func TestReserveAttempt(t *testing.T) {
+    a := newTestApp(t)
+    mailer := &recordingMailer{}
+    a.Mailer = mailer
+    a.BaseURL = "https://forum.example.com"
+    createTestUser(t, a, "alice")
+    p := lockoutPolicies[scopeAccount]
+    keys := []loginKey{{scopeIP, "192.0.2.1"}, {scopeAccount, "alice@example.com"}}
+    now := time.Unix(1700000000, 0)
+    reserve := func() time.Duration {
+        t.Helper()
+        wait, err := a.reserveAttempt(keys, now)
+        if err != nil {
+            t.Fatal(err)
+        }
+        return wait
+    }
+    failures := func(k loginKey) int {
+        t.Helper()
+        return count(t, a, `SELECT COALESCE(SUM(failures), 0) FROM login_failures WHERE scope = ? AND key = ?`, k.Scope, k.Key)
+    }
+
+    // The free attempts go through at once.
+    for i := 0; i < p.Free; i++ {
+        if wait := reserve(); wait != 0 {
+            t.Fatalf("free attempt %d has to wait %v", i, wait)
+        }
+    }
+    // The next has to wait, and waiting is not counted.
+    if wait := reserve(); wait != time.Second {
+        t.Fatalf("attempt after the free ones waits %v, want 1s", wait)
+    }
+    if n := failures(keys[1]); n != p.Free {
+        t.Fatalf("%d failures counted, want %d", n, p.Free)
+    }
+    // The delay doubles with every failure.
+    for n := p.Free; n < p.Limit-1; n++ {
+        now = now.Add(p.delay(n))
+        if wait := reserve(); wait != 0 {
+            t.Fatalf("attempt %d after its delay has to wait %v", n, wait)
+        }
+        if wait := reserve(); wait != p.delay(n+1) {
+            t.Fatalf("attempt right after attempt %d waits %v, want %v", n, wait, p.delay(n+1))
+        }
+    }
+
+    // A success takes its reservation back.
+    before := failures(keys[0])
+    req := httptest.NewRequest(http.MethodPost, "/login", nil)
+    req.RemoteAddr = "192.0.2.1:1234"
+    now = now.Add(p.delay(p.Limit - 1))
+    if wait := reserve(); wait != 0 {
+        t.Fatalf("last attempt has to wait %v", wait)
+    }
+    if err := a.releaseLoginAttempt(req, "Alice@Example.com "); err != nil {
+        t.Fatal(err)
+    }
+    if n := failures(keys[0]); n != before {
+        t.Fatalf("%d address failures after a release, want %d", n, before)
+    }
+
+    // The failure that reaches the limit locks the account, and its
+    // owner hears about it.
+    now = now.Add(p.delay(p.Limit - 1))
+    if wait := reserve(); wait != 0 {
+        t.Fatalf("last attempt has to wait %v", wait)
+    }
+    locked, err := a.lockExhausted(keys, now)
+    if err != nil || !locked {
+        t.Fatalf("lockExhausted = %v, %v", locked, err)
+    }
+    a.notifyLockout(req, "alice@example.com", p.Lockout)
+    a.WaitBackground()
+    if len(mailer.sent) != 1 || mailer.sent[0].To != "alice@example.com" {
+        t.Fatalf("lockout mail: %+v", mailer.sent)
+    }
+    now = now.Add(p.Lockout - time.Minute)
+    if wait := reserve(); wait != time.Minute {
+        t.Fatalf("locked account waits %v, want 1m", wait)
+    }
+    now = now.Add(time.Minute)
+    if wait := reserve(); wait != 0 {
+        t.Fatalf("after the lockout the attempt has to wait %v", wait)
+    }
+
+    // A complete login forgets the account's failures but not those
+    // of the address.
+    if err := a.clearLoginFailures(createTestUser(t, a, "bob")); err != nil {
+        t.Fatal(err)
+    }
+    if n := failures(keys[1]); n != 1 {
+        t.Fatalf("another user's login cleared alice's failures: %d left", n)
+    }
+    var alice int64
+    if err := a.DB.QueryRow(`SELECT id FROM users WHERE username = 'alice'`).Scan(&alice); err != nil {
+        t.Fatal(err)
+    }
+    if err := a.clearLoginFailures(alice); err != nil {
+        t.Fatal(err)
+    }
+    if n := count(t, a, `SELECT COUNT(*) FROM login_failures WHERE scope = ?`, scopeAccount); n != 0 {
+        t.Fatalf("%d account rows after clearing", n)
+    }
+    if n := failures(keys[0]); n == 0 {
+        t.Fatal("clearing the account cleared the address")
+    }
+
+    // Failures older than the window are forgotten.
+    now = now.Add(failureWindow + time.Second)
+    if wait := reserve(); wait != 0 {
+        t.Fatalf("after the window the attempt has to wait %v", wait)
+    }
+    if n := failures(keys[0]); n != 1 {
+        t.Fatalf("%d address failures after the window, want 1", n)
+    }
+}
+
+func TestReserveAttemptParallel(t *testing.T) {
+    a := newTestApp(t)
+    keys := []loginKey{{scopeIP, "192.0.2.1"}, {scopeAccount, "alice@example.com"}}
+    now := time.Unix(1700000000, 0)
+    var mu sync.Mutex
+    var wg sync.WaitGroup
+    passed := 0
+    for i := 0; i < 20; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            wait, err := a.reserveAttempt(keys, now)
+            if err != nil {
+                t.Error(err)
+                return
+            }
+            if wait == 0 {
+                mu.Lock()
+                passed++
+                mu.Unlock()
+            }
+        }()
+    }
+    wg.Wait()
+    if free := lockoutPolicies[scopeAccount].Free; passed != free {
+        t.Fatalf("%d parallel attempts passed, want %d", passed, free)
+    }
+}
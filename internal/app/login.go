@@ -3,11 +3,16 @@ package app
 // This file defines the handler for user login. Users provide
 // their email and password. If the credentials match an existing
 // account a session is created and the user is redirected to the
-// home page. On failure the form is re‑rendered with an error.
+// home page, unless the account uses two-factor authentication, in
+// which case the code step in twofactor.go comes first. On failure the
+// form is re‑rendered with an error. Failed attempts are counted and
+// throttled as described in lockout.go.
 
 import (
     "database/sql"
+    "errors"
     "net/http"
+    "net/url"
 
     "golang.org/x/crypto/bcrypt"
 )
@@ -23,7 +28,10 @@ func (a *App) HandleLogin(w http.ResponseWriter, r *http.Request) {
         if msg := r.URL.Query().Get("error"); msg != "" {
             data["Error"] = msg
         }
-        tmpl := a.Templates["login.html"]
+        if msg := r.URL.Query().Get("notice"); msg != "" {
+            data["Notice"] = msg
+        }
+        tmpl := a.Templates.Lookup("login.html")
         tmpl.ExecuteTemplate(w, "login.html", data)
     case http.MethodPost:
         if err := r.ParseForm(); err != nil {
@@ -36,30 +44,83 @@ func (a *App) HandleLogin(w http.ResponseWriter, r *http.Request) {
             http.Redirect(w, r, "/login?error=Email and password are required", http.StatusSeeOther)
             return
         }
-        // Look up the user by email. If not found return an error.
-        var id int64
-        var username, hash string
-        err := a.DB.QueryRow(`SELECT id, username, password_hash FROM users WHERE email = ?`, email).Scan(&id, &username, &hash)
-        if err == sql.ErrNoRows {
-            http.Redirect(w, r, "/login?error=Invalid credentials", http.StatusSeeOther)
-            return
-        }
+        wait, err := a.reserveLoginAttempt(r, email)
         if err != nil {
             http.Error(w, "database error", http.StatusInternalServerError)
             return
         }
-        // Compare the provided password with the stored hash.
-        if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+        if wait > 0 {
+            http.Redirect(w, r, "/login?error="+url.QueryEscape(throttledMessage(wait)), http.StatusSeeOther)
+            return
+        }
+        id, err := a.authenticate(email, password)
+        if err == errInvalidCredentials {
+            if err := a.recordLoginFailure(r, email); err != nil {
+                http.Error(w, "database error", http.StatusInternalServerError)
+                return
+            }
             http.Redirect(w, r, "/login?error=Invalid credentials", http.StatusSeeOther)
             return
         }
-        // Credentials valid; create a session.
-        if err := a.SetSession(w, id); err != nil {
-            http.Error(w, "failed to create session", http.StatusInternalServerError)
+        if err != nil {
+            _ = a.releaseLoginAttempt(r, email)
+            http.Error(w, "database error", http.StatusInternalServerError)
+            return
+        }
+        // Credentials valid.
+        if err := a.releaseLoginAttempt(r, email); err != nil {
+            http.Error(w, "database error", http.StatusInternalServerError)
             return
         }
-        http.Redirect(w, r, "/", http.StatusSeeOther)
+        a.completeLogin(w, r, id)
     default:
         http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
     }
-}
\ No newline at end of file
+}
+
+// completeLogin logs in user id once the first factor, a password or
+// an external identity, has been checked. Accounts with 2FA continue
+// with the code step; everyone else gets a session right away and has
+// their failed attempts forgotten.
+func (a *App) completeLogin(w http.ResponseWriter, r *http.Request, id int64) {
+    if a.twoFactorEnabled(id) {
+        if err := a.startChallenge(w, id); err != nil {
+            http.Error(w, "database error", http.StatusInternalServerError)
+            return
+        }
+        http.Redirect(w, r, "/login/2fa", http.StatusSeeOther)
+        return
+    }
+    if err := a.SetSession(w, r, id); err != nil {
+        http.Error(w, "failed to create session", http.StatusInternalServerError)
+        return
+    }
+    _ = a.clearLoginFailures(id)
+    http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// errInvalidCredentials is returned by authenticate when the email is
+// unknown or the password does not match. Both cases share one error
+// so callers cannot reveal which accounts exist.
+var errInvalidCredentials = errors.New("invalid credentials")
+
+// authenticate checks an email and password pair and returns the ID
+// of the matching user. It is shared by the login form and the API
+// token endpoint.
+func (a *App) authenticate(email, password string) (int64, error) {
+    // Look up the user by email. If not found return an error.
+    var id int64
+    var hash string
+    err := a.DB.QueryRow(`SELECT id, password_hash FROM users WHERE email = ?`, email).Scan(&id, &hash)
+    if err == sql.ErrNoRows {
+        return 0, errInvalidCredentials
+    }
+    if err != nil {
+        return 0, err
+    }
+    // Compare the provided password with the stored hash.
+    if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+        return 0, errInvalidCredentials
+    }
+    return id, nil
+}
@@ -7,10 +7,14 @@ package app
 import "net/http"
 
 // HandleLogout terminates the user session and redirects to the
-// home page. It accepts both GET and POST for convenience.
+// home page. Only POST is accepted so that the request carries a CSRF
+// token; otherwise any page could log our users out with an image
+// tag, and crawlers following links would do the same.
 func (a *App) HandleLogout(w http.ResponseWriter, r *http.Request) {
-    // We allow both GET and POST to log out. In practice you may
-    // prefer POST to avoid accidental logouts triggered by crawlers.
+    if r.Method != http.MethodPost {
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
     a.ClearSession(w, r)
     http.Redirect(w, r, "/", http.StatusSeeOther)
 }
\ No newline at end of file
@@ -6,9 +6,12 @@ package app
 // body and one or more categories.
 
 import (
+    "database/sql"
+    "errors"
     "net/http"
     "strings"
     "strconv"
+    "unicode/utf8"
 )
 
 // HandleNewPost displays the new post form on GET and inserts a
@@ -20,7 +23,7 @@ func (a *App) HandleNewPost(w http.ResponseWriter, r *http.Request) {
     switch r.Method {
     case http.MethodGet:
         data := a.baseData(r)
-        tmpl := a.Templates["post_new.html"]
+        tmpl := a.Templates.Lookup("post_new.html")
         tmpl.ExecuteTemplate(w, "post_new.html", data)
     case http.MethodPost:
         uid, _, ok := a.CurrentUser(r)
@@ -39,30 +42,87 @@ func (a *App) HandleNewPost(w http.ResponseWriter, r *http.Request) {
             http.Error(w, "all fields are required", http.StatusBadRequest)
             return
         }
-        // Insert the post and get its ID.
-        res, err := a.DB.Exec(`INSERT INTO posts(user_id, title, body) VALUES(?,?,?)`, uid, title, body)
+        pid, err := a.createPost(uid, title, body, cats)
+        if err == errNoCategory || err == errBodyTooLong {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
         if err != nil {
             http.Error(w, "database error", http.StatusInternalServerError)
             return
         }
-        pid, err := res.LastInsertId()
+        http.Redirect(w, r, "/post?id="+strconv.FormatInt(pid, 10), http.StatusSeeOther)
+    default:
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+// errNoCategory is returned by createPost and updatePost when none of
+// the submitted category names is an existing, unarchived category.
+var errNoCategory = errors.New("choose at least one existing category")
+
+// maxBody is the longest accepted body of a post or comment, in
+// characters. Bodies are rendered from Markdown on every view, so
+// their length is what bounds the work of showing a page.
+const maxBody = 20000
+
+// errBodyTooLong is returned when a post or comment body is longer
+// than maxBody.
+var errBodyTooLong = errors.New("posts and comments are limited to 20000 characters")
+
+// stripControl removes ASCII control characters other than tab,
+// newline and carriage return from text about to be stored. They have
+// no use in Markdown, and among them are the markers that search
+// snippets use to highlight matches (see markStart).
+func stripControl(s string) string {
+    return strings.Map(func(r rune) rune {
+        if r < 0x20 && r != '\t' && r != '\n' && r != '\r' {
+            return -1
+        }
+        return r
+    }, s)
+}
+
+// createPost inserts a post authored by uid and links it to the named
+// categories, returning the new post ID. Unknown and archived category
+// names are ignored, but if that leaves none nothing is written and
+// errNoCategory is returned; an overlong body gives errBodyTooLong.
+// Control characters are removed from the title and body. The insert and the category links are written in a single
+// transaction. Webhooks subscribed to new posts are queued afterwards.
+func (a *App) createPost(uid int64, title, body string, cats []string) (int64, error) {
+    title, body = stripControl(title), stripControl(body)
+    if utf8.RuneCountInString(body) > maxBody {
+        return 0, errBodyTooLong
+    }
+    var pid int64
+    err := a.inTx(func(tx *sql.Tx) error {
+        // Insert the post and get its ID.
+        res, err := tx.Exec(`INSERT INTO posts(user_id, title, body) VALUES(?,?,?)`, uid, title, body)
         if err != nil {
-            http.Error(w, "failed to retrieve post id", http.StatusInternalServerError)
-            return
+            return err
         }
-        // Associate the post with categories. We lookup the ID for
-        // each category name to avoid inserting invalid names.
+        pid, err = res.LastInsertId()
+        if err != nil {
+            return err
+        }
+        // Associate the post with categories. Selecting the ID by name
+        // inserts nothing for invalid or archived names.
+        var linked int64
         for _, name := range cats {
-            var cid int64
-            err := a.DB.QueryRow(`SELECT id FROM categories WHERE name = ?`, name).Scan(&cid)
+            res, err := tx.Exec(`INSERT OR IGNORE INTO post_categories(post_id, category_id) SELECT ?, id FROM categories WHERE name = ? AND archived = 0`, pid, name)
             if err != nil {
-                // Ignore invalid categories.
-                continue
+                return err
             }
-            _, _ = a.DB.Exec(`INSERT OR IGNORE INTO post_categories(post_id, category_id) VALUES(?,?)`, pid, cid)
+            n, _ := res.RowsAffected()
+            linked += n
         }
-        http.Redirect(w, r, "/post?id="+strconv.FormatInt(pid, 10), http.StatusSeeOther)
-    default:
-        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        if linked == 0 {
+            return errNoCategory
+        }
+        return nil
+    })
+    if err == nil {
+        a.webhookPostCreated(pid)
     }
-}
\ No newline at end of file
+    return pid, err
+}
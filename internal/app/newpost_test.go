@@ -0,0 +1,121 @@
+package app
+
+// Tests of filing posts under categories when they are created and
+// edited, and of the limit on the length of bodies.
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "strings"
+    "testing"
+)
+
+func TestPostNeedsExistingCategory(t *testing.T) {
+    a := newTestApp(t)
+    alice := createTestUser(t, a, "alice")
+    addAccess(t, a, alice, "alice")
+    if _, err := a.DB.Exec(`UPDATE categories SET archived = 1 WHERE name = 'Off-topic'`); err != nil {
+        t.Fatal(err)
+    }
+
+    // Only unknown and archived names: rejected, and nothing written.
+    if _, err := a.createPost(alice, "Hello", "body", []string{"Nonsense", "Off-topic"}); err != errNoCategory {
+        t.Fatalf("createPost returned %v, want errNoCategory", err)
+    }
+    if n := count(t, a, `SELECT COUNT(*) FROM posts`); n != 0 {
+        t.Fatalf("%d posts written", n)
+    }
+
+    form := url.Values{"title": {"Hello"}, "body": {"body"}, "categories": {"Nonsense"}}
+    req := httptest.NewRequest(http.MethodPost, "/post/new", strings.NewReader(form.Encode()))
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    req.AddCookie(&http.Cookie{Name: a.CookieName, Value: "session-alice"})
+    rec := httptest.NewRecorder()
+    a.HandleNewPost(rec, req)
+    if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "category") {
+        t.Fatalf("form with an unknown category: status %d, %q", rec.Code, rec.Body)
+    }
+    if n := count(t, a, `SELECT COUNT(*) FROM posts`); n != 0 {
+        t.Fatalf("%d posts written through the form", n)
+    }
+
+    // One valid name is enough; the others are ignored.
+    pid, err := a.createPost(alice, "Hello", "body", []string{"Nonsense", "Help"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if names, _ := a.postCategoryNames(pid); len(names) != 1 || names[0] != "Help" {
+        t.Fatalf("post filed under %v", names)
+    }
+
+    // Editing cannot take every category away either.
+    p := editablePost{ID: pid, UserID: alice, Title: "Hello", Body: "body"}
+    if err := a.updatePost(alice, p, "Changed", "body", []string{"Nonsense"}); err != errNoCategory {
+        t.Fatalf("updatePost returned %v, want errNoCategory", err)
+    }
+    if names, _ := a.postCategoryNames(pid); len(names) != 1 || names[0] != "Help" {
+        t.Fatalf("after the rejected edit the post is filed under %v", names)
+    }
+    if n := count(t, a, `SELECT COUNT(*) FROM posts WHERE id = ? AND title = 'Hello'`, pid); n != 1 {
+        t.Fatal("the rejected edit changed the title")
+    }
+}
+
+func TestBodyLength(t *testing.T) {
+    a := newTestApp(t)
+    alice := createTestUser(t, a, "alice")
+    addAccess(t, a, alice, "alice")
+    // The limit counts characters, not bytes.
+    full := strings.Repeat("é", maxBody)
+    long := full + "x"
+
+    if _, err := a.createPost(alice, "Hello", long, []string{"Help"}); err != errBodyTooLong {
+        t.Fatalf("createPost returned %v, want errBodyTooLong", err)
+    }
+    pid, err := a.createPost(alice, "Hello", full, []string{"Help"})
+    if err != nil {
+        t.Fatalf("createPost at the limit: %v", err)
+    }
+    p := editablePost{ID: pid, UserID: alice, Title: "Hello", Body: full}
+    if err := a.updatePost(alice, p, "Hello", long, []string{"Help"}); err != errBodyTooLong {
+        t.Fatalf("updatePost returned %v, want errBodyTooLong", err)
+    }
+
+    if _, err := a.createComment(alice, pid, 0, long); err != errBodyTooLong {
+        t.Fatalf("createComment returned %v, want errBodyTooLong", err)
+    }
+    cid, err := a.createComment(alice, pid, 0, "short")
+    if err != nil {
+        t.Fatal(err)
+    }
+    c := editableComment{ID: cid, PostID: pid, UserID: alice, Body: "short"}
+    if err := a.updateComment(alice, c, long); err != errBodyTooLong {
+        t.Fatalf("updateComment returned %v, want errBodyTooLong", err)
+    }
+    if n := count(t, a, `SELECT COUNT(*) FROM comments WHERE body = 'short'`); n != 1 {
+        t.Fatal("the rejected edit changed the comment")
+    }
+
+    // The form and the API answer 400.
+    form := url.Values{"title": {"Hello"}, "body": {long}, "categories": {"Help"}}
+    req := httptest.NewRequest(http.MethodPost, "/post/new", strings.NewReader(form.Encode()))
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    req.AddCookie(&http.Cookie{Name: a.CookieName, Value: "session-alice"})
+    rec := httptest.NewRecorder()
+    a.HandleNewPost(rec, req)
+    if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "20000") {
+        t.Fatalf("form: status %d, %q", rec.Code, rec.Body)
+    }
+    req = httptest.NewRequest(http.MethodPost, "/api/v1/posts", strings.NewReader(`{"title":"Hello","body":"`+long+`","categories":["Help"]}`))
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("Authorization", "Bearer token-alice")
+    rec = httptest.NewRecorder()
+    a.HandleAPI(rec, req)
+    if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "invalid_post") {
+        t.Fatalf("API: status %d, %q", rec.Code, rec.Body)
+    }
+    if n := count(t, a, `SELECT COUNT(*) FROM posts`); n != 1 {
+        t.Fatalf("%d posts written", n)
+    }
+}
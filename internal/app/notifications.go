@@ -0,0 +1,361 @@
+package app
+
+// This file implements in-app notifications. When someone comments on
+// a post, replies to a comment or likes a post or comment, its author
+// gets a notification (see notifyComment and notifyLike, called from
+// createComment and react, so the HTML forms and the API both create
+// them). The header shows how many are unread and /notifications lists
+// them, marks them read and holds the per-type preferences.
+//
+// Opening a notification marks it read, so it is a small POST form
+// rather than a link: a GET request that changes state could be
+// triggered by any page.
+
+import (
+    "database/sql"
+    "log"
+    "net/http"
+    "net/url"
+    "strconv"
+    "time"
+
+    "forum/internal/markdown"
+)
+
+// notificationsPerPage is the number of notifications listed per page.
+const notificationsPerPage = 30
+
+// notificationExcerpt is the length of the comment previews shown with
+// notifications.
+const notificationExcerpt = 140
+
+// notificationType describes a kind of notification for the
+// preferences form. Types the user has not chosen anything for are
+// delivered when Default is true.
+type notificationType struct {
+    Name    string
+    Label   string
+    Default bool
+}
+
+// notificationTypes lists every kind of notification, in the order the
+// preferences form shows them.
+var notificationTypes = []notificationType{
+    {Name: "comment", Label: "Comments on my posts", Default: true},
+    {Name: "reply", Label: "Replies to my comments", Default: true},
+    {Name: "like", Label: "Likes on my posts and comments", Default: true},
+}
+
+// notificationView is a notification as shown on /notifications.
+// CommentID is the new comment for comments and replies and the liked
+// comment for likes of a comment; it is zero for likes of a post.
+// Excerpt previews that comment.
+type notificationView struct {
+    ID        int64
+    Type      string
+    Actor     string
+    PostID    int64
+    PostTitle string
+    CommentID int64
+    Excerpt   string
+    CreatedAt time.Time
+    Read      bool
+}
+
+// notificationPref is a row of the preferences form.
+type notificationPref struct {
+    Name    string
+    Label   string
+    Enabled bool
+}
+
+// HandleNotifications lists the notifications of the logged-in user on
+// GET, newest first, paged with `before` (the ID of the last one on the
+// previous page). On POST the `action` field selects what to do:
+//
+//   open   mark the notification `id` read and go to what it is about
+//   read   mark the notification `id` read and return to the page
+//          given by `before`
+//   all    mark every notification read
+//   prefs  receive exactly the types listed in `notify`
+func (a *App) HandleNotifications(w http.ResponseWriter, r *http.Request) {
+    uid, _, _ := a.CurrentUser(r)
+    switch r.Method {
+    case http.MethodGet:
+        var before int64
+        if v := r.URL.Query().Get("before"); v != "" {
+            n, err := strconv.ParseInt(v, 10, 64)
+            if err != nil || n <= 0 {
+                http.Error(w, "invalid cursor", http.StatusBadRequest)
+                return
+            }
+            before = n
+        }
+        list, more, err := a.listNotifications(uid, before)
+        if err != nil {
+            http.Error(w, "database error", http.StatusInternalServerError)
+            return
+        }
+        prefs, err := a.notificationPrefs(uid)
+        if err != nil {
+            http.Error(w, "database error", http.StatusInternalServerError)
+            return
+        }
+        data := a.baseData(r)
+        data["Notifications"] = list
+        data["Prefs"] = prefs
+        data["Before"] = before
+        if more {
+            data["Older"] = list[len(list)-1].ID
+        }
+        if msg := r.URL.Query().Get("notice"); msg != "" {
+            data["Notice"] = msg
+        }
+        tmpl := a.Templates.Lookup("notifications.html")
+        tmpl.ExecuteTemplate(w, "notifications.html", data)
+    case http.MethodPost:
+        switch action := r.FormValue("action"); action {
+        case "open", "read":
+            id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+            if err != nil || id <= 0 {
+                http.Error(w, "invalid notification id", http.StatusBadRequest)
+                return
+            }
+            // The user_id condition keeps users from touching
+            // notifications that are not theirs.
+            var postID int64
+            var commentID sql.NullInt64
+            err = a.DB.QueryRow(`UPDATE notifications SET read_at = COALESCE(read_at, ?) WHERE id = ? AND user_id = ? RETURNING post_id, comment_id`,
+                time.Now().UTC(), id, uid).Scan(&postID, &commentID)
+            if err == sql.ErrNoRows {
+                http.NotFound(w, r)
+                return
+            }
+            if err != nil {
+                http.Error(w, "database error", http.StatusInternalServerError)
+                return
+            }
+            // Marking one read keeps the user on the page they were
+            // looking at.
+            target := "/notifications"
+            if before, err := strconv.ParseInt(r.FormValue("before"), 10, 64); err == nil && before > 0 {
+                target += "?before=" + strconv.FormatInt(before, 10)
+            }
+            if action == "open" {
+                target = "/post?id=" + strconv.FormatInt(postID, 10)
+                if commentID.Valid {
+                    target = a.commentURL(postID, commentID.Int64)
+                }
+            }
+            http.Redirect(w, r, target, http.StatusSeeOther)
+        case "all":
+            if _, err := a.DB.Exec(`UPDATE notifications SET read_at = ? WHERE user_id = ? AND read_at IS NULL`, time.Now().UTC(), uid); err != nil {
+                http.Error(w, "database error", http.StatusInternalServerError)
+                return
+            }
+            http.Redirect(w, r, "/notifications", http.StatusSeeOther)
+        case "prefs":
+            wanted := make(map[string]bool)
+            for _, name := range r.PostForm["notify"] {
+                wanted[name] = true
+            }
+            err := a.inTx(func(tx *sql.Tx) error {
+                for _, t := range notificationTypes {
+                    _, err := tx.Exec(`INSERT INTO notification_prefs(user_id, type, enabled) VALUES(?,?,?)
+                        ON CONFLICT(user_id, type) DO UPDATE SET enabled = excluded.enabled`, uid, t.Name, wanted[t.Name])
+                    if err != nil {
+                        return err
+                    }
+                }
+                return nil
+            })
+            if err != nil {
+                http.Error(w, "database error", http.StatusInternalServerError)
+                return
+            }
+            http.Redirect(w, r, "/notifications?notice="+url.QueryEscape("Your notification preferences have been saved."), http.StatusSeeOther)
+        default:
+            http.Error(w, "unknown action", http.StatusBadRequest)
+        }
+    default:
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+// listNotifications returns a page of the notifications of user uid,
+// newest first, starting below ID before (or at the newest when it is
+// zero), and whether older ones follow.
+func (a *App) listNotifications(uid, before int64) ([]notificationView, bool, error) {
+    if before == 0 {
+        before = 1<<63 - 1
+    }
+    rows, err := a.DB.Query(`SELECT n.id, n.type, u.username, n.post_id, p.title, n.comment_id, c.body, n.created_at, n.read_at
+        FROM notifications n
+        JOIN users u ON u.id = n.actor_id
+        JOIN posts p ON p.id = n.post_id
+        LEFT JOIN comments c ON c.id = n.comment_id
+        WHERE n.user_id = ? AND n.id < ?
+        ORDER BY n.id DESC LIMIT ?`, uid, before, notificationsPerPage+1)
+    if err != nil {
+        return nil, false, err
+    }
+    defer rows.Close()
+    var list []notificationView
+    for rows.Next() {
+        var n notificationView
+        var commentID sql.NullInt64
+        var body sql.NullString
+        var readAt sql.NullTime
+        if err := rows.Scan(&n.ID, &n.Type, &n.Actor, &n.PostID, &n.PostTitle, &commentID, &body, &n.CreatedAt, &readAt); err != nil {
+            return nil, false, err
+        }
+        n.CommentID = commentID.Int64
+        if body.Valid {
+            n.Excerpt = markdown.Excerpt(body.String, notificationExcerpt)
+        }
+        n.Read = readAt.Valid
+        list = append(list, n)
+    }
+    if err := rows.Err(); err != nil {
+        return nil, false, err
+    }
+    more := len(list) > notificationsPerPage
+    if more {
+        list = list[:notificationsPerPage]
+    }
+    return list, more, nil
+}
+
+// unreadNotifications returns the number of unread notifications of
+// user uid, or zero when it cannot be read.
+func (a *App) unreadNotifications(uid int64) int {
+    var n int
+    a.DB.QueryRow(`SELECT COUNT(*) FROM notifications WHERE user_id = ? AND read_at IS NULL`, uid).Scan(&n)
+    return n
+}
+
+// notificationPrefs returns the preferences of user uid for every
+// notification type.
+func (a *App) notificationPrefs(uid int64) ([]notificationPref, error) {
+    rows, err := a.DB.Query(`SELECT type, enabled FROM notification_prefs WHERE user_id = ?`, uid)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    chosen := make(map[string]bool)
+    for rows.Next() {
+        var name string
+        var enabled bool
+        if err := rows.Scan(&name, &enabled); err != nil {
+            return nil, err
+        }
+        chosen[name] = enabled
+    }
+    if err := rows.Err(); err != nil {
+        return nil, err
+    }
+    prefs := make([]notificationPref, 0, len(notificationTypes))
+    for _, t := range notificationTypes {
+        enabled, ok := chosen[t.Name]
+        if !ok {
+            enabled = t.Default
+        }
+        prefs = append(prefs, notificationPref{Name: t.Name, Label: t.Label, Enabled: enabled})
+    }
+    return prefs, nil
+}
+
+// wantsNotification reports whether user uid receives notifications of
+// type typ.
+func (a *App) wantsNotification(uid int64, typ string) (bool, error) {
+    var enabled bool
+    err := a.DB.QueryRow(`SELECT enabled FROM notification_prefs WHERE user_id = ? AND type = ?`, uid, typ).Scan(&enabled)
+    if err == sql.ErrNoRows {
+        for _, t := range notificationTypes {
+            if t.Name == typ {
+                return t.Default, nil
+            }
+        }
+        return false, nil
+    }
+    return enabled, err
+}
+
+// notify records a notification of type typ for user uid about
+// something actor did, unless it is their own doing or they have
+// turned the type off.
+func (a *App) notify(uid, actor int64, typ string, postID int64, commentID sql.NullInt64) error {
+    if uid == actor {
+        return nil
+    }
+    ok, err := a.wantsNotification(uid, typ)
+    if err != nil || !ok {
+        return err
+    }
+    _, err = a.DB.Exec(`INSERT INTO notifications(user_id, actor_id, type, post_id, comment_id) VALUES(?,?,?,?,?)`,
+        uid, actor, typ, postID, commentID)
+    return err
+}
+
+// notifyComment tells the author of post postID about comment cid by
+// actor and, when it is a reply, the author of the parent comment. An
+// author who gets a reply to their comment on their own post is told
+// once, about the reply. Failures are logged rather than returned: the
+// comment has been saved either way.
+func (a *App) notifyComment(actor, postID, parentID, cid int64) {
+    comment := sql.NullInt64{Int64: cid, Valid: true}
+    var postAuthor, parentAuthor int64
+    if err := a.DB.QueryRow(`SELECT user_id FROM posts WHERE id = ?`, postID).Scan(&postAuthor); err != nil {
+        log.Printf("notifying about comment %d: %v", cid, err)
+        return
+    }
+    if parentID != 0 {
+        if err := a.DB.QueryRow(`SELECT user_id FROM comments WHERE id = ?`, parentID).Scan(&parentAuthor); err != nil {
+            log.Printf("notifying about comment %d: %v", cid, err)
+            return
+        }
+        if err := a.notify(parentAuthor, actor, "reply", postID, comment); err != nil {
+            log.Printf("notifying about comment %d: %v", cid, err)
+        }
+    }
+    if postAuthor != parentAuthor {
+        if err := a.notify(postAuthor, actor, "comment", postID, comment); err != nil {
+            log.Printf("notifying about comment %d: %v", cid, err)
+        }
+    }
+}
+
+// notifyLike updates the notifications about a like by actor of the
+// target after their reaction to it changed. A new like tells the
+// author, unless an unread notification about the same like is still
+// waiting; taking the like back, or turning it into a dislike, removes
+// that notification again if it has not been read. Dislikes themselves
+// are not announced. Failures are logged, as in notifyComment.
+func (a *App) notifyLike(actor int64, targetType string, targetID int64, liked bool) {
+    var author, postID int64
+    var comment sql.NullInt64
+    var err error
+    if targetType == "comment" {
+        comment = sql.NullInt64{Int64: targetID, Valid: true}
+        err = a.DB.QueryRow(`SELECT user_id, post_id FROM comments WHERE id = ?`, targetID).Scan(&author, &postID)
+    } else {
+        postID = targetID
+        err = a.DB.QueryRow(`SELECT user_id FROM posts WHERE id = ?`, targetID).Scan(&author)
+    }
+    if err == nil {
+        // IS compares NULL comment IDs as equal, which = does not.
+        const same = `user_id = ? AND actor_id = ? AND type = 'like' AND post_id = ? AND comment_id IS ? AND read_at IS NULL`
+        if !liked {
+            _, err = a.DB.Exec(`DELETE FROM notifications WHERE `+same, author, actor, postID, comment)
+        } else {
+            var waiting int
+            err = a.DB.QueryRow(`SELECT COUNT(*) FROM notifications WHERE `+same, author, actor, postID, comment).Scan(&waiting)
+            if err == nil && waiting == 0 {
+                err = a.notify(author, actor, "like", postID, comment)
+            }
+        }
+    }
+    if err != nil {
+        log.Printf("notifying about %s %d: %v", targetType, targetID, err)
+    }
+}
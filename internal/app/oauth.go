@@ -0,0 +1,409 @@
+package app
+
+// This file implements logging in with external identity providers
+// through OAuth 2.0 and OpenID Connect (see internal/oauth). The flow
+// starts with a POST to /oauth/start, which stores the PKCE verifier
+// and nonce under a random state value and sends the browser to the
+// provider. The provider returns to /oauth/callback/{provider}, where
+// the code is exchanged for the user's identity.
+//
+// Identities are linked to users in the identities table. A known
+// identity logs its user in through completeLogin, so two-factor
+// authentication and SetSession apply as for password logins. An
+// unknown identity creates a new account, unless its email address
+// already belongs to one: taking over that account would trust the
+// provider with it, so the owner has to log in and link the identity
+// from /account/identities instead.
+
+import (
+    "database/sql"
+    "errors"
+    "log"
+    "net/http"
+    "net/url"
+    "regexp"
+    "strconv"
+    "strings"
+    "time"
+
+    "forum/internal/oauth"
+)
+
+const (
+    // oauthStateCookie binds an authorization request to the browser
+    // that started it.
+    oauthStateCookie = "forum_oauth"
+    // oauthStateTTL is how long the user has to finish at the
+    // provider.
+    oauthStateTTL = 10 * time.Minute
+)
+
+// oauthProvider returns the configured provider with the given name.
+func (a *App) oauthProvider(name string) *oauth.Provider {
+    for _, p := range a.OAuthProviders {
+        if p.Name == name {
+            return p
+        }
+    }
+    return nil
+}
+
+// oauthRedirectURI is the callback address registered with provider
+// p.
+func (a *App) oauthRedirectURI(r *http.Request, p *oauth.Provider) string {
+    return a.absoluteURL(r, "/oauth/callback/"+p.Name)
+}
+
+// HandleOAuthStart begins a login or, with `link=1` from a logged-in
+// user, the linking of another identity. The form field `provider`
+// names the provider.
+func (a *App) HandleOAuthStart(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    p := a.oauthProvider(r.FormValue("provider"))
+    if p == nil {
+        http.Error(w, "unknown provider", http.StatusBadRequest)
+        return
+    }
+    var linkUser sql.NullInt64
+    if r.FormValue("link") == "1" {
+        uid, _, ok := a.CurrentUser(r)
+        if !ok {
+            http.Redirect(w, r, "/login", http.StatusSeeOther)
+            return
+        }
+        linkUser = sql.NullInt64{Int64: uid, Valid: true}
+    }
+    state, err := oauth.NewState()
+    if err != nil {
+        http.Error(w, "internal error", http.StatusInternalServerError)
+        return
+    }
+    nonce, err := oauth.NewState()
+    if err != nil {
+        http.Error(w, "internal error", http.StatusInternalServerError)
+        return
+    }
+    verifier, err := oauth.NewVerifier()
+    if err != nil {
+        http.Error(w, "internal error", http.StatusInternalServerError)
+        return
+    }
+    target, err := p.AuthCodeURL(r.Context(), a.oauthRedirectURI(r, p), state, verifier, nonce)
+    if err != nil {
+        log.Printf("%v", err)
+        a.oauthFail(w, r, linkUser.Valid, p.Title+" is not reachable right now. Please try again later.")
+        return
+    }
+    expires := time.Now().Add(oauthStateTTL)
+    _, err = a.DB.Exec(`INSERT INTO oauth_states(state_hash, provider, verifier, nonce, link_user_id, expires_at) VALUES(?,?,?,?,?,?)`,
+        hashToken(state), p.Name, verifier, nonce, linkUser, expires.UTC())
+    if err != nil {
+        http.Error(w, "database error", http.StatusInternalServerError)
+        return
+    }
+    // SameSite=Lax still sends the cookie on the top-level redirect
+    // back from the provider.
+    http.SetCookie(w, &http.Cookie{
+        Name:     oauthStateCookie,
+        Value:    state,
+        Path:     "/oauth",
+        Expires:  expires,
+        HttpOnly: true,
+        SameSite: http.SameSiteLaxMode,
+    })
+    http.Redirect(w, r, target, http.StatusSeeOther)
+}
+
+// oauthFail sends the user back with an error message: to the login
+// page, or to the identities page when linking.
+func (a *App) oauthFail(w http.ResponseWriter, r *http.Request, linking bool, msg string) {
+    target := "/login"
+    if linking {
+        target = "/account/identities"
+    }
+    http.Redirect(w, r, target+"?error="+url.QueryEscape(msg), http.StatusSeeOther)
+}
+
+// HandleOAuthCallback completes the flow at
+// /oauth/callback/{provider}. The state parameter must match the
+// browser's state cookie and a stored, unexpired request for the same
+// provider; it can be used only once.
+func (a *App) HandleOAuthCallback(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    p := a.oauthProvider(strings.TrimPrefix(r.URL.Path, "/oauth/callback/"))
+    if p == nil {
+        http.NotFound(w, r)
+        return
+    }
+    q := r.URL.Query()
+    state := q.Get("state")
+    c, err := r.Cookie(oauthStateCookie)
+    if err != nil || state == "" || c.Value != state {
+        a.oauthFail(w, r, false, "Your login request has expired. Please try again.")
+        return
+    }
+    http.SetCookie(w, &http.Cookie{Name: oauthStateCookie, Value: "", Path: "/oauth", MaxAge: -1, HttpOnly: true, SameSite: http.SameSiteLaxMode})
+    var provider, verifier, nonce string
+    var linkUser sql.NullInt64
+    var expires time.Time
+    err = a.DB.QueryRow(`SELECT provider, verifier, nonce, link_user_id, expires_at FROM oauth_states WHERE state_hash = ?`, hashToken(state)).
+        Scan(&provider, &verifier, &nonce, &linkUser, &expires)
+    if err == nil {
+        // Deleting the request makes the state single-use; of two
+        // concurrent callbacks only one removes the row.
+        var res sql.Result
+        if res, err = a.DB.Exec(`DELETE FROM oauth_states WHERE state_hash = ?`, hashToken(state)); err == nil {
+            if n, _ := res.RowsAffected(); n == 0 {
+                err = sql.ErrNoRows
+            }
+        }
+    }
+    if err != nil || provider != p.Name || time.Now().After(expires) {
+        a.oauthFail(w, r, false, "Your login request has expired. Please try again.")
+        return
+    }
+    linking := linkUser.Valid
+    if e := q.Get("error"); e != "" {
+        msg := "Logging in with " + p.Title + " failed."
+        if e == "access_denied" {
+            msg = "Logging in with " + p.Title + " was cancelled."
+        }
+        a.oauthFail(w, r, linking, msg)
+        return
+    }
+    tok, err := p.Exchange(r.Context(), q.Get("code"), a.oauthRedirectURI(r, p), verifier)
+    if err != nil {
+        log.Printf("%v", err)
+        a.oauthFail(w, r, linking, "Logging in with "+p.Title+" failed.")
+        return
+    }
+    ident, err := p.Identity(r.Context(), tok, nonce)
+    if err != nil {
+        log.Printf("%v", err)
+        a.oauthFail(w, r, linking, "Logging in with "+p.Title+" failed.")
+        return
+    }
+    if linking {
+        a.linkIdentity(w, r, p, ident, linkUser.Int64)
+        return
+    }
+
+    var uid int64
+    err = a.DB.QueryRow(`SELECT user_id FROM identities WHERE provider = ? AND subject = ?`, p.Name, ident.Subject).Scan(&uid)
+    switch {
+    case err == sql.ErrNoRows:
+        uid, err = a.createOAuthUser(r, p, ident)
+        if err == errEmailTaken {
+            a.oauthFail(w, r, false, "An account with the email address "+ident.Email+" already exists. Log in with your password and link "+p.Title+" under Linked accounts in your account settings.")
+            return
+        }
+        if err == errNoEmail {
+            a.oauthFail(w, r, false, p.Title+" did not share an email address, which the forum needs for your account.")
+            return
+        }
+        if err != nil {
+            http.Error(w, "database error", http.StatusInternalServerError)
+            return
+        }
+    case err != nil:
+        http.Error(w, "database error", http.StatusInternalServerError)
+        return
+    }
+    _, _ = a.DB.Exec(`UPDATE identities SET last_login_at = ? WHERE provider = ? AND subject = ?`, time.Now().UTC(), p.Name, ident.Subject)
+    a.completeLogin(w, r, uid)
+}
+
+// linkIdentity attaches ident to user uid, who started the linking.
+// The user must still be logged in in the same browser.
+func (a *App) linkIdentity(w http.ResponseWriter, r *http.Request, p *oauth.Provider, ident *oauth.Identity, uid int64) {
+    if cur, _, ok := a.CurrentUser(r); !ok || cur != uid {
+        a.oauthFail(w, r, false, "Please log in again to link "+p.Title+".")
+        return
+    }
+    var owner int64
+    err := a.DB.QueryRow(`SELECT user_id FROM identities WHERE provider = ? AND subject = ?`, p.Name, ident.Subject).Scan(&owner)
+    if err == nil {
+        msg := "This " + p.Title + " account is already linked to another forum account."
+        if owner == uid {
+            msg = "This " + p.Title + " account is already linked."
+        }
+        a.oauthFail(w, r, true, msg)
+        return
+    }
+    if err != sql.ErrNoRows {
+        http.Error(w, "database error", http.StatusInternalServerError)
+        return
+    }
+    if _, err := a.DB.Exec(`INSERT INTO identities(user_id, provider, subject, email) VALUES(?,?,?,?)`, uid, p.Name, ident.Subject, ident.Email); err != nil {
+        http.Error(w, "database error", http.StatusInternalServerError)
+        return
+    }
+    http.Redirect(w, r, "/account/identities?notice="+url.QueryEscape(p.Title+" is now linked to your account."), http.StatusSeeOther)
+}
+
+var (
+    errEmailTaken = errors.New("email address already registered")
+    errNoEmail    = errors.New("provider returned no email address")
+)
+
+// createOAuthUser registers a new account for an identity that is not
+// linked yet. The username is derived from the provider's username or
+// the email address and made unique with a number. The email counts as
+// verified when the provider says so; otherwise a verification mail is
+// sent as for password registrations.
+func (a *App) createOAuthUser(r *http.Request, p *oauth.Provider, ident *oauth.Identity) (int64, error) {
+    if ident.Email == "" {
+        return 0, errNoEmail
+    }
+    var exists bool
+    if err := a.DB.QueryRow(`SELECT EXISTS(SELECT 1 FROM users WHERE email = ?)`, ident.Email).Scan(&exists); err != nil {
+        return 0, err
+    }
+    if exists {
+        return 0, errEmailTaken
+    }
+    base := ident.Username
+    if base == "" {
+        base = ident.Email[:strings.IndexByte(ident.Email+"@", '@')]
+    }
+    base = usernameRe.ReplaceAllString(base, "")
+    if base == "" {
+        base = "user"
+    }
+    var verified sql.NullTime
+    if ident.EmailVerified {
+        verified = sql.NullTime{Time: time.Now().UTC(), Valid: true}
+    }
+    var uid int64
+    err := a.inTx(func(tx *sql.Tx) error {
+        name := base
+        for n := 2; ; n++ {
+            var taken bool
+            if err := tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM users WHERE username = ?)`, name).Scan(&taken); err != nil {
+                return err
+            }
+            if !taken {
+                break
+            }
+            name = base + strconv.Itoa(n)
+        }
+        res, err := tx.Exec(`INSERT INTO users(email, username, password_hash, email_verified_at) VALUES(?,?,?,?)`, ident.Email, name, "", verified)
+        if err != nil {
+            return err
+        }
+        uid, _ = res.LastInsertId()
+        _, err = tx.Exec(`INSERT INTO identities(user_id, provider, subject, email) VALUES(?,?,?,?)`, uid, p.Name, ident.Subject, ident.Email)
+        return err
+    })
+    if err != nil {
+        return 0, err
+    }
+    if !ident.EmailVerified {
+        if err := a.sendVerification(uid); err != nil {
+            log.Printf("verification mail for user %d: %v", uid, err)
+        }
+    }
+    return uid, nil
+}
+
+// usernameRe matches the characters removed from suggested usernames.
+var usernameRe = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// accountIdentity is a row on the identities page.
+type accountIdentity struct {
+    ID        int64
+    Provider  string
+    Title     string
+    Email     string
+    CreatedAt time.Time
+    LastLogin *time.Time
+}
+
+// HandleAccountIdentities lists the identities linked to the logged-in
+// user and the providers that can still be linked on GET. On POST with
+// `action=unlink` it removes the identity `id`, unless it is the only
+// way left to log in.
+func (a *App) HandleAccountIdentities(w http.ResponseWriter, r *http.Request) {
+    uid, _, _ := a.CurrentUser(r)
+    switch r.Method {
+    case http.MethodGet:
+        rows, err := a.DB.Query(`SELECT id, provider, email, created_at, last_login_at FROM identities WHERE user_id = ? ORDER BY created_at`, uid)
+        if err != nil {
+            http.Error(w, "database error", http.StatusInternalServerError)
+            return
+        }
+        defer rows.Close()
+        var linked []accountIdentity
+        have := map[string]bool{}
+        for rows.Next() {
+            var i accountIdentity
+            var last sql.NullTime
+            if err := rows.Scan(&i.ID, &i.Provider, &i.Email, &i.CreatedAt, &last); err != nil {
+                http.Error(w, "database error", http.StatusInternalServerError)
+                return
+            }
+            if last.Valid {
+                i.LastLogin = &last.Time
+            }
+            i.Title = i.Provider
+            if p := a.oauthProvider(i.Provider); p != nil {
+                i.Title = p.Title
+            }
+            have[i.Provider] = true
+            linked = append(linked, i)
+        }
+        var available []*oauth.Provider
+        for _, p := range a.OAuthProviders {
+            if !have[p.Name] {
+                available = append(available, p)
+            }
+        }
+        data := a.baseData(r)
+        data["Identities"] = linked
+        data["Available"] = available
+        if msg := r.URL.Query().Get("error"); msg != "" {
+            data["Error"] = msg
+        }
+        if msg := r.URL.Query().Get("notice"); msg != "" {
+            data["Notice"] = msg
+        }
+        tmpl := a.Templates.Lookup("account_identities.html")
+        tmpl.ExecuteTemplate(w, "account_identities.html", data)
+    case http.MethodPost:
+        if r.FormValue("action") != "unlink" {
+            http.Error(w, "unknown action", http.StatusBadRequest)
+            return
+        }
+        id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+        if err != nil || id <= 0 {
+            http.Error(w, "invalid identity id", http.StatusBadRequest)
+            return
+        }
+        // Accounts without a password need another identity to log in
+        // with afterwards.
+        var hasPassword bool
+        var others int
+        err = a.DB.QueryRow(`SELECT password_hash <> '', (SELECT COUNT(*) FROM identities WHERE user_id = ? AND id <> ?) FROM users WHERE id = ?`, uid, id, uid).Scan(&hasPassword, &others)
+        if err != nil {
+            http.Error(w, "database error", http.StatusInternalServerError)
+            return
+        }
+        if !hasPassword && others == 0 {
+            http.Redirect(w, r, "/account/identities?error="+url.QueryEscape("This is the only way to log in to your account. Set a password with \"Forgot your password?\" on the login page first."), http.StatusSeeOther)
+            return
+        }
+        if _, err := a.DB.Exec(`DELETE FROM identities WHERE id = ? AND user_id = ?`, id, uid); err != nil {
+            http.Error(w, "database error", http.StatusInternalServerError)
+            return
+        }
+        http.Redirect(w, r, "/account/identities", http.StatusSeeOther)
+    default:
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    }
+}
@@ -0,0 +1,336 @@
+package app
+
+// Tests of logging in with an external provider. Every test runs the
+// whole authorization code flow with PKCE: the forum's handlers and the
+// fake provider of the oauthtest package are each served by
+// net/http/httptest, and a client with a cookie jar plays the browser,
+// following the redirects between the two by hand.
+
+import (
+    "net/http"
+    "net/http/cookiejar"
+    "net/http/httptest"
+    "net/url"
+    "strings"
+    "testing"
+    "time"
+
+    "forum/internal/oauth"
+    "forum/internal/oauth/oauthtest"
+)
+
+// oauthEnv is a forum with one provider, "mock", and a browser.
+type oauthEnv struct {
+    a       *App
+    app     *httptest.Server
+    browser *http.Client
+}
+
+func newOAuthEnv(t *testing.T) *oauthEnv {
+    t.Helper()
+    a := newTestApp(t)
+    idp := oauthtest.New("forum", "secret")
+    idpSrv := httptest.NewServer(idp)
+    t.Cleanup(idpSrv.Close)
+    idp.Issuer = idpSrv.URL
+    a.OAuthProviders = []*oauth.Provider{{
+        Name:         "mock",
+        Title:        "Mock",
+        Type:         oauth.TypeOIDC,
+        Issuer:       idpSrv.URL,
+        ClientID:     "forum",
+        ClientSecret: "secret",
+        Scopes:       []string{"openid", "email", "profile"},
+        Client:       idpSrv.Client(),
+    }}
+
+    mux := http.NewServeMux()
+    mux.HandleFunc("/oauth/start", a.HandleOAuthStart)
+    mux.HandleFunc("/oauth/callback/", a.HandleOAuthCallback)
+    appSrv := httptest.NewServer(mux)
+    t.Cleanup(appSrv.Close)
+
+    jar, err := cookiejar.New(nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    browser := &http.Client{
+        Jar: jar,
+        CheckRedirect: func(*http.Request, []*http.Request) error {
+            return http.ErrUseLastResponse
+        },
+    }
+    return &oauthEnv{a: a, app: appSrv, browser: browser}
+}
+
+// redirect sends req and returns where the response redirects to.
+func (e *oauthEnv) redirect(t *testing.T, req *http.Request) string {
+    t.Helper()
+    resp, err := e.browser.Do(req)
+    if err != nil {
+        t.Fatalf("%s %s: %v", req.Method, req.URL, err)
+    }
+    resp.Body.Close()
+    loc := resp.Header.Get("Location")
+    if resp.StatusCode != http.StatusFound && resp.StatusCode != http.StatusSeeOther || loc == "" {
+        t.Fatalf("%s %s: status %s, want a redirect", req.Method, req.URL, resp.Status)
+    }
+    return loc
+}
+
+// start posts the login button, or the link button with link set, and
+// returns the address of the provider's consent page.
+func (e *oauthEnv) start(t *testing.T, link bool) string {
+    t.Helper()
+    form := url.Values{"provider": {"mock"}}
+    if link {
+        form.Set("link", "1")
+    }
+    req, _ := http.NewRequest(http.MethodPost, e.app.URL+"/oauth/start", strings.NewReader(form.Encode()))
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    return e.redirect(t, req)
+}
+
+// authorize logs in at the provider as email and returns the callback
+// address the provider sends the browser back to.
+func (e *oauthEnv) authorize(t *testing.T, consent, email string) string {
+    t.Helper()
+    req, _ := http.NewRequest(http.MethodGet, consent+"&email="+url.QueryEscape(email), nil)
+    return e.redirect(t, req)
+}
+
+// callback returns to the forum and returns where it sends the browser
+// next.
+func (e *oauthEnv) callback(t *testing.T, callback string) string {
+    t.Helper()
+    req, _ := http.NewRequest(http.MethodGet, callback, nil)
+    return e.redirect(t, req)
+}
+
+// login runs the whole flow as email.
+func (e *oauthEnv) login(t *testing.T, email string, link bool) string {
+    t.Helper()
+    return e.callback(t, e.authorize(t, e.start(t, link), email))
+}
+
+// setCookie puts a cookie into the browser.
+func (e *oauthEnv) setCookie(c *http.Cookie) {
+    u, _ := url.Parse(e.app.URL + "/")
+    e.browser.Jar.SetCookies(u, []*http.Cookie{c})
+}
+
+// loggedInAs returns the user of the browser's session, or 0.
+func (e *oauthEnv) loggedInAs(t *testing.T) int64 {
+    t.Helper()
+    u, _ := url.Parse(e.app.URL + "/")
+    for _, c := range e.browser.Jar.Cookies(u) {
+        if c.Name == e.a.CookieName {
+            var uid int64
+            if err := e.a.DB.QueryRow(`SELECT user_id FROM sessions WHERE id = ?`, c.Value).Scan(&uid); err == nil {
+                return uid
+            }
+        }
+    }
+    return 0
+}
+
+// logInWithSession gives the browser a session for user uid, as a
+// password login would.
+func (e *oauthEnv) logInWithSession(t *testing.T, uid int64) {
+    t.Helper()
+    rec := httptest.NewRecorder()
+    if err := e.a.SetSession(rec, httptest.NewRequest(http.MethodPost, "/login", nil), uid); err != nil {
+        t.Fatal(err)
+    }
+    for _, c := range rec.Result().Cookies() {
+        e.setCookie(c)
+    }
+}
+
+// failedLogin checks that the flow ended on the login page with an
+// error.
+func failedLogin(t *testing.T, loc, what string) {
+    t.Helper()
+    if !strings.HasPrefix(loc, "/login?error=") {
+        t.Fatalf("%s: redirected to %q, want the login page with an error", what, loc)
+    }
+}
+
+func TestOAuthLoginCreatesAccount(t *testing.T) {
+    e := newOAuthEnv(t)
+    if loc := e.login(t, "bob@example.org", false); loc != "/" {
+        t.Fatalf("login redirected to %q", loc)
+    }
+    var uid int64
+    var verified bool
+    err := e.a.DB.QueryRow(`SELECT id, email_verified_at IS NOT NULL FROM users WHERE email = ?`, "bob@example.org").Scan(&uid, &verified)
+    if err != nil {
+        t.Fatalf("no account was created: %v", err)
+    }
+    if !verified {
+        t.Error("the provider's verified address was not taken as verified")
+    }
+    if got := e.loggedInAs(t); got != uid {
+        t.Fatalf("browser is logged in as %d, want %d", got, uid)
+    }
+    if n := count(t, e.a, `SELECT COUNT(*) FROM identities WHERE user_id = ? AND provider = 'mock' AND subject = ?`, uid, oauthtest.Subject("bob@example.org")); n != 1 {
+        t.Fatalf("%d identities for the new account, want 1", n)
+    }
+
+    // The second time the identity logs in to the same account.
+    e.login(t, "bob@example.org", false)
+    if got := e.loggedInAs(t); got != uid {
+        t.Fatalf("second login is user %d, want %d", got, uid)
+    }
+    if n := count(t, e.a, `SELECT COUNT(*) FROM users`); n != 1 {
+        t.Fatalf("%d users after logging in twice, want 1", n)
+    }
+    if n := count(t, e.a, `SELECT COUNT(*) FROM oauth_states`); n != 0 {
+        t.Fatalf("%d login requests left behind", n)
+    }
+}
+
+func TestOAuthLinksExistingUser(t *testing.T) {
+    e := newOAuthEnv(t)
+    alice := createTestUser(t, e.a, "alice")
+
+    // The provider vouching for alice's address is not enough to log
+    // in to alice's account.
+    failedLogin(t, e.login(t, "alice@example.com", false), "login with a registered address")
+    if e.loggedInAs(t) != 0 || count(t, e.a, `SELECT COUNT(*) FROM identities`) != 0 {
+        t.Fatal("an identity with a registered address logged in to the account")
+    }
+
+    // Logged in with a password, alice links the identity.
+    e.logInWithSession(t, alice)
+    if loc := e.login(t, "alice@example.com", true); !strings.HasPrefix(loc, "/account/identities?notice=") {
+        t.Fatalf("linking redirected to %q", loc)
+    }
+    var owner int64
+    err := e.a.DB.QueryRow(`SELECT user_id FROM identities WHERE provider = 'mock' AND subject = ?`, oauthtest.Subject("alice@example.com")).Scan(&owner)
+    if err != nil || owner != alice {
+        t.Fatalf("identity belongs to %d (%v), want %d", owner, err, alice)
+    }
+
+    // From a new browser the identity now logs in as alice, without a
+    // new account.
+    e.browser.Jar, _ = cookiejar.New(nil)
+    if loc := e.login(t, "alice@example.com", false); loc != "/" {
+        t.Fatalf("login redirected to %q", loc)
+    }
+    if got := e.loggedInAs(t); got != alice {
+        t.Fatalf("logged in as %d, want alice (%d)", got, alice)
+    }
+    if n := count(t, e.a, `SELECT COUNT(*) FROM users`); n != 1 {
+        t.Fatalf("%d users, want 1", n)
+    }
+
+    // The same identity cannot be linked to a second account.
+    bob := createTestUser(t, e.a, "bob")
+    e.logInWithSession(t, bob)
+    if loc := e.login(t, "alice@example.com", true); !strings.HasPrefix(loc, "/account/identities?error=") {
+        t.Fatalf("linking a taken identity redirected to %q", loc)
+    }
+    if n := count(t, e.a, `SELECT COUNT(*) FROM identities WHERE user_id = ?`, bob); n != 0 {
+        t.Fatal("the identity was linked to a second account")
+    }
+}
+
+func TestOAuthRejectsBadState(t *testing.T) {
+    e := newOAuthEnv(t)
+
+    // The state sent to the provider is the one in the cookie.
+    consent := e.start(t, false)
+    u, err := url.Parse(consent)
+    if err != nil {
+        t.Fatal(err)
+    }
+    state := u.Query().Get("state")
+    if state == "" || u.Query().Get("code_challenge_method") != "S256" {
+        t.Fatalf("consent URL %q lacks state or PKCE", consent)
+    }
+    cb := e.authorize(t, consent, "carol@example.org")
+
+    // The genuine callback followed in another browser, as in a login
+    // CSRF attack, with no login request of its own or with another.
+    browser := e.browser.Jar
+    e.browser.Jar, _ = cookiejar.New(nil)
+    failedLogin(t, e.callback(t, cb), "callback in a browser without a request")
+    e.start(t, false)
+    failedLogin(t, e.callback(t, cb), "callback in a browser with another request")
+
+    // An unknown state, even with a matching cookie.
+    forged, _ := url.Parse(cb)
+    q := forged.Query()
+    q.Set("state", "forged")
+    forged.RawQuery = q.Encode()
+    e.setCookie(&http.Cookie{Name: oauthStateCookie, Value: "forged", Path: "/oauth"})
+    failedLogin(t, e.callback(t, forged.String()), "unknown state")
+
+    // The genuine callback in the browser that started it works once
+    // ...
+    e.browser.Jar = browser
+    if loc := e.callback(t, cb); loc != "/" {
+        t.Fatalf("genuine callback redirected to %q", loc)
+    }
+    uid := e.loggedInAs(t)
+    if uid == 0 {
+        t.Fatal("genuine callback did not log in")
+    }
+
+    // ... and not a second time, even with the cookie put back.
+    e.browser.Jar, _ = cookiejar.New(nil)
+    e.setCookie(&http.Cookie{Name: oauthStateCookie, Value: state, Path: "/oauth"})
+    failedLogin(t, e.callback(t, cb), "replayed state")
+    if e.loggedInAs(t) != 0 {
+        t.Fatal("the replayed callback logged in")
+    }
+
+    // An expired request.
+    consent = e.start(t, false)
+    if _, err := e.a.DB.Exec(`UPDATE oauth_states SET expires_at = ?`, time.Now().Add(-time.Minute).UTC()); err != nil {
+        t.Fatal(err)
+    }
+    failedLogin(t, e.callback(t, e.authorize(t, consent, "carol@example.org")), "expired state")
+    if n := count(t, e.a, `SELECT COUNT(*) FROM sessions`); n != 1 {
+        t.Fatalf("%d sessions, want only the genuine one", n)
+    }
+}
+
+func TestOAuthChecksVerifierAndNonce(t *testing.T) {
+    e := newOAuthEnv(t)
+
+    // The challenge sent to the provider belongs to the stored
+    // verifier.
+    consent := e.start(t, false)
+    var verifier string
+    if err := e.a.DB.QueryRow(`SELECT verifier FROM oauth_states`).Scan(&verifier); err != nil {
+        t.Fatal(err)
+    }
+    u, _ := url.Parse(consent)
+    if got := u.Query().Get("code_challenge"); got != oauth.Challenge(verifier) {
+        t.Fatalf("code challenge %q does not match the stored verifier", got)
+    }
+
+    // Exchanging the code with another verifier fails at the provider,
+    // as it would for an attacker who intercepted the code.
+    other, _ := oauth.NewVerifier()
+    if _, err := e.a.DB.Exec(`UPDATE oauth_states SET verifier = ?`, other); err != nil {
+        t.Fatal(err)
+    }
+    failedLogin(t, e.callback(t, e.authorize(t, consent, "dave@example.org")), "wrong verifier")
+
+    // An ID token issued for another login request.
+    consent = e.start(t, false)
+    if _, err := e.a.DB.Exec(`UPDATE oauth_states SET nonce = 'other'`); err != nil {
+        t.Fatal(err)
+    }
+    failedLogin(t, e.callback(t, e.authorize(t, consent, "dave@example.org")), "wrong nonce")
+
+    if n := count(t, e.a, `SELECT COUNT(*) FROM users`); n != 0 {
+        t.Fatalf("%d accounts created by failed logins", n)
+    }
+    if e.loggedInAs(t) != 0 {
+        t.Fatal("a failed login left a session")
+    }
+}
@@ -0,0 +1,132 @@
+package app
+
+// This file implements keyset pagination for the post index. Rather
+// than skipping rows with OFFSET, which gets slower the deeper a
+// reader goes, each page remembers the sort key and ID of its first
+// and last post. The next page continues strictly after the last post
+// and the previous page ends strictly before the first one, so pages
+// stay stable while new posts are being written.
+
+import (
+    "encoding/base64"
+    "errors"
+    "strconv"
+    "strings"
+)
+
+// postsPerPage is the number of posts shown on one index page.
+const postsPerPage = 20
+
+// postSort describes one sort mode of the index. Expr computes the
+// numeric sort key from the columns of the inner listing query (see
+// listPosts); Asc selects ascending order. Posts with equal keys are
+// ordered by ID in the same direction so that every post has a unique
+// position. ByDate marks the sorts whose key is the creation time in
+// Unix seconds: they page through the index on posts(created_at, id)
+// and only count reactions and comments of the posts shown.
+type postSort struct {
+    Label  string
+    Expr   string
+    Asc    bool
+    ByDate bool
+}
+
+// hotExpr ranks posts by their net score divided by the square of
+// their age in hours, so newer posts with a few likes float above
+// older posts with many. `?` is the reference time as a Julian day;
+// it is pinned in the cursor so every page of a listing uses the same
+// clock and the order does not shift while someone pages through it.
+const hotExpr = `(t.like_count - t.dislike_count + 1) /
+    (((? - julianday(t.created_at)) * 24 + 2) * ((? - julianday(t.created_at)) * 24 + 2))`
+
+// dateExpr is the sort key of the ByDate sorts. Whole seconds are
+// exact, so the cursor can be turned back into a created_at value that
+// compares equal to the column.
+const dateExpr = `CAST(strftime('%s', t.created_at) AS INTEGER)`
+
+// postSorts lists the supported sort modes keyed by the value of the
+// `sort` query parameter.
+var postSorts = map[string]postSort{
+    "new":      {Label: "Newest", Expr: dateExpr, ByDate: true},
+    "old":      {Label: "Oldest", Expr: dateExpr, Asc: true, ByDate: true},
+    "top":      {Label: "Most liked", Expr: "t.like_count"},
+    "comments": {Label: "Most commented", Expr: "t.comment_count"},
+    "hot":      {Label: "Hot", Expr: hotExpr},
+}
+
+// postSortOrder fixes the order in which sort modes are offered.
+var postSortOrder = []string{"new", "old", "top", "comments", "hot"}
+
+// sortOption is a sort mode as presented in the index form.
+type sortOption struct {
+    Value string
+    Label string
+}
+
+// sortOptions returns the sort modes in display order.
+func sortOptions() []sortOption {
+    out := make([]sortOption, 0, len(postSortOrder))
+    for _, v := range postSortOrder {
+        out = append(out, sortOption{Value: v, Label: postSorts[v].Label})
+    }
+    return out
+}
+
+// pageCursor marks a position in a sorted listing: the sort key and
+// ID of a post, plus the reference time used by time-dependent sorts.
+type pageCursor struct {
+    Key float64
+    ID  int64
+    Now int64
+}
+
+// encode serialises the cursor into an opaque URL-safe string.
+func (c pageCursor) encode() string {
+    raw := strconv.FormatFloat(c.Key, 'g', -1, 64) + "~" + strconv.FormatInt(c.ID, 10) + "~" + strconv.FormatInt(c.Now, 10)
+    return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// decodeCursor parses a cursor produced by encode.
+func decodeCursor(s string) (pageCursor, error) {
+    var c pageCursor
+    raw, err := base64.RawURLEncoding.DecodeString(s)
+    if err != nil {
+        return c, err
+    }
+    parts := strings.Split(string(raw), "~")
+    if len(parts) != 3 {
+        return c, errors.New("malformed cursor")
+    }
+    if c.Key, err = strconv.ParseFloat(parts[0], 64); err != nil {
+        return c, err
+    }
+    if c.ID, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+        return c, err
+    }
+    if c.Now, err = strconv.ParseInt(parts[2], 10, 64); err != nil {
+        return c, err
+    }
+    return c, nil
+}
+
+// pageRequest selects one page of a listing. At most one of After
+// and Before is set; with neither the first page is returned.
+type pageRequest struct {
+    Sort   string
+    After  string
+    Before string
+}
+
+// postPage is one page of posts along with the cursors for the
+// neighbouring pages. A cursor is empty when there is no such page.
+type postPage struct {
+    Posts []postListing `json:"posts"`
+    Next  string        `json:"next,omitempty"`
+    Prev  string        `json:"prev,omitempty"`
+}
+
+// julianDay converts a Unix timestamp to the Julian day number used by
+// SQLite's julianday() function.
+func julianDay(unix int64) float64 {
+    return float64(unix)/86400 + 2440587.5
+}
@@ -0,0 +1,249 @@
+package app
+
+// This file implements the "forgot password" flow. A user enters their
+// email address and receives a link containing a random token. The
+// link is valid for resetTokenTTL and can be used once; only a hash of
+// the token is stored. Setting a new password through the link logs
+// the account out everywhere by deleting its sessions and API tokens.
+
+import (
+    "database/sql"
+    "errors"
+    "log"
+    "net/http"
+    "net/url"
+    "strings"
+    "time"
+
+    "forum/internal/mail"
+
+    "golang.org/x/crypto/bcrypt"
+)
+
+const (
+    // resetTokenTTL is how long a password reset link stays valid.
+    resetTokenTTL = time.Hour
+    // maxOpenResets is how many unexpired reset links an account may
+    // have. Further requests are answered as usual but send nothing,
+    // so the form cannot be used to flood someone's inbox. Requests
+    // per IP address are limited by the "forgot" rate limit.
+    maxOpenResets = 3
+)
+
+// errResetToken is returned for reset tokens that are unknown, used
+// or expired. The cases are not told apart to the user.
+var errResetToken = errors.New("this reset link is invalid or has expired")
+
+// HandleForgotPassword shows the "forgot password" form on GET. On
+// POST it emails a reset link when the `email` field belongs to an
+// account. The response is the same whether or not the account
+// exists, and the mail is sent in the background so that response
+// times do not reveal it either. An account with maxOpenResets open
+// links gets no further mail until one expires.
+func (a *App) HandleForgotPassword(w http.ResponseWriter, r *http.Request) {
+    switch r.Method {
+    case http.MethodGet:
+        data := a.baseData(r)
+        data["Sent"] = r.URL.Query().Get("sent") == "1"
+        tmpl := a.Templates.Lookup("password_forgot.html")
+        tmpl.ExecuteTemplate(w, "password_forgot.html", data)
+    case http.MethodPost:
+        email := strings.TrimSpace(r.FormValue("email"))
+        if email == "" {
+            http.Error(w, "email is required", http.StatusBadRequest)
+            return
+        }
+        var uid int64
+        var username string
+        err := a.DB.QueryRow(`SELECT id, username FROM users WHERE email = ?`, email).Scan(&uid, &username)
+        if err != nil && err != sql.ErrNoRows {
+            http.Error(w, "database error", http.StatusInternalServerError)
+            return
+        }
+        if err == nil {
+            var open int
+            if err := a.DB.QueryRow(`SELECT COUNT(*) FROM password_resets WHERE user_id = ? AND expires_at > ?`, uid, time.Now().UTC()).Scan(&open); err != nil {
+                http.Error(w, "database error", http.StatusInternalServerError)
+                return
+            }
+            if open >= maxOpenResets {
+                log.Printf("user %d already has %d open reset links; not sending another", uid, open)
+                http.Redirect(w, r, "/password/forgot?sent=1", http.StatusSeeOther)
+                return
+            }
+            // The answer is the same when no mail can be sent, so
+            // that it does not tell which addresses have accounts.
+            base, err := a.mailBase()
+            if err != nil {
+                log.Printf("not sending a reset link to user %d: %v", uid, err)
+                http.Redirect(w, r, "/password/forgot?sent=1", http.StatusSeeOther)
+                return
+            }
+            token, err := a.createResetToken(uid)
+            if err != nil {
+                http.Error(w, "database error", http.StatusInternalServerError)
+                return
+            }
+            link := base + "/password/reset?token=" + url.QueryEscape(token)
+            a.sendMail(mail.Message{
+                To:      email,
+                Subject: "Reset your forum password",
+                Body: "Hello " + username + ",\n\n" +
+                    "someone asked to reset the password of your forum account.\n" +
+                    "Open the link below within one hour to choose a new password:\n\n" +
+                    link + "\n\n" +
+                    "If you did not ask for this, you can ignore this message;\n" +
+                    "your password stays unchanged.\n",
+            })
+        }
+        http.Redirect(w, r, "/password/forgot?sent=1", http.StatusSeeOther)
+    default:
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+// HandleResetPassword shows the new password form for the `token`
+// query parameter on GET and applies the new password on POST, where
+// the form carries `token`, `password` and `confirm`. On success all
+// sessions and API tokens of the account are removed and the user is
+// sent to the login page.
+func (a *App) HandleResetPassword(w http.ResponseWriter, r *http.Request) {
+    token := r.FormValue("token")
+    data := a.baseData(r)
+    data["Token"] = token
+    render := func() {
+        tmpl := a.Templates.Lookup("password_reset.html")
+        tmpl.ExecuteTemplate(w, "password_reset.html", data)
+    }
+    switch r.Method {
+    case http.MethodGet:
+        if _, err := a.resetTokenUser(a.DB, token); err != nil {
+            if err != errResetToken {
+                http.Error(w, "database error", http.StatusInternalServerError)
+                return
+            }
+            data["Invalid"] = true
+        }
+        render()
+    case http.MethodPost:
+        password := r.FormValue("password")
+        if password == "" || password != r.FormValue("confirm") {
+            data["Error"] = "The passwords are empty or do not match"
+            render()
+            return
+        }
+        err := a.resetPassword(token, password)
+        if err == errResetToken {
+            data["Invalid"] = true
+            render()
+            return
+        }
+        if err != nil {
+            http.Error(w, "database error", http.StatusInternalServerError)
+            return
+        }
+        http.Redirect(w, r, "/login?notice="+url.QueryEscape("Your password has been changed. Please log in."), http.StatusSeeOther)
+    default:
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+// createResetToken stores a new reset token for uid and returns the
+// plain token for the email.
+func (a *App) createResetToken(uid int64) (string, error) {
+    token, err := newToken()
+    if err != nil {
+        return "", err
+    }
+    _, err = a.DB.Exec(`INSERT INTO password_resets(user_id, token_hash, expires_at) VALUES(?,?,?)`,
+        uid, hashToken(token), time.Now().Add(resetTokenTTL).UTC())
+    return token, err
+}
+
+// queryRower is satisfied by both *sql.DB and *sql.Tx.
+type queryRower interface {
+    QueryRow(query string, args ...any) *sql.Row
+}
+
+// resetTokenUser returns the user a reset token belongs to, or
+// errResetToken when the token cannot be used.
+func (a *App) resetTokenUser(q queryRower, token string) (int64, error) {
+    if token == "" {
+        return 0, errResetToken
+    }
+    var uid int64
+    var expires time.Time
+    var used sql.NullTime
+    err := q.QueryRow(`SELECT user_id, expires_at, used_at FROM password_resets WHERE token_hash = ?`, hashToken(token)).Scan(&uid, &expires, &used)
+    if err == sql.ErrNoRows {
+        return 0, errResetToken
+    }
+    if err != nil {
+        return 0, err
+    }
+    if used.Valid || time.Now().After(expires) {
+        return 0, errResetToken
+    }
+    return uid, nil
+}
+
+// resetPassword sets a new password for the owner of token. The token
+// and any other open tokens of the user are spent, and every session
+// and API token of the user is deleted so that whoever knew the old
+// password is logged out, including any token they created with it.
+func (a *App) resetPassword(token, password string) error {
+    hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+    if err != nil {
+        return err
+    }
+    return a.inTx(func(tx *sql.Tx) error {
+        uid, err := a.resetTokenUser(tx, token)
+        if err != nil {
+            return err
+        }
+        if _, err := tx.Exec(`UPDATE users SET password_hash = ? WHERE id = ?`, string(hash), uid); err != nil {
+            return err
+        }
+        if _, err := tx.Exec(`UPDATE password_resets SET used_at = ? WHERE user_id = ? AND used_at IS NULL`, time.Now().UTC(), uid); err != nil {
+            return err
+        }
+        if _, err := tx.Exec(`DELETE FROM sessions WHERE user_id = ?`, uid); err != nil {
+            return err
+        }
+        if _, err := tx.Exec(`DELETE FROM api_tokens WHERE user_id = ?`, uid); err != nil {
+            return err
+        }
+        // Whoever can read the account's email may log in again, even
+        // if someone else's guessing got it locked.
+        var email string
+        if err := tx.QueryRow(`SELECT email FROM users WHERE id = ?`, uid).Scan(&email); err != nil {
+            return err
+        }
+        _, err = tx.Exec(`DELETE FROM login_failures WHERE scope = ? AND key = ?`, scopeAccount, accountKey(email))
+        return err
+    })
+}
+
+// sendMail hands msg to the configured mailer in the background and
+// logs failures. Without a mailer the message is dropped with a log
+// line.
+func (a *App) sendMail(msg mail.Message) {
+    if a.Mailer == nil {
+        log.Printf("no mailer configured; dropping mail to %s: %q", msg.To, msg.Subject)
+        return
+    }
+    a.background.Add(1)
+    go func() {
+        defer a.background.Done()
+        if err := a.Mailer.Send(msg); err != nil {
+            log.Printf("sending mail to %s failed: %v", msg.To, err)
+        }
+    }()
+}
+
+// WaitBackground waits for the work handlers left running in the
+// background, such as mail being sent, so that shutting down does not
+// cut it off.
+func (a *App) WaitBackground() {
+    a.background.Wait()
+}
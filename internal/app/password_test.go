@@ -0,0 +1,152 @@
+package app
+
+// Tests of the password reset: how often links are mailed, what a
+// link changes and that it works once.
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    "forum/internal/mail"
+
+    "golang.org/x/crypto/bcrypt"
+)
+
+// recordingMailer keeps the messages sent through it.
+type recordingMailer struct {
+    mu   sync.Mutex
+    sent []mail.Message
+}
+
+func (m *recordingMailer) Send(msg mail.Message) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.sent = append(m.sent, msg)
+    return nil
+}
+
+// addAccess gives user uid a session and an API token, as a browser
+// and an API client of the account would have.
+func addAccess(t *testing.T, a *App, uid int64, name string) {
+    t.Helper()
+    now := time.Now().UTC()
+    if _, err := a.DB.Exec(`INSERT INTO sessions(id, user_id, expires_at, created_at, last_seen_at, user_agent, ip) VALUES(?,?,?,?,?,?,?)`,
+        "session-"+name, uid, now.Add(time.Hour).Unix(), now, now, "test", "127.0.0.1"); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := a.DB.Exec(`INSERT INTO api_tokens(user_id, name, token_hash) VALUES(?,?,?)`, uid, name, hashToken("token-"+name)); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestResetPasswordRevokesAccess(t *testing.T) {
+    a := newTestApp(t)
+    alice := createTestUser(t, a, "alice")
+    bob := createTestUser(t, a, "bob")
+    addAccess(t, a, alice, "alice")
+    addAccess(t, a, bob, "bob")
+    // A token someone created after taking the account over.
+    if _, err := a.DB.Exec(`INSERT INTO api_tokens(user_id, name, token_hash) VALUES(?,?,?)`, alice, "intruder", hashToken("token-intruder")); err != nil {
+        t.Fatal(err)
+    }
+
+    token, err := a.createResetToken(alice)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := a.resetPassword(token, "correct horse"); err != nil {
+        t.Fatalf("resetPassword: %v", err)
+    }
+    var hash string
+    if err := a.DB.QueryRow(`SELECT password_hash FROM users WHERE id = ?`, alice).Scan(&hash); err != nil {
+        t.Fatal(err)
+    }
+    if bcrypt.CompareHashAndPassword([]byte(hash), []byte("correct horse")) != nil {
+        t.Fatal("the new password was not stored")
+    }
+    if n := count(t, a, `SELECT COUNT(*) FROM sessions WHERE user_id = ?`, alice); n != 0 {
+        t.Errorf("%d sessions survived the reset", n)
+    }
+    if n := count(t, a, `SELECT COUNT(*) FROM api_tokens WHERE user_id = ?`, alice); n != 0 {
+        t.Errorf("%d API tokens survived the reset", n)
+    }
+    if _, _, ok := a.tokenUser("token-intruder"); ok {
+        t.Error("the intruder's API token still authenticates")
+    }
+
+    // Other accounts keep their access.
+    if count(t, a, `SELECT COUNT(*) FROM sessions WHERE user_id = ?`, bob) != 1 || count(t, a, `SELECT COUNT(*) FROM api_tokens WHERE user_id = ?`, bob) != 1 {
+        t.Error("another account lost its access")
+    }
+
+    // The link works once.
+    if err := a.resetPassword(token, "another"); err != errResetToken {
+        t.Fatalf("second use of the link returned %v, want errResetToken", err)
+    }
+}
+
+func TestResetTokenExpires(t *testing.T) {
+    a := newTestApp(t)
+    alice := createTestUser(t, a, "alice")
+    token, err := a.createResetToken(alice)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := a.DB.Exec(`UPDATE password_resets SET expires_at = ?`, time.Now().Add(-time.Minute).UTC()); err != nil {
+        t.Fatal(err)
+    }
+    if err := a.resetPassword(token, "correct horse"); err != errResetToken {
+        t.Fatalf("expired link returned %v, want errResetToken", err)
+    }
+    if err := a.resetPassword("", "correct horse"); err != errResetToken {
+        t.Fatalf("empty token returned %v, want errResetToken", err)
+    }
+}
+
+func TestForgotPasswordLimitsMails(t *testing.T) {
+    a := newTestApp(t)
+    mailer := &recordingMailer{}
+    a.Mailer = mailer
+    a.BaseURL = "https://forum.example.com"
+    createTestUser(t, a, "alice")
+
+    forgot := func(email string) (int, string) {
+        form := url.Values{"email": {email}}
+        req := httptest.NewRequest(http.MethodPost, "/password/forgot", strings.NewReader(form.Encode()))
+        req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+        rec := httptest.NewRecorder()
+        a.HandleForgotPassword(rec, req)
+        return rec.Code, rec.Header().Get("Location")
+    }
+    for i := 0; i < maxOpenResets+3; i++ {
+        if code, loc := forgot("alice@example.com"); code != http.StatusSeeOther || loc != "/password/forgot?sent=1" {
+            t.Fatalf("request %d: %d to %q", i+1, code, loc)
+        }
+    }
+    // Unknown addresses get the same answer.
+    if code, loc := forgot("nobody@example.com"); code != http.StatusSeeOther || loc != "/password/forgot?sent=1" {
+        t.Fatalf("unknown address: %d to %q", code, loc)
+    }
+    a.WaitBackground()
+    if len(mailer.sent) != maxOpenResets {
+        t.Fatalf("%d mails sent, want %d", len(mailer.sent), maxOpenResets)
+    }
+    if n := count(t, a, `SELECT COUNT(*) FROM password_resets`); n != maxOpenResets {
+        t.Fatalf("%d reset links stored, want %d", n, maxOpenResets)
+    }
+
+    // Once the links have expired, a new one can be sent.
+    if _, err := a.DB.Exec(`UPDATE password_resets SET expires_at = ?`, time.Now().Add(-time.Minute).UTC()); err != nil {
+        t.Fatal(err)
+    }
+    forgot("alice@example.com")
+    a.WaitBackground()
+    if len(mailer.sent) != maxOpenResets+1 {
+        t.Fatalf("%d mails sent after the links expired, want %d", len(mailer.sent), maxOpenResets+1)
+    }
+}
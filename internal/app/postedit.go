@@ -0,0 +1,228 @@
+package app
+
+// This file defines the handlers for editing and deleting posts. Only
+// the author of a post may edit it; moderators may also remove it. Every edit stores the previous
+// title and body in the revisions table before the post is updated so
+// that earlier versions remain available on the history page.
+
+import (
+    "database/sql"
+    "net/http"
+    "strconv"
+    "strings"
+    "unicode/utf8"
+)
+
+// editablePost holds the fields shown on the post edit form.
+type editablePost struct {
+    ID     int64
+    UserID int64
+    Title  string
+    Body   string
+}
+
+// loadEditablePost fetches the post identified by the `id` form or
+// query value. It writes a 404 response and returns false when the
+// post does not exist and a 403 response when the current user is not
+// its author. With allowModerator set, moderators and admins pass the
+// check as well; this is used for removal but never for editing.
+func (a *App) loadEditablePost(w http.ResponseWriter, r *http.Request, uid int64, allowModerator bool) (editablePost, bool) {
+    var p editablePost
+    pid, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+    if err != nil || pid <= 0 {
+        http.NotFound(w, r)
+        return p, false
+    }
+    err = a.DB.QueryRow(`SELECT id, user_id, title, body FROM posts WHERE id = ?`, pid).Scan(&p.ID, &p.UserID, &p.Title, &p.Body)
+    if err == sql.ErrNoRows {
+        http.NotFound(w, r)
+        return p, false
+    }
+    if err != nil {
+        http.Error(w, "database error", http.StatusInternalServerError)
+        return p, false
+    }
+    if p.UserID != uid && !(allowModerator && hasRole(a.userRole(uid), RoleModerator)) {
+        http.Error(w, "only the author may change this post", http.StatusForbidden)
+        return p, false
+    }
+    return p, true
+}
+
+// HandleEditPost displays the edit form on GET and saves the changes
+// on POST. It expects the form fields `id`, `title`, `body` and
+// `categories`, mirroring the new post form. The previous version is
+// recorded as a revision before the update is applied.
+func (a *App) HandleEditPost(w http.ResponseWriter, r *http.Request) {
+    uid, _, ok := a.CurrentUser(r)
+    if !ok {
+        http.Redirect(w, r, "/login", http.StatusSeeOther)
+        return
+    }
+    switch r.Method {
+    case http.MethodGet:
+        p, ok := a.loadEditablePost(w, r, uid, false)
+        if !ok {
+            return
+        }
+        // Mark the categories currently attached to the post so the
+        // form can pre-select them.
+        names, err := a.postCategoryNames(p.ID)
+        if err != nil {
+            http.Error(w, "database error", http.StatusInternalServerError)
+            return
+        }
+        selected := make(map[string]bool)
+        for _, name := range names {
+            selected[name] = true
+        }
+        data := a.baseData(r)
+        data["Post"] = p
+        data["SelectedCategories"] = selected
+        tmpl := a.Templates.Lookup("post_edit.html")
+        tmpl.ExecuteTemplate(w, "post_edit.html", data)
+    case http.MethodPost:
+        if err := r.ParseForm(); err != nil {
+            http.Error(w, "unable to parse form", http.StatusBadRequest)
+            return
+        }
+        p, ok := a.loadEditablePost(w, r, uid, false)
+        if !ok {
+            return
+        }
+        title := strings.TrimSpace(r.Form.Get("title"))
+        body := strings.TrimSpace(r.Form.Get("body"))
+        cats := r.Form["categories"]
+        if title == "" || body == "" || len(cats) == 0 {
+            http.Error(w, "all fields are required", http.StatusBadRequest)
+            return
+        }
+        err := a.updatePost(uid, p, title, body, cats)
+        if err == errNoCategory || err == errBodyTooLong {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        if err != nil {
+            http.Error(w, "database error", http.StatusInternalServerError)
+            return
+        }
+        http.Redirect(w, r, "/post?id="+strconv.FormatInt(p.ID, 10), http.StatusSeeOther)
+    default:
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+// postCategoryNames returns the names of the categories attached to a
+// post.
+func (a *App) postCategoryNames(pid int64) ([]string, error) {
+    rows, err := a.DB.Query(`SELECT c.name FROM post_categories pc JOIN categories c ON c.id = pc.category_id WHERE pc.post_id = ? ORDER BY c.name`, pid)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    var names []string
+    for rows.Next() {
+        var name string
+        if err := rows.Scan(&name); err != nil {
+            return nil, err
+        }
+        names = append(names, name)
+    }
+    return names, rows.Err()
+}
+
+// updatePost saves a new title, body and category set for post p on
+// behalf of uid. The previous title and body are stored as a revision
+// when the text changed; adjusting categories alone is not a content
+// edit and leaves the history untouched. A post may keep an archived
+// category it already has but cannot be newly filed under one. When
+// the submitted names leave the post without any category nothing is
+// changed and errNoCategory is returned. Bodies longer than maxBody
+// are refused with errBodyTooLong. Control characters are removed as
+// in createPost.
+func (a *App) updatePost(uid int64, p editablePost, title, body string, cats []string) error {
+    title, body = stripControl(title), stripControl(body)
+    if utf8.RuneCountInString(body) > maxBody {
+        return errBodyTooLong
+    }
+    return a.inTx(func(tx *sql.Tx) error {
+        if title != p.Title || body != p.Body {
+            if _, err := tx.Exec(`INSERT INTO revisions(target_type, target_id, user_id, title, body) VALUES('post',?,?,?,?)`, p.ID, uid, p.Title, p.Body); err != nil {
+                return err
+            }
+            if _, err := tx.Exec(`UPDATE posts SET title = ?, body = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`, title, body, p.ID); err != nil {
+                return err
+            }
+        }
+        // Add the newly chosen categories, then drop the links that
+        // were not submitted. Existing links are left alone, which is
+        // what lets a post keep an archived category.
+        for _, name := range cats {
+            if _, err := tx.Exec(`INSERT OR IGNORE INTO post_categories(post_id, category_id) SELECT ?, id FROM categories WHERE name = ? AND archived = 0`, p.ID, name); err != nil {
+                return err
+            }
+        }
+        args := []any{p.ID}
+        for _, name := range cats {
+            args = append(args, name)
+        }
+        placeholders := strings.TrimSuffix(strings.Repeat("?,", len(cats)), ",")
+        if _, err := tx.Exec(`DELETE FROM post_categories WHERE post_id = ? AND category_id NOT IN (SELECT id FROM categories WHERE name IN (`+placeholders+`))`, args...); err != nil {
+            return err
+        }
+        var left int
+        if err := tx.QueryRow(`SELECT COUNT(*) FROM post_categories WHERE post_id = ?`, p.ID).Scan(&left); err != nil {
+            return err
+        }
+        if left == 0 {
+            return errNoCategory
+        }
+        return nil
+    })
+}
+
+// HandleDeletePost removes a post together with its comments,
+// reactions and revision history. Authors may delete their own posts
+// and moderators may remove any post. It only accepts POST so that a
+// link or crawler cannot delete content by accident. After deletion
+// the user is redirected to the home page.
+func (a *App) HandleDeletePost(w http.ResponseWriter, r *http.Request) {
+    uid, _, ok := a.CurrentUser(r)
+    if !ok {
+        http.Redirect(w, r, "/login", http.StatusSeeOther)
+        return
+    }
+    if r.Method != http.MethodPost {
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    p, ok := a.loadEditablePost(w, r, uid, true)
+    if !ok {
+        return
+    }
+    if err := a.inTx(func(tx *sql.Tx) error { return deletePost(tx, p.ID) }); err != nil {
+        http.Error(w, "database error", http.StatusInternalServerError)
+        return
+    }
+    http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// deletePost removes a post and everything attached to it. Likes and
+// revisions reference their target by type and ID rather than by
+// foreign key, so they are deleted explicitly before the post row.
+// Comments and category links are removed by ON DELETE CASCADE.
+func deletePost(tx *sql.Tx, pid int64) error {
+    stmts := []string{
+        `DELETE FROM likes WHERE target_type='comment' AND target_id IN (SELECT id FROM comments WHERE post_id = ?)`,
+        `DELETE FROM revisions WHERE target_type='comment' AND target_id IN (SELECT id FROM comments WHERE post_id = ?)`,
+        `DELETE FROM likes WHERE target_type='post' AND target_id = ?`,
+        `DELETE FROM revisions WHERE target_type='post' AND target_id = ?`,
+        `DELETE FROM posts WHERE id = ?`,
+    }
+    for _, stmt := range stmts {
+        if _, err := tx.Exec(stmt, pid); err != nil {
+            return err
+        }
+    }
+    return nil
+}
@@ -0,0 +1,233 @@
+package app
+
+// This file implements public user profiles at /user/{username}. A
+// profile shows who the user is (display name, bio, avatar, role and
+// join date), a few numbers about their contributions and their posts
+// and comments, newest first. The activity list uses the same keyset
+// cursors as the post index (see pagination.go).
+
+import (
+    "database/sql"
+    "hash/fnv"
+    "html/template"
+    "net/http"
+    "strings"
+    "time"
+    "unicode"
+    "unicode/utf8"
+
+    "forum/internal/markdown"
+)
+
+// activityPerPage is the number of posts and comments shown on one
+// page of a profile.
+const activityPerPage = 20
+
+// activityExcerpt is the length of the text previews in the activity
+// list.
+const activityExcerpt = 200
+
+// profileView is the data shown at the top of a profile.
+type profileView struct {
+    ID           int64
+    Username     string
+    DisplayName  string
+    BioHTML      template.HTML
+    Role         string
+    JoinedAt     time.Time
+    PostCount    int
+    CommentCount int
+    // Score is the sum of likes minus dislikes on the user's posts and
+    // comments.
+    Score  int
+    Avatar avatar
+    // AvatarURL is the uploaded avatar, if any, shown instead of the
+    // placeholder.
+    AvatarURL string
+}
+
+// avatar is a placeholder picture made of the user's initial on a
+// background colour derived from their username, so that every user
+// gets a stable, distinct avatar without uploading anything.
+type avatar struct {
+    Initial string
+    Hue     int
+}
+
+// newAvatar builds the placeholder avatar for a user.
+func newAvatar(username, displayName string) avatar {
+    name := displayName
+    if name == "" {
+        name = username
+    }
+    r, _ := utf8.DecodeRuneInString(name)
+    h := fnv.New32a()
+    h.Write([]byte(username))
+    return avatar{Initial: string(unicode.ToUpper(r)), Hue: int(h.Sum32() % 360)}
+}
+
+// activityItem is a post or comment in a profile's activity list.
+type activityItem struct {
+    // Kind is "post" or "comment".
+    Kind      string
+    PostID    int64
+    PostTitle string
+    CommentID int64
+    Excerpt   string
+    CreatedAt time.Time
+}
+
+// activityPage is one page of activity with the cursors of its
+// neighbours, empty when there is no such page.
+type activityPage struct {
+    Items []activityItem
+    Next  string
+    Prev  string
+}
+
+// HandleUserProfile renders the profile of the user named in the path.
+// `after` and `before` query parameters page through the activity.
+func (a *App) HandleUserProfile(w http.ResponseWriter, r *http.Request) {
+    name := strings.TrimPrefix(r.URL.Path, "/user/")
+    if name == "" {
+        http.NotFound(w, r)
+        return
+    }
+    p, err := a.loadProfile(name)
+    if err == sql.ErrNoRows {
+        http.NotFound(w, r)
+        return
+    }
+    if err != nil {
+        http.Error(w, "database error", http.StatusInternalServerError)
+        return
+    }
+    q := r.URL.Query()
+    page, err := a.userActivity(p.ID, q.Get("after"), q.Get("before"))
+    if err == errBadCursor {
+        http.Error(w, "invalid page cursor", http.StatusBadRequest)
+        return
+    }
+    if err != nil {
+        http.Error(w, "database error", http.StatusInternalServerError)
+        return
+    }
+    data := a.baseData(r)
+    data["Profile"] = p
+    data["Activity"] = page
+    tmpl := a.Templates.Lookup("user_profile.html")
+    tmpl.ExecuteTemplate(w, "user_profile.html", data)
+}
+
+// loadProfile fetches the profile of the user with the given username.
+func (a *App) loadProfile(username string) (profileView, error) {
+    var p profileView
+    var bio string
+    err := a.DB.QueryRow(`SELECT u.id, u.username, u.display_name, u.bio, u.role, u.created_at,
+        (SELECT COUNT(*) FROM posts WHERE user_id = u.id),
+        (SELECT COUNT(*) FROM comments WHERE user_id = u.id)
+        FROM users u WHERE u.username = ?`, username).Scan(&p.ID, &p.Username, &p.DisplayName, &bio, &p.Role, &p.JoinedAt, &p.PostCount, &p.CommentCount)
+    if err != nil {
+        return p, err
+    }
+    err = a.DB.QueryRow(`SELECT COALESCE(SUM(l.value), 0) FROM likes l WHERE
+        (l.target_type = 'post' AND l.target_id IN (SELECT id FROM posts WHERE user_id = ?)) OR
+        (l.target_type = 'comment' AND l.target_id IN (SELECT id FROM comments WHERE user_id = ?))`, p.ID, p.ID).Scan(&p.Score)
+    if err != nil {
+        return p, err
+    }
+    p.BioHTML = markdown.Render(bio)
+    p.Avatar = newAvatar(p.Username, p.DisplayName)
+    p.AvatarURL, _ = a.avatarURLs(p.ID)
+    return p, nil
+}
+
+// activityQuery lists a user's posts and comments with their sort key,
+// the Julian day of creation. Posts and comments are numbered apart in
+// seq (even for posts, odd for comments) so that every row has a
+// unique position for the page cursors.
+const activityQuery = `SELECT kind, post_id, title, comment_id, body, key, seq FROM (
+    SELECT 'post' AS kind, p.id AS post_id, p.title AS title, 0 AS comment_id, p.body AS body,
+        julianday(p.created_at) AS key, p.id * 2 AS seq
+    FROM posts p WHERE p.user_id = ?1
+    UNION ALL
+    SELECT 'comment', p.id, p.title, c.id, c.body, julianday(c.created_at), c.id * 2 + 1
+    FROM comments c JOIN posts p ON p.id = c.post_id WHERE c.user_id = ?1
+)`
+
+// userActivity returns one page of user uid's activity. after and
+// before are cursors from a previous page; both empty selects the
+// newest page.
+func (a *App) userActivity(uid int64, after, before string) (activityPage, error) {
+    var page activityPage
+    query := activityQuery + ` ORDER BY key DESC, seq DESC LIMIT ?2`
+    args := []any{uid, activityPerPage + 1}
+    backwards := before != ""
+    if after != "" || before != "" {
+        raw := after
+        if backwards {
+            raw = before
+        }
+        c, err := decodeCursor(raw)
+        if err != nil {
+            return page, errBadCursor
+        }
+        if backwards {
+            query = activityQuery + ` WHERE (key, seq) > (?3, ?4) ORDER BY key ASC, seq ASC LIMIT ?2`
+        } else {
+            query = activityQuery + ` WHERE (key, seq) < (?3, ?4) ORDER BY key DESC, seq DESC LIMIT ?2`
+        }
+        args = append(args, c.Key, c.ID)
+    }
+    rows, err := a.DB.Query(query, args...)
+    if err != nil {
+        return page, err
+    }
+    defer rows.Close()
+    var keys []pageCursor
+    for rows.Next() {
+        var it activityItem
+        var body string
+        var c pageCursor
+        if err := rows.Scan(&it.Kind, &it.PostID, &it.PostTitle, &it.CommentID, &body, &c.Key, &c.ID); err != nil {
+            return page, err
+        }
+        it.Excerpt = markdown.Excerpt(body, activityExcerpt)
+        it.CreatedAt = julianTime(c.Key)
+        page.Items = append(page.Items, it)
+        keys = append(keys, c)
+    }
+    if err := rows.Err(); err != nil {
+        return page, err
+    }
+    more := len(page.Items) > activityPerPage
+    if more {
+        page.Items = page.Items[:activityPerPage]
+        keys = keys[:activityPerPage]
+    }
+    if backwards {
+        for i, j := 0, len(page.Items)-1; i < j; i, j = i+1, j-1 {
+            page.Items[i], page.Items[j] = page.Items[j], page.Items[i]
+            keys[i], keys[j] = keys[j], keys[i]
+        }
+    }
+    if len(page.Items) == 0 {
+        return page, nil
+    }
+    // Going forwards there is a newer page whenever we started from a
+    // cursor and an older one when more rows were found; going
+    // backwards it is the other way round.
+    if (backwards && more) || (!backwards && after != "") {
+        page.Prev = keys[0].encode()
+    }
+    if (!backwards && more) || backwards {
+        page.Next = keys[len(keys)-1].encode()
+    }
+    return page, nil
+}
+
+// julianTime converts a Julian day as returned by SQLite's julianday()
+// back into a time, rounded to the second.
+func julianTime(jd float64) time.Time {
+    return time.Unix(0, int64((jd-2440587.5)*86400*float64(time.Second))).Round(time.Second).UTC()
+}
@@ -7,7 +7,9 @@ package app
 // with an appropriate error message.
 
 import (
+    "log"
     "net/http"
+    "net/url"
 
     "golang.org/x/crypto/bcrypt"
 )
@@ -15,7 +17,9 @@ import (
 // HandleRegister renders the registration form on GET and processes
 // new user registrations on POST. It expects the form fields
 // `email`, `username` and `password`. On successful registration the
-// user is redirected to the login page. On error the form is
+// account starts unverified, a verification link is mailed to the
+// address and the user is redirected to the login page. On error the
+// form is
 // re‑rendered with an error message.
 func (a *App) HandleRegister(w http.ResponseWriter, r *http.Request) {
     switch r.Method {
@@ -27,7 +31,7 @@ func (a *App) HandleRegister(w http.ResponseWriter, r *http.Request) {
         if msg := r.URL.Query().Get("error"); msg != "" {
             data["Error"] = msg
         }
-        tmpl := a.Templates["register.html"]
+        tmpl := a.Templates.Lookup("register.html")
         tmpl.ExecuteTemplate(w, "register.html", data)
     case http.MethodPost:
         // Parse the form values.
@@ -53,7 +57,7 @@ func (a *App) HandleRegister(w http.ResponseWriter, r *http.Request) {
         // statements to avoid injection. The UNIQUE constraints on
         // email and username will cause the Exec call to fail if
         // duplicates exist.
-        _, err = a.DB.Exec(`INSERT INTO users(email, username, password_hash) VALUES(?,?,?)`, email, username, string(hash))
+        res, err := a.DB.Exec(`INSERT INTO users(email, username, password_hash) VALUES(?,?,?)`, email, username, string(hash))
         if err != nil {
             // Determine if the error is due to uniqueness. SQLite
             // returns an error string containing "UNIQUE" for such
@@ -67,8 +71,14 @@ func (a *App) HandleRegister(w http.ResponseWriter, r *http.Request) {
             http.Redirect(w, r, "/register?error="+msg, http.StatusSeeOther)
             return
         }
-        // Registration successful; redirect to login page.
-        http.Redirect(w, r, "/login", http.StatusSeeOther)
+        // Registration successful. Mail the verification link; a
+        // failure here is not fatal since the user can ask for a new
+        // link after logging in.
+        uid, _ := res.LastInsertId()
+        if err := a.sendVerification(uid); err != nil {
+            log.Printf("verification mail for user %d: %v", uid, err)
+        }
+        http.Redirect(w, r, "/login?notice="+url.QueryEscape("Account created. We sent you an email to confirm your address."), http.StatusSeeOther)
     default:
         http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
     }
@@ -0,0 +1,163 @@
+package app
+
+// This file implements the revision history page for posts and
+// comments. Each row in the revisions table holds the content as it
+// was before an edit. Combining those rows with the current content
+// yields the full list of versions, and consecutive versions are
+// compared line by line to show what every edit changed.
+
+import (
+    "database/sql"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// diffLine is a single line of a line-based diff. Op is "+" for an
+// added line, "-" for a removed line and " " for an unchanged line.
+type diffLine struct {
+    Op   string
+    Text string
+}
+
+// revisionChange describes one edit: when it happened and how the
+// title (posts only) and body changed.
+type revisionChange struct {
+    EditedAt  time.Time
+    TitleDiff []diffLine
+    BodyDiff  []diffLine
+}
+
+// contentVersion is one historical version of a post or comment.
+type contentVersion struct {
+    Title string
+    Body  string
+    At    time.Time
+}
+
+// HandleRevisions renders the edit history of a post or comment. It
+// expects the query parameters `type` (post or comment) and `id`.
+// Edits are listed newest first, each shown as a diff against the
+// version it replaced.
+func (a *App) HandleRevisions(w http.ResponseWriter, r *http.Request) {
+    targetType := r.URL.Query().Get("type")
+    if targetType != "post" && targetType != "comment" {
+        http.Error(w, "invalid target type", http.StatusBadRequest)
+        return
+    }
+    id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+    if err != nil || id <= 0 {
+        http.NotFound(w, r)
+        return
+    }
+    // Load the current content. Comments have no title so we select
+    // an empty string in its place, and we remember the post ID so
+    // the page can link back to the thread.
+    var current contentVersion
+    var createdAt time.Time
+    var postID int64
+    if targetType == "post" {
+        err = a.DB.QueryRow(`SELECT id, title, body, created_at FROM posts WHERE id = ?`, id).Scan(&postID, &current.Title, &current.Body, &createdAt)
+    } else {
+        err = a.DB.QueryRow(`SELECT post_id, '', body, created_at FROM comments WHERE id = ?`, id).Scan(&postID, &current.Title, &current.Body, &createdAt)
+    }
+    if err == sql.ErrNoRows {
+        http.NotFound(w, r)
+        return
+    }
+    if err != nil {
+        http.Error(w, "database error", http.StatusInternalServerError)
+        return
+    }
+    rows, err := a.DB.Query(`SELECT COALESCE(title, ''), body, created_at FROM revisions WHERE target_type = ? AND target_id = ? ORDER BY created_at ASC, id ASC`, targetType, id)
+    if err != nil {
+        http.Error(w, "database error", http.StatusInternalServerError)
+        return
+    }
+    defer rows.Close()
+    // A revision row stores the content that existed until the edit
+    // recorded at its created_at. The first version therefore dates
+    // from the original creation and each later version from the
+    // edit that replaced its predecessor.
+    var versions []contentVersion
+    at := createdAt
+    for rows.Next() {
+        var v contentVersion
+        var editedAt time.Time
+        if err := rows.Scan(&v.Title, &v.Body, &editedAt); err != nil {
+            http.Error(w, "database error", http.StatusInternalServerError)
+            return
+        }
+        v.At = at
+        at = editedAt
+        versions = append(versions, v)
+    }
+    current.At = at
+    versions = append(versions, current)
+    var changes []revisionChange
+    for i := len(versions) - 1; i > 0; i-- {
+        prev, next := versions[i-1], versions[i]
+        ch := revisionChange{EditedAt: next.At, BodyDiff: diffLines(prev.Body, next.Body)}
+        if prev.Title != next.Title {
+            ch.TitleDiff = diffLines(prev.Title, next.Title)
+        }
+        changes = append(changes, ch)
+    }
+    data := a.baseData(r)
+    data["TargetType"] = targetType
+    data["PostID"] = postID
+    data["Current"] = current
+    data["Changes"] = changes
+    tmpl := a.Templates.Lookup("revisions.html")
+    tmpl.ExecuteTemplate(w, "revisions.html", data)
+}
+
+// diffLines compares two texts line by line using the longest common
+// subsequence and returns the lines of the new text interleaved with
+// the removed lines of the old one. Post bodies are small enough that
+// the quadratic table is not a concern.
+func diffLines(oldText, newText string) []diffLine {
+    a := strings.Split(strings.ReplaceAll(oldText, "\r\n", "\n"), "\n")
+    b := strings.Split(strings.ReplaceAll(newText, "\r\n", "\n"), "\n")
+    // lcs[i][j] is the length of the longest common subsequence of
+    // a[i:] and b[j:].
+    lcs := make([][]int, len(a)+1)
+    for i := range lcs {
+        lcs[i] = make([]int, len(b)+1)
+    }
+    for i := len(a) - 1; i >= 0; i-- {
+        for j := len(b) - 1; j >= 0; j-- {
+            if a[i] == b[j] {
+                lcs[i][j] = lcs[i+1][j+1] + 1
+            } else if lcs[i+1][j] >= lcs[i][j+1] {
+                lcs[i][j] = lcs[i+1][j]
+            } else {
+                lcs[i][j] = lcs[i][j+1]
+            }
+        }
+    }
+    var out []diffLine
+    i, j := 0, 0
+    for i < len(a) && j < len(b) {
+        switch {
+        case a[i] == b[j]:
+            out = append(out, diffLine{Op: " ", Text: a[i]})
+            i++
+            j++
+        case lcs[i+1][j] >= lcs[i][j+1]:
+            out = append(out, diffLine{Op: "-", Text: a[i]})
+            i++
+        default:
+            out = append(out, diffLine{Op: "+", Text: b[j]})
+            j++
+        }
+    }
+    for ; i < len(a); i++ {
+        out = append(out, diffLine{Op: "-", Text: a[i]})
+    }
+    for ; j < len(b); j++ {
+        out = append(out, diffLine{Op: "+", Text: b[j]})
+    }
+    return out
+}
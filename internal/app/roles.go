@@ -0,0 +1,92 @@
+package app
+
+// This file implements role-based permissions. Every user has one of
+// three roles stored in users.role. Roles are ordered: a moderator can
+// do everything a user can, and an admin everything a moderator can.
+// Moderators may remove any post or comment; admins may also manage
+// users, categories and forum settings.
+
+import "net/http"
+
+// Role names as stored in the users table.
+const (
+    RoleUser      = "user"
+    RoleModerator = "moderator"
+    RoleAdmin     = "admin"
+)
+
+// roleRank orders the roles so that a higher rank includes every
+// permission of the lower ones. Unknown roles rank below RoleUser.
+var roleRank = map[string]int{
+    RoleUser:      1,
+    RoleModerator: 2,
+    RoleAdmin:     3,
+}
+
+// ValidRole reports whether name is one of the known roles.
+func ValidRole(name string) bool {
+    _, ok := roleRank[name]
+    return ok
+}
+
+// hasRole reports whether role grants at least the permissions of
+// min.
+func hasRole(role, min string) bool {
+    return roleRank[role] >= roleRank[min]
+}
+
+// userRole returns the role the given user may act with. Anonymous
+// visitors and unknown users have no role and an empty string is
+// returned. When admins require two-factor authentication for a role
+// (see twofactor.go), users holding that role without 2FA enabled act
+// as regular users until they set it up.
+func (a *App) userRole(uid int64) string {
+    role, enabled := a.storedRole(uid)
+    if role != RoleUser && role != "" && !enabled && a.twoFactorRequired(role) {
+        return RoleUser
+    }
+    return role
+}
+
+// storedRole returns the role recorded for the user, regardless of
+// any 2FA requirement, and whether the user has 2FA enabled.
+func (a *App) storedRole(uid int64) (string, bool) {
+    if uid == 0 {
+        return "", false
+    }
+    var role string
+    var enabled bool
+    if err := a.DB.QueryRow(`SELECT role, totp_enabled_at IS NOT NULL FROM users WHERE id = ?`, uid).Scan(&role, &enabled); err != nil {
+        return "", false
+    }
+    return role, enabled
+}
+
+// CurrentRole returns the role of the logged-in user or an empty
+// string for anonymous visitors.
+func (a *App) CurrentRole(r *http.Request) string {
+    uid, _, ok := a.CurrentUser(r)
+    if !ok {
+        return ""
+    }
+    return a.userRole(uid)
+}
+
+// RequireRole wraps a handler so that it only runs for users holding
+// at least the given role. Anonymous visitors are redirected to the
+// login page like with RequireAuth; logged-in users without the role
+// receive a 403 Forbidden response.
+func (a *App) RequireRole(role string, next http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        uid, _, ok := a.CurrentUser(r)
+        if !ok {
+            http.Redirect(w, r, "/login", http.StatusSeeOther)
+            return
+        }
+        if !hasRole(a.userRole(uid), role) {
+            http.Error(w, "forbidden", http.StatusForbidden)
+            return
+        }
+        next(w, r)
+    }
+}
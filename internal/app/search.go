@@ -0,0 +1,214 @@
+package app
+
+// This file implements full-text search over posts and comments. The
+// posts_fts and comments_fts tables are SQLite FTS5 indexes kept in
+// sync by triggers (see migration 0004_search). Results from both
+// indexes are merged and ordered by their bm25 rank, and each result
+// carries a snippet with the matching words highlighted.
+
+import (
+    "html/template"
+    "net/http"
+    "strings"
+    "time"
+)
+
+// maxSearchResults caps the number of results rendered on one page.
+const maxSearchResults = 50
+
+// Snippet highlight markers. FTS5 inserts these control characters
+// around matching terms, and they are replaced with <mark> tags after
+// the snippet is escaped. Posts and comments are stored without
+// control characters (see stripControl), so the markers can only come
+// from FTS5; highlight still keeps the tags balanced for text written
+// before that was the case.
+const (
+    markStart = "\x02"
+    markEnd   = "\x03"
+)
+
+// searchResult is a single search hit. Kind is "post" or "comment";
+// comment hits link to the post they belong to.
+type searchResult struct {
+    Kind      string
+    PostID    int64
+    PostTitle string
+    Snippet   template.HTML
+    Author    string
+    CreatedAt time.Time
+}
+
+// searchQuery holds the parsed search form.
+type searchQuery struct {
+    Text     string
+    Category string
+    Author   string
+    From     string
+    To       string
+}
+
+// HandleSearch renders the search page. The query parameters are:
+//   q=<words>          – required search terms
+//   category=<name>    – only posts in this category
+//   author=<username>  – only content written by this user
+//   from=YYYY-MM-DD    – only content created on or after this day
+//   to=YYYY-MM-DD      – only content created on or before this day
+// Without `q` the empty search form is shown.
+func (a *App) HandleSearch(w http.ResponseWriter, r *http.Request) {
+    q := searchQuery{
+        Text:     strings.TrimSpace(r.URL.Query().Get("q")),
+        Category: r.URL.Query().Get("category"),
+        Author:   strings.TrimSpace(r.URL.Query().Get("author")),
+        From:     r.URL.Query().Get("from"),
+        To:       r.URL.Query().Get("to"),
+    }
+    // Dates come from <input type="date"> but may be edited by hand;
+    // reject anything that is not a calendar date.
+    for _, d := range []string{q.From, q.To} {
+        if d == "" {
+            continue
+        }
+        if _, err := time.Parse("2006-01-02", d); err != nil {
+            http.Error(w, "invalid date", http.StatusBadRequest)
+            return
+        }
+    }
+    data := a.baseData(r)
+    data["Query"] = q
+    if match := ftsQuery(q.Text); match != "" {
+        results, err := a.search(match, q)
+        if err != nil {
+            http.Error(w, "database error", http.StatusInternalServerError)
+            return
+        }
+        data["Results"] = results
+        data["Searched"] = true
+    }
+    tmpl := a.Templates.Lookup("search.html")
+    tmpl.ExecuteTemplate(w, "search.html", data)
+}
+
+// ftsQuery turns free text typed by a user into a safe FTS5 query.
+// Every word is quoted so that FTS5 operators and punctuation cannot
+// cause syntax errors, and the words are combined with an implicit
+// AND. A trailing `*` on a word is kept as a prefix search.
+func ftsQuery(text string) string {
+    var terms []string
+    for _, word := range strings.Fields(text) {
+        prefix := strings.HasSuffix(word, "*")
+        word = strings.Trim(word, `"*`)
+        word = strings.ReplaceAll(word, `"`, `""`)
+        if word == "" {
+            continue
+        }
+        term := `"` + word + `"`
+        if prefix {
+            term += "*"
+        }
+        terms = append(terms, term)
+    }
+    return strings.Join(terms, " ")
+}
+
+// search runs the FTS query against posts and comments, applies the
+// optional filters and returns the best ranked results.
+func (a *App) search(match string, q searchQuery) ([]searchResult, error) {
+    // The filters apply to both halves of the UNION, so the clause and
+    // its arguments are built once and used twice. In both halves `p`
+    // is the post (or the comment's post), `u` the author and `x` the
+    // row that matched.
+    var where []string
+    var filterArgs []any
+    if q.Category != "" {
+        where = append(where, `EXISTS (SELECT 1 FROM post_categories pc JOIN categories c ON c.id = pc.category_id WHERE pc.post_id = p.id AND c.name = ?)`)
+        filterArgs = append(filterArgs, q.Category)
+    }
+    if q.Author != "" {
+        where = append(where, `u.username = ?`)
+        filterArgs = append(filterArgs, q.Author)
+    }
+    if q.From != "" {
+        where = append(where, `date(x.created_at) >= ?`)
+        filterArgs = append(filterArgs, q.From)
+    }
+    if q.To != "" {
+        where = append(where, `date(x.created_at) <= ?`)
+        filterArgs = append(filterArgs, q.To)
+    }
+    filters := ""
+    if len(where) > 0 {
+        filters = " AND " + strings.Join(where, " AND ")
+    }
+    // Titles weigh more than bodies when ranking posts. bm25 returns
+    // lower values for better matches, hence the ascending order.
+    query := `SELECT 'post', p.id, p.title,
+            snippet(posts_fts, -1, char(2), char(3), '…', 16),
+            u.username, x.created_at, bm25(posts_fts, 5.0, 1.0) AS rank
+        FROM posts_fts
+        JOIN posts x ON x.id = posts_fts.rowid
+        JOIN posts p ON p.id = x.id
+        JOIN users u ON u.id = x.user_id
+        WHERE posts_fts MATCH ?` + filters + `
+    UNION ALL
+    SELECT 'comment', p.id, p.title,
+            snippet(comments_fts, 0, char(2), char(3), '…', 16),
+            u.username, x.created_at, bm25(comments_fts) AS rank
+        FROM comments_fts
+        JOIN comments x ON x.id = comments_fts.rowid
+        JOIN posts p ON p.id = x.post_id
+        JOIN users u ON u.id = x.user_id
+        WHERE comments_fts MATCH ?` + filters + `
+    ORDER BY rank
+    LIMIT ?`
+    args := append([]any{match}, filterArgs...)
+    args = append(args, match)
+    args = append(args, filterArgs...)
+    args = append(args, maxSearchResults)
+    rows, err := a.DB.Query(query, args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    var results []searchResult
+    for rows.Next() {
+        var res searchResult
+        var snippet string
+        var rank float64
+        if err := rows.Scan(&res.Kind, &res.PostID, &res.PostTitle, &snippet, &res.Author, &res.CreatedAt, &rank); err != nil {
+            return nil, err
+        }
+        res.Snippet = highlight(snippet)
+        results = append(results, res)
+    }
+    return results, rows.Err()
+}
+
+// highlight escapes a snippet produced by FTS5 and converts the
+// highlight markers into <mark> elements. Markers that would nest or
+// close nothing are dropped, and a mark still open at the end is
+// closed.
+func highlight(snippet string) template.HTML {
+    escaped := template.HTMLEscapeString(snippet)
+    var b strings.Builder
+    open := false
+    for i := 0; i < len(escaped); i++ {
+        switch c := escaped[i]; {
+        case c == markStart[0]:
+            if !open {
+                b.WriteString("<mark>")
+                open = true
+            }
+        case c == markEnd[0]:
+            if open {
+                b.WriteString("</mark>")
+                open = false
+            }
+        default:
+            b.WriteByte(c)
+        }
+    }
+    if open {
+        b.WriteString("</mark>")
+    }
+    return template.HTML(b.String())
+}
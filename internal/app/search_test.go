@@ -0,0 +1,54 @@
+package app
+
+// Tests of search snippets: the highlight markers FTS5 inserts become
+// balanced <mark> tags, and text cannot smuggle in markers of its own.
+
+import (
+    "strings"
+    "testing"
+)
+
+func TestHighlight(t *testing.T) {
+    tests := []struct {
+        in, want string
+    }{
+        {"a \x02match\x03 b", "a <mark>match</mark> b"},
+        {"<b>\x02x\x03</b>", "&lt;b&gt;<mark>x</mark>&lt;/b&gt;"},
+        // Stray markers, as in text stored before they were stripped.
+        {"\x03a \x02\x02b\x03\x03", "a <mark>b</mark>"},
+        {"a \x02b", "a <mark>b</mark>"},
+    }
+    for _, tt := range tests {
+        if got := string(highlight(tt.in)); got != tt.want {
+            t.Errorf("highlight(%q) = %q, want %q", tt.in, got, tt.want)
+        }
+    }
+}
+
+func TestSearchStripsMarkers(t *testing.T) {
+    a := newTestApp(t)
+    alice := createTestUser(t, a, "alice")
+    pid, err := a.createPost(alice, "Hello\x02", "needle \x03\x02haystack\x01\ttab", []string{"Help"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := a.createComment(alice, pid, 0, "\x03needle\x02"); err != nil {
+        t.Fatal(err)
+    }
+    if n := count(t, a, `SELECT COUNT(*) FROM posts WHERE title = 'Hello' AND body = 'needle haystack'||char(9)||'tab'`); n != 1 {
+        t.Fatal("control characters were stored")
+    }
+    results, err := a.search(ftsQuery("needle"), searchQuery{Text: "needle"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(results) != 2 {
+        t.Fatalf("%d results, want 2", len(results))
+    }
+    for _, res := range results {
+        s := string(res.Snippet)
+        if strings.Count(s, "<mark>") != 1 || strings.Count(s, "</mark>") != 1 || !strings.Contains(s, "<mark>needle</mark>") {
+            t.Errorf("%s snippet %q", res.Kind, s)
+        }
+    }
+}
@@ -3,10 +3,11 @@ package app
 // This file implements session management for the forum. Sessions are
 // stored in the database so that they persist across restarts and to
 // allow revocation. Each session has a UUID identifier, the ID of
-// the associated user and an expiry timestamp. A unique constraint
-// on user_id ensures that a user may only have a single active
-// session at a time. The session cookie is HTTP‑only and scoped to
-// the root path.
+// the associated user and an expiry timestamp. A user may be logged in
+// from several browsers at once; every session remembers the user
+// agent and IP address it was created from and when it was last used,
+// so that users can review and revoke them at /account/sessions. The
+// session cookie is HTTP‑only and scoped to the root path.
 
 import (
     "net/http"
@@ -15,24 +16,39 @@ import (
     "github.com/google/uuid"
 )
 
+// sessionSeenInterval is how often the last-seen time and IP of a
+// session are refreshed while it is in use.
+const sessionSeenInterval = time.Minute
+
+// maxUserAgent caps the length of stored user agent strings.
+const maxUserAgent = 512
+
 // SetSession creates a new session for the provided user ID and
-// writes the session cookie to the response. Any existing session
-// for the user is replaced. The expiration of the session is
+// writes the session cookie to the response. Sessions the user has in
+// other browsers stay valid. The user agent and client IP of r are
+// recorded with the session. A session cookie replaced by this login
+// in the same browser is removed. The expiration of the session is
 // determined by App.SessionTTL. A zero TTL will create a session
 // cookie without an expiry, which becomes a session cookie in the
 // browser.
-func (a *App) SetSession(w http.ResponseWriter, userID int64) error {
+func (a *App) SetSession(w http.ResponseWriter, r *http.Request, userID int64) error {
     // Generate a new unique session ID. uuid.New() never returns an
     // error so we can call String() directly.
     sid := uuid.New().String()
     // Determine the expiry. Use Unix timestamps for easy storage.
     expires := time.Now().Add(a.SessionTTL)
-    // Remove any existing session for this user so that they have
-    // only one active session at a time.
-    _, _ = a.DB.Exec(`DELETE FROM sessions WHERE user_id = ?`, userID)
-    // Insert the new session. Use INSERT OR REPLACE to handle
-    // existing rows gracefully.
-    _, err := a.DB.Exec(`INSERT INTO sessions(id, user_id, expires_at) VALUES(?,?,?)`, sid, userID, expires.Unix())
+    // A browser holds one session cookie, so a session it was still
+    // carrying is dropped rather than left behind unreachable.
+    if c, err := r.Cookie(a.CookieName); err == nil {
+        _, _ = a.DB.Exec(`DELETE FROM sessions WHERE id = ?`, c.Value)
+    }
+    ua := r.UserAgent()
+    if len(ua) > maxUserAgent {
+        ua = ua[:maxUserAgent]
+    }
+    now := time.Now().UTC()
+    _, err := a.DB.Exec(`INSERT INTO sessions(id, user_id, expires_at, created_at, last_seen_at, user_agent, ip) VALUES(?,?,?,?,?,?,?)`,
+        sid, userID, expires.Unix(), now, now, ua, a.ClientIP(r))
     if err != nil {
         return err
     }
@@ -72,27 +88,39 @@ func (a *App) ClearSession(w http.ResponseWriter, r *http.Request) {
 // CurrentUser returns the ID and username of the logged‑in user along
 // with a boolean indicating whether a valid session exists. If no
 // session cookie is present or the session has expired the boolean
-// will be false. Expired sessions are removed automatically.
+// will be false. Expired sessions are removed automatically. Requests
+// with an `Authorization: Bearer` header are authenticated by API
+// token instead.
 func (a *App) CurrentUser(r *http.Request) (int64, string, bool) {
+    // API clients may authenticate with a bearer token instead of the
+    // cookie. A request carrying a token is judged on the token alone.
+    if token, ok := bearerToken(r); ok {
+        return a.tokenUser(token)
+    }
     c, err := r.Cookie(a.CookieName)
     if err != nil {
         return 0, "", false
     }
     var userID int64
-    var expiresUnix int64
+    var expires time.Time
     var username string
     // Join the sessions and users table to fetch the username in a
-    // single query.
+    // single query. expires_at is declared as DATETIME, so the driver
+    // converts the stored Unix timestamp into a time.Time for us.
     row := a.DB.QueryRow(`SELECT s.user_id, s.expires_at, u.username FROM sessions s JOIN users u ON s.user_id = u.id WHERE s.id = ?`, c.Value)
-    if err := row.Scan(&userID, &expiresUnix, &username); err != nil {
+    if err := row.Scan(&userID, &expires, &username); err != nil {
         return 0, "", false
     }
-    expires := time.Unix(expiresUnix, 0)
     if time.Now().After(expires) {
         // Session has expired. Remove it and indicate no user.
         _, _ = a.DB.Exec(`DELETE FROM sessions WHERE id = ?`, c.Value)
         return 0, "", false
     }
+    // Record the activity. The condition limits the writes to one
+    // per sessionSeenInterval instead of one per request.
+    now := time.Now().UTC()
+    _, _ = a.DB.Exec(`UPDATE sessions SET last_seen_at = ?, ip = ? WHERE id = ? AND (last_seen_at IS NULL OR last_seen_at < ?)`,
+        now, a.ClientIP(r), c.Value, now.Add(-sessionSeenInterval))
     return userID, username, true
 }
 
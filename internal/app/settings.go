@@ -0,0 +1,72 @@
+package app
+
+// This file stores forum-wide settings that admins change at runtime
+// from /admin/settings. Settings live in the settings table as
+// key/value text pairs; a missing key means the built-in default.
+
+import (
+    "net/http"
+    "net/url"
+)
+
+// Setting keys.
+const (
+    // settingRequire2FA names the lowest role that must use two-factor
+    // authentication, or is empty when 2FA is optional for everyone.
+    settingRequire2FA = "require_2fa_role"
+)
+
+// setting returns the value stored under key, or def when the key is
+// not set or cannot be read.
+func (a *App) setting(key, def string) string {
+    var v string
+    if err := a.DB.QueryRow(`SELECT value FROM settings WHERE key = ?`, key).Scan(&v); err != nil {
+        return def
+    }
+    return v
+}
+
+// setSetting stores value under key, replacing any previous value.
+func (a *App) setSetting(key, value string) error {
+    _, err := a.DB.Exec(`INSERT INTO settings(key, value) VALUES(?,?) ON CONFLICT(key) DO UPDATE SET value = excluded.value`, key, value)
+    return err
+}
+
+// HandleAdminSettings shows the forum settings on GET and saves them
+// on POST. The only setting so far is `require_2fa`, which is empty,
+// "moderator" (moderators and admins) or "admin". An admin can only
+// turn the requirement on after enabling 2FA for their own account,
+// since they would otherwise lose their admin rights on the spot.
+func (a *App) HandleAdminSettings(w http.ResponseWriter, r *http.Request) {
+    switch r.Method {
+    case http.MethodGet:
+        data := a.baseData(r)
+        data["Require2FA"] = a.setting(settingRequire2FA, "")
+        if msg := r.URL.Query().Get("error"); msg != "" {
+            data["Error"] = msg
+        }
+        if r.URL.Query().Get("saved") == "1" {
+            data["Notice"] = "Settings saved."
+        }
+        tmpl := a.Templates.Lookup("admin_settings.html")
+        tmpl.ExecuteTemplate(w, "admin_settings.html", data)
+    case http.MethodPost:
+        uid, _, _ := a.CurrentUser(r)
+        req := r.FormValue("require_2fa")
+        if req != "" && req != RoleModerator && req != RoleAdmin {
+            http.Error(w, "invalid role", http.StatusBadRequest)
+            return
+        }
+        if req != "" && !a.twoFactorEnabled(uid) {
+            http.Redirect(w, r, "/admin/settings?error="+url.QueryEscape("Enable two-factor authentication for your own account before requiring it."), http.StatusSeeOther)
+            return
+        }
+        if err := a.setSetting(settingRequire2FA, req); err != nil {
+            http.Error(w, "database error", http.StatusInternalServerError)
+            return
+        }
+        http.Redirect(w, r, "/admin/settings?saved=1", http.StatusSeeOther)
+    default:
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    }
+}
@@ -3,44 +3,64 @@ package app
 // This file defines the handler for displaying a single post and its
 // associated comments. It gathers all necessary data such as the
 // author, categories, like/dislike counts and the current user's
-// reaction. Comments are ordered by creation time.
+// reaction. Comments are ordered by creation time. Bodies are stored
+// as Markdown and rendered to sanitised HTML for display.
 
 import (
     "database/sql"
+    "html/template"
     "net/http"
     "strconv"
     "time"
+
+    "forum/internal/markdown"
 )
 
-// commentView holds the data needed to render a comment.
+// commentView holds the data needed to render a comment. The JSON
+// tags define how the struct is exposed by the API. Body is the
+// Markdown source and BodyHTML its rendered, sanitised form.
 type commentView struct {
-    ID           int64
-    Body         string
-    Author       string
-    CreatedAt    time.Time
-    LikeCount    int
-    DislikeCount int
-    MyReaction   int
+    ID           int64         `json:"id"`
+    Body         string        `json:"body"`
+    BodyHTML     template.HTML `json:"body_html"`
+    // ParentID is the comment this one replies to; it is nil for
+    // top-level comments.
+    ParentID     *int64    `json:"parent_id,omitempty"`
+    AuthorID     int64     `json:"author_id"`
+    Author       string    `json:"author"`
+    CreatedAt    time.Time `json:"created_at"`
+    // UpdatedAt is set when the comment has been edited.
+    UpdatedAt    *time.Time `json:"updated_at,omitempty"`
+    LikeCount    int        `json:"like_count"`
+    DislikeCount int        `json:"dislike_count"`
+    MyReaction   int        `json:"my_reaction"`
 }
 
 // postView holds the data needed to render a post along with its
-// comments.
+// comments. As with commentView, Body holds the Markdown source and
+// BodyHTML the HTML shown on the page.
 type postView struct {
-    ID           int64
-    Title        string
-    Body         string
-    Author       string
-    Categories   string
-    CreatedAt    time.Time
-    LikeCount    int
-    DislikeCount int
-    MyReaction   int
-    Comments     []commentView
+    ID           int64         `json:"id"`
+    Title        string        `json:"title"`
+    Body         string        `json:"body"`
+    BodyHTML     template.HTML `json:"body_html"`
+    AuthorID     int64     `json:"author_id"`
+    Author       string    `json:"author"`
+    Categories   string    `json:"categories"`
+    CreatedAt    time.Time `json:"created_at"`
+    // UpdatedAt is set when the post has been edited.
+    UpdatedAt    *time.Time    `json:"updated_at,omitempty"`
+    LikeCount    int           `json:"like_count"`
+    DislikeCount int           `json:"dislike_count"`
+    MyReaction   int           `json:"my_reaction"`
+    Comments     []commentView `json:"comments"`
 }
 
 // HandleShowPost renders a single post page. If the post ID is
 // missing or invalid a 404 page is shown. The page includes the
-// post itself and its comments.
+// post itself and its comments arranged in reply threads. With a
+// `thread` parameter only the branch starting at that comment is
+// shown, which is where "continue this thread" links lead.
 func (a *App) HandleShowPost(w http.ResponseWriter, r *http.Request) {
     idStr := r.URL.Query().Get("id")
     pid, err := strconv.ParseInt(idStr, 10, 64)
@@ -50,13 +70,68 @@ func (a *App) HandleShowPost(w http.ResponseWriter, r *http.Request) {
     }
     // Determine current user ID for personalised data.
     uid, _, _ := a.CurrentUser(r)
+    p, err := a.loadPost(pid, uid)
+    if err == sql.ErrNoRows {
+        http.NotFound(w, r)
+        return
+    }
+    if err != nil {
+        http.Error(w, "database error", http.StatusInternalServerError)
+        return
+    }
+    data := a.baseData(r)
+    var root int64
+    if v := r.URL.Query().Get("thread"); v != "" {
+        root, err = strconv.ParseInt(v, 10, 64)
+        if err != nil || root <= 0 {
+            http.NotFound(w, r)
+            return
+        }
+    }
+    page := &threadPage{
+        PostID:      p.ID,
+        LoggedIn:    data["LoggedIn"].(bool),
+        UserID:      uid,
+        IsModerator: data["IsModerator"].(bool),
+        CSRFToken:   CSRFToken(r),
+    }
+    thread := buildThread(p.Comments, root, a.maxCommentDepth(), page)
+    if root != 0 {
+        if thread == nil {
+            http.NotFound(w, r)
+            return
+        }
+        data["ThreadRoot"] = thread[0].Comment
+    }
+    // The live update script asks for the comments after the newest
+    // one on the page.
+    var last int64
+    for _, c := range p.Comments {
+        if c.ID > last {
+            last = c.ID
+        }
+    }
+    data["Post"] = p
+    data["Thread"] = thread
+    data["Live"] = a.Live != nil
+    data["LastCommentID"] = last
+    data["MaxDepth"] = a.maxCommentDepth()
+    tmpl := a.Templates.Lookup("post_show.html")
+    tmpl.ExecuteTemplate(w, "post_show.html", data)
+}
+
+// loadPost fetches a post with its metadata and comments as seen by
+// user uid (zero when anonymous). It returns sql.ErrNoRows when the
+// post does not exist. It is shared by the HTML page and the API.
+func (a *App) loadPost(pid, uid int64) (postView, error) {
     // Query the post and its metadata.
     var p postView
     var cats sql.NullString
     var myReact sql.NullInt64
+    var updated sql.NullTime
     row := a.DB.QueryRow(`SELECT
-        p.id, p.title, p.body, p.created_at,
-        u.username,
+        p.id, p.title, p.body, p.created_at, p.updated_at,
+        u.id, u.username,
         GROUP_CONCAT(c.name),
         (SELECT COUNT(*) FROM likes WHERE target_type='post' AND target_id=p.id AND value=1) as like_count,
         (SELECT COUNT(*) FROM likes WHERE target_type='post' AND target_id=p.id AND value=-1) as dislike_count,
@@ -67,49 +142,61 @@ func (a *App) HandleShowPost(w http.ResponseWriter, r *http.Request) {
     LEFT JOIN categories c ON pc.category_id = c.id
     WHERE p.id = ?
     GROUP BY p.id`, uid, pid)
-    if err := row.Scan(&p.ID, &p.Title, &p.Body, &p.CreatedAt, &p.Author, &cats, &p.LikeCount, &p.DislikeCount, &myReact); err != nil {
-        if err == sql.ErrNoRows {
-            http.NotFound(w, r)
-            return
-        }
-        http.Error(w, "database error", http.StatusInternalServerError)
-        return
+    if err := row.Scan(&p.ID, &p.Title, &p.Body, &p.CreatedAt, &updated, &p.AuthorID, &p.Author, &cats, &p.LikeCount, &p.DislikeCount, &myReact); err != nil {
+        return p, err
     }
+    p.BodyHTML = markdown.Render(p.Body)
     if cats.Valid {
         p.Categories = cats.String
     }
     if myReact.Valid {
         p.MyReaction = int(myReact.Int64)
     }
-    // Query comments for this post.
+    if updated.Valid {
+        p.UpdatedAt = &updated.Time
+    }
+    comments, err := a.loadComments(pid, uid, 0)
+    p.Comments = comments
+    return p, err
+}
+
+// loadComments fetches the comments of post pid with IDs above after,
+// oldest first, as seen by user uid. loadPost passes zero for all of
+// them; live streams ask only for those they have not sent yet.
+func (a *App) loadComments(pid, uid, after int64) ([]commentView, error) {
     rows, err := a.DB.Query(`SELECT
-        cm.id, cm.body, cm.created_at, u.username,
+        cm.id, cm.parent_id, cm.body, cm.created_at, cm.updated_at, u.id, u.username,
         (SELECT COUNT(*) FROM likes WHERE target_type='comment' AND target_id=cm.id AND value=1) as like_count,
         (SELECT COUNT(*) FROM likes WHERE target_type='comment' AND target_id=cm.id AND value=-1) as dislike_count,
         COALESCE((SELECT value FROM likes WHERE target_type='comment' AND target_id=cm.id AND user_id=?), 0)
     FROM comments cm
     JOIN users u ON cm.user_id = u.id
-    WHERE cm.post_id = ?
-    ORDER BY cm.created_at ASC`, uid, pid)
+    WHERE cm.post_id = ? AND cm.id > ?
+    ORDER BY cm.created_at ASC, cm.id ASC`, uid, pid, after)
     if err != nil {
-        http.Error(w, "database error", http.StatusInternalServerError)
-        return
+        return nil, err
     }
     defer rows.Close()
+    var comments []commentView
     for rows.Next() {
         var cmt commentView
         var mycReact sql.NullInt64
-        if err := rows.Scan(&cmt.ID, &cmt.Body, &cmt.CreatedAt, &cmt.Author, &cmt.LikeCount, &cmt.DislikeCount, &mycReact); err != nil {
-            http.Error(w, "database error", http.StatusInternalServerError)
-            return
+        var cUpdated sql.NullTime
+        var parent sql.NullInt64
+        if err := rows.Scan(&cmt.ID, &parent, &cmt.Body, &cmt.CreatedAt, &cUpdated, &cmt.AuthorID, &cmt.Author, &cmt.LikeCount, &cmt.DislikeCount, &mycReact); err != nil {
+            return nil, err
+        }
+        cmt.BodyHTML = markdown.Render(cmt.Body)
+        if parent.Valid {
+            cmt.ParentID = &parent.Int64
         }
         if mycReact.Valid {
             cmt.MyReaction = int(mycReact.Int64)
         }
-        p.Comments = append(p.Comments, cmt)
+        if cUpdated.Valid {
+            cmt.UpdatedAt = &cUpdated.Time
+        }
+        comments = append(comments, cmt)
     }
-    data := a.baseData(r)
-    data["Post"] = p
-    tmpl := a.Templates["post_show.html"]
-    tmpl.ExecuteTemplate(w, "post_show.html", data)
-}
\ No newline at end of file
+    return comments, rows.Err()
+}
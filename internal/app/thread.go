@@ -0,0 +1,127 @@
+package app
+
+// This file arranges the comments of a post into reply threads. The
+// comments are loaded as a flat list (see loadPost) and linked into a
+// tree here. Only MaxCommentDepth levels are rendered on the post
+// page; deeper replies are reached through a "continue this thread"
+// link that shows the branch on its own, starting from the comment
+// where the post page stopped.
+
+import (
+    "database/sql"
+    "strconv"
+)
+
+// defaultCommentDepth is used when App.MaxCommentDepth is not set.
+const defaultCommentDepth = 5
+
+// commentThread is one comment together with the replies shown below
+// it. Hidden counts the replies that lie beyond the depth limit and
+// are therefore left to the thread view. Page carries the page-wide
+// values the recursive comment template needs, since a nested template
+// only sees the node it is given.
+type commentThread struct {
+    Comment commentView
+    Replies []*commentThread
+    Depth   int
+    Hidden  int
+    Page    *threadPage
+}
+
+// threadPage holds the values shared by every node of a thread.
+type threadPage struct {
+    PostID      int64
+    LoggedIn    bool
+    UserID      int64
+    IsModerator bool
+    CSRFToken   string
+}
+
+// maxCommentDepth returns the number of reply levels rendered on one
+// page.
+func (a *App) maxCommentDepth() int {
+    if a.MaxCommentDepth > 0 {
+        return a.MaxCommentDepth
+    }
+    return defaultCommentDepth
+}
+
+// buildThread links comments into reply trees. With root zero the
+// result holds the top-level comments; otherwise it holds just the
+// comment with that ID and the branch below it, or nil when no such
+// comment exists. Comments keep the order of the input slice among
+// their siblings. At most maxDepth levels are built.
+func buildThread(comments []commentView, root int64, maxDepth int, page *threadPage) []*commentThread {
+    known := make(map[int64]bool, len(comments))
+    for _, c := range comments {
+        known[c.ID] = true
+    }
+    children := make(map[int64][]commentView)
+    var tops []commentView
+    for _, c := range comments {
+        switch {
+        case c.ID == root:
+            tops = append(tops, c)
+        case c.ParentID != nil && known[*c.ParentID]:
+            children[*c.ParentID] = append(children[*c.ParentID], c)
+        case root == 0:
+            // Top-level comments, and replies whose parent is gone,
+            // start their own thread.
+            tops = append(tops, c)
+        }
+    }
+    var count func(id int64) int
+    count = func(id int64) int {
+        n := 0
+        for _, c := range children[id] {
+            n += 1 + count(c.ID)
+        }
+        return n
+    }
+    var build func(c commentView, depth int) *commentThread
+    build = func(c commentView, depth int) *commentThread {
+        node := &commentThread{Comment: c, Depth: depth, Page: page}
+        if depth+1 >= maxDepth {
+            node.Hidden = count(c.ID)
+            return node
+        }
+        for _, child := range children[c.ID] {
+            node.Replies = append(node.Replies, build(child, depth+1))
+        }
+        return node
+    }
+    var out []*commentThread
+    for _, c := range tops {
+        out = append(out, build(c, 0))
+    }
+    return out
+}
+
+// commentDepth returns how many ancestors a comment has; top-level
+// comments have depth zero.
+func (a *App) commentDepth(cid int64) (int, error) {
+    var depth int
+    err := a.DB.QueryRow(`WITH RECURSIVE ancestors(id, parent_id) AS (
+        SELECT id, parent_id FROM comments WHERE id = ?
+        UNION ALL
+        SELECT c.id, c.parent_id FROM comments c JOIN ancestors a ON c.id = a.parent_id
+    ) SELECT COUNT(*) - 1 FROM ancestors`, cid).Scan(&depth)
+    if err == nil && depth < 0 {
+        err = sql.ErrNoRows
+    }
+    return depth, err
+}
+
+// commentURL returns the path that shows comment cid of post postID:
+// the post page, or the thread view of its parent when the comment is
+// nested deeper than the post page shows.
+func (a *App) commentURL(postID, cid int64) string {
+    target := "/post?id=" + strconv.FormatInt(postID, 10)
+    var parent sql.NullInt64
+    if err := a.DB.QueryRow(`SELECT parent_id FROM comments WHERE id = ?`, cid).Scan(&parent); err == nil && parent.Valid {
+        if depth, err := a.commentDepth(cid); err == nil && depth >= a.maxCommentDepth() {
+            target += "&thread=" + strconv.FormatInt(parent.Int64, 10)
+        }
+    }
+    return target + "#c" + strconv.FormatInt(cid, 10)
+}
@@ -0,0 +1,31 @@
+package app
+
+// This file contains helpers for the random secrets handed out to
+// users, such as API tokens. Tokens are shown to their owner once and
+// only a hash is stored, in the same spirit as password hashes.
+
+import (
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/hex"
+)
+
+// newToken returns a random URL-safe token carrying 256 bits of
+// entropy. The error is only non-nil if the system's secure random
+// source fails.
+func newToken() (string, error) {
+    b := make([]byte, 32)
+    if _, err := rand.Read(b); err != nil {
+        return "", err
+    }
+    return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken returns the hex encoded SHA-256 hash of a token. Tokens
+// are long and random so a fast hash is sufficient; unlike passwords
+// they cannot be guessed from a dictionary.
+func hashToken(token string) string {
+    sum := sha256.Sum256([]byte(token))
+    return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,518 @@
+package app
+
+// This file implements two-factor authentication with time-based
+// one-time passwords (see internal/totp). Users enroll at /account/2fa
+// by adding the shown otpauth URI to an authenticator app and entering
+// a first code, after which they receive one-time recovery codes.
+//
+// Logging in then takes two steps. When the password is correct,
+// HandleLogin does not create a session but starts a login challenge:
+// a short-lived random token in the forum_2fa cookie, stored hashed in
+// login_challenges. HandleLogin2FA asks for a code and only calls
+// SetSession once the code or a recovery code is accepted.
+//
+// Admins can require 2FA for moderators and admins. Privileged users
+// who have not enrolled keep their role in the database but act as
+// regular users (see userRole) until they do.
+
+import (
+    "crypto/rand"
+    "database/sql"
+    "html/template"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "time"
+
+    "forum/internal/totp"
+
+    "golang.org/x/crypto/bcrypt"
+)
+
+const (
+    // challengeCookie holds the login challenge between the password
+    // and the code step.
+    challengeCookie = "forum_2fa"
+    // challengeTTL is how long the code step may take.
+    challengeTTL = 5 * time.Minute
+    // maxChallengeAttempts is the number of wrong codes after which
+    // the user has to start over with the password.
+    maxChallengeAttempts = 5
+    // recoveryCodeCount is the number of recovery codes handed out at
+    // once.
+    recoveryCodeCount = 10
+    // totpIssuer names the forum in authenticator apps.
+    totpIssuer = "Forum"
+)
+
+// twoFactorEnabled reports whether the user has completed 2FA
+// enrollment.
+func (a *App) twoFactorEnabled(uid int64) bool {
+    _, enabled := a.storedRole(uid)
+    return enabled
+}
+
+// twoFactorRequired reports whether admins require 2FA for role.
+func (a *App) twoFactorRequired(role string) bool {
+    min := a.setting(settingRequire2FA, "")
+    return min != "" && hasRole(role, min)
+}
+
+// needsTwoFactor reports whether the user holds a role that requires
+// 2FA without having enabled it. Such users are shown a reminder.
+func (a *App) needsTwoFactor(uid int64) bool {
+    role, enabled := a.storedRole(uid)
+    return role != "" && !enabled && a.twoFactorRequired(role)
+}
+
+// checkSecondFactor accepts either a current TOTP code or an unused
+// recovery code for uid. TOTP codes are bound to their time step so
+// that each can only be used once; recovery codes are marked used.
+// usedRecovery reports which kind was accepted.
+func (a *App) checkSecondFactor(uid int64, code string) (ok, usedRecovery bool, err error) {
+    code = strings.TrimSpace(code)
+    if code == "" {
+        return false, false, nil
+    }
+    if isDigits(strings.ReplaceAll(code, " ", "")) {
+        var secret sql.NullString
+        var last int64
+        err := a.DB.QueryRow(`SELECT totp_secret, totp_last_step FROM users WHERE id = ? AND totp_enabled_at IS NOT NULL`, uid).Scan(&secret, &last)
+        if err == sql.ErrNoRows || (err == nil && !secret.Valid) {
+            return false, false, nil
+        }
+        if err != nil {
+            return false, false, err
+        }
+        step, ok := totp.Validate(secret.String, code, time.Now(), last)
+        if !ok {
+            return false, false, nil
+        }
+        // The condition on the last step makes concurrent logins with
+        // the same code race safely: only one of them updates the row.
+        res, err := a.DB.Exec(`UPDATE users SET totp_last_step = ? WHERE id = ? AND totp_last_step < ?`, step, uid, step)
+        if err != nil {
+            return false, false, err
+        }
+        n, _ := res.RowsAffected()
+        return n == 1, false, nil
+    }
+    res, err := a.DB.Exec(`UPDATE recovery_codes SET used_at = ? WHERE user_id = ? AND code_hash = ? AND used_at IS NULL`,
+        time.Now().UTC(), uid, hashToken(normalizeRecoveryCode(code)))
+    if err != nil {
+        return false, false, err
+    }
+    n, _ := res.RowsAffected()
+    return n > 0, n > 0, nil
+}
+
+// isDigits reports whether s is a non-empty string of ASCII digits.
+func isDigits(s string) bool {
+    for _, c := range s {
+        if c < '0' || c > '9' {
+            return false
+        }
+    }
+    return s != ""
+}
+
+// recoveryAlphabet avoids characters that are easily confused when
+// copied by hand, such as 0/O and 1/I.
+const recoveryAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// newRecoveryCode returns a random code formatted as XXXXX-XXXXX,
+// carrying 50 bits of entropy.
+func newRecoveryCode() (string, error) {
+    b := make([]byte, 10)
+    if _, err := rand.Read(b); err != nil {
+        return "", err
+    }
+    var sb strings.Builder
+    for i, v := range b {
+        if i == 5 {
+            sb.WriteByte('-')
+        }
+        sb.WriteByte(recoveryAlphabet[int(v)%len(recoveryAlphabet)])
+    }
+    return sb.String(), nil
+}
+
+// normalizeRecoveryCode makes the comparison of recovery codes
+// forgiving about case, spaces and the dash.
+func normalizeRecoveryCode(code string) string {
+    code = strings.ToUpper(code)
+    return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+// replaceRecoveryCodes discards the user's recovery codes and stores a
+// fresh set, returning the codes in plain text so they can be shown
+// once. Like API tokens the codes are random, so a SHA-256 hash is
+// enough to protect them.
+func (a *App) replaceRecoveryCodes(tx *sql.Tx, uid int64) ([]string, error) {
+    if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE user_id = ?`, uid); err != nil {
+        return nil, err
+    }
+    codes := make([]string, 0, recoveryCodeCount)
+    for i := 0; i < recoveryCodeCount; i++ {
+        code, err := newRecoveryCode()
+        if err != nil {
+            return nil, err
+        }
+        if _, err := tx.Exec(`INSERT INTO recovery_codes(user_id, code_hash) VALUES(?,?)`, uid, hashToken(normalizeRecoveryCode(code))); err != nil {
+            return nil, err
+        }
+        codes = append(codes, code)
+    }
+    return codes, nil
+}
+
+// startChallenge begins the second login step for uid and sets the
+// challenge cookie.
+func (a *App) startChallenge(w http.ResponseWriter, uid int64) error {
+    token, err := newToken()
+    if err != nil {
+        return err
+    }
+    expires := time.Now().Add(challengeTTL)
+    if _, err := a.DB.Exec(`INSERT INTO login_challenges(token_hash, user_id, expires_at) VALUES(?,?,?)`, hashToken(token), uid, expires.UTC()); err != nil {
+        return err
+    }
+    http.SetCookie(w, &http.Cookie{
+        Name:     challengeCookie,
+        Value:    token,
+        Path:     "/login",
+        Expires:  expires,
+        HttpOnly: true,
+        SameSite: http.SameSiteLaxMode,
+    })
+    return nil
+}
+
+// challengeUser returns the user of the request's login challenge, or
+// false when there is no valid challenge.
+func (a *App) challengeUser(r *http.Request) (int64, bool) {
+    c, err := r.Cookie(challengeCookie)
+    if err != nil {
+        return 0, false
+    }
+    var uid int64
+    var expires time.Time
+    err = a.DB.QueryRow(`SELECT user_id, expires_at FROM login_challenges WHERE token_hash = ?`, hashToken(c.Value)).Scan(&uid, &expires)
+    if err != nil || time.Now().After(expires) {
+        return 0, false
+    }
+    return uid, true
+}
+
+// endChallenge removes the request's login challenge and its cookie.
+func (a *App) endChallenge(w http.ResponseWriter, r *http.Request) {
+    if c, err := r.Cookie(challengeCookie); err == nil {
+        _, _ = a.DB.Exec(`DELETE FROM login_challenges WHERE token_hash = ?`, hashToken(c.Value))
+    }
+    http.SetCookie(w, &http.Cookie{
+        Name:     challengeCookie,
+        Value:    "",
+        Path:     "/login",
+        MaxAge:   -1,
+        HttpOnly: true,
+        SameSite: http.SameSiteLaxMode,
+    })
+}
+
+// HandleLogin2FA is the second login step. GET shows the code form;
+// POST checks the `code` field, which may hold a TOTP code or a
+// recovery code. On success the session is created. After
+// maxChallengeAttempts wrong codes the challenge is dropped and the
+// user has to enter the password again.
+func (a *App) HandleLogin2FA(w http.ResponseWriter, r *http.Request) {
+    uid, ok := a.challengeUser(r)
+    if !ok {
+        http.Redirect(w, r, "/login?error="+url.QueryEscape("Your login has expired. Please log in again."), http.StatusSeeOther)
+        return
+    }
+    render := func(msg string) {
+        data := a.baseData(r)
+        data["Error"] = msg
+        tmpl := a.Templates.Lookup("login_2fa.html")
+        tmpl.ExecuteTemplate(w, "login_2fa.html", data)
+    }
+    switch r.Method {
+    case http.MethodGet:
+        render("")
+    case http.MethodPost:
+        // Wrong codes count against the account like wrong passwords,
+        // so restarting the login does not buy more guesses.
+        email, err := a.userEmail(uid)
+        if err != nil {
+            http.Error(w, "database error", http.StatusInternalServerError)
+            return
+        }
+        wait, err := a.reserveLoginAttempt(r, email)
+        if err != nil {
+            http.Error(w, "database error", http.StatusInternalServerError)
+            return
+        }
+        if wait > 0 {
+            render(throttledMessage(wait))
+            return
+        }
+        ok, usedRecovery, err := a.checkSecondFactor(uid, r.FormValue("code"))
+        if err != nil {
+            _ = a.releaseLoginAttempt(r, email)
+            http.Error(w, "database error", http.StatusInternalServerError)
+            return
+        }
+        if !ok {
+            if err := a.recordLoginFailure(r, email); err != nil {
+                http.Error(w, "database error", http.StatusInternalServerError)
+                return
+            }
+            // challengeUser found the cookie, but the challenge may
+            // have been ended by a parallel request since.
+            c, _ := r.Cookie(challengeCookie)
+            var attempts int
+            err := a.DB.QueryRow(`UPDATE login_challenges SET attempts = attempts + 1 WHERE token_hash = ? RETURNING attempts`, hashToken(c.Value)).Scan(&attempts)
+            if err == sql.ErrNoRows {
+                a.endChallenge(w, r)
+                http.Redirect(w, r, "/login?error="+url.QueryEscape("Your login has expired. Please log in again."), http.StatusSeeOther)
+                return
+            }
+            if err != nil {
+                http.Error(w, "database error", http.StatusInternalServerError)
+                return
+            }
+            if attempts >= maxChallengeAttempts {
+                a.endChallenge(w, r)
+                http.Redirect(w, r, "/login?error="+url.QueryEscape("Too many wrong codes. Please log in again."), http.StatusSeeOther)
+                return
+            }
+            render("That code is not valid. Please try again.")
+            return
+        }
+        a.endChallenge(w, r)
+        if err := a.SetSession(w, r, uid); err != nil {
+            http.Error(w, "failed to create session", http.StatusInternalServerError)
+            return
+        }
+        _ = a.releaseLoginAttempt(r, email)
+        _ = a.clearLoginFailures(uid)
+        if usedRecovery {
+            var left int
+            a.DB.QueryRow(`SELECT COUNT(*) FROM recovery_codes WHERE user_id = ? AND used_at IS NULL`, uid).Scan(&left)
+            msg := "You logged in with a recovery code. " + strconv.Itoa(left) + " unused codes remain."
+            http.Redirect(w, r, "/account/2fa?notice="+url.QueryEscape(msg), http.StatusSeeOther)
+            return
+        }
+        http.Redirect(w, r, "/", http.StatusSeeOther)
+    default:
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+// HandleTwoFactor manages the 2FA settings of the logged-in user at
+// /account/2fa. GET shows either the enrollment instructions with the
+// otpauth URI or, once enabled, the status of the recovery codes. POST
+// takes an `action`:
+//
+//   enable      confirm enrollment with `code`
+//   regenerate  replace the recovery codes, confirmed with `code`
+//   disable     turn 2FA off, confirmed with `password` and `code`
+//
+// Freshly created recovery codes are shown once in the response.
+// Users whose role requires 2FA cannot disable it.
+func (a *App) HandleTwoFactor(w http.ResponseWriter, r *http.Request) {
+    uid, _, _ := a.CurrentUser(r)
+    fail := func(msg string) {
+        http.Redirect(w, r, "/account/2fa?error="+url.QueryEscape(msg), http.StatusSeeOther)
+    }
+    switch r.Method {
+    case http.MethodGet:
+        data, err := a.twoFactorData(r, uid)
+        if err != nil {
+            http.Error(w, "database error", http.StatusInternalServerError)
+            return
+        }
+        tmpl := a.Templates.Lookup("account_2fa.html")
+        tmpl.ExecuteTemplate(w, "account_2fa.html", data)
+    case http.MethodPost:
+        enabled := a.twoFactorEnabled(uid)
+        var codes []string
+        switch r.FormValue("action") {
+        case "enable":
+            if enabled {
+                fail("Two-factor authentication is already enabled.")
+                return
+            }
+            var secret sql.NullString
+            if err := a.DB.QueryRow(`SELECT totp_secret FROM users WHERE id = ?`, uid).Scan(&secret); err != nil || !secret.Valid {
+                fail("Please start the setup again.")
+                return
+            }
+            step, ok := totp.Validate(secret.String, r.FormValue("code"), time.Now(), 0)
+            if !ok {
+                fail("That code is not valid. Check that your device's clock is correct and try again.")
+                return
+            }
+            err := a.inTx(func(tx *sql.Tx) error {
+                if _, err := tx.Exec(`UPDATE users SET totp_enabled_at = ?, totp_last_step = ? WHERE id = ?`, time.Now().UTC(), step, uid); err != nil {
+                    return err
+                }
+                var err error
+                codes, err = a.replaceRecoveryCodes(tx, uid)
+                return err
+            })
+            if err != nil {
+                http.Error(w, "database error", http.StatusInternalServerError)
+                return
+            }
+        case "regenerate":
+            if !a.confirmTOTP(w, r, uid, fail) {
+                return
+            }
+            err := a.inTx(func(tx *sql.Tx) error {
+                var err error
+                codes, err = a.replaceRecoveryCodes(tx, uid)
+                return err
+            })
+            if err != nil {
+                http.Error(w, "database error", http.StatusInternalServerError)
+                return
+            }
+        case "disable":
+            role, _ := a.storedRole(uid)
+            if a.twoFactorRequired(role) {
+                fail("Your role requires two-factor authentication, so it cannot be turned off.")
+                return
+            }
+            var hash string
+            if err := a.DB.QueryRow(`SELECT password_hash FROM users WHERE id = ?`, uid).Scan(&hash); err != nil {
+                http.Error(w, "database error", http.StatusInternalServerError)
+                return
+            }
+            if bcrypt.CompareHashAndPassword([]byte(hash), []byte(r.FormValue("password"))) != nil {
+                fail("The password is not correct.")
+                return
+            }
+            if !a.confirmTOTP(w, r, uid, fail) {
+                return
+            }
+            if err := a.disableTwoFactor(uid); err != nil {
+                http.Error(w, "database error", http.StatusInternalServerError)
+                return
+            }
+            http.Redirect(w, r, "/account/2fa?notice="+url.QueryEscape("Two-factor authentication is now off."), http.StatusSeeOther)
+            return
+        default:
+            http.Error(w, "unknown action", http.StatusBadRequest)
+            return
+        }
+        data, err := a.twoFactorData(r, uid)
+        if err != nil {
+            http.Error(w, "database error", http.StatusInternalServerError)
+            return
+        }
+        data["RecoveryCodes"] = codes
+        tmpl := a.Templates.Lookup("account_2fa.html")
+        tmpl.ExecuteTemplate(w, "account_2fa.html", data)
+    default:
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+// confirmTOTP checks the `code` form field against the user's
+// authenticator. Recovery codes are not accepted here, so a stolen
+// recovery code cannot be used to change the 2FA settings. On failure
+// it reports the error through fail and returns false.
+func (a *App) confirmTOTP(w http.ResponseWriter, r *http.Request, uid int64, fail func(string)) bool {
+    code := r.FormValue("code")
+    if !isDigits(strings.ReplaceAll(code, " ", "")) {
+        fail("Please enter the current code from your authenticator app.")
+        return false
+    }
+    ok, _, err := a.checkSecondFactor(uid, code)
+    if err != nil {
+        http.Error(w, "database error", http.StatusInternalServerError)
+        return false
+    }
+    if !ok {
+        fail("That code is not valid. Please try again.")
+        return false
+    }
+    return true
+}
+
+// disableTwoFactor turns 2FA off for uid and removes the secret and
+// recovery codes. It is used by the user and by admins helping a user
+// who lost their device.
+func (a *App) disableTwoFactor(uid int64) error {
+    return a.inTx(func(tx *sql.Tx) error {
+        if _, err := tx.Exec(`UPDATE users SET totp_secret = NULL, totp_enabled_at = NULL, totp_last_step = 0 WHERE id = ?`, uid); err != nil {
+            return err
+        }
+        if _, err := tx.Exec(`DELETE FROM login_challenges WHERE user_id = ?`, uid); err != nil {
+            return err
+        }
+        _, err := tx.Exec(`DELETE FROM recovery_codes WHERE user_id = ?`, uid)
+        return err
+    })
+}
+
+// twoFactorData builds the template data of the 2FA page. Users who
+// have not enrolled get a secret, created on first visit and kept
+// until enrollment completes so that reloading the page does not
+// invalidate an app entry the user already added.
+func (a *App) twoFactorData(r *http.Request, uid int64) (map[string]any, error) {
+    data := a.baseData(r)
+    var email string
+    var secret sql.NullString
+    var enabledAt sql.NullTime
+    err := a.DB.QueryRow(`SELECT email, totp_secret, totp_enabled_at FROM users WHERE id = ?`, uid).Scan(&email, &secret, &enabledAt)
+    if err != nil {
+        return nil, err
+    }
+    data["Enabled"] = enabledAt.Valid
+    role, _ := a.storedRole(uid)
+    data["Required"] = a.twoFactorRequired(role)
+    if enabledAt.Valid {
+        data["EnabledAt"] = enabledAt.Time
+        var left int
+        if err := a.DB.QueryRow(`SELECT COUNT(*) FROM recovery_codes WHERE user_id = ? AND used_at IS NULL`, uid).Scan(&left); err != nil {
+            return nil, err
+        }
+        data["CodesLeft"] = left
+    } else {
+        if !secret.Valid {
+            s, err := totp.NewSecret()
+            if err != nil {
+                return nil, err
+            }
+            if _, err := a.DB.Exec(`UPDATE users SET totp_secret = ? WHERE id = ?`, s, uid); err != nil {
+                return nil, err
+            }
+            secret = sql.NullString{String: s, Valid: true}
+        }
+        data["Secret"] = groupSecret(secret.String)
+        // otpauth is not a scheme html/template trusts in links, so
+        // the URI we built ourselves is marked as safe.
+        data["URI"] = template.URL(totp.URI(totpIssuer, email, secret.String))
+    }
+    if msg := r.URL.Query().Get("error"); msg != "" {
+        data["Error"] = msg
+    }
+    if msg := r.URL.Query().Get("notice"); msg != "" {
+        data["Notice"] = msg
+    }
+    return data, nil
+}
+
+// groupSecret splits a base32 secret into blocks of four characters,
+// which is easier to type into an app by hand.
+func groupSecret(s string) string {
+    var parts []string
+    for len(s) > 4 {
+        parts = append(parts, s[:4])
+        s = s[4:]
+    }
+    return strings.Join(append(parts, s), " ")
+}
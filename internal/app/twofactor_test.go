@@ -0,0 +1,225 @@
+package app
+
+// Tests of the second login factor: TOTP codes bound to their time
+// step, hashed single-use recovery codes, and the code step of the
+// login, which gives up after too many wrong codes.
+
+import (
+    "database/sql"
+    "html/template"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "regexp"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+
+    "forum/internal/totp"
+)
+
+// enableTestTOTP turns on two-factor authentication for uid and
+// returns the secret.
+func enableTestTOTP(t *testing.T, a *App, uid int64) string {
+    t.Helper()
+    secret, err := totp.NewSecret()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := a.DB.Exec(`UPDATE users SET totp_secret = ?, totp_enabled_at = ?, totp_last_step = 0 WHERE id = ?`, secret, time.Now().UTC(), uid); err != nil {
+        t.Fatal(err)
+    }
+    return secret
+}
+
+// newTestRecoveryCodes stores a fresh set of recovery codes for uid.
+func newTestRecoveryCodes(t *testing.T, a *App, uid int64) []string {
+    t.Helper()
+    var codes []string
+    err := a.inTx(func(tx *sql.Tx) error {
+        var err error
+        codes, err = a.replaceRecoveryCodes(tx, uid)
+        return err
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    return codes
+}
+
+func TestTOTPCodeWorksOnce(t *testing.T) {
+    a := newTestApp(t)
+    alice := createTestUser(t, a, "alice")
+    secret := enableTestTOTP(t, a, alice)
+
+    step := totp.Step(time.Now())
+    code, err := totp.Code(secret, step)
+    if err != nil {
+        t.Fatal(err)
+    }
+    ok, recovery, err := a.checkSecondFactor(alice, code)
+    if err != nil || !ok || recovery {
+        t.Fatalf("first use: ok=%v recovery=%v err=%v", ok, recovery, err)
+    }
+    // Replaying the code, say after watching it being typed, fails
+    // even within the same time step.
+    if ok, _, _ := a.checkSecondFactor(alice, code); ok {
+        t.Fatal("the same code was accepted twice")
+    }
+    // So does the code of the previous step, which is otherwise
+    // still within the allowed clock drift.
+    prev, _ := totp.Code(secret, step-1)
+    if ok, _, _ := a.checkSecondFactor(alice, prev); ok {
+        t.Fatal("an older code was accepted after a newer one")
+    }
+
+    // The stored step is per user.
+    bob := createTestUser(t, a, "bob")
+    if _, err := a.DB.Exec(`UPDATE users SET totp_secret = ?, totp_enabled_at = ? WHERE id = ?`, secret, time.Now().UTC(), bob); err != nil {
+        t.Fatal(err)
+    }
+    if ok, _, _ := a.checkSecondFactor(bob, code); !ok {
+        t.Fatal("another user with the same secret could not use the code")
+    }
+
+    // Without 2FA enabled no code is accepted.
+    carol := createTestUser(t, a, "carol")
+    if ok, _, _ := a.checkSecondFactor(carol, code); ok {
+        t.Fatal("a code was accepted for a user without 2FA")
+    }
+}
+
+func TestRecoveryCodes(t *testing.T) {
+    a := newTestApp(t)
+    alice := createTestUser(t, a, "alice")
+    enableTestTOTP(t, a, alice)
+    codes := newTestRecoveryCodes(t, a, alice)
+
+    if len(codes) != recoveryCodeCount {
+        t.Fatalf("got %d codes, want %d", len(codes), recoveryCodeCount)
+    }
+    format := regexp.MustCompile(`^[` + recoveryAlphabet + `]{5}-[` + recoveryAlphabet + `]{5}$`)
+    seen := map[string]bool{}
+    for _, c := range codes {
+        if !format.MatchString(c) {
+            t.Errorf("code %q is not formatted as XXXXX-XXXXX", c)
+        }
+        if seen[c] {
+            t.Errorf("code %q handed out twice", c)
+        }
+        seen[c] = true
+    }
+
+    // Only hashes are stored.
+    rows, err := a.DB.Query(`SELECT code_hash FROM recovery_codes WHERE user_id = ?`, alice)
+    if err != nil {
+        t.Fatal(err)
+    }
+    hashes := map[string]bool{}
+    for rows.Next() {
+        var h string
+        rows.Scan(&h)
+        hashes[h] = true
+    }
+    rows.Close()
+    for _, c := range codes {
+        if hashes[c] || hashes[normalizeRecoveryCode(c)] {
+            t.Fatalf("recovery code %q is stored in plain text", c)
+        }
+        if !hashes[hashToken(normalizeRecoveryCode(c))] {
+            t.Fatalf("no hash stored for %q", c)
+        }
+    }
+
+    // A code works once, typed loosely.
+    typed := strings.ToLower(strings.Replace(codes[0], "-", " ", 1))
+    ok, recovery, err := a.checkSecondFactor(alice, typed)
+    if err != nil || !ok || !recovery {
+        t.Fatalf("first use of %q: ok=%v recovery=%v err=%v", typed, ok, recovery, err)
+    }
+    if ok, _, _ := a.checkSecondFactor(alice, codes[0]); ok {
+        t.Fatal("a recovery code was accepted twice")
+    }
+    if n := count(t, a, `SELECT COUNT(*) FROM recovery_codes WHERE user_id = ? AND used_at IS NULL`, alice); n != recoveryCodeCount-1 {
+        t.Fatalf("%d unused codes left, want %d", n, recoveryCodeCount-1)
+    }
+
+    // Codes belong to their user.
+    bob := createTestUser(t, a, "bob")
+    enableTestTOTP(t, a, bob)
+    if ok, _, _ := a.checkSecondFactor(bob, codes[1]); ok {
+        t.Fatal("alice's recovery code worked for bob")
+    }
+
+    // New codes replace the old ones.
+    fresh := newTestRecoveryCodes(t, a, alice)
+    if ok, _, _ := a.checkSecondFactor(alice, codes[1]); ok {
+        t.Fatal("a replaced recovery code was accepted")
+    }
+    if ok, _, _ := a.checkSecondFactor(alice, fresh[0]); !ok {
+        t.Fatal("a new recovery code was rejected")
+    }
+}
+
+func TestLogin2FAWrongCodes(t *testing.T) {
+    a := newTestApp(t)
+    a.Templates = template.Must(template.New("login_2fa.html").Parse(`{{.Error}}`))
+    alice := createTestUser(t, a, "alice")
+    enableTestTOTP(t, a, alice)
+    // challenge starts a login challenge for alice and returns its
+    // cookie.
+    challenge := func() *http.Cookie {
+        rec := httptest.NewRecorder()
+        if err := a.startChallenge(rec, alice); err != nil {
+            t.Fatal(err)
+        }
+        return rec.Result().Cookies()[0]
+    }
+    // submit posts a wrong code from a new address each time, so that
+    // the throttle does not get in the way.
+    n := 0
+    submit := func(c *http.Cookie) *httptest.ResponseRecorder {
+        n++
+        req := httptest.NewRequest(http.MethodPost, "/login/2fa", strings.NewReader(url.Values{"code": {"000000"}}.Encode()))
+        req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+        req.RemoteAddr = "192.0.2." + strconv.Itoa(n) + ":1234"
+        req.AddCookie(c)
+        rec := httptest.NewRecorder()
+        a.HandleLogin2FA(rec, req)
+        return rec
+    }
+    clearThrottle := func() {
+        if _, err := a.DB.Exec(`DELETE FROM login_failures`); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    // Wrong codes are refused until there have been too many.
+    c := challenge()
+    for i := 1; i < maxChallengeAttempts; i++ {
+        clearThrottle()
+        if rec := submit(c); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "not valid") {
+            t.Fatalf("wrong code %d: %d %q", i, rec.Code, rec.Body)
+        }
+    }
+    clearThrottle()
+    if rec := submit(c); !strings.Contains(rec.Header().Get("Location"), "Too+many") {
+        t.Fatalf("last wrong code: %d to %q", rec.Code, rec.Header().Get("Location"))
+    }
+    if n := count(t, a, `SELECT COUNT(*) FROM login_challenges`); n != 0 {
+        t.Fatalf("%d challenges left after too many codes", n)
+    }
+
+    // A challenge that another request ends while the code is being
+    // checked sends the user back to the login form.
+    c = challenge()
+    clearThrottle()
+    if _, err := a.DB.Exec(`CREATE TRIGGER end_challenges AFTER INSERT ON login_failures BEGIN DELETE FROM login_challenges; END`); err != nil {
+        t.Fatal(err)
+    }
+    rec := submit(c)
+    if loc := rec.Header().Get("Location"); rec.Code != http.StatusSeeOther || !strings.Contains(loc, "expired") {
+        t.Fatalf("vanished challenge: %d to %q", rec.Code, loc)
+    }
+}
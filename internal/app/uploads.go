@@ -0,0 +1,520 @@
+package app
+
+// This file implements image uploads: avatars, chosen under account
+// settings, and pictures for posts and comments, managed at
+// /account/uploads and embedded with ordinary Markdown image syntax.
+// Every upload is sniffed, decoded and re-encoded by the imaging
+// package before it is stored, and a smaller version is kept alongside
+// it (a thumbnail for pictures, a small avatar for the page header).
+//
+// Files are kept in a storage.Storage and served at /uploads/{key}.
+// Keys are random and never reused, so the responses can be cached
+// forever, and only keys recorded in the uploads table are served.
+
+import (
+    "context"
+    "crypto/rand"
+    "database/sql"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "image"
+    "io"
+    "log"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "time"
+
+    "forum/internal/imaging"
+    "forum/internal/storage"
+)
+
+// Pixel sizes of stored images.
+const (
+    // imageMaxSide is the longest side of pictures for posts; larger
+    // ones are scaled down.
+    imageMaxSide = 2048
+    // thumbSide is the longest side of their thumbnails.
+    thumbSide = 400
+    // avatarSide and avatarThumbSide are the sizes of the square
+    // avatar and its small version.
+    avatarSide      = 256
+    avatarThumbSide = 64
+)
+
+// DefaultMaxUploadSize is the largest file accepted unless
+// App.MaxUploadSize says otherwise.
+const DefaultMaxUploadSize = 5 << 20
+
+// maxUploadsPerUser limits how many pictures a user can keep.
+const maxUploadsPerUser = 200
+
+// Upload kinds, as stored in uploads.kind.
+const (
+    uploadAvatar = "avatar"
+    uploadImage  = "image"
+)
+
+var (
+    // errUploadTooLarge is returned for files over the size limit.
+    errUploadTooLarge = errors.New("upload too large")
+    // errUploadQuota is returned when a user has too many pictures.
+    errUploadQuota = errors.New("too many uploads")
+)
+
+// uploadView is an upload as listed on the uploads page and returned
+// by the API.
+type uploadView struct {
+    ID          int64     `json:"id"`
+    URL         string    `json:"url"`
+    ThumbURL    string    `json:"thumbnail_url"`
+    ContentType string    `json:"content_type"`
+    Width       int       `json:"width"`
+    Height      int       `json:"height"`
+    Size        int64     `json:"size"`
+    CreatedAt   time.Time `json:"created_at"`
+    // Markdown embeds the picture, showing the thumbnail as a link to
+    // the full size version when there is one.
+    Markdown string `json:"markdown"`
+
+    key string
+}
+
+// uploadURL returns the path an object is served at.
+func uploadURL(key string) string {
+    return "/uploads/" + key
+}
+
+// newUploadView fills in the derived fields of an upload.
+func newUploadView(id int64, key, thumbKey, contentType string, width, height int, size int64, created time.Time) uploadView {
+    u := uploadView{
+        key:         key,
+        ID:          id,
+        URL:         uploadURL(key),
+        ThumbURL:    uploadURL(thumbKey),
+        ContentType: contentType,
+        Width:       width,
+        Height:      height,
+        Size:        size,
+        CreatedAt:   created,
+    }
+    u.Markdown = "![image](" + u.URL + ")"
+    if thumbKey != key {
+        u.Markdown = "[![image](" + u.ThumbURL + ")](" + u.URL + ")"
+    }
+    return u
+}
+
+// maxUploadSize returns the configured upload limit in bytes.
+func (a *App) maxUploadSize() int64 {
+    if a.MaxUploadSize > 0 {
+        return a.MaxUploadSize
+    }
+    return DefaultMaxUploadSize
+}
+
+// uploadErrorMessage explains why storeImage failed, or returns ""
+// for errors that are the server's fault.
+func (a *App) uploadErrorMessage(err error) string {
+    switch err {
+    case errUploadTooLarge:
+        return "Images are limited to " + formatBytes(a.maxUploadSize()) + "."
+    case errUploadQuota:
+        return fmt.Sprintf("You can keep at most %d images. Delete some to upload more.", maxUploadsPerUser)
+    case imaging.ErrUnsupported:
+        return "Only JPEG, PNG and GIF images can be uploaded."
+    case imaging.ErrTooLarge:
+        return "That image has too many pixels."
+    case imaging.ErrCorrupt:
+        return "That image could not be read."
+    }
+    return ""
+}
+
+// formatBytes renders a size such as 5 MB for messages.
+func formatBytes(n int64) string {
+    switch {
+    case n >= 1<<20 && n%(1<<20) == 0:
+        return strconv.FormatInt(n>>20, 10) + " MB"
+    case n >= 1<<20:
+        return strconv.FormatFloat(float64(n)/(1<<20), 'f', 1, 64) + " MB"
+    case n >= 1<<10:
+        return strconv.FormatInt(n>>10, 10) + " KB"
+    }
+    return strconv.FormatInt(n, 10) + " bytes"
+}
+
+// randomName returns a random lowercase hex name for new objects.
+func randomName() (string, error) {
+    b := make([]byte, 16)
+    if _, err := rand.Read(b); err != nil {
+        return "", err
+    }
+    return hex.EncodeToString(b), nil
+}
+
+// storeImage processes data uploaded by user uid as an image of the
+// given kind, stores it with its small version and records it in the
+// uploads table. Avatars are cropped square; pictures keep their
+// shape.
+func (a *App) storeImage(ctx context.Context, uid int64, kind string, data []byte) (uploadView, error) {
+    var u uploadView
+    if int64(len(data)) > a.maxUploadSize() {
+        return u, errUploadTooLarge
+    }
+    if kind == uploadImage {
+        var n int
+        if err := a.DB.QueryRow(`SELECT COUNT(*) FROM uploads WHERE user_id = ? AND kind = ?`, uid, uploadImage).Scan(&n); err != nil {
+            return u, err
+        }
+        if n >= maxUploadsPerUser {
+            return u, errUploadQuota
+        }
+    }
+    img, ct, err := imaging.Decode(data)
+    if err != nil {
+        return u, err
+    }
+    var full, small *image.RGBA
+    if kind == uploadAvatar {
+        full, small = imaging.Square(img, avatarSide), imaging.Square(img, avatarThumbSide)
+    } else {
+        full, small = imaging.Fit(img, imageMaxSide), imaging.Fit(img, thumbSide)
+    }
+    fullData, outType, err := imaging.Encode(full, ct)
+    if err != nil {
+        return u, err
+    }
+    name, err := randomName()
+    if err != nil {
+        return u, err
+    }
+    ext := imaging.Extension(outType)
+    var key, thumbKey string
+    if kind == uploadAvatar {
+        key, thumbKey = "avatars/"+name+ext, "avatars/"+name+"-small"+ext
+    } else {
+        key, thumbKey = "images/"+name+ext, "thumbs/"+name+ext
+    }
+    if err := a.Storage.Put(ctx, key, outType, fullData); err != nil {
+        return u, err
+    }
+    // Pictures that are small already serve as their own thumbnail.
+    if small == full {
+        thumbKey = key
+    } else {
+        smallData, _, err := imaging.Encode(small, ct)
+        if err == nil {
+            err = a.Storage.Put(ctx, thumbKey, outType, smallData)
+        }
+        if err != nil {
+            a.deleteObjects(ctx, key)
+            return u, err
+        }
+    }
+    b := full.Bounds()
+    now := time.Now().UTC()
+    res, err := a.DB.Exec(`INSERT INTO uploads(user_id, kind, key, thumb_key, content_type, width, height, size, created_at) VALUES(?,?,?,?,?,?,?,?,?)`,
+        uid, kind, key, thumbKey, outType, b.Dx(), b.Dy(), len(fullData), now)
+    if err != nil {
+        a.deleteObjects(ctx, key, thumbKey)
+        return u, err
+    }
+    id, _ := res.LastInsertId()
+    return newUploadView(id, key, thumbKey, outType, b.Dx(), b.Dy(), int64(len(fullData)), now), nil
+}
+
+// deleteObjects removes objects from storage. Failures only leave
+// unreachable files behind, so they are logged rather than reported.
+func (a *App) deleteObjects(ctx context.Context, keys ...string) {
+    seen := map[string]bool{}
+    for _, key := range keys {
+        if key == "" || seen[key] {
+            continue
+        }
+        seen[key] = true
+        if err := a.Storage.Delete(ctx, key); err != nil {
+            log.Printf("deleting upload %s: %v", key, err)
+        }
+    }
+}
+
+// readUploadedFile reads the `file` field of a multipart form, or
+// returns a message for the user.
+func (a *App) readUploadedFile(r *http.Request) ([]byte, string) {
+    f, _, err := r.FormFile("file")
+    if err != nil {
+        return nil, "Choose an image to upload."
+    }
+    defer f.Close()
+    data, err := io.ReadAll(io.LimitReader(f, a.maxUploadSize()+1))
+    if err != nil {
+        return nil, "The upload failed. Please try again."
+    }
+    if int64(len(data)) > a.maxUploadSize() {
+        return nil, a.uploadErrorMessage(errUploadTooLarge)
+    }
+    return data, ""
+}
+
+// userUploads lists the pictures of user uid, newest first.
+func (a *App) userUploads(uid int64) ([]uploadView, error) {
+    rows, err := a.DB.Query(`SELECT id, key, thumb_key, content_type, width, height, size, created_at FROM uploads WHERE user_id = ? AND kind = ? ORDER BY id DESC`, uid, uploadImage)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    var out []uploadView
+    for rows.Next() {
+        var id, size int64
+        var key, thumbKey, ct string
+        var width, height int
+        var created time.Time
+        if err := rows.Scan(&id, &key, &thumbKey, &ct, &width, &height, &size, &created); err != nil {
+            return nil, err
+        }
+        out = append(out, newUploadView(id, key, thumbKey, ct, width, height, size, created))
+    }
+    return out, rows.Err()
+}
+
+// HandleAccountUploads lists the pictures of the logged-in user on
+// GET. On POST the `action` field selects what to do:
+//
+//   upload  store the image in the `file` field
+//   delete  delete the upload `id`
+func (a *App) HandleAccountUploads(w http.ResponseWriter, r *http.Request) {
+    uid, _, _ := a.CurrentUser(r)
+    redirect := func(kind, msg string) {
+        http.Redirect(w, r, "/account/uploads?"+kind+"="+url.QueryEscape(msg), http.StatusSeeOther)
+    }
+    switch r.Method {
+    case http.MethodGet:
+        uploads, err := a.userUploads(uid)
+        if err != nil {
+            http.Error(w, "database error", http.StatusInternalServerError)
+            return
+        }
+        data := a.baseData(r)
+        data["Uploads"] = uploads
+        data["MaxUploadSize"] = formatBytes(a.maxUploadSize())
+        if msg := r.URL.Query().Get("error"); msg != "" {
+            data["Error"] = msg
+        }
+        if msg := r.URL.Query().Get("notice"); msg != "" {
+            data["Notice"] = msg
+        }
+        tmpl := a.Templates.Lookup("account_uploads.html")
+        tmpl.ExecuteTemplate(w, "account_uploads.html", data)
+    case http.MethodPost:
+        switch r.FormValue("action") {
+        case "upload":
+            body, msg := a.readUploadedFile(r)
+            if msg != "" {
+                redirect("error", msg)
+                return
+            }
+            if _, err := a.storeImage(r.Context(), uid, uploadImage, body); err != nil {
+                if msg := a.uploadErrorMessage(err); msg != "" {
+                    redirect("error", msg)
+                    return
+                }
+                log.Printf("storing upload of user %d: %v", uid, err)
+                http.Error(w, "storage error", http.StatusInternalServerError)
+                return
+            }
+            redirect("notice", "Your image has been uploaded. Copy its Markdown into a post or comment to show it.")
+        case "delete":
+            id, _ := strconv.ParseInt(r.FormValue("id"), 10, 64)
+            var key, thumbKey string
+            err := a.DB.QueryRow(`DELETE FROM uploads WHERE id = ? AND user_id = ? AND kind = ? RETURNING key, thumb_key`, id, uid, uploadImage).Scan(&key, &thumbKey)
+            if err == sql.ErrNoRows {
+                http.NotFound(w, r)
+                return
+            }
+            if err != nil {
+                http.Error(w, "database error", http.StatusInternalServerError)
+                return
+            }
+            a.deleteObjects(r.Context(), key, thumbKey)
+            redirect("notice", "The image has been deleted.")
+        default:
+            http.Error(w, "unknown action", http.StatusBadRequest)
+        }
+    default:
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+// HandleAccountAvatar changes the avatar of the logged-in user. The
+// `action` field is "upload", with the image in `file`, or "remove" to
+// go back to the generated placeholder. The previous avatar is
+// deleted either way.
+func (a *App) HandleAccountAvatar(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    uid, _, _ := a.CurrentUser(r)
+    redirect := func(kind, msg string) {
+        http.Redirect(w, r, "/account/settings?"+kind+"="+url.QueryEscape(msg), http.StatusSeeOther)
+    }
+    var newKey, notice string
+    switch r.FormValue("action") {
+    case "upload":
+        body, msg := a.readUploadedFile(r)
+        if msg != "" {
+            redirect("error", msg)
+            return
+        }
+        u, err := a.storeImage(r.Context(), uid, uploadAvatar, body)
+        if err != nil {
+            if msg := a.uploadErrorMessage(err); msg != "" {
+                redirect("error", msg)
+                return
+            }
+            log.Printf("storing avatar of user %d: %v", uid, err)
+            http.Error(w, "storage error", http.StatusInternalServerError)
+            return
+        }
+        newKey = u.key
+        notice = "Your avatar has been updated."
+    case "remove":
+        notice = "Your avatar has been removed."
+    default:
+        http.Error(w, "unknown action", http.StatusBadRequest)
+        return
+    }
+    // Swap the avatar and forget every other one the user had.
+    var old [][2]string
+    err := a.inTx(func(tx *sql.Tx) error {
+        if _, err := tx.Exec(`UPDATE users SET avatar_key = ? WHERE id = ?`, newKey, uid); err != nil {
+            return err
+        }
+        rows, err := tx.Query(`DELETE FROM uploads WHERE user_id = ? AND kind = ? AND key != ? RETURNING key, thumb_key`, uid, uploadAvatar, newKey)
+        if err != nil {
+            return err
+        }
+        defer rows.Close()
+        for rows.Next() {
+            var keys [2]string
+            if err := rows.Scan(&keys[0], &keys[1]); err != nil {
+                return err
+            }
+            old = append(old, keys)
+        }
+        return rows.Err()
+    })
+    if err != nil {
+        http.Error(w, "database error", http.StatusInternalServerError)
+        return
+    }
+    for _, keys := range old {
+        a.deleteObjects(r.Context(), keys[0], keys[1])
+    }
+    redirect("notice", notice)
+}
+
+// avatarURLs returns the paths of the avatar of user uid and of its
+// small version, both empty when the user has none.
+func (a *App) avatarURLs(uid int64) (string, string) {
+    var key, thumbKey string
+    err := a.DB.QueryRow(`SELECT up.key, up.thumb_key FROM users u JOIN uploads up ON up.key = u.avatar_key WHERE u.id = ?`, uid).Scan(&key, &thumbKey)
+    if err != nil {
+        return "", ""
+    }
+    return uploadURL(key), uploadURL(thumbKey)
+}
+
+// HandleUpload serves a stored upload at /uploads/{key}. The response
+// is locked down so that a file cannot act as a page of the forum even
+// if a browser were to ignore its content type.
+func (a *App) HandleUpload(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet && r.Method != http.MethodHead {
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    key := strings.TrimPrefix(r.URL.Path, "/uploads/")
+    if !storage.ValidKey(key) {
+        http.NotFound(w, r)
+        return
+    }
+    var ct string
+    err := a.DB.QueryRow(`SELECT content_type FROM uploads WHERE key = ?1 OR thumb_key = ?1 LIMIT 1`, key).Scan(&ct)
+    if err == sql.ErrNoRows {
+        http.NotFound(w, r)
+        return
+    }
+    if err != nil {
+        http.Error(w, "database error", http.StatusInternalServerError)
+        return
+    }
+    // Keys are never reused, so the same URL always means the same
+    // bytes.
+    if r.Header.Get("If-None-Match") == `"`+key+`"` {
+        w.WriteHeader(http.StatusNotModified)
+        return
+    }
+    obj, err := a.Storage.Get(r.Context(), key)
+    if err == storage.ErrNotFound {
+        http.NotFound(w, r)
+        return
+    }
+    if err != nil {
+        log.Printf("reading upload %s: %v", key, err)
+        http.Error(w, "storage error", http.StatusInternalServerError)
+        return
+    }
+    defer obj.Body.Close()
+    h := w.Header()
+    h.Set("Content-Type", ct)
+    h.Set("X-Content-Type-Options", "nosniff")
+    h.Set("Content-Security-Policy", "default-src 'none'; sandbox")
+    h.Set("Cache-Control", "public, max-age=31536000, immutable")
+    h.Set("ETag", `"`+key+`"`)
+    if obj.Size > 0 {
+        h.Set("Content-Length", strconv.FormatInt(obj.Size, 10))
+    }
+    if r.Method == http.MethodHead {
+        return
+    }
+    io.Copy(w, obj.Body)
+}
+
+// apiUploads stores the image sent as the raw request body and returns
+// it as an uploadView, including the Markdown to embed it:
+//
+//   curl -H 'Authorization: Bearer …' --data-binary @photo.jpg /api/v1/uploads
+func (a *App) apiUploads(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        apiMethodNotAllowed(w, http.MethodPost)
+        return
+    }
+    uid, _, ok := a.apiVerifiedUser(w, r)
+    if !ok {
+        return
+    }
+    data, err := io.ReadAll(io.LimitReader(r.Body, a.maxUploadSize()+1))
+    if err != nil {
+        apiError(w, http.StatusBadRequest, "invalid_body", "the request body could not be read")
+        return
+    }
+    u, err := a.storeImage(r.Context(), uid, uploadImage, data)
+    switch err {
+    case nil:
+        writeJSON(w, http.StatusCreated, u)
+    case errUploadTooLarge:
+        apiError(w, http.StatusRequestEntityTooLarge, "too_large", a.uploadErrorMessage(err))
+    case errUploadQuota:
+        apiError(w, http.StatusForbidden, "quota_exceeded", a.uploadErrorMessage(err))
+    case imaging.ErrUnsupported:
+        apiError(w, http.StatusUnsupportedMediaType, "unsupported_type", a.uploadErrorMessage(err))
+    case imaging.ErrTooLarge, imaging.ErrCorrupt:
+        apiError(w, http.StatusUnprocessableEntity, "invalid_image", a.uploadErrorMessage(err))
+    default:
+        log.Printf("storing upload of user %d: %v", uid, err)
+        apiError(w, http.StatusInternalServerError, "storage_error", "the image could not be stored")
+    }
+}
@@ -0,0 +1,260 @@
+package app
+
+// This file implements email verification. New accounts are mailed a
+// link containing a random token and stay unverified until they open
+// it. Unverified users can log in and read, but RequireVerified keeps
+// them from posting or commenting. A background job removes accounts
+// that are never verified, along with other expired data (see
+// PurgeExpired). As with password resets only a hash of the token is
+// stored.
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "log"
+    "net/http"
+    "net/url"
+    "time"
+
+    "forum/internal/mail"
+)
+
+// errVerifyToken is returned for verification tokens that are unknown
+// or expired.
+var errVerifyToken = errors.New("this verification link is invalid or has expired")
+
+// verifyTokenTTL is how long a verification link stays valid. Users
+// whose link expired can ask for a new one from /verify.
+const verifyTokenTTL = 48 * time.Hour
+
+// verifyResendInterval is the minimum time between two verification
+// mails requested by a user, so the resend button cannot be used to
+// flood an inbox.
+const verifyResendInterval = 5 * time.Minute
+
+// isVerified reports whether the user has confirmed their email
+// address. Unknown users are not verified.
+func (a *App) isVerified(uid int64) bool {
+    var verified sql.NullTime
+    if err := a.DB.QueryRow(`SELECT email_verified_at FROM users WHERE id = ?`, uid).Scan(&verified); err != nil {
+        return false
+    }
+    return verified.Valid
+}
+
+// sendVerification creates a new verification token for uid and mails
+// the link to the user's address. Without a configured base URL
+// nothing is done and errNoBaseURL is returned.
+func (a *App) sendVerification(uid int64) error {
+    base, err := a.mailBase()
+    if err != nil {
+        return err
+    }
+    var email, username string
+    if err := a.DB.QueryRow(`SELECT email, username FROM users WHERE id = ?`, uid).Scan(&email, &username); err != nil {
+        return err
+    }
+    token, err := newToken()
+    if err != nil {
+        return err
+    }
+    _, err = a.DB.Exec(`INSERT INTO email_verifications(user_id, token_hash, expires_at) VALUES(?,?,?)`,
+        uid, hashToken(token), time.Now().Add(verifyTokenTTL).UTC())
+    if err != nil {
+        return err
+    }
+    link := base + "/verify?token=" + url.QueryEscape(token)
+    a.sendMail(mail.Message{
+        To:      email,
+        Subject: "Confirm your forum email address",
+        Body: "Hello " + username + ",\n\n" +
+            "please confirm your email address by opening the link below\n" +
+            "within 48 hours. Until then you can read the forum but not\n" +
+            "post or comment.\n\n" +
+            link + "\n\n" +
+            "If you did not create an account, you can ignore this message.\n",
+    })
+    return nil
+}
+
+// verifyEmail marks the owner of token as verified and removes all of
+// their verification tokens. Unknown or expired tokens yield
+// errVerifyToken.
+func (a *App) verifyEmail(token string) error {
+    return a.inTx(func(tx *sql.Tx) error {
+        var uid int64
+        var expires time.Time
+        err := tx.QueryRow(`SELECT user_id, expires_at FROM email_verifications WHERE token_hash = ?`, hashToken(token)).Scan(&uid, &expires)
+        if err == sql.ErrNoRows || (err == nil && time.Now().After(expires)) {
+            return errVerifyToken
+        }
+        if err != nil {
+            return err
+        }
+        return a.markVerified(tx, uid)
+    })
+}
+
+// markVerified sets the verification time of uid unless it is already
+// set and removes the user's outstanding tokens.
+func (a *App) markVerified(tx *sql.Tx, uid int64) error {
+    if _, err := tx.Exec(`UPDATE users SET email_verified_at = ? WHERE id = ? AND email_verified_at IS NULL`, time.Now().UTC(), uid); err != nil {
+        return err
+    }
+    _, err := tx.Exec(`DELETE FROM email_verifications WHERE user_id = ?`, uid)
+    return err
+}
+
+// HandleVerify confirms an email address when called with a `token`
+// query parameter, as in the emailed link. Without a token it shows
+// the verification status of the logged-in user along with a button
+// to send a new link.
+func (a *App) HandleVerify(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    data := a.baseData(r)
+    if token := r.URL.Query().Get("token"); token != "" {
+        err := a.verifyEmail(token)
+        if err != nil && err != errVerifyToken {
+            http.Error(w, "database error", http.StatusInternalServerError)
+            return
+        }
+        data["Invalid"] = err == errVerifyToken
+        data["JustVerified"] = err == nil
+        // Refresh the banner state now that the account may be
+        // verified.
+        data["Unverified"] = data["LoggedIn"].(bool) && !a.isVerified(data["UserID"].(int64))
+    }
+    data["Sent"] = r.URL.Query().Get("sent") == "1"
+    if msg := r.URL.Query().Get("error"); msg != "" {
+        data["Error"] = msg
+    }
+    tmpl := a.Templates.Lookup("verify.html")
+    tmpl.ExecuteTemplate(w, "verify.html", data)
+}
+
+// HandleResendVerification mails a new verification link to the
+// logged-in user. Requests within verifyResendInterval of the previous
+// mail are refused.
+func (a *App) HandleResendVerification(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    uid, _, _ := a.CurrentUser(r)
+    if a.isVerified(uid) {
+        http.Redirect(w, r, "/verify", http.StatusSeeOther)
+        return
+    }
+    // MAX() would lose the column's DATETIME type, so the newest row
+    // is selected instead to let the driver parse the time.
+    var last time.Time
+    err := a.DB.QueryRow(`SELECT created_at FROM email_verifications WHERE user_id = ? ORDER BY created_at DESC LIMIT 1`, uid).Scan(&last)
+    if err != nil && err != sql.ErrNoRows {
+        http.Error(w, "database error", http.StatusInternalServerError)
+        return
+    }
+    if err == nil && time.Since(last) < verifyResendInterval {
+        http.Redirect(w, r, "/verify?error="+url.QueryEscape("A link was sent a moment ago. Please wait a few minutes before asking for another one."), http.StatusSeeOther)
+        return
+    }
+    if err := a.sendVerification(uid); err == errNoBaseURL {
+        http.Error(w, "this forum is not set up to send email", http.StatusServiceUnavailable)
+        return
+    } else if err != nil {
+        http.Error(w, "database error", http.StatusInternalServerError)
+        return
+    }
+    http.Redirect(w, r, "/verify?sent=1", http.StatusSeeOther)
+}
+
+// RequireVerified wraps a handler so that it only runs for logged-in
+// users with a verified email address. Anonymous visitors are sent to
+// the login page and unverified users to /verify, which explains what
+// to do.
+func (a *App) RequireVerified(next http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        uid, _, ok := a.CurrentUser(r)
+        if !ok {
+            http.Redirect(w, r, "/login", http.StatusSeeOther)
+            return
+        }
+        if !a.isVerified(uid) {
+            http.Redirect(w, r, "/verify", http.StatusSeeOther)
+            return
+        }
+        next(w, r)
+    }
+}
+
+// PurgeExpired deletes what has outlived its use: expired
+// verification and password reset tokens, email changes, login
+// challenges, OAuth requests and sessions, login failures that no
+// longer count, and webhook deliveries finished more than a month ago.
+// It also deletes regular user accounts that were created more than
+// unverifiedTTL ago and never verified, together with everything that
+// references them; moderators and admins are never removed, and an
+// unverifiedTTL of 0 keeps every account. The number of deleted
+// accounts is returned.
+func (a *App) PurgeExpired(unverifiedTTL time.Duration) (int64, error) {
+    var n int64
+    if unverifiedTTL > 0 {
+        // created_at is filled in by SQLite as "YYYY-MM-DD HH:MM:SS" in
+        // UTC, so the cutoff is formatted the same way to compare as
+        // text.
+        cutoff := time.Now().Add(-unverifiedTTL).UTC().Format("2006-01-02 15:04:05")
+        res, err := a.DB.Exec(`DELETE FROM users WHERE email_verified_at IS NULL AND role = ? AND created_at < ?`, RoleUser, cutoff)
+        if err != nil {
+            return 0, err
+        }
+        n, _ = res.RowsAffected()
+    }
+    now := time.Now().UTC()
+    if _, err := a.DB.Exec(`DELETE FROM email_verifications WHERE expires_at < ?`, now); err != nil {
+        return n, err
+    }
+    if _, err := a.DB.Exec(`DELETE FROM password_resets WHERE expires_at < ?`, now); err != nil {
+        return n, err
+    }
+    if _, err := a.DB.Exec(`DELETE FROM email_changes WHERE expires_at < ?`, now); err != nil {
+        return n, err
+    }
+    if _, err := a.DB.Exec(`DELETE FROM login_challenges WHERE expires_at < ?`, now); err != nil {
+        return n, err
+    }
+    if _, err := a.DB.Exec(`DELETE FROM oauth_states WHERE expires_at < ?`, now); err != nil {
+        return n, err
+    }
+    if _, err := a.DB.Exec(`DELETE FROM login_failures WHERE locked_until < ? AND last_failure_at < ?`, now.Unix(), now.Add(-failureWindow).Unix()); err != nil {
+        return n, err
+    }
+    if _, err := a.DB.Exec(`DELETE FROM webhook_deliveries WHERE status != 'pending' AND last_attempt_at < ?`, now.Add(-webhookLogRetention).Unix()); err != nil {
+        return n, err
+    }
+    // Session expiry is stored as a Unix timestamp.
+    _, err := a.DB.Exec(`DELETE FROM sessions WHERE expires_at < ?`, now.Unix())
+    return n, err
+}
+
+// RunPurge calls PurgeExpired every interval until ctx is cancelled.
+// It is started in the background by main.
+func (a *App) RunPurge(ctx context.Context, interval, unverifiedTTL time.Duration) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for {
+        n, err := a.PurgeExpired(unverifiedTTL)
+        if err != nil {
+            log.Printf("purging expired data failed: %v", err)
+        } else if n > 0 {
+            log.Printf("removed %d unverified account(s)", n)
+        }
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        }
+    }
+}
@@ -0,0 +1,57 @@
+package app
+
+// Tests of the hourly purge of unverified accounts and expired data.
+
+import (
+    "testing"
+    "time"
+)
+
+func TestPurgeExpired(t *testing.T) {
+    a := newTestApp(t)
+    alice := createTestUser(t, a, "alice")
+    addAccess(t, a, alice, "alice")
+    old := time.Now().Add(-10 * 24 * time.Hour).UTC().Format("2006-01-02 15:04:05")
+    add := func(name, role, created string) int64 {
+        res, err := a.DB.Exec(`INSERT INTO users(email, username, password_hash, role, created_at) VALUES(?,?,?,?,?)`,
+            name+"@example.com", name, "-", role, created)
+        if err != nil {
+            t.Fatal(err)
+        }
+        id, _ := res.LastInsertId()
+        return id
+    }
+    stale := add("stale", RoleUser, old)
+    add("fresh", RoleUser, time.Now().UTC().Format("2006-01-02 15:04:05"))
+    add("mod", RoleModerator, old)
+    if _, err := a.DB.Exec(`INSERT INTO sessions(id, user_id, expires_at, created_at, last_seen_at, user_agent, ip) VALUES(?,?,?,?,?,?,?)`,
+        "expired", alice, time.Now().Add(-time.Minute).Unix(), old, old, "test", "127.0.0.1"); err != nil {
+        t.Fatal(err)
+    }
+
+    // With no time limit accounts are kept, but expired data still
+    // goes.
+    if n, err := a.PurgeExpired(0); err != nil || n != 0 {
+        t.Fatalf("PurgeExpired(0) = %d, %v", n, err)
+    }
+    if n := count(t, a, `SELECT COUNT(*) FROM users`); n != 4 {
+        t.Fatalf("%d users left, want all 4", n)
+    }
+    if n := count(t, a, `SELECT COUNT(*) FROM sessions WHERE id = 'expired'`); n != 0 {
+        t.Fatal("the expired session was kept")
+    }
+    if n := count(t, a, `SELECT COUNT(*) FROM sessions WHERE id = 'session-alice'`); n != 1 {
+        t.Fatal("a live session was purged")
+    }
+
+    // A week removes the stale account only.
+    if n, err := a.PurgeExpired(7 * 24 * time.Hour); err != nil || n != 1 {
+        t.Fatalf("PurgeExpired(7 days) = %d, %v; want 1", n, err)
+    }
+    if n := count(t, a, `SELECT COUNT(*) FROM users WHERE id = ?`, stale); n != 0 {
+        t.Fatal("the stale unverified account was kept")
+    }
+    if n := count(t, a, `SELECT COUNT(*) FROM users`); n != 3 {
+        t.Fatalf("%d users left, want 3", n)
+    }
+}
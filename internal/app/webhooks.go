@@ -0,0 +1,430 @@
+package app
+
+// This file turns forum events into webhook deliveries and sends them.
+// createPost, createComment and react call the webhook* functions
+// below, which find the active webhooks that subscribe to the event,
+// and to a category of the post it concerns when they are limited to
+// some, and queue one delivery per webhook in webhook_deliveries.
+// RunWebhooks, started by main, sends the queued deliveries and retries
+// failed ones with exponential backoff. Because the queue is a table,
+// deliveries survive restarts. See the webhook package for how a
+// delivery looks on the wire and admin_webhooks.go for the admin pages.
+//
+// Links in payloads are absolute only when App.BaseURL is set, since
+// there is no request to take the host name from; the path is always
+// included.
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "log"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "forum/internal/webhook"
+)
+
+// Webhook event names.
+const (
+    EventPostCreated     = "post.created"
+    EventCommentCreated  = "comment.created"
+    EventReactionChanged = "reaction.changed"
+    // EventPing is sent by the "Send test" button to one webhook only.
+    EventPing = "ping"
+)
+
+// webhookEvents lists the events webhooks can subscribe to, in the
+// order the admin page shows them.
+var webhookEvents = []struct {
+    Name  string
+    Label string
+}{
+    {EventPostCreated, "New posts"},
+    {EventCommentCreated, "New comments and replies"},
+    {EventReactionChanged, "Likes and dislikes added, changed or removed"},
+}
+
+// Delivery schedule. A failed delivery is retried after
+// webhookFirstRetry, then after twice as long each time, until
+// webhookMaxAttempts attempts have failed: with these values the last
+// try comes a little over four hours after the first.
+const (
+    webhookMaxAttempts = 10
+    webhookFirstRetry  = 30 * time.Second
+    webhookTimeout     = 10 * time.Second
+    // webhookBatch is the number of due deliveries loaded at once.
+    webhookBatch = 20
+    // webhookPoll is the longest the sender sleeps when nothing is due,
+    // which picks up webhooks that were switched back on.
+    webhookPoll = time.Minute
+    // webhookLogRetention is how long finished deliveries stay in the
+    // log (see PurgeExpired).
+    webhookLogRetention = 30 * 24 * time.Hour
+)
+
+// webhookClient sends the deliveries. Redirects are not followed: a
+// receiver that moved has to be updated by an admin.
+var webhookClient = &http.Client{
+    Timeout: webhookTimeout,
+    CheckRedirect: func(*http.Request, []*http.Request) error {
+        return http.ErrUseLastResponse
+    },
+}
+
+// webhookPayload is the JSON document sent for an event. Only the
+// fields that belong to the event are set.
+type webhookPayload struct {
+    Event     string           `json:"event"`
+    CreatedAt time.Time        `json:"created_at"`
+    Post      *webhookPost     `json:"post,omitempty"`
+    Comment   *webhookComment  `json:"comment,omitempty"`
+    Reaction  *webhookReaction `json:"reaction,omitempty"`
+    Webhook   *webhookRef      `json:"webhook,omitempty"`
+}
+
+// webhookPost is a post in a payload. Body is the Markdown source.
+type webhookPost struct {
+    ID         int64     `json:"id"`
+    Title      string    `json:"title"`
+    Body       string    `json:"body,omitempty"`
+    Author     string    `json:"author"`
+    Categories []string  `json:"categories"`
+    Path       string    `json:"path"`
+    URL        string    `json:"url,omitempty"`
+    CreatedAt  time.Time `json:"created_at"`
+}
+
+// webhookComment is a comment in a payload. Body is the Markdown
+// source.
+type webhookComment struct {
+    ID        int64     `json:"id"`
+    ParentID  *int64    `json:"parent_id"`
+    Body      string    `json:"body"`
+    Author    string    `json:"author"`
+    Path      string    `json:"path"`
+    URL       string    `json:"url,omitempty"`
+    CreatedAt time.Time `json:"created_at"`
+}
+
+// webhookReaction describes a changed reaction. Value is the user's
+// reaction after the change: 1, -1 or 0 when it was taken back. Likes
+// and Dislikes are the new totals of the target.
+type webhookReaction struct {
+    TargetType string `json:"target_type"`
+    TargetID   int64  `json:"target_id"`
+    User       string `json:"user"`
+    Value      int    `json:"value"`
+    Likes      int    `json:"likes"`
+    Dislikes   int    `json:"dislikes"`
+}
+
+// webhookRef names the webhook a ping is sent to.
+type webhookRef struct {
+    ID int64 `json:"id"`
+}
+
+// webhookPostCreated queues post.created deliveries for post pid.
+func (a *App) webhookPostCreated(pid int64) {
+    a.emitWebhook(EventPostCreated, pid, func() (*webhookPayload, error) {
+        p, err := a.webhookPostData(pid, true)
+        if err != nil {
+            return nil, err
+        }
+        return &webhookPayload{Post: p}, nil
+    })
+}
+
+// webhookCommentCreated queues comment.created deliveries for comment
+// cid of post pid.
+func (a *App) webhookCommentCreated(pid, cid int64) {
+    a.emitWebhook(EventCommentCreated, pid, func() (*webhookPayload, error) {
+        p, err := a.webhookPostData(pid, false)
+        if err != nil {
+            return nil, err
+        }
+        c := &webhookComment{ID: cid, Path: a.commentURL(pid, cid)}
+        var parent sql.NullInt64
+        err = a.DB.QueryRow(`SELECT c.parent_id, c.body, u.username, c.created_at FROM comments c JOIN users u ON u.id = c.user_id WHERE c.id = ?`, cid).
+            Scan(&parent, &c.Body, &c.Author, &c.CreatedAt)
+        if err != nil {
+            return nil, err
+        }
+        if parent.Valid {
+            c.ParentID = &parent.Int64
+        }
+        c.URL = a.webhookLink(c.Path)
+        return &webhookPayload{Post: p, Comment: c}, nil
+    })
+}
+
+// webhookReactionChanged queues reaction.changed deliveries after user
+// uid changed their reaction to the target to value.
+func (a *App) webhookReactionChanged(uid int64, targetType string, targetID int64, value int) {
+    pid := targetID
+    if targetType == "comment" {
+        if err := a.DB.QueryRow(`SELECT post_id FROM comments WHERE id = ?`, targetID).Scan(&pid); err != nil {
+            log.Printf("webhook %s for comment %d: %v", EventReactionChanged, targetID, err)
+            return
+        }
+    }
+    a.emitWebhook(EventReactionChanged, pid, func() (*webhookPayload, error) {
+        p, err := a.webhookPostData(pid, false)
+        if err != nil {
+            return nil, err
+        }
+        re := &webhookReaction{TargetType: targetType, TargetID: targetID, Value: value}
+        if err := a.DB.QueryRow(`SELECT username FROM users WHERE id = ?`, uid).Scan(&re.User); err != nil {
+            return nil, err
+        }
+        re.Likes, re.Dislikes, _, err = a.reactionCounts(0, targetType, targetID)
+        if err != nil {
+            return nil, err
+        }
+        return &webhookPayload{Post: p, Reaction: re}, nil
+    })
+}
+
+// webhookPostData loads post pid for a payload, with its body when
+// withBody is set.
+func (a *App) webhookPostData(pid int64, withBody bool) (*webhookPost, error) {
+    p := &webhookPost{ID: pid, Categories: []string{}}
+    var body string
+    err := a.DB.QueryRow(`SELECT p.title, p.body, u.username, p.created_at FROM posts p JOIN users u ON u.id = p.user_id WHERE p.id = ?`, pid).
+        Scan(&p.Title, &body, &p.Author, &p.CreatedAt)
+    if err != nil {
+        return nil, err
+    }
+    if withBody {
+        p.Body = body
+    }
+    rows, err := a.DB.Query(`SELECT c.name FROM post_categories pc JOIN categories c ON c.id = pc.category_id WHERE pc.post_id = ? ORDER BY c.position, c.name`, pid)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var name string
+        if err := rows.Scan(&name); err != nil {
+            return nil, err
+        }
+        p.Categories = append(p.Categories, name)
+    }
+    p.Path = "/post?id=" + strconv.FormatInt(pid, 10)
+    p.URL = a.webhookLink(p.Path)
+    return p, rows.Err()
+}
+
+// webhookLink returns the absolute URL of path, or "" when no BaseURL
+// is configured.
+func (a *App) webhookLink(path string) string {
+    if a.BaseURL == "" {
+        return ""
+    }
+    return strings.TrimSuffix(a.BaseURL, "/") + path
+}
+
+// emitWebhook queues a delivery of event to every active webhook that
+// subscribes to it and is not limited to categories post pid lacks.
+// build makes the payload; it is only called when some webhook wants
+// the event. Failures are logged: the event itself has happened.
+func (a *App) emitWebhook(event string, pid int64, build func() (*webhookPayload, error)) {
+    rows, err := a.DB.Query(`SELECT w.id FROM webhooks w
+        JOIN webhook_events e ON e.webhook_id = w.id AND e.event = ?
+        WHERE w.active = 1 AND (
+            NOT EXISTS (SELECT 1 FROM webhook_categories wc WHERE wc.webhook_id = w.id)
+            OR EXISTS (SELECT 1 FROM webhook_categories wc JOIN post_categories pc ON pc.category_id = wc.category_id
+                WHERE wc.webhook_id = w.id AND pc.post_id = ?))`, event, pid)
+    if err != nil {
+        log.Printf("webhook %s for post %d: %v", event, pid, err)
+        return
+    }
+    var hooks []int64
+    for rows.Next() {
+        var id int64
+        if err := rows.Scan(&id); err != nil {
+            rows.Close()
+            log.Printf("webhook %s for post %d: %v", event, pid, err)
+            return
+        }
+        hooks = append(hooks, id)
+    }
+    rows.Close()
+    if len(hooks) == 0 {
+        return
+    }
+    payload, err := build()
+    if err == nil {
+        err = a.queueWebhook(event, payload, hooks...)
+    }
+    if err != nil {
+        log.Printf("webhook %s for post %d: %v", event, pid, err)
+    }
+}
+
+// queueWebhook adds a delivery of payload as event for each of the
+// webhooks and wakes the sender.
+func (a *App) queueWebhook(event string, payload *webhookPayload, hooks ...int64) error {
+    payload.Event = event
+    payload.CreatedAt = time.Now().UTC()
+    data, err := json.Marshal(payload)
+    if err != nil {
+        return err
+    }
+    err = a.inTx(func(tx *sql.Tx) error {
+        for _, id := range hooks {
+            if _, err := tx.Exec(`INSERT INTO webhook_deliveries(webhook_id, event, payload, next_attempt_at) VALUES(?,?,?,?)`,
+                id, event, string(data), time.Now().Unix()); err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+    if err == nil {
+        a.wakeWebhooks()
+    }
+    return err
+}
+
+// wakeWebhooks tells RunWebhooks that there is something to send.
+func (a *App) wakeWebhooks() {
+    select {
+    case a.webhookWake() <- struct{}{}:
+    default:
+        // The sender already has a wake-up pending.
+    }
+}
+
+// webhookWake returns the channel that wakes RunWebhooks.
+func (a *App) webhookWake() chan struct{} {
+    a.webhookOnce.Do(func() {
+        a.webhookSignal = make(chan struct{}, 1)
+    })
+    return a.webhookSignal
+}
+
+// RunWebhooks sends queued webhook deliveries until ctx is cancelled.
+// It is started in the background by main. Deliveries are sent one at
+// a time, oldest due first.
+func (a *App) RunWebhooks(ctx context.Context) {
+    for {
+        n, err := a.sendDueWebhooks(ctx)
+        if ctx.Err() != nil {
+            return
+        }
+        if err != nil {
+            log.Printf("sending webhooks: %v", err)
+        }
+        if err == nil && n == webhookBatch {
+            // There may be more due right away.
+            continue
+        }
+        wait := webhookPoll
+        var next sql.NullInt64
+        if err == nil && a.DB.QueryRow(`SELECT next_attempt_at FROM webhook_deliveries d JOIN webhooks w ON w.id = d.webhook_id
+            WHERE d.status = 'pending' AND w.active = 1 ORDER BY d.next_attempt_at LIMIT 1`).Scan(&next) == nil {
+            if d := time.Until(time.Unix(next.Int64, 0)); d < wait {
+                wait = d
+            }
+        }
+        if wait < time.Second {
+            wait = time.Second
+        }
+        timer := time.NewTimer(wait)
+        select {
+        case <-ctx.Done():
+            timer.Stop()
+            return
+        case <-a.webhookWake():
+        case <-timer.C:
+        }
+        timer.Stop()
+    }
+}
+
+// dueWebhook is a delivery ready to be sent.
+type dueWebhook struct {
+    id       int64
+    event    string
+    payload  string
+    attempts int
+    url      string
+    secret   string
+}
+
+// sendDueWebhooks sends up to webhookBatch deliveries that are due and
+// records the outcome of each. It returns how many it tried.
+func (a *App) sendDueWebhooks(ctx context.Context) (int, error) {
+    rows, err := a.DB.Query(`SELECT d.id, d.event, d.payload, d.attempts, w.url, w.secret
+        FROM webhook_deliveries d JOIN webhooks w ON w.id = d.webhook_id
+        WHERE d.status = 'pending' AND d.next_attempt_at <= ? AND w.active = 1
+        ORDER BY d.next_attempt_at, d.id LIMIT ?`, time.Now().Unix(), webhookBatch)
+    if err != nil {
+        return 0, err
+    }
+    var due []dueWebhook
+    for rows.Next() {
+        var d dueWebhook
+        if err := rows.Scan(&d.id, &d.event, &d.payload, &d.attempts, &d.url, &d.secret); err != nil {
+            rows.Close()
+            return 0, err
+        }
+        due = append(due, d)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return 0, err
+    }
+    for i, d := range due {
+        res, err := webhook.Send(ctx, webhookClient, d.url, d.secret, d.event, d.id, []byte(d.payload))
+        if ctx.Err() != nil {
+            // Shutting down: the attempt was cut short, so it does
+            // not count. The delivery is tried again after a restart.
+            return i, nil
+        }
+        if err := a.recordWebhookAttempt(d, res, err); err != nil {
+            return i + 1, err
+        }
+    }
+    return len(due), nil
+}
+
+// recordWebhookAttempt stores the outcome of sending d, both on the
+// delivery and as a new row of its attempt history, and schedules the
+// next attempt when it failed and attempts remain.
+func (a *App) recordWebhookAttempt(d dueWebhook, res webhook.Result, sendErr error) error {
+    now := time.Now()
+    attempts := d.attempts + 1
+    status, next, msg := "delivered", now, ""
+    if sendErr != nil {
+        msg = sendErr.Error()
+        status = "pending"
+        next = now.Add(webhookBackoff(attempts))
+        if attempts >= webhookMaxAttempts {
+            status = "failed"
+        }
+    }
+    var code sql.NullInt64
+    if res.Status != 0 {
+        code = sql.NullInt64{Int64: int64(res.Status), Valid: true}
+    }
+    return a.inTx(func(tx *sql.Tx) error {
+        _, err := tx.Exec(`UPDATE webhook_deliveries SET status = ?, attempts = ?, next_attempt_at = ?, last_attempt_at = ?,
+            last_status = ?, last_error = ?, last_response = ?, last_duration_ms = ? WHERE id = ?`,
+            status, attempts, next.Unix(), now.Unix(), code, msg, res.Body, res.Duration.Milliseconds(), d.id)
+        if err != nil {
+            return err
+        }
+        _, err = tx.Exec(`INSERT INTO webhook_attempts(delivery_id, attempted_at, status, error, duration_ms) VALUES(?,?,?,?,?)`,
+            d.id, now.Unix(), code, msg, res.Duration.Milliseconds())
+        return err
+    })
+}
+
+// webhookBackoff returns the wait before the next attempt after the
+// given number of failed attempts.
+func webhookBackoff(attempts int) time.Duration {
+    return webhookFirstRetry << (attempts - 1)
+}
@@ -0,0 +1,263 @@
+package app
+
+// Tests of the webhook delivery queue against a local receiver. The
+// tests drive sendDueWebhooks by hand instead of running RunWebhooks,
+// and make a retry due by moving its next_attempt_at to the present,
+// so they run without waiting for the backoff.
+
+import (
+    "context"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "sync"
+    "testing"
+    "time"
+
+    "forum/internal/webhook"
+)
+
+const testWebhookSecret = "test-secret"
+
+// testReceiver is a webhook receiver that fails the first fail
+// requests with 500 Internal Server Error.
+type testReceiver struct {
+    t *testing.T
+
+    mu    sync.Mutex
+    fail  int
+    calls int
+}
+
+func (rc *testReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    body, err := io.ReadAll(r.Body)
+    if err != nil {
+        rc.t.Errorf("reading delivery: %v", err)
+    }
+    if err := webhook.Verify(testWebhookSecret, r.Header, body, time.Now()); err != nil {
+        rc.t.Errorf("delivery %s: %v", r.Header.Get(webhook.HeaderDelivery), err)
+    }
+    rc.mu.Lock()
+    defer rc.mu.Unlock()
+    rc.calls++
+    if rc.fail > 0 {
+        rc.fail--
+        http.Error(w, "try again later", http.StatusInternalServerError)
+        return
+    }
+    io.WriteString(w, "ok")
+}
+
+func (rc *testReceiver) callCount() int {
+    rc.mu.Lock()
+    defer rc.mu.Unlock()
+    return rc.calls
+}
+
+// addTestWebhook registers a webhook for url that receives every event.
+func addTestWebhook(t *testing.T, a *App, url string) int64 {
+    t.Helper()
+    res, err := a.DB.Exec(`INSERT INTO webhooks(url, secret) VALUES(?,?)`, url, testWebhookSecret)
+    if err != nil {
+        t.Fatal(err)
+    }
+    id, _ := res.LastInsertId()
+    for _, e := range webhookEvents {
+        if _, err := a.DB.Exec(`INSERT INTO webhook_events(webhook_id, event) VALUES(?,?)`, id, e.Name); err != nil {
+            t.Fatal(err)
+        }
+    }
+    return id
+}
+
+// deliveryState is the queue state of a delivery.
+type deliveryState struct {
+    status      string
+    attempts    int
+    lastStatus  int
+    nextAttempt int64
+    lastAttempt int64
+}
+
+func loadDelivery(t *testing.T, a *App, id int64) deliveryState {
+    t.Helper()
+    var d deliveryState
+    err := a.DB.QueryRow(`SELECT status, attempts, COALESCE(last_status, 0), next_attempt_at, COALESCE(last_attempt_at, 0)
+        FROM webhook_deliveries WHERE id = ?`, id).Scan(&d.status, &d.attempts, &d.lastStatus, &d.nextAttempt, &d.lastAttempt)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return d
+}
+
+// sendDue runs one round of the sender and checks how many deliveries
+// it tried.
+func sendDue(t *testing.T, a *App, want int) {
+    t.Helper()
+    n, err := a.sendDueWebhooks(context.Background())
+    if err != nil {
+        t.Fatalf("sendDueWebhooks: %v", err)
+    }
+    if n != want {
+        t.Fatalf("sendDueWebhooks tried %d deliveries, want %d", n, want)
+    }
+}
+
+// makeDue moves the next attempt of every pending delivery to now.
+func makeDue(t *testing.T, a *App) {
+    t.Helper()
+    if _, err := a.DB.Exec(`UPDATE webhook_deliveries SET next_attempt_at = ? WHERE status = 'pending'`, time.Now().Unix()); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestWebhookRetriesWithBackoff(t *testing.T) {
+    a := newTestApp(t)
+    rc := &testReceiver{t: t, fail: 3}
+    srv := httptest.NewServer(rc)
+    defer srv.Close()
+    hook := addTestWebhook(t, a, srv.URL)
+
+    if err := a.queueWebhook(EventPing, &webhookPayload{Webhook: &webhookRef{ID: hook}}, hook); err != nil {
+        t.Fatal(err)
+    }
+    var id int64
+    if err := a.DB.QueryRow(`SELECT id FROM webhook_deliveries WHERE webhook_id = ?`, hook).Scan(&id); err != nil {
+        t.Fatal(err)
+    }
+
+    // Each failure doubles the wait before the next attempt.
+    for i, wait := range []int64{30, 60, 120} {
+        sendDue(t, a, 1)
+        d := loadDelivery(t, a, id)
+        if d.status != "pending" || d.attempts != i+1 || d.lastStatus != 500 {
+            t.Fatalf("after failure %d: got %+v", i+1, d)
+        }
+        if got := d.nextAttempt - d.lastAttempt; got != wait {
+            t.Fatalf("after failure %d: next attempt in %ds, want %ds", i+1, got, wait)
+        }
+        // Nothing is sent again before the retry is due.
+        sendDue(t, a, 0)
+        makeDue(t, a)
+    }
+
+    sendDue(t, a, 1)
+    d := loadDelivery(t, a, id)
+    if d.status != "delivered" || d.attempts != 4 || d.lastStatus != 200 {
+        t.Fatalf("after success: got %+v", d)
+    }
+
+    // A delivered delivery is never sent again, even when it would be
+    // due.
+    if _, err := a.DB.Exec(`UPDATE webhook_deliveries SET next_attempt_at = 0`); err != nil {
+        t.Fatal(err)
+    }
+    sendDue(t, a, 0)
+    if n := rc.callCount(); n != 4 {
+        t.Fatalf("receiver got %d requests, want 4", n)
+    }
+
+    // Every attempt is in the log, with its outcome.
+    rows, err := a.DB.Query(`SELECT COALESCE(status, 0) FROM webhook_attempts WHERE delivery_id = ? ORDER BY id`, id)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer rows.Close()
+    var statuses []int
+    for rows.Next() {
+        var s int
+        if err := rows.Scan(&s); err != nil {
+            t.Fatal(err)
+        }
+        statuses = append(statuses, s)
+    }
+    want := []int{500, 500, 500, 200}
+    if len(statuses) != len(want) {
+        t.Fatalf("attempt log has %v, want %v", statuses, want)
+    }
+    for i := range want {
+        if statuses[i] != want[i] {
+            t.Fatalf("attempt log has %v, want %v", statuses, want)
+        }
+    }
+}
+
+func TestWebhookGivesUp(t *testing.T) {
+    a := newTestApp(t)
+    rc := &testReceiver{t: t, fail: 1000}
+    srv := httptest.NewServer(rc)
+    defer srv.Close()
+    hook := addTestWebhook(t, a, srv.URL)
+    if err := a.queueWebhook(EventPing, &webhookPayload{Webhook: &webhookRef{ID: hook}}, hook); err != nil {
+        t.Fatal(err)
+    }
+    for i := 0; i < webhookMaxAttempts; i++ {
+        sendDue(t, a, 1)
+        makeDue(t, a)
+    }
+    if n := count(t, a, `SELECT COUNT(*) FROM webhook_deliveries WHERE status = 'failed' AND attempts = ?`, webhookMaxAttempts); n != 1 {
+        t.Fatalf("delivery not failed after %d attempts", webhookMaxAttempts)
+    }
+    sendDue(t, a, 0)
+    if n := count(t, a, `SELECT COUNT(*) FROM webhook_attempts`); n != webhookMaxAttempts {
+        t.Fatalf("attempt log has %d rows, want %d", n, webhookMaxAttempts)
+    }
+}
+
+func TestWebhookUnreachableReceiver(t *testing.T) {
+    a := newTestApp(t)
+    srv := httptest.NewServer(http.NotFoundHandler())
+    url := srv.URL
+    srv.Close()
+    hook := addTestWebhook(t, a, url)
+    if err := a.queueWebhook(EventPing, &webhookPayload{Webhook: &webhookRef{ID: hook}}, hook); err != nil {
+        t.Fatal(err)
+    }
+    sendDue(t, a, 1)
+    var status, msg string
+    var code *int
+    err := a.DB.QueryRow(`SELECT d.status, a.status, a.error FROM webhook_attempts a JOIN webhook_deliveries d ON d.id = a.delivery_id`).
+        Scan(&status, &code, &msg)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if status != "pending" || code != nil || msg == "" {
+        t.Fatalf("got status %q, HTTP status %v, error %q; want a pending retry without status and with an error", status, code, msg)
+    }
+}
+
+func TestWebhookCategoryFilter(t *testing.T) {
+    a := newTestApp(t)
+    uid := createTestUser(t, a, "alice")
+    everything := addTestWebhook(t, a, "http://127.0.0.1:1/")
+    limited := addTestWebhook(t, a, "http://127.0.0.1:1/")
+    var general, help int64
+    if err := a.DB.QueryRow(`SELECT id FROM categories WHERE name = 'General'`).Scan(&general); err != nil {
+        t.Fatal(err)
+    }
+    if err := a.DB.QueryRow(`SELECT id FROM categories WHERE name = 'Help'`).Scan(&help); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := a.DB.Exec(`INSERT INTO webhook_categories(webhook_id, category_id) VALUES(?,?)`, limited, help); err != nil {
+        t.Fatal(err)
+    }
+    post := func(category int64) int64 {
+        res, err := a.DB.Exec(`INSERT INTO posts(user_id, title, body) VALUES(?,?,?)`, uid, "Title", "Body")
+        if err != nil {
+            t.Fatal(err)
+        }
+        pid, _ := res.LastInsertId()
+        if _, err := a.DB.Exec(`INSERT INTO post_categories(post_id, category_id) VALUES(?,?)`, pid, category); err != nil {
+            t.Fatal(err)
+        }
+        return pid
+    }
+    a.webhookPostCreated(post(general))
+    a.webhookPostCreated(post(help))
+    if n := count(t, a, `SELECT COUNT(*) FROM webhook_deliveries WHERE webhook_id = ?`, everything); n != 2 {
+        t.Errorf("unfiltered webhook got %d deliveries, want 2", n)
+    }
+    if n := count(t, a, `SELECT COUNT(*) FROM webhook_deliveries WHERE webhook_id = ?`, limited); n != 1 {
+        t.Errorf("webhook limited to Help got %d deliveries, want 1", n)
+    }
+}
@@ -0,0 +1,248 @@
+package db
+
+// This file implements a small versioned migration runner for the
+// forum database. Migrations are plain SQL files embedded into the
+// binary from the migrations directory. Each migration has an "up"
+// file that moves the schema forward and a "down" file that reverts
+// it. File names follow the pattern `0002_add_roles.up.sql` where the
+// leading number is the version. Applied versions are recorded in the
+// schema_migrations table so that every migration runs exactly once.
+
+import (
+    "database/sql"
+    "embed"
+    "fmt"
+    "io/fs"
+    "path"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// migrationFiles holds every SQL file in the migrations directory.
+// Embedding them means the binary can upgrade a database no matter
+// which directory it is started from.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Migration describes a single schema change. Up and Down hold the
+// SQL text executed when applying and reverting the migration.
+type Migration struct {
+    Version int
+    Name    string
+    Up      string
+    Down    string
+}
+
+// MigrationStatus reports whether a migration has been applied to a
+// database and, if so, when.
+type MigrationStatus struct {
+    Migration
+    Applied   bool
+    AppliedAt time.Time
+}
+
+// createMigrationsTable is executed before any other operation so that
+// the runner can record its progress.
+const createMigrationsTable = `CREATE TABLE IF NOT EXISTS schema_migrations (
+    version INTEGER PRIMARY KEY,
+    name TEXT NOT NULL,
+    applied_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+)`
+
+// Migrations returns all embedded migrations sorted by version. Every
+// version must have both an up and a down file; a missing half or a
+// duplicate version is reported as an error.
+func Migrations() ([]Migration, error) {
+    return parseMigrations(migrationFiles)
+}
+
+// parseMigrations reads the migrations in the migrations directory of
+// fsys. The tests use it with migrations of their own.
+func parseMigrations(fsys fs.FS) ([]Migration, error) {
+    files, err := fs.Glob(fsys, "migrations/*.sql")
+    if err != nil {
+        return nil, err
+    }
+    byVersion := make(map[int]*Migration)
+    for _, file := range files {
+        base := path.Base(file)
+        // Split "0001_initial.up.sql" into "0001_initial" and "up".
+        name := strings.TrimSuffix(base, ".sql")
+        dot := strings.LastIndex(name, ".")
+        if dot < 0 {
+            return nil, fmt.Errorf("migration %s: missing .up or .down suffix", base)
+        }
+        direction := name[dot+1:]
+        name = name[:dot]
+        under := strings.Index(name, "_")
+        if under < 0 {
+            return nil, fmt.Errorf("migration %s: missing version prefix", base)
+        }
+        version, err := strconv.Atoi(name[:under])
+        if err != nil || version <= 0 {
+            return nil, fmt.Errorf("migration %s: invalid version", base)
+        }
+        body, err := fs.ReadFile(fsys, file)
+        if err != nil {
+            return nil, err
+        }
+        m, ok := byVersion[version]
+        if !ok {
+            m = &Migration{Version: version, Name: name[under+1:]}
+            byVersion[version] = m
+        } else if m.Name != name[under+1:] {
+            return nil, fmt.Errorf("migration %s: version %d already used by %q", base, version, m.Name)
+        }
+        switch direction {
+        case "up":
+            m.Up = string(body)
+        case "down":
+            m.Down = string(body)
+        default:
+            return nil, fmt.Errorf("migration %s: unknown direction %q", base, direction)
+        }
+    }
+    out := make([]Migration, 0, len(byVersion))
+    for _, m := range byVersion {
+        if m.Up == "" || m.Down == "" {
+            return nil, fmt.Errorf("migration %04d_%s: both up and down files are required", m.Version, m.Name)
+        }
+        out = append(out, *m)
+    }
+    sort.Slice(out, func(i, j int) bool { return out[i].Version < out[j].Version })
+    return out, nil
+}
+
+// appliedVersions returns the recorded versions along with the time
+// each one was applied.
+func appliedVersions(db *sql.DB) (map[int]time.Time, error) {
+    if _, err := db.Exec(createMigrationsTable); err != nil {
+        return nil, err
+    }
+    rows, err := db.Query(`SELECT version, applied_at FROM schema_migrations`)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    applied := make(map[int]time.Time)
+    for rows.Next() {
+        var version int
+        var at time.Time
+        if err := rows.Scan(&version, &at); err != nil {
+            return nil, err
+        }
+        applied[version] = at
+    }
+    return applied, rows.Err()
+}
+
+// Up applies every pending migration in version order and returns the
+// migrations that were applied. Each migration runs inside its own
+// transaction together with the insert into schema_migrations, so a
+// failing migration leaves the database at the previous version.
+func Up(db *sql.DB) ([]Migration, error) {
+    all, err := Migrations()
+    if err != nil {
+        return nil, err
+    }
+    return up(db, all)
+}
+
+// up applies the migrations of all that are still pending.
+func up(db *sql.DB, all []Migration) ([]Migration, error) {
+    applied, err := appliedVersions(db)
+    if err != nil {
+        return nil, err
+    }
+    var done []Migration
+    for _, m := range all {
+        if _, ok := applied[m.Version]; ok {
+            continue
+        }
+        err := inTx(db, func(tx *sql.Tx) error {
+            if _, err := tx.Exec(m.Up); err != nil {
+                return err
+            }
+            _, err := tx.Exec(`INSERT INTO schema_migrations(version, name) VALUES(?,?)`, m.Version, m.Name)
+            return err
+        })
+        if err != nil {
+            return done, fmt.Errorf("migration %04d_%s: %w", m.Version, m.Name, err)
+        }
+        done = append(done, m)
+    }
+    return done, nil
+}
+
+// Down reverts the most recently applied migration and returns it. If
+// no migration has been applied a nil migration is returned.
+func Down(db *sql.DB) (*Migration, error) {
+    all, err := Migrations()
+    if err != nil {
+        return nil, err
+    }
+    return down(db, all)
+}
+
+// down reverts the latest migration of all that has been applied.
+func down(db *sql.DB, all []Migration) (*Migration, error) {
+    applied, err := appliedVersions(db)
+    if err != nil {
+        return nil, err
+    }
+    // Walk backwards to find the latest applied migration we know of.
+    for i := len(all) - 1; i >= 0; i-- {
+        m := all[i]
+        if _, ok := applied[m.Version]; !ok {
+            continue
+        }
+        err := inTx(db, func(tx *sql.Tx) error {
+            if _, err := tx.Exec(m.Down); err != nil {
+                return err
+            }
+            _, err := tx.Exec(`DELETE FROM schema_migrations WHERE version = ?`, m.Version)
+            return err
+        })
+        if err != nil {
+            return nil, fmt.Errorf("migration %04d_%s: %w", m.Version, m.Name, err)
+        }
+        return &m, nil
+    }
+    return nil, nil
+}
+
+// Status lists every embedded migration and whether it has been
+// applied to the database.
+func Status(db *sql.DB) ([]MigrationStatus, error) {
+    all, err := Migrations()
+    if err != nil {
+        return nil, err
+    }
+    applied, err := appliedVersions(db)
+    if err != nil {
+        return nil, err
+    }
+    out := make([]MigrationStatus, 0, len(all))
+    for _, m := range all {
+        at, ok := applied[m.Version]
+        out = append(out, MigrationStatus{Migration: m, Applied: ok, AppliedAt: at})
+    }
+    return out, nil
+}
+
+// inTx runs fn inside a transaction, committing when it succeeds and
+// rolling back when it returns an error.
+func inTx(db *sql.DB, fn func(tx *sql.Tx) error) error {
+    tx, err := db.Begin()
+    if err != nil {
+        return err
+    }
+    if err := fn(tx); err != nil {
+        tx.Rollback()
+        return err
+    }
+    return tx.Commit()
+}
@@ -0,0 +1,238 @@
+package db
+
+// Tests of the migration runner, on in-memory databases. The real
+// migrations are applied, reverted one by one and applied again; the
+// behaviour on failure is checked with a small set of migrations of
+// the test's own. The search migration needs SQLite's FTS5 extension,
+// which the driver only compiles in with the sqlite_fts5 build tag;
+// without it the test of the real migrations is skipped.
+
+import (
+    "database/sql"
+    "strings"
+    "testing"
+    "testing/fstest"
+
+    _ "github.com/mattn/go-sqlite3"
+)
+
+// openMemory returns an empty in-memory database. It is limited to
+// one connection because every connection to ":memory:" would get a
+// database of its own.
+func openMemory(t *testing.T) *sql.DB {
+    t.Helper()
+    db, err := sql.Open("sqlite3", ":memory:?_foreign_keys=on")
+    if err != nil {
+        t.Fatal(err)
+    }
+    db.SetMaxOpenConns(1)
+    t.Cleanup(func() { db.Close() })
+    return db
+}
+
+// schema returns the definition of every table, index and trigger,
+// in name order.
+func schema(t *testing.T, db *sql.DB) []string {
+    t.Helper()
+    rows, err := db.Query(`SELECT type, name, COALESCE(sql, '') FROM sqlite_master WHERE name NOT LIKE 'sqlite_%' ORDER BY type, name`)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer rows.Close()
+    var out []string
+    for rows.Next() {
+        var typ, name, def string
+        if err := rows.Scan(&typ, &name, &def); err != nil {
+            t.Fatal(err)
+        }
+        out = append(out, typ+" "+name+": "+def)
+    }
+    return out
+}
+
+// recorded returns the versions in schema_migrations, in order.
+func recorded(t *testing.T, db *sql.DB) []int {
+    t.Helper()
+    rows, err := db.Query(`SELECT version FROM schema_migrations ORDER BY version`)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer rows.Close()
+    var out []int
+    for rows.Next() {
+        var v int
+        rows.Scan(&v)
+        out = append(out, v)
+    }
+    return out
+}
+
+func TestUpDownUp(t *testing.T) {
+    all, err := Migrations()
+    if err != nil {
+        t.Fatalf("Migrations: %v", err)
+    }
+    db := openMemory(t)
+    applied, err := Up(db)
+    if err != nil {
+        if strings.Contains(err.Error(), "fts5") {
+            t.Skip("the schema needs FTS5; run the tests with -tags sqlite_fts5")
+        }
+        t.Fatalf("Up: %v", err)
+    }
+    if len(applied) != len(all) {
+        t.Fatalf("Up applied %d migrations, want %d", len(applied), len(all))
+    }
+    if got := recorded(t, db); len(got) != len(all) {
+        t.Fatalf("schema_migrations holds %v", got)
+    }
+    full := strings.Join(schema(t, db), "\n")
+
+    // Up again has nothing to do.
+    if applied, err := Up(db); err != nil || len(applied) != 0 {
+        t.Fatalf("second Up applied %d migrations (%v)", len(applied), err)
+    }
+
+    // Revert everything, newest first.
+    for i := len(all) - 1; i >= 0; i-- {
+        m, err := Down(db)
+        if err != nil {
+            t.Fatalf("Down: %v", err)
+        }
+        if m == nil || m.Version != all[i].Version {
+            t.Fatalf("Down reverted %v, want %04d_%s", m, all[i].Version, all[i].Name)
+        }
+        if got := recorded(t, db); len(got) != i {
+            t.Fatalf("after reverting %04d, schema_migrations holds %v", m.Version, got)
+        }
+    }
+    if m, err := Down(db); m != nil || err != nil {
+        t.Fatalf("Down on an empty database returned %v, %v", m, err)
+    }
+    // Only the runner's own table is left.
+    if got := schema(t, db); len(got) != 1 || !strings.HasPrefix(got[0], "table schema_migrations:") {
+        t.Fatalf("down migrations left behind:\n%s", strings.Join(got, "\n"))
+    }
+
+    // And up again to the same schema.
+    if _, err := Up(db); err != nil {
+        t.Fatalf("Up after Down: %v", err)
+    }
+    if got := strings.Join(schema(t, db), "\n"); got != full {
+        t.Fatalf("schema differs after down and up again:\n%s\nwant\n%s", got, full)
+    }
+}
+
+func TestFailingMigrationRollsBack(t *testing.T) {
+    all, err := parseMigrations(fstest.MapFS{
+        "migrations/0001_notes.up.sql":     {Data: []byte("CREATE TABLE notes (id INTEGER PRIMARY KEY, body TEXT);")},
+        "migrations/0001_notes.down.sql":   {Data: []byte("DROP TABLE IF EXISTS notes;")},
+        "migrations/0002_tags.up.sql":      {Data: []byte("CREATE TABLE tags (id INTEGER PRIMARY KEY);\nINSERT INTO notes(body) VALUES('half done');\nINSERT INTO missing VALUES(1);")},
+        "migrations/0002_tags.down.sql":    {Data: []byte("DROP TABLE IF EXISTS tags;")},
+        "migrations/0003_authors.up.sql":   {Data: []byte("CREATE TABLE authors (id INTEGER PRIMARY KEY);")},
+        "migrations/0003_authors.down.sql": {Data: []byte("DROP TABLE IF EXISTS authors;")},
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    db := openMemory(t)
+    applied, err := up(db, all)
+    if err == nil || !strings.Contains(err.Error(), "0002_tags") {
+        t.Fatalf("up returned %v, want the error of 0002_tags", err)
+    }
+    if len(applied) != 1 || applied[0].Version != 1 {
+        t.Fatalf("up reports %v as applied, want only 0001", applied)
+    }
+    if got := recorded(t, db); len(got) != 1 || got[0] != 1 {
+        t.Fatalf("schema_migrations holds %v, want [1]", got)
+    }
+    // Nothing of 0002 survived, and 0003 did not run.
+    s := strings.Join(schema(t, db), "\n")
+    if strings.Contains(s, "tags") || strings.Contains(s, "authors") {
+        t.Fatalf("the failed migration left tables behind:\n%s", s)
+    }
+    var n int
+    db.QueryRow(`SELECT COUNT(*) FROM notes`).Scan(&n)
+    if n != 0 {
+        t.Fatalf("the failed migration left %d rows behind", n)
+    }
+
+    // Once fixed, the migration runs.
+    all[1].Up = "CREATE TABLE tags (id INTEGER PRIMARY KEY);"
+    if applied, err := up(db, all); err != nil || len(applied) != 2 {
+        t.Fatalf("up after the fix applied %d migrations (%v), want 2", len(applied), err)
+    }
+
+    // A failing down migration stays recorded.
+    all[2].Down = "DROP TABLE missing;"
+    if _, err := down(db, all); err == nil {
+        t.Fatal("down succeeded with a failing migration")
+    }
+    if got := recorded(t, db); len(got) != 3 {
+        t.Fatalf("schema_migrations holds %v after a failed down, want all three", got)
+    }
+}
+
+func TestParseMigrations(t *testing.T) {
+    file := func(data string) *fstest.MapFile { return &fstest.MapFile{Data: []byte(data)} }
+    tests := map[string]fstest.MapFS{
+        "missing down": {
+            "migrations/0001_a.up.sql": file("SELECT 1;"),
+        },
+        "version used twice": {
+            "migrations/0001_a.up.sql":   file("SELECT 1;"),
+            "migrations/0001_a.down.sql": file("SELECT 1;"),
+            "migrations/0001_b.up.sql":   file("SELECT 1;"),
+            "migrations/0001_b.down.sql": file("SELECT 1;"),
+        },
+        "no direction": {
+            "migrations/0001_a.sql": file("SELECT 1;"),
+        },
+        "unknown direction": {
+            "migrations/0001_a.sideways.sql": file("SELECT 1;"),
+        },
+        "no version": {
+            "migrations/initial.up.sql": file("SELECT 1;"),
+        },
+        "version zero": {
+            "migrations/0000_a.up.sql":   file("SELECT 1;"),
+            "migrations/0000_a.down.sql": file("SELECT 1;"),
+        },
+    }
+    for name, fsys := range tests {
+        if _, err := parseMigrations(fsys); err == nil {
+            t.Errorf("%s: no error", name)
+        }
+    }
+
+    // Versions come out in order, whatever order the files are in.
+    all, err := parseMigrations(fstest.MapFS{
+        "migrations/0010_c.up.sql":   file("c"),
+        "migrations/0010_c.down.sql": file("-c"),
+        "migrations/0002_b.up.sql":   file("b"),
+        "migrations/0002_b.down.sql": file("-b"),
+        "migrations/0001_a.up.sql":   file("a"),
+        "migrations/0001_a.down.sql": file("-a"),
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(all) != 3 || all[0].Name != "a" || all[1].Version != 2 || all[2].Up != "c" || all[2].Down != "-c" {
+        t.Fatalf("parsed %+v", all)
+    }
+}
+
+func TestMigrationsAreDocumented(t *testing.T) {
+    all, err := Migrations()
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, m := range all {
+        if !strings.HasPrefix(m.Up, "-- ") {
+            t.Errorf("%04d_%s.up.sql does not start with a comment", m.Version, m.Name)
+        }
+        if !strings.HasPrefix(m.Down, "-- ") {
+            t.Errorf("%04d_%s.down.sql does not start with a comment", m.Version, m.Name)
+        }
+    }
+}
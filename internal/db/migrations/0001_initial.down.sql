@@ -0,0 +1,10 @@
+-- Reverts the initial schema by dropping every table it created.
+-- Dependent tables are dropped before the tables they reference.
+
+DROP TABLE IF EXISTS likes;
+DROP TABLE IF EXISTS post_categories;
+DROP TABLE IF EXISTS categories;
+DROP TABLE IF EXISTS comments;
+DROP TABLE IF EXISTS posts;
+DROP TABLE IF EXISTS sessions;
+DROP TABLE IF EXISTS users;
@@ -1,8 +1,10 @@
--- Schema for the forum application.
+-- Initial schema for the forum application.
 --
--- This SQL file defines all tables required by the forum along with a few
--- seed categories. It is safe to run on every startup; each CREATE
--- statement is guarded with IF NOT EXISTS.
+-- This migration defines all tables required by the forum along with a
+-- few seed categories. Every CREATE statement is guarded with IF NOT
+-- EXISTS so that databases created before the migration runner existed
+-- (when this file was executed on every startup) adopt it without
+-- losing any data.
 
 CREATE TABLE IF NOT EXISTS users (
     id INTEGER PRIMARY KEY,
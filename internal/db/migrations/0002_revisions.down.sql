@@ -0,0 +1,6 @@
+-- Removes revision history and the edit timestamps.
+
+DROP INDEX IF EXISTS idx_revisions_target;
+DROP TABLE IF EXISTS revisions;
+ALTER TABLE comments DROP COLUMN updated_at;
+ALTER TABLE posts DROP COLUMN updated_at;
@@ -0,0 +1,22 @@
+-- Allows posts and comments to be edited after publication.
+--
+-- updated_at records when the content was last edited and stays NULL
+-- for content that was never changed. Every edit stores the previous
+-- version in the revisions table so earlier versions can be compared.
+
+ALTER TABLE posts ADD COLUMN updated_at DATETIME;
+ALTER TABLE comments ADD COLUMN updated_at DATETIME;
+
+CREATE TABLE IF NOT EXISTS revisions (
+    id INTEGER PRIMARY KEY,
+    target_type TEXT NOT NULL CHECK (target_type IN ('post','comment')),
+    target_id INTEGER NOT NULL,
+    user_id INTEGER NOT NULL,
+    -- title is only used for posts; comments have no title.
+    title TEXT,
+    body TEXT NOT NULL,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_revisions_target ON revisions(target_type, target_id);
@@ -0,0 +1,3 @@
+-- Removes API tokens.
+
+DROP TABLE IF EXISTS api_tokens;
@@ -0,0 +1,15 @@
+-- Personal access tokens for the JSON API.
+--
+-- API clients authenticate with `Authorization: Bearer <token>` as an
+-- alternative to the session cookie. Only the SHA-256 hash of each
+-- token is stored, so a leaked database does not reveal usable tokens.
+
+CREATE TABLE IF NOT EXISTS api_tokens (
+    id INTEGER PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    name TEXT NOT NULL,
+    token_hash TEXT NOT NULL UNIQUE,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_used_at DATETIME,
+    FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+);
@@ -0,0 +1,3 @@
+-- Removes user roles.
+
+ALTER TABLE users DROP COLUMN role;
@@ -0,0 +1,5 @@
+-- Adds a role to every user. Regular members are `user`, moderators
+-- may remove any post or comment and admins may additionally manage
+-- users and categories. Existing accounts become regular users.
+
+ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'user' CHECK (role IN ('user','moderator','admin'));
@@ -0,0 +1,5 @@
+-- Removes category descriptions, ordering and archiving.
+
+ALTER TABLE categories DROP COLUMN archived;
+ALTER TABLE categories DROP COLUMN position;
+ALTER TABLE categories DROP COLUMN description;
@@ -0,0 +1,11 @@
+-- Lets admins manage categories from the web interface. Categories
+-- gain a description, an explicit display position and an archived
+-- flag. Archived categories keep their posts but cannot be chosen for
+-- new ones. Existing categories are numbered in alphabetical order so
+-- the listing does not change.
+
+ALTER TABLE categories ADD COLUMN description TEXT NOT NULL DEFAULT '';
+ALTER TABLE categories ADD COLUMN position INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE categories ADD COLUMN archived INTEGER NOT NULL DEFAULT 0;
+
+UPDATE categories SET position = (SELECT COUNT(*) FROM categories c WHERE c.name <= categories.name);
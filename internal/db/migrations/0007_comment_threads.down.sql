@@ -0,0 +1,4 @@
+-- Flattens comment threads again. Replies stay as top-level comments.
+
+DROP INDEX IF EXISTS comments_parent_id;
+ALTER TABLE comments DROP COLUMN parent_id;
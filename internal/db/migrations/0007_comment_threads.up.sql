@@ -0,0 +1,9 @@
+-- Lets comments reply to other comments. parent_id is NULL for a
+-- top-level comment and otherwise names a comment on the same post.
+-- Replies are removed together with their parent by the application
+-- (see deleteComment), which also cleans up their likes and
+-- revisions, so no foreign key cascade is declared here.
+
+ALTER TABLE comments ADD COLUMN parent_id INTEGER;
+
+CREATE INDEX IF NOT EXISTS comments_parent_id ON comments(parent_id);
@@ -0,0 +1,3 @@
+-- Removes password reset tokens.
+
+DROP TABLE IF EXISTS password_resets;
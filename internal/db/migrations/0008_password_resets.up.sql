@@ -0,0 +1,14 @@
+-- Stores password reset requests. Only the SHA-256 hash of each
+-- emailed token is kept, so a leaked database cannot be used to reset
+-- passwords. A token is valid until expires_at and only until it is
+-- used; completing a reset marks every open token of the user as used.
+
+CREATE TABLE IF NOT EXISTS password_resets (
+    id INTEGER PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    token_hash TEXT NOT NULL UNIQUE,
+    expires_at DATETIME NOT NULL,
+    used_at DATETIME,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+);
@@ -0,0 +1,4 @@
+-- Removes email verification.
+
+DROP TABLE IF EXISTS email_verifications;
+ALTER TABLE users DROP COLUMN email_verified_at;
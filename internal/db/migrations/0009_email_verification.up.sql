@@ -0,0 +1,19 @@
+-- Email verification. New accounts start with email_verified_at unset
+-- and may not post or comment until they follow the link mailed to
+-- them. Accounts that existed before this migration are treated as
+-- verified so that current members are not locked out.
+--
+-- Like password resets, only the SHA-256 hash of each emailed token is
+-- stored. Verifying an account removes all of its tokens.
+
+ALTER TABLE users ADD COLUMN email_verified_at DATETIME;
+UPDATE users SET email_verified_at = created_at;
+
+CREATE TABLE IF NOT EXISTS email_verifications (
+    id INTEGER PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    token_hash TEXT NOT NULL UNIQUE,
+    expires_at DATETIME NOT NULL,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+);
@@ -0,0 +1,41 @@
+-- Two-factor authentication with time-based one-time passwords.
+--
+-- totp_secret holds the base32 secret shared with the user's
+-- authenticator app. It is set when enrollment starts; the second
+-- factor is only active once totp_enabled_at is set after the user
+-- entered a first valid code. totp_last_step remembers the time step
+-- of the last accepted code so that a code cannot be replayed.
+
+ALTER TABLE users ADD COLUMN totp_secret TEXT;
+ALTER TABLE users ADD COLUMN totp_enabled_at DATETIME;
+ALTER TABLE users ADD COLUMN totp_last_step INTEGER NOT NULL DEFAULT 0;
+
+-- One-time recovery codes for users who lose their authenticator.
+-- Only the SHA-256 hash of each code is stored.
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    id INTEGER PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    code_hash TEXT NOT NULL,
+    used_at DATETIME,
+    FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_recovery_codes_user ON recovery_codes(user_id);
+
+-- Logins waiting for their second factor. After the password has been
+-- checked the browser holds a cookie with a random token whose hash
+-- is stored here until the code is entered, the challenge expires or
+-- too many wrong codes were tried.
+CREATE TABLE IF NOT EXISTS login_challenges (
+    token_hash TEXT PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    expires_at DATETIME NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Forum-wide settings changed by admins at runtime, as key/value
+-- pairs. Missing keys use the default built into the application.
+CREATE TABLE IF NOT EXISTS settings (
+    key TEXT PRIMARY KEY,
+    value TEXT NOT NULL
+);
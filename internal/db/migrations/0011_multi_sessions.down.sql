@@ -0,0 +1,14 @@
+-- Returns to a single session per user. Only the most recently created
+-- session of each user survives.
+
+CREATE TABLE sessions_old (
+    id TEXT PRIMARY KEY,
+    user_id INTEGER NOT NULL UNIQUE,
+    expires_at DATETIME NOT NULL,
+    FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+INSERT INTO sessions_old(id, user_id, expires_at)
+    SELECT id, user_id, expires_at FROM sessions s
+    WHERE s.rowid = (SELECT rowid FROM sessions WHERE user_id = s.user_id ORDER BY created_at DESC, rowid DESC LIMIT 1);
+DROP TABLE sessions;
+ALTER TABLE sessions_old RENAME TO sessions;
@@ -0,0 +1,21 @@
+-- Allows several sessions per user, one per browser or device, and
+-- records where each one is used so users can review and revoke them.
+--
+-- SQLite cannot drop the UNIQUE constraint on user_id in place, so the
+-- table is rebuilt. Existing sessions are kept; their creation time is
+-- unknown and set to the time of the migration.
+
+CREATE TABLE sessions_new (
+    id TEXT PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    expires_at DATETIME NOT NULL,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_seen_at DATETIME,
+    user_agent TEXT NOT NULL DEFAULT '',
+    ip TEXT NOT NULL DEFAULT '',
+    FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+INSERT INTO sessions_new(id, user_id, expires_at) SELECT id, user_id, expires_at FROM sessions;
+DROP TABLE sessions;
+ALTER TABLE sessions_new RENAME TO sessions;
+CREATE INDEX IF NOT EXISTS idx_sessions_user ON sessions(user_id);
@@ -0,0 +1,5 @@
+-- Removes external identities. Accounts created through a provider
+-- stay, but can only log in after a password reset.
+
+DROP TABLE IF EXISTS oauth_states;
+DROP TABLE IF EXISTS identities;
@@ -0,0 +1,32 @@
+-- External identities for logging in with OAuth 2.0 / OpenID Connect
+-- providers. A user may link several identities; each identity, a
+-- subject at a provider, belongs to exactly one user. Accounts created
+-- through a provider have an empty password hash, which never matches
+-- a password, until the user sets one with a password reset.
+
+CREATE TABLE IF NOT EXISTS identities (
+    id INTEGER PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    provider TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    email TEXT NOT NULL DEFAULT '',
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_login_at DATETIME,
+    UNIQUE (provider, subject),
+    FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_identities_user ON identities(user_id);
+
+-- Authorization requests in progress. The state value is also kept in
+-- a cookie so the callback can only be completed by the browser that
+-- started the flow. link_user_id is set when a logged-in user links a
+-- new identity rather than logging in.
+CREATE TABLE IF NOT EXISTS oauth_states (
+    state_hash TEXT PRIMARY KEY,
+    provider TEXT NOT NULL,
+    verifier TEXT NOT NULL,
+    nonce TEXT NOT NULL,
+    link_user_id INTEGER,
+    expires_at DATETIME NOT NULL,
+    FOREIGN KEY(link_user_id) REFERENCES users(id) ON DELETE CASCADE
+);
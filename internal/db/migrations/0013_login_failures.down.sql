@@ -0,0 +1,3 @@
+-- Removes the record of failed logins and the lockouts based on it.
+
+DROP TABLE IF EXISTS login_failures;
@@ -0,0 +1,13 @@
+-- Failed login attempts, counted separately per account (by normalised
+-- email address, so unknown addresses are throttled the same way) and
+-- per client IP address. Times are Unix seconds, like sessions.expires_at.
+-- A row stays until its failures are forgotten, the lockout it carries
+-- has expired or an admin clears it.
+CREATE TABLE IF NOT EXISTS login_failures (
+    scope TEXT NOT NULL CHECK (scope IN ('account', 'ip')),
+    key TEXT NOT NULL,
+    failures INTEGER NOT NULL DEFAULT 0,
+    last_failure_at INTEGER NOT NULL,
+    locked_until INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (scope, key)
+);
@@ -0,0 +1,5 @@
+-- Removes profiles and pending email changes.
+
+DROP TABLE IF EXISTS email_changes;
+ALTER TABLE users DROP COLUMN bio;
+ALTER TABLE users DROP COLUMN display_name;
@@ -0,0 +1,18 @@
+-- Public profiles. display_name is shown next to the username when
+-- set, and bio is Markdown written by the user about themselves.
+--
+-- A new email address only replaces the current one once the user
+-- follows a link mailed to it. Until then it waits in email_changes,
+-- which stores the SHA-256 hash of the token like the other emailed
+-- token tables.
+
+ALTER TABLE users ADD COLUMN display_name TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN bio TEXT NOT NULL DEFAULT '';
+
+CREATE TABLE IF NOT EXISTS email_changes (
+    token_hash TEXT PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    new_email TEXT NOT NULL,
+    expires_at DATETIME NOT NULL,
+    FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+);
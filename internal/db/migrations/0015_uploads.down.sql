@@ -0,0 +1,5 @@
+-- Removes the record of uploaded images. The files themselves stay in
+-- the storage backend.
+
+ALTER TABLE users DROP COLUMN avatar_key;
+DROP TABLE IF EXISTS uploads;
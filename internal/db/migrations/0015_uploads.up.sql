@@ -0,0 +1,27 @@
+-- Uploaded images. Files live in the configured storage backend under
+-- key (and thumb_key for the smaller version); this table records who
+-- uploaded them and is what decides which keys are served. kind is
+-- 'avatar' for profile pictures and 'image' for pictures used in
+-- posts and comments. For images that are already small, thumb_key
+-- equals key.
+--
+-- users.avatar_key points at the current avatar; empty means the
+-- generated placeholder is shown.
+
+CREATE TABLE IF NOT EXISTS uploads (
+    id INTEGER PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    kind TEXT NOT NULL CHECK (kind IN ('avatar', 'image')),
+    key TEXT NOT NULL UNIQUE,
+    thumb_key TEXT NOT NULL,
+    content_type TEXT NOT NULL,
+    width INTEGER NOT NULL,
+    height INTEGER NOT NULL,
+    size INTEGER NOT NULL,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_uploads_user ON uploads(user_id, kind, id);
+CREATE INDEX IF NOT EXISTS idx_uploads_thumb ON uploads(thumb_key);
+
+ALTER TABLE users ADD COLUMN avatar_key TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,4 @@
+-- Removes notifications and notification preferences.
+
+DROP TABLE IF EXISTS notification_prefs;
+DROP TABLE IF EXISTS notifications;
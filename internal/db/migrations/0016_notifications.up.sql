@@ -0,0 +1,37 @@
+-- In-app notifications. A row tells user_id that actor_id did
+-- something involving their content: commented on their post
+-- ('comment'), replied to their comment ('reply') or liked their post
+-- or comment ('like'). post_id is the post concerned and comment_id
+-- the new comment, or for likes the comment that was liked (NULL when
+-- the post itself was). read_at stays NULL until the user has seen
+-- the notification. Deleting the post, comment or either user removes
+-- the notification with it.
+--
+-- notification_prefs records the types a user has chosen to receive or
+-- not; types without a row use the default from the application.
+
+CREATE TABLE IF NOT EXISTS notifications (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    actor_id INTEGER NOT NULL,
+    type TEXT NOT NULL CHECK (type IN ('comment', 'reply', 'like')),
+    post_id INTEGER NOT NULL,
+    comment_id INTEGER,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    read_at DATETIME,
+    FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY(actor_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY(post_id) REFERENCES posts(id) ON DELETE CASCADE,
+    FOREIGN KEY(comment_id) REFERENCES comments(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_notifications_user ON notifications(user_id, id);
+CREATE INDEX IF NOT EXISTS idx_notifications_unread ON notifications(user_id) WHERE read_at IS NULL;
+
+CREATE TABLE IF NOT EXISTS notification_prefs (
+    user_id INTEGER NOT NULL,
+    type TEXT NOT NULL,
+    enabled INTEGER NOT NULL,
+    PRIMARY KEY (user_id, type),
+    FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+);
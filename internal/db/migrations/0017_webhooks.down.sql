@@ -0,0 +1,6 @@
+-- Removes webhooks and their delivery log.
+
+DROP TABLE IF EXISTS webhook_deliveries;
+DROP TABLE IF EXISTS webhook_categories;
+DROP TABLE IF EXISTS webhook_events;
+DROP TABLE IF EXISTS webhooks;
@@ -0,0 +1,57 @@
+-- Outgoing webhooks. An admin registers a URL together with the events
+-- it receives (webhook_events) and, optionally, the categories it is
+-- limited to (webhook_categories; no rows means every post). secret
+-- keys the HMAC signature of each request. Inactive webhooks keep
+-- their settings and queued deliveries but receive nothing.
+--
+-- webhook_deliveries is both the queue and the log. Each event sent to
+-- a webhook is a row holding the exact JSON payload, so retries send
+-- the same document. A pending row is tried at next_attempt_at (Unix
+-- seconds, like the other retry times); failures push that back
+-- exponentially until the delivery succeeds ('delivered') or runs out
+-- of attempts ('failed'). The last_* columns describe the most recent
+-- attempt.
+
+CREATE TABLE IF NOT EXISTS webhooks (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    url TEXT NOT NULL,
+    secret TEXT NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    active INTEGER NOT NULL DEFAULT 1,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS webhook_events (
+    webhook_id INTEGER NOT NULL,
+    event TEXT NOT NULL,
+    PRIMARY KEY (webhook_id, event),
+    FOREIGN KEY(webhook_id) REFERENCES webhooks(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS webhook_categories (
+    webhook_id INTEGER NOT NULL,
+    category_id INTEGER NOT NULL,
+    PRIMARY KEY (webhook_id, category_id),
+    FOREIGN KEY(webhook_id) REFERENCES webhooks(id) ON DELETE CASCADE,
+    FOREIGN KEY(category_id) REFERENCES categories(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    webhook_id INTEGER NOT NULL,
+    event TEXT NOT NULL,
+    payload TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'delivered', 'failed')),
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at INTEGER NOT NULL,
+    last_attempt_at INTEGER,
+    last_status INTEGER,
+    last_error TEXT NOT NULL DEFAULT '',
+    last_response TEXT NOT NULL DEFAULT '',
+    last_duration_ms INTEGER,
+    created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(webhook_id) REFERENCES webhooks(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_due ON webhook_deliveries(next_attempt_at) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_webhook ON webhook_deliveries(webhook_id, id);
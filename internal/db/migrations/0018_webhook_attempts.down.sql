@@ -0,0 +1,3 @@
+-- Removes the history of webhook delivery attempts.
+
+DROP TABLE IF EXISTS webhook_attempts;
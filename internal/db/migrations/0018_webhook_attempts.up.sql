@@ -0,0 +1,19 @@
+-- The history of every attempt to send a webhook delivery. The row in
+-- webhook_deliveries only describes the latest attempt; each attempt,
+-- failed or not, also adds a row here so that the delivery log can show
+-- how a delivery got to where it is. status is the HTTP status of the
+-- response, or NULL when none arrived, and attempted_at is in Unix
+-- seconds like the times of webhook_deliveries. The rows go with their
+-- delivery.
+
+CREATE TABLE IF NOT EXISTS webhook_attempts (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    delivery_id INTEGER NOT NULL,
+    attempted_at INTEGER NOT NULL,
+    status INTEGER,
+    error TEXT NOT NULL DEFAULT '',
+    duration_ms INTEGER NOT NULL,
+    FOREIGN KEY(delivery_id) REFERENCES webhook_deliveries(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhook_attempts_delivery ON webhook_attempts(delivery_id, id);
@@ -0,0 +1,3 @@
+-- Removes the creation time index of posts.
+
+DROP INDEX IF EXISTS idx_posts_created;
@@ -0,0 +1,5 @@
+-- Orders posts by creation time for the index. The newest and oldest
+-- sorts page through this index, applying the cursor and the page
+-- size before any counts are computed.
+
+CREATE INDEX IF NOT EXISTS idx_posts_created ON posts(created_at, id);
@@ -0,0 +1,125 @@
+package imaging
+
+// Cameras store photos as the sensor saw them and record in the EXIF
+// Orientation tag how they must be turned for display. This file reads
+// that tag from a JPEG file and applies it to the decoded pixels.
+
+import (
+    "encoding/binary"
+    "image"
+)
+
+// exifOrientation returns the EXIF Orientation (1 to 8) of the JPEG
+// file data, or 1, meaning upright, when there is none or the EXIF
+// data cannot be read.
+func exifOrientation(data []byte) int {
+    // Walk the marker segments up to the start of the image data,
+    // looking for an APP1 segment holding EXIF.
+    if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+        return 1
+    }
+    i := 2
+    for i+4 <= len(data) {
+        if data[i] != 0xFF {
+            return 1
+        }
+        marker := data[i+1]
+        if marker == 0xD8 || (marker >= 0xD0 && marker <= 0xD7) || marker == 0x01 || marker == 0xFF {
+            i++
+            continue
+        }
+        if marker == 0xDA || marker == 0xD9 {
+            return 1
+        }
+        n := int(binary.BigEndian.Uint16(data[i+2:]))
+        if n < 2 || i+2+n > len(data) {
+            return 1
+        }
+        seg := data[i+4 : i+2+n]
+        if marker == 0xE1 && len(seg) >= 6 && string(seg[:6]) == "Exif\x00\x00" {
+            return tiffOrientation(seg[6:])
+        }
+        i += 2 + n
+    }
+    return 1
+}
+
+// tiffOrientation reads the Orientation tag from the first image file
+// directory of the TIFF structure inside an EXIF segment.
+func tiffOrientation(t []byte) int {
+    if len(t) < 8 {
+        return 1
+    }
+    var order binary.ByteOrder
+    switch string(t[:2]) {
+    case "II":
+        order = binary.LittleEndian
+    case "MM":
+        order = binary.BigEndian
+    default:
+        return 1
+    }
+    if order.Uint16(t[2:]) != 42 {
+        return 1
+    }
+    ifd := int(order.Uint32(t[4:]))
+    if ifd < 8 || ifd+2 > len(t) {
+        return 1
+    }
+    count := int(order.Uint16(t[ifd:]))
+    for k := 0; k < count; k++ {
+        e := ifd + 2 + 12*k
+        if e+12 > len(t) {
+            return 1
+        }
+        // The tag is a SHORT whose value sits in the first two bytes
+        // of the value field.
+        if order.Uint16(t[e:]) == 0x0112 && order.Uint16(t[e+2:]) == 3 {
+            if o := int(order.Uint16(t[e+8:])); o >= 1 && o <= 8 {
+                return o
+            }
+            return 1
+        }
+    }
+    return 1
+}
+
+// orient returns src turned according to EXIF orientation o. Values 5
+// to 8 swap width and height.
+func orient(src *image.RGBA, o int) *image.RGBA {
+    if o <= 1 || o > 8 {
+        return src
+    }
+    w, h := src.Bounds().Dx(), src.Bounds().Dy()
+    dw, dh := w, h
+    if o >= 5 {
+        dw, dh = h, w
+    }
+    dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+    for y := 0; y < dh; y++ {
+        for x := 0; x < dw; x++ {
+            // (sx, sy) is the source pixel shown at (x, y).
+            var sx, sy int
+            switch o {
+            case 2: // mirrored
+                sx, sy = w-1-x, y
+            case 3: // upside down
+                sx, sy = w-1-x, h-1-y
+            case 4: // upside down and mirrored
+                sx, sy = x, h-1-y
+            case 5: // transposed
+                sx, sy = y, x
+            case 6: // needs turning clockwise
+                sx, sy = y, h-1-x
+            case 7: // transversed
+                sx, sy = w-1-y, h-1-x
+            case 8: // needs turning counter-clockwise
+                sx, sy = w-1-y, x
+            }
+            si := src.PixOffset(sx, sy)
+            di := dst.PixOffset(x, y)
+            copy(dst.Pix[di:di+4], src.Pix[si:si+4])
+        }
+    }
+    return dst
+}
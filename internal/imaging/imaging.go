@@ -0,0 +1,129 @@
+package imaging
+
+// This package turns uploaded files into images that are safe to serve.
+// Uploads are never stored as sent: the type is sniffed from the
+// content rather than trusted from the client, the image is decoded and
+// encoded again, and only the pixels survive. That strips EXIF and
+// other metadata, which often include the GPS position of a photo, and
+// anything smuggled in after the image data. Because re-encoding drops
+// the EXIF orientation flag, photos are rotated upright first.
+//
+// Only the standard library codecs are used, so JPEG, PNG and GIF are
+// accepted. JPEG stays JPEG; PNG and GIF become PNG. Animated GIFs keep
+// their first frame only.
+
+import (
+    "bytes"
+    "errors"
+    "image"
+    "image/draw"
+    "image/gif"
+    "image/jpeg"
+    "image/png"
+    "net/http"
+)
+
+// MaxPixels limits the size of decoded images, so that a small file
+// claiming huge dimensions cannot exhaust memory. 25 megapixels covers
+// the photos of current phones.
+const MaxPixels = 25_000_000
+
+// jpegQuality is the quality JPEG images are encoded with.
+const jpegQuality = 85
+
+var (
+    // ErrUnsupported is returned for files that are not JPEG, PNG or
+    // GIF images.
+    ErrUnsupported = errors.New("imaging: unsupported image type")
+    // ErrTooLarge is returned for images over MaxPixels.
+    ErrTooLarge = errors.New("imaging: image has too many pixels")
+    // ErrCorrupt is returned for files that look like images but do
+    // not decode.
+    ErrCorrupt = errors.New("imaging: image data is corrupt")
+)
+
+// Sniff returns the content type of data as detected from its first
+// bytes, or ErrUnsupported when it is not an accepted image type.
+func Sniff(data []byte) (string, error) {
+    switch ct := http.DetectContentType(data); ct {
+    case "image/jpeg", "image/png", "image/gif":
+        return ct, nil
+    }
+    return "", ErrUnsupported
+}
+
+// Decode sniffs and decodes data, checking its dimensions before the
+// pixels are read. JPEG images are turned upright according to their
+// EXIF orientation. It returns the image and its content type.
+func Decode(data []byte) (*image.RGBA, string, error) {
+    ct, err := Sniff(data)
+    if err != nil {
+        return nil, "", err
+    }
+    var cfg image.Config
+    switch ct {
+    case "image/jpeg":
+        cfg, err = jpeg.DecodeConfig(bytes.NewReader(data))
+    case "image/png":
+        cfg, err = png.DecodeConfig(bytes.NewReader(data))
+    case "image/gif":
+        cfg, err = gif.DecodeConfig(bytes.NewReader(data))
+    }
+    if err != nil || cfg.Width <= 0 || cfg.Height <= 0 {
+        return nil, "", ErrCorrupt
+    }
+    if cfg.Width*cfg.Height > MaxPixels {
+        return nil, "", ErrTooLarge
+    }
+    var src image.Image
+    switch ct {
+    case "image/jpeg":
+        src, err = jpeg.Decode(bytes.NewReader(data))
+    case "image/png":
+        src, err = png.Decode(bytes.NewReader(data))
+    case "image/gif":
+        src, err = gif.Decode(bytes.NewReader(data))
+    }
+    if err != nil {
+        return nil, "", ErrCorrupt
+    }
+    img := toRGBA(src)
+    if ct == "image/jpeg" {
+        img = orient(img, exifOrientation(data))
+    }
+    return img, ct, nil
+}
+
+// Encode encodes img in the output format for an upload of type ct:
+// JPEG for JPEG uploads and PNG otherwise. It returns the encoded data
+// and its content type.
+func Encode(img image.Image, ct string) ([]byte, string, error) {
+    var buf bytes.Buffer
+    if ct == "image/jpeg" {
+        if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpegQuality}); err != nil {
+            return nil, "", err
+        }
+        return buf.Bytes(), "image/jpeg", nil
+    }
+    if err := png.Encode(&buf, img); err != nil {
+        return nil, "", err
+    }
+    return buf.Bytes(), "image/png", nil
+}
+
+// Extension returns the file extension, including the dot, used for
+// images of content type ct as returned by Encode.
+func Extension(ct string) string {
+    if ct == "image/jpeg" {
+        return ".jpg"
+    }
+    return ".png"
+}
+
+// toRGBA copies src into an RGBA image with its origin at (0, 0).
+func toRGBA(src image.Image) *image.RGBA {
+    b := src.Bounds()
+    dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+    draw.Draw(dst, dst.Bounds(), src, b.Min, draw.Src)
+    return dst
+}
@@ -0,0 +1,194 @@
+package imaging
+
+// Tests of the upload pipeline: sniffing, decoding with the size check
+// and re-encoding. The images are built in the tests, including a JPEG
+// with an EXIF segment carrying an orientation and a made-up GPS note,
+// so no binary fixtures are needed.
+
+import (
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "hash/crc32"
+    "image"
+    "image/color"
+    "image/jpeg"
+    "image/png"
+    "testing"
+)
+
+// testImage returns a w×h image whose left half is red and right half
+// blue, so that rotations can be told apart.
+func testImage(w, h int) *image.RGBA {
+    img := image.NewRGBA(image.Rect(0, 0, w, h))
+    for y := 0; y < h; y++ {
+        for x := 0; x < w; x++ {
+            c := color.RGBA{R: 255, A: 255}
+            if x >= w/2 {
+                c = color.RGBA{B: 255, A: 255}
+            }
+            img.SetRGBA(x, y, c)
+        }
+    }
+    return img
+}
+
+// gpsNote stands for the metadata that must not survive re-encoding.
+const gpsNote = "GPS 52.5200N 13.4050E"
+
+// jpegWithEXIF encodes img as JPEG and inserts, right after the start
+// of image marker, an EXIF segment with the given orientation followed
+// by gpsNote.
+func jpegWithEXIF(t *testing.T, img image.Image, orientation uint16) []byte {
+    t.Helper()
+    var buf bytes.Buffer
+    if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95}); err != nil {
+        t.Fatal(err)
+    }
+    // A little-endian TIFF header and one directory with a single
+    // entry: Orientation, type SHORT, count 1.
+    var tiff bytes.Buffer
+    tiff.WriteString("II")
+    binary.Write(&tiff, binary.LittleEndian, uint16(42))
+    binary.Write(&tiff, binary.LittleEndian, uint32(8))
+    binary.Write(&tiff, binary.LittleEndian, uint16(1))
+    binary.Write(&tiff, binary.LittleEndian, []uint16{0x0112, 3})
+    binary.Write(&tiff, binary.LittleEndian, uint32(1))
+    binary.Write(&tiff, binary.LittleEndian, []uint16{orientation, 0})
+    binary.Write(&tiff, binary.LittleEndian, uint32(0))
+    tiff.WriteString(gpsNote)
+
+    seg := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+    var out bytes.Buffer
+    out.Write(buf.Bytes()[:2])
+    out.Write([]byte{0xFF, 0xE1})
+    binary.Write(&out, binary.BigEndian, uint16(len(seg)+2))
+    out.Write(seg)
+    out.Write(buf.Bytes()[2:])
+    return out.Bytes()
+}
+
+// pngHeader returns the start of a PNG file declaring a w×h image,
+// with a valid header chunk but no pixel data.
+func pngHeader(w, h uint32) []byte {
+    var ihdr bytes.Buffer
+    ihdr.WriteString("IHDR")
+    binary.Write(&ihdr, binary.BigEndian, w)
+    binary.Write(&ihdr, binary.BigEndian, h)
+    ihdr.Write([]byte{8, 6, 0, 0, 0})
+    var out bytes.Buffer
+    out.WriteString("\x89PNG\r\n\x1a\n")
+    binary.Write(&out, binary.BigEndian, uint32(ihdr.Len()-4))
+    out.Write(ihdr.Bytes())
+    binary.Write(&out, binary.BigEndian, crc32.ChecksumIEEE(ihdr.Bytes()))
+    return out.Bytes()
+}
+
+func TestReencodeStripsEXIF(t *testing.T) {
+    // Orientation 6 means the camera was turned: the stored 40×20
+    // image is shown as 20×40, rotated clockwise.
+    data := jpegWithEXIF(t, testImage(40, 20), 6)
+    if !bytes.Contains(data, []byte(gpsNote)) || exifOrientation(data) != 6 {
+        t.Fatal("the test image lacks its EXIF segment")
+    }
+    img, ct, err := Decode(data)
+    if err != nil {
+        t.Fatalf("Decode: %v", err)
+    }
+    if ct != "image/jpeg" {
+        t.Fatalf("content type %q", ct)
+    }
+    if b := img.Bounds(); b.Dx() != 20 || b.Dy() != 40 {
+        t.Fatalf("decoded size %v, want 20×40 after turning upright", b.Size())
+    }
+    // The red left half is now on top.
+    if r, _, b, _ := img.At(10, 5).RGBA(); r < b {
+        t.Fatalf("top of the turned image is not red")
+    }
+
+    out, outType, err := Encode(img, ct)
+    if err != nil {
+        t.Fatalf("Encode: %v", err)
+    }
+    if outType != "image/jpeg" {
+        t.Fatalf("encoded as %q", outType)
+    }
+    if bytes.Contains(out, []byte("Exif")) || bytes.Contains(out, []byte(gpsNote)) {
+        t.Fatal("re-encoded image still carries the EXIF segment")
+    }
+    if exifOrientation(out) != 1 {
+        t.Fatal("re-encoded image has an orientation")
+    }
+    again, _, err := Decode(out)
+    if err != nil {
+        t.Fatalf("decoding the re-encoded image: %v", err)
+    }
+    if again.Bounds() != img.Bounds() {
+        t.Fatalf("re-encoded image is %v, want %v", again.Bounds(), img.Bounds())
+    }
+}
+
+func TestEncodeFormats(t *testing.T) {
+    // Anything but JPEG comes out as PNG.
+    for _, ct := range []string{"image/png", "image/gif"} {
+        _, got, err := Encode(testImage(4, 4), ct)
+        if err != nil || got != "image/png" {
+            t.Errorf("Encode for %s gave %q, %v", ct, got, err)
+        }
+    }
+    if Extension("image/jpeg") != ".jpg" || Extension("image/png") != ".png" {
+        t.Error("wrong extensions")
+    }
+}
+
+func TestDecodeRejectsTooManyPixels(t *testing.T) {
+    gif := []byte("GIF89a")
+    gif = binary.LittleEndian.AppendUint16(gif, 10000)
+    gif = binary.LittleEndian.AppendUint16(gif, 10000)
+    gif = append(gif, 0, 0, 0)
+
+    tests := map[string][]byte{
+        "png 6000×6000":   pngHeader(6000, 6000),
+        "png 100000×1000": pngHeader(100000, 1000),
+        "gif 10000×10000": gif,
+    }
+    for name, data := range tests {
+        if _, _, err := Decode(data); !errors.Is(err, ErrTooLarge) {
+            t.Errorf("%s: Decode returned %v, want ErrTooLarge", name, err)
+        }
+    }
+    // Just under the limit passes the size check; the missing pixel
+    // data then makes it corrupt.
+    if _, _, err := Decode(pngHeader(5000, 5000)); !errors.Is(err, ErrCorrupt) {
+        t.Errorf("25 megapixel PNG header: Decode returned %v, want ErrCorrupt", err)
+    }
+}
+
+func TestDecodeRejectsOtherFiles(t *testing.T) {
+    tests := map[string][]byte{
+        "empty":      nil,
+        "text":       []byte("hello, world"),
+        "html":       []byte("<!DOCTYPE html><html><body><script>alert(1)</script></body></html>"),
+        "svg":        []byte(`<svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script></svg>`),
+        "pdf":        []byte("%PDF-1.4\n%âãÏÓ\n"),
+        "bmp":        append([]byte("BM"), make([]byte, 64)...),
+        "zip":        []byte("PK\x03\x04\x14\x00\x00\x00"),
+        "executable": []byte("\x7fELF\x02\x01\x01\x00"),
+    }
+    for name, data := range tests {
+        if _, err := Sniff(data); !errors.Is(err, ErrUnsupported) {
+            t.Errorf("%s: Sniff returned %v, want ErrUnsupported", name, err)
+        }
+        if _, _, err := Decode(data); !errors.Is(err, ErrUnsupported) {
+            t.Errorf("%s: Decode returned %v, want ErrUnsupported", name, err)
+        }
+    }
+
+    // A real image header with nothing after it is corrupt, not
+    // unsupported.
+    var buf bytes.Buffer
+    png.Encode(&buf, testImage(8, 8))
+    if _, _, err := Decode(buf.Bytes()[:40]); !errors.Is(err, ErrCorrupt) {
+        t.Errorf("truncated PNG: Decode returned %v, want ErrCorrupt", err)
+    }
+}
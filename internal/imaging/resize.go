@@ -0,0 +1,87 @@
+package imaging
+
+// Images are only ever made smaller, using a box filter: every output
+// pixel is the average of the source pixels it covers. That is cheap
+// and looks good for the downscaling factors of thumbnails and
+// avatars. Averaging works on premultiplied colours, so transparent
+// pixels do not bleed their colour into their neighbours.
+
+import "image"
+
+// Fit scales img down so that neither side exceeds max pixels, keeping
+// the aspect ratio. Images that already fit are returned unchanged.
+func Fit(img *image.RGBA, max int) *image.RGBA {
+    w, h := img.Bounds().Dx(), img.Bounds().Dy()
+    if w <= max && h <= max {
+        return img
+    }
+    if w >= h {
+        h = h * max / w
+        w = max
+    } else {
+        w = w * max / h
+        h = max
+    }
+    if w < 1 {
+        w = 1
+    }
+    if h < 1 {
+        h = 1
+    }
+    return scale(img, img.Bounds(), w, h)
+}
+
+// Square crops the largest centred square out of img and scales it
+// down to size by size pixels, or leaves it at its own size when it is
+// smaller than that.
+func Square(img *image.RGBA, size int) *image.RGBA {
+    b := img.Bounds()
+    side := b.Dx()
+    if b.Dy() < side {
+        side = b.Dy()
+    }
+    x0 := b.Min.X + (b.Dx()-side)/2
+    y0 := b.Min.Y + (b.Dy()-side)/2
+    crop := image.Rect(x0, y0, x0+side, y0+side)
+    if side < size {
+        size = side
+    }
+    return scale(img, crop, size, size)
+}
+
+// scale resizes the part r of src to w by h pixels.
+func scale(src *image.RGBA, r image.Rectangle, w, h int) *image.RGBA {
+    dst := image.NewRGBA(image.Rect(0, 0, w, h))
+    sw, sh := r.Dx(), r.Dy()
+    for y := 0; y < h; y++ {
+        y0 := r.Min.Y + y*sh/h
+        y1 := r.Min.Y + (y+1)*sh/h
+        if y1 <= y0 {
+            y1 = y0 + 1
+        }
+        for x := 0; x < w; x++ {
+            x0 := r.Min.X + x*sw/w
+            x1 := r.Min.X + (x+1)*sw/w
+            if x1 <= x0 {
+                x1 = x0 + 1
+            }
+            var sum [4]uint64
+            for sy := y0; sy < y1; sy++ {
+                i := src.PixOffset(x0, sy)
+                for sx := x0; sx < x1; sx++ {
+                    sum[0] += uint64(src.Pix[i])
+                    sum[1] += uint64(src.Pix[i+1])
+                    sum[2] += uint64(src.Pix[i+2])
+                    sum[3] += uint64(src.Pix[i+3])
+                    i += 4
+                }
+            }
+            n := uint64((x1 - x0) * (y1 - y0))
+            d := dst.PixOffset(x, y)
+            for c := 0; c < 4; c++ {
+                dst.Pix[d+c] = uint8((sum[c] + n/2) / n)
+            }
+        }
+    }
+    return dst
+}
@@ -0,0 +1,151 @@
+package live
+
+// This package passes events between the parts of the forum running in
+// this process, so that pages held open by browsers (see the
+// /post/events stream in the app package) learn about new comments
+// and reactions as they are written. Subscribers listen on a topic,
+// such as one post, and publishers send events to everyone listening
+// on it.
+//
+// Publishing never blocks. Each subscriber has a small buffer, and a
+// subscriber that lets it fill up is dropped: its channel is closed and
+// it is expected to reconnect and catch up from the database. This
+// keeps one stalled connection from holding up the writer of a comment.
+
+import (
+    "errors"
+    "sync"
+)
+
+// bufferSize is the number of events a subscriber may fall behind by
+// before it is dropped.
+const bufferSize = 16
+
+// Errors returned by Subscribe.
+var (
+    ErrTooManySubscribers = errors.New("live: too many subscribers")
+    ErrTooManyForClient   = errors.New("live: too many subscribers for this client")
+    ErrClosed             = errors.New("live: hub closed")
+)
+
+// Event is a message sent to the subscribers of a topic. Name says
+// what happened and Data carries the details, typically as JSON.
+type Event struct {
+    Name string
+    Data []byte
+}
+
+// Hub delivers events to subscribers. MaxSubscribers caps the number
+// of subscriptions at once and MaxPerClient the number held by one
+// client, such as one IP address; zero means no limit. The limits must
+// be set before the hub is first used.
+type Hub struct {
+    MaxSubscribers int
+    MaxPerClient   int
+
+    mu      sync.Mutex
+    topics  map[string]map[*Subscription]struct{}
+    clients map[string]int
+    total   int
+    closed  bool
+}
+
+// Subscription is one subscriber's interest in a topic. Events arrive
+// on C, which is closed when the subscriber is dropped for falling
+// behind or the hub is closed.
+type Subscription struct {
+    C <-chan Event
+
+    c      chan Event
+    hub    *Hub
+    topic  string
+    client string
+}
+
+// Subscribe starts listening on topic on behalf of client. The caller
+// must Close the subscription when it is done with it.
+func (h *Hub) Subscribe(topic, client string) (*Subscription, error) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    switch {
+    case h.closed:
+        return nil, ErrClosed
+    case h.MaxSubscribers > 0 && h.total >= h.MaxSubscribers:
+        return nil, ErrTooManySubscribers
+    case h.MaxPerClient > 0 && h.clients[client] >= h.MaxPerClient:
+        return nil, ErrTooManyForClient
+    }
+    if h.topics == nil {
+        h.topics = make(map[string]map[*Subscription]struct{})
+        h.clients = make(map[string]int)
+    }
+    c := make(chan Event, bufferSize)
+    s := &Subscription{C: c, c: c, hub: h, topic: topic, client: client}
+    if h.topics[topic] == nil {
+        h.topics[topic] = make(map[*Subscription]struct{})
+    }
+    h.topics[topic][s] = struct{}{}
+    h.clients[client]++
+    h.total++
+    return s, nil
+}
+
+// Close stops the subscription. It may be called more than once, and
+// after the subscription was dropped.
+func (s *Subscription) Close() {
+    s.hub.mu.Lock()
+    defer s.hub.mu.Unlock()
+    s.hub.remove(s)
+}
+
+// Publish sends ev to every subscriber of topic. Subscribers whose
+// buffer is full are dropped.
+func (h *Hub) Publish(topic string, ev Event) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    for s := range h.topics[topic] {
+        select {
+        case s.c <- ev:
+        default:
+            h.remove(s)
+        }
+    }
+}
+
+// Close drops every subscriber and refuses new ones, for shutting the
+// server down.
+func (h *Hub) Close() {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    h.closed = true
+    for _, subs := range h.topics {
+        for s := range subs {
+            h.remove(s)
+        }
+    }
+}
+
+// Count returns the number of subscriptions.
+func (h *Hub) Count() int {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    return h.total
+}
+
+// remove unregisters s and closes its channel unless that already
+// happened. h.mu must be held.
+func (h *Hub) remove(s *Subscription) {
+    subs := h.topics[s.topic]
+    if _, ok := subs[s]; !ok {
+        return
+    }
+    delete(subs, s)
+    if len(subs) == 0 {
+        delete(h.topics, s.topic)
+    }
+    if h.clients[s.client]--; h.clients[s.client] <= 0 {
+        delete(h.clients, s.client)
+    }
+    h.total--
+    close(s.c)
+}
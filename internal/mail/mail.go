@@ -0,0 +1,130 @@
+package mail
+
+// This package sends the forum's email, such as password reset links.
+// Handlers talk to the Mailer interface so the transport can be chosen
+// at startup: SMTPMailer delivers through a real mail server while
+// LogMailer writes messages to a directory or the log, which is handy
+// during development.
+
+import (
+    "crypto/rand"
+    "encoding/hex"
+    "fmt"
+    "log"
+    "mime"
+    "net"
+    "net/smtp"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+)
+
+// Message is a plain-text email to a single recipient.
+type Message struct {
+    To      string
+    Subject string
+    Body    string
+}
+
+// Mailer delivers messages. Implementations must be safe for
+// concurrent use.
+type Mailer interface {
+    Send(msg Message) error
+}
+
+// SMTPMailer sends mail through an SMTP server. STARTTLS is used when
+// the server offers it. Username and Password are optional; when set
+// the PLAIN mechanism is used, which the standard library only allows
+// over TLS or to localhost.
+type SMTPMailer struct {
+    Addr     string // host:port of the server
+    From     string
+    Username string
+    Password string
+}
+
+// Send delivers msg to the configured server.
+func (m *SMTPMailer) Send(msg Message) error {
+    var auth smtp.Auth
+    if m.Username != "" {
+        host, _, err := net.SplitHostPort(m.Addr)
+        if err != nil {
+            return err
+        }
+        auth = smtp.PlainAuth("", m.Username, m.Password, host)
+    }
+    data, err := format(m.From, msg)
+    if err != nil {
+        return err
+    }
+    return smtp.SendMail(m.Addr, auth, m.From, []string{msg.To}, data)
+}
+
+// LogMailer does not deliver mail. With Dir set each message is saved
+// there as an .eml file that any mail client can open; otherwise the
+// whole message is written to the log.
+type LogMailer struct {
+    Dir  string
+    From string
+}
+
+// Send records msg in the directory or the log.
+func (m *LogMailer) Send(msg Message) error {
+    data, err := format(m.From, msg)
+    if err != nil {
+        return err
+    }
+    if m.Dir == "" {
+        log.Printf("mail to %s:\n%s", msg.To, data)
+        return nil
+    }
+    if err := os.MkdirAll(m.Dir, 0o755); err != nil {
+        return err
+    }
+    name := time.Now().UTC().Format("20060102T150405") + "-" + randomID(4) + ".eml"
+    path := filepath.Join(m.Dir, name)
+    if err := os.WriteFile(path, data, 0o600); err != nil {
+        return err
+    }
+    log.Printf("mail to %s: %q saved to %s", msg.To, msg.Subject, path)
+    return nil
+}
+
+// format renders msg as an RFC 5322 message with CRLF line endings.
+// Addresses and the subject may not contain line breaks, which would
+// otherwise allow extra headers to be injected.
+func format(from string, msg Message) ([]byte, error) {
+    for _, v := range []string{from, msg.To, msg.Subject} {
+        if strings.ContainsAny(v, "\r\n") {
+            return nil, fmt.Errorf("mail: header value contains a line break")
+        }
+    }
+    domain := "localhost"
+    if at := strings.LastIndexByte(from, '@'); at >= 0 {
+        domain = strings.Trim(from[at+1:], "> ")
+    }
+    var b strings.Builder
+    b.WriteString("From: " + from + "\r\n")
+    b.WriteString("To: " + msg.To + "\r\n")
+    b.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", msg.Subject) + "\r\n")
+    b.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+    b.WriteString("Message-ID: <" + randomID(16) + "@" + domain + ">\r\n")
+    b.WriteString("MIME-Version: 1.0\r\n")
+    b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+    b.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+    b.WriteString("\r\n")
+    body := strings.ReplaceAll(msg.Body, "\r\n", "\n")
+    b.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+    if !strings.HasSuffix(body, "\n") {
+        b.WriteString("\r\n")
+    }
+    return []byte(b.String()), nil
+}
+
+// randomID returns n random bytes in hex.
+func randomID(n int) string {
+    b := make([]byte, n)
+    rand.Read(b)
+    return hex.EncodeToString(b)
+}
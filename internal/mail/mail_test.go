@@ -0,0 +1,264 @@
+package mail
+
+// Tests of the mailers. SMTPMailer talks to a fake SMTP server on a
+// local port that speaks just enough of the protocol for net/smtp:
+// EHLO, AUTH PLAIN, MAIL, RCPT, DATA and QUIT. It records what it
+// receives exactly as sent, line endings and all.
+
+import (
+    "encoding/base64"
+    "net"
+    "net/textproto"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "testing"
+)
+
+// received is one message accepted by the fake server.
+type received struct {
+    from string
+    to   []string
+    // user is who authenticated, if anyone.
+    user string
+    // data is the message with dot-stuffing undone.
+    data string
+}
+
+// fakeSMTP is the fake server. With User set it offers AUTH PLAIN and
+// refuses mail from clients that have not logged in.
+type fakeSMTP struct {
+    Addr     string
+    User     string
+    Password string
+    // RejectRcpt makes the server refuse every recipient.
+    RejectRcpt bool
+
+    mu   sync.Mutex
+    mail []received
+}
+
+// startSMTP starts a fake server on a local port.
+func startSMTP(t *testing.T, configure func(*fakeSMTP)) *fakeSMTP {
+    t.Helper()
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { ln.Close() })
+    s := &fakeSMTP{Addr: ln.Addr().String()}
+    if configure != nil {
+        configure(s)
+    }
+    go func() {
+        for {
+            c, err := ln.Accept()
+            if err != nil {
+                return
+            }
+            go s.serve(c)
+        }
+    }()
+    return s
+}
+
+// received returns the messages accepted so far.
+func (s *fakeSMTP) received() []received {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return append([]received(nil), s.mail...)
+}
+
+// serve handles one SMTP session.
+func (s *fakeSMTP) serve(c net.Conn) {
+    defer c.Close()
+    tc := textproto.NewConn(c)
+    tc.PrintfLine("220 fake ESMTP")
+    var m received
+    for {
+        line, err := tc.ReadLine()
+        if err != nil {
+            return
+        }
+        verb, arg, _ := strings.Cut(line, " ")
+        switch strings.ToUpper(verb) {
+        case "EHLO", "HELO":
+            if s.User != "" {
+                tc.PrintfLine("250-fake")
+                tc.PrintfLine("250 AUTH PLAIN")
+            } else {
+                tc.PrintfLine("250 fake")
+            }
+        case "AUTH":
+            mech, resp, _ := strings.Cut(arg, " ")
+            creds, _ := base64.StdEncoding.DecodeString(resp)
+            if s.User == "" || mech != "PLAIN" || string(creds) != "\x00"+s.User+"\x00"+s.Password {
+                tc.PrintfLine("535 authentication failed")
+                continue
+            }
+            m.user = s.User
+            tc.PrintfLine("235 authenticated")
+        case "MAIL":
+            if s.User != "" && m.user == "" {
+                tc.PrintfLine("530 authentication required")
+                continue
+            }
+            m.from = address(arg)
+            tc.PrintfLine("250 ok")
+        case "RCPT":
+            if s.RejectRcpt {
+                tc.PrintfLine("550 no such user")
+                continue
+            }
+            m.to = append(m.to, address(arg))
+            tc.PrintfLine("250 ok")
+        case "DATA":
+            tc.PrintfLine("354 go ahead")
+            var data strings.Builder
+            for {
+                l, err := tc.R.ReadString('\n')
+                if err != nil {
+                    return
+                }
+                if l == ".\r\n" {
+                    break
+                }
+                data.WriteString(strings.TrimPrefix(l, "."))
+            }
+            m.data = data.String()
+            s.mu.Lock()
+            s.mail = append(s.mail, m)
+            s.mu.Unlock()
+            m = received{user: m.user}
+            tc.PrintfLine("250 queued")
+        case "RSET", "NOOP":
+            tc.PrintfLine("250 ok")
+        case "QUIT":
+            tc.PrintfLine("221 bye")
+            return
+        default:
+            tc.PrintfLine("502 not implemented")
+        }
+    }
+}
+
+// address extracts the address from a "FROM:<a@b> ..." argument.
+func address(arg string) string {
+    start, end := strings.IndexByte(arg, '<'), strings.IndexByte(arg, '>')
+    if start < 0 || end < start {
+        return ""
+    }
+    return arg[start+1 : end]
+}
+
+func TestSMTPMailerDelivers(t *testing.T) {
+    srv := startSMTP(t, nil)
+    m := &SMTPMailer{Addr: srv.Addr, From: "forum@example.com"}
+    msg := Message{
+        To:      "alice@example.org",
+        Subject: "Réinitialiser le mot de passe",
+        Body:    "Hello,\n.this line starts with a dot\nbye\n",
+    }
+    if err := m.Send(msg); err != nil {
+        t.Fatalf("Send: %v", err)
+    }
+    got := srv.received()
+    if len(got) != 1 {
+        t.Fatalf("server received %d messages, want 1", len(got))
+    }
+    r := got[0]
+    if r.from != "forum@example.com" || len(r.to) != 1 || r.to[0] != "alice@example.org" {
+        t.Fatalf("envelope from %q to %q", r.from, r.to)
+    }
+    header, body, ok := strings.Cut(r.data, "\r\n\r\n")
+    if !ok {
+        t.Fatalf("no header/body separator in %q", r.data)
+    }
+    for _, want := range []string{
+        "From: forum@example.com\r\n",
+        "To: alice@example.org\r\n",
+        "Subject: =?utf-8?q?R=C3=A9initialiser_le_mot_de_passe?=\r\n",
+        "Content-Type: text/plain; charset=utf-8\r\n",
+        "Message-ID: <",
+        "@example.com>\r\n",
+    } {
+        if !strings.Contains(header+"\r\n", want) {
+            t.Errorf("header lacks %q:\n%s", want, header)
+        }
+    }
+    if want := "Hello,\r\n.this line starts with a dot\r\nbye\r\n"; body != want {
+        t.Errorf("body %q, want %q", body, want)
+    }
+}
+
+func TestSMTPMailerAuthenticates(t *testing.T) {
+    srv := startSMTP(t, func(s *fakeSMTP) { s.User, s.Password = "forum", "s3cret" })
+    msg := Message{To: "alice@example.org", Subject: "Hi", Body: "Hi"}
+
+    m := &SMTPMailer{Addr: srv.Addr, From: "forum@example.com", Username: "forum", Password: "wrong"}
+    if err := m.Send(msg); err == nil {
+        t.Fatal("Send with the wrong password succeeded")
+    }
+    m.Password = "s3cret"
+    if err := m.Send(msg); err != nil {
+        t.Fatalf("Send: %v", err)
+    }
+    got := srv.received()
+    if len(got) != 1 || got[0].user != "forum" {
+        t.Fatalf("server received %+v, want one authenticated message", got)
+    }
+}
+
+func TestSMTPMailerReportsErrors(t *testing.T) {
+    srv := startSMTP(t, func(s *fakeSMTP) { s.RejectRcpt = true })
+    m := &SMTPMailer{Addr: srv.Addr, From: "forum@example.com"}
+    if err := m.Send(Message{To: "nobody@example.org", Subject: "Hi", Body: "Hi"}); err == nil {
+        t.Fatal("Send succeeded though the recipient was refused")
+    }
+
+    // Header values with line breaks could add headers of their own.
+    srv = startSMTP(t, nil)
+    m = &SMTPMailer{Addr: srv.Addr, From: "forum@example.com"}
+    for _, msg := range []Message{
+        {To: "alice@example.org", Subject: "Hi\r\nBcc: everyone@example.org", Body: "Hi"},
+        {To: "alice@example.org\nBcc: everyone@example.org", Subject: "Hi", Body: "Hi"},
+    } {
+        if err := m.Send(msg); err == nil {
+            t.Errorf("Send accepted %q / %q", msg.To, msg.Subject)
+        }
+    }
+    if n := len(srv.received()); n != 0 {
+        t.Fatalf("server received %d messages with injected headers", n)
+    }
+
+    // Nothing listening on a port that was free a moment ago.
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    ln.Close()
+    m = &SMTPMailer{Addr: ln.Addr().String(), From: "forum@example.com"}
+    if err := m.Send(Message{To: "alice@example.org", Subject: "Hi", Body: "Hi"}); err == nil {
+        t.Fatal("Send succeeded without a server")
+    }
+}
+
+func TestLogMailerSavesMessages(t *testing.T) {
+    dir := filepath.Join(t.TempDir(), "mail")
+    m := &LogMailer{Dir: dir, From: "forum@example.com"}
+    if err := m.Send(Message{To: "alice@example.org", Subject: "Verify", Body: "Click"}); err != nil {
+        t.Fatalf("Send: %v", err)
+    }
+    files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+    if err != nil || len(files) != 1 {
+        t.Fatalf("found %v (%v), want one .eml file", files, err)
+    }
+    data, err := os.ReadFile(files[0])
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !strings.Contains(string(data), "Subject: Verify\r\n") || !strings.HasSuffix(string(data), "\r\n\r\nClick\r\n") {
+        t.Fatalf("saved message is %q", data)
+    }
+}
@@ -0,0 +1,522 @@
+package markdown
+
+// This file renders inline Markdown: code spans, emphasis, strong
+// emphasis, strikethrough, links, images, autolinks, backslash
+// escapes and hard line breaks. Everything else is HTML-escaped text.
+//
+// Bodies are untrusted and rendered on every page view, so the time
+// taken must grow linearly with their length. Rather than scanning
+// forward from every `[` or `*` for its partner, which is quadratic
+// when none exists, the partners are found for the whole text in one
+// pass (see findDelimiters). Link text and emphasis are rendered
+// recursively, and nesting deeper than maxInlineDepth is shown as
+// plain text.
+
+import (
+    "html"
+    "strings"
+    "unicode"
+    "unicode/utf8"
+)
+
+// maxInlineDepth is how deeply links, images and emphasis may nest.
+// Real text stays far below it.
+const maxInlineDepth = 16
+
+// maxDestParens is how deeply parentheses may nest in a link
+// destination, as in CommonMark's reference implementation. It keeps
+// unclosed destinations such as a long run of `[a](` from each being
+// scanned to the end of the text.
+const maxDestParens = 32
+
+// renderInline converts the inline content of a block to HTML.
+func renderInline(s string) string {
+    return renderInlineAt(s, 0)
+}
+
+// renderInlineAt is renderInline for text nested depth levels deep.
+func renderInlineAt(s string, depth int) string {
+    var b strings.Builder
+    inline(&b, s, true, depth)
+    return b.String()
+}
+
+// inline renders s into b. links is false inside link text so that
+// links cannot nest; depth counts the enclosing links, images and
+// emphasis.
+func inline(b *strings.Builder, s string, links bool, depth int) {
+    if depth > maxInlineDepth {
+        b.WriteString(html.EscapeString(s))
+        return
+    }
+    var d *delimiters
+    delims := func() *delimiters {
+        if d == nil {
+            d = findDelimiters(s)
+        }
+        return d
+    }
+    i := 0
+    for i < len(s) {
+        c := s[i]
+        switch {
+        case c == '\\' && i+1 < len(s) && s[i+1] == '\n':
+            b.WriteString("<br />\n")
+            i += 2
+        case c == '\\' && i+1 < len(s) && isPunct(s[i+1]):
+            b.WriteString(html.EscapeString(s[i+1 : i+2]))
+            i += 2
+        case c == '`':
+            i = codeSpan(b, s, i)
+        case c == '!' && i+1 < len(s) && s[i+1] == '[':
+            if n, ok := linkOrImage(b, s, i+1, true, delims(), depth); ok {
+                i = n
+            } else {
+                b.WriteString("!")
+                i++
+            }
+        case c == '[' && links:
+            if n, ok := linkOrImage(b, s, i, false, delims(), depth); ok {
+                i = n
+            } else {
+                b.WriteString("[")
+                i++
+            }
+        case c == '<':
+            if n, ok := autolink(b, s, i, links); ok {
+                i = n
+            } else {
+                b.WriteString("&lt;")
+                i++
+            }
+        case (c == 'h' || c == 'H') && links && bareURLStart(s, i):
+            i = bareURL(b, s, i)
+        case c == '*' || c == '_' || c == '~':
+            i = emphasis(b, s, i, links, delims(), depth)
+        case c == '\n':
+            b.WriteString("\n")
+            i++
+            // Leading spaces of the next line are not significant.
+            for i < len(s) && s[i] == ' ' {
+                i++
+            }
+        default:
+            // Copy a run of ordinary characters in one go.
+            j := i + 1
+            for j < len(s) && !strings.ContainsRune("\\`![<*_~\nhH", rune(s[j])) {
+                j++
+            }
+            text := s[i:j]
+            if j < len(s) && s[j] == '\n' {
+                // Two or more trailing spaces before a newline force
+                // a line break; otherwise the spaces are dropped and
+                // the newline stays a soft break.
+                trimmed := strings.TrimRight(text, " ")
+                b.WriteString(html.EscapeString(trimmed))
+                if len(text)-len(trimmed) >= 2 {
+                    b.WriteString("<br />")
+                }
+                i = j
+                continue
+            }
+            b.WriteString(html.EscapeString(text))
+            i = j
+        }
+    }
+}
+
+// isPunct reports whether c is ASCII punctuation and may therefore be
+// backslash-escaped.
+func isPunct(c byte) bool {
+    return strings.IndexByte("!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~", c) >= 0
+}
+
+// codeSpan renders a code span opening at s[i]. A run of backticks is
+// closed by a run of the same length; an unmatched run is literal.
+func codeSpan(b *strings.Builder, s string, i int) int {
+    n := 0
+    for i+n < len(s) && s[i+n] == '`' {
+        n++
+    }
+    fence := s[i : i+n]
+    j := i + n
+    for {
+        k := strings.Index(s[j:], fence)
+        if k < 0 {
+            b.WriteString(fence)
+            return i + n
+        }
+        k += j
+        end := k + n
+        if end < len(s) && s[end] == '`' {
+            // Part of a longer run; keep looking after it.
+            for end < len(s) && s[end] == '`' {
+                end++
+            }
+            j = end
+            continue
+        }
+        code := strings.ReplaceAll(s[i+n:k], "\n", " ")
+        if len(code) > 2 && code[0] == ' ' && code[len(code)-1] == ' ' && strings.TrimSpace(code) != "" {
+            code = code[1 : len(code)-1]
+        }
+        b.WriteString("<code>" + html.EscapeString(code) + "</code>")
+        return end
+    }
+}
+
+// skipCodeSpan returns the index after the code span opening at s[i],
+// or after the run of backticks when they are unmatched. It lets
+// findDelimiters ignore delimiters inside code.
+func skipCodeSpan(s string, i int) int {
+    var b strings.Builder
+    return codeSpan(&b, s, i)
+}
+
+// delimiters records where the brackets and emphasis runs of a text
+// are closed.
+type delimiters struct {
+    // brackets maps each `[` to the index of its matching `]`, or to
+    // -1 when it has none.
+    brackets map[int]int
+    // runs holds the start of every run of `*`, `_` or `~`.
+    runs map[int]bool
+    // closers lists, by character and run length, the runs that can
+    // close emphasis.
+    closers map[runKey]*closerList
+}
+
+// runKey identifies runs of the same character and length.
+type runKey struct {
+    c byte
+    n int
+}
+
+// closerList holds the positions of closing runs in order. Openers are
+// looked up from left to right, so next only ever moves forward.
+type closerList struct {
+    pos  []int
+    next int
+}
+
+// findDelimiters finds the brackets and emphasis runs of s in a single
+// pass. Backslash escapes and code spans are skipped, and runs and
+// brackets are matched, exactly as scanning forward from each opener
+// would, so the answers are the same; only the time is linear.
+// Openers the pass did not see, because the rest of the renderer
+// consumed text differently (a backtick inside a URL, say), are
+// printed literally.
+func findDelimiters(s string) *delimiters {
+    d := &delimiters{brackets: map[int]int{}, runs: map[int]bool{}, closers: map[runKey]*closerList{}}
+    var open []int
+    for j := 0; j < len(s); {
+        switch c := s[j]; c {
+        case '\\':
+            j += 2
+        case '`':
+            j = skipCodeSpan(s, j)
+        case '[':
+            d.brackets[j] = -1
+            open = append(open, j)
+            j++
+        case ']':
+            if len(open) > 0 {
+                d.brackets[open[len(open)-1]] = j
+                open = open[:len(open)-1]
+            }
+            j++
+        case '*', '_', '~':
+            m := 0
+            for j+m < len(s) && s[j+m] == c {
+                m++
+            }
+            d.runs[j] = true
+            // A closing run follows a non-space character, and an
+            // underscore run does not continue into a word.
+            if j > 0 && !isSpace(s[j-1]) && !(c == '_' && j+m < len(s) && isWordByte(s[j+m])) {
+                k := runKey{c, m}
+                if d.closers[k] == nil {
+                    d.closers[k] = &closerList{}
+                }
+                d.closers[k].pos = append(d.closers[k].pos, j)
+            }
+            j += m
+        default:
+            j++
+        }
+    }
+    return d
+}
+
+// closer returns the first run of n characters c at or after from that
+// can close emphasis, or -1.
+func (d *delimiters) closer(c byte, n, from int) int {
+    l := d.closers[runKey{c, n}]
+    if l == nil {
+        return -1
+    }
+    for l.next < len(l.pos) && l.pos[l.next] < from {
+        l.next++
+    }
+    if l.next == len(l.pos) {
+        return -1
+    }
+    return l.pos[l.next]
+}
+
+// linkOrImage renders `[text](dest "title")` starting at the bracket
+// s[i], or an image when image is set. It reports false when the
+// syntax is incomplete so the bracket can be printed literally.
+func linkOrImage(b *strings.Builder, s string, i int, image bool, d *delimiters, depth int) (int, bool) {
+    j, ok := d.brackets[i]
+    if !ok || j < 0 || j+1 >= len(s) || s[j+1] != '(' {
+        return 0, false
+    }
+    text := s[i+1 : j]
+    dest, title, end, ok := linkDestination(s, j+2)
+    if !ok {
+        return 0, false
+    }
+    if image {
+        alt := plainInline(text, depth+1)
+        if !safeURL(dest, true) {
+            b.WriteString(html.EscapeString(alt))
+            return end, true
+        }
+        b.WriteString(`<img src="` + html.EscapeString(dest) + `" alt="` + html.EscapeString(alt) + `"`)
+        if title != "" {
+            b.WriteString(` title="` + html.EscapeString(title) + `"`)
+        }
+        b.WriteString(" />")
+        return end, true
+    }
+    if !safeURL(dest, false) {
+        inline(b, text, false, depth+1)
+        return end, true
+    }
+    b.WriteString(`<a href="` + html.EscapeString(dest) + `"`)
+    if title != "" {
+        b.WriteString(` title="` + html.EscapeString(title) + `"`)
+    }
+    b.WriteString(">")
+    inline(b, text, false, depth+1)
+    b.WriteString("</a>")
+    return end, true
+}
+
+// linkDestination parses the part of an inline link after `(`:
+// a destination, an optional quoted title and the closing `)`. It
+// returns the index after the parenthesis. Destinations in angle
+// brackets cannot contain `<`, and bare ones may nest parentheses at
+// most maxDestParens deep.
+func linkDestination(s string, i int) (dest, title string, end int, ok bool) {
+    skip := func() {
+        for i < len(s) && (s[i] == ' ' || s[i] == '\n') {
+            i++
+        }
+    }
+    skip()
+    if i < len(s) && s[i] == '<' {
+        k := strings.IndexAny(s[i+1:], "<>\n")
+        if k < 0 || s[i+1+k] != '>' {
+            return "", "", 0, false
+        }
+        dest = s[i+1 : i+1+k]
+        i += k + 2
+    } else {
+        start, depth := i, 0
+        for i < len(s) && s[i] != ' ' && s[i] != '\n' {
+            if s[i] == '\\' && i+1 < len(s) {
+                i += 2
+                continue
+            }
+            if s[i] == '(' {
+                depth++
+                if depth > maxDestParens {
+                    return "", "", 0, false
+                }
+            } else if s[i] == ')' {
+                if depth == 0 {
+                    break
+                }
+                depth--
+            }
+            i++
+        }
+        dest = s[start:i]
+    }
+    skip()
+    if i < len(s) && (s[i] == '"' || s[i] == '\'') {
+        q := s[i]
+        k := strings.IndexByte(s[i+1:], q)
+        if k < 0 {
+            return "", "", 0, false
+        }
+        title = s[i+1 : i+1+k]
+        i += k + 2
+        skip()
+    }
+    if i >= len(s) || s[i] != ')' {
+        return "", "", 0, false
+    }
+    return unescapePunct(dest), unescapePunct(title), i + 1, true
+}
+
+// unescapePunct removes backslash escapes from link destinations and
+// titles.
+func unescapePunct(s string) string {
+    if !strings.Contains(s, "\\") {
+        return s
+    }
+    var b strings.Builder
+    for i := 0; i < len(s); i++ {
+        if s[i] == '\\' && i+1 < len(s) && isPunct(s[i+1]) {
+            i++
+        }
+        b.WriteByte(s[i])
+    }
+    return b.String()
+}
+
+// plainInline returns the text of inline Markdown without markup, for
+// use in image alt attributes.
+func plainInline(s string, depth int) string {
+    return PlainText(renderInlineAt(s, depth))
+}
+
+// autolink renders `<https://example.com>` or `<me@example.com>`
+// starting at s[i].
+func autolink(b *strings.Builder, s string, i int, links bool) (int, bool) {
+    k := strings.IndexAny(s[i+1:], "<> \n")
+    if k < 0 || s[i+1+k] != '>' {
+        return 0, false
+    }
+    target := s[i+1 : i+1+k]
+    href := target
+    switch {
+    case strings.Contains(target, "://"):
+    case strings.Count(target, "@") == 1 && !strings.Contains(target, ":"):
+        href = "mailto:" + target
+    default:
+        return 0, false
+    }
+    if !safeURL(href, false) {
+        return 0, false
+    }
+    if links {
+        b.WriteString(`<a href="` + html.EscapeString(href) + `">` + html.EscapeString(target) + "</a>")
+    } else {
+        b.WriteString(html.EscapeString(target))
+    }
+    return i + k + 2, true
+}
+
+// bareURLStart reports whether s[i:] begins a bare http(s) URL that is
+// not glued to a preceding word.
+func bareURLStart(s string, i int) bool {
+    if i > 0 {
+        r, _ := utf8.DecodeLastRuneInString(s[:i])
+        if unicode.IsLetter(r) || unicode.IsDigit(r) {
+            return false
+        }
+    }
+    rest := strings.ToLower(s[i:min(len(s), i+8)])
+    return strings.HasPrefix(rest, "http://") || strings.HasPrefix(rest, "https://")
+}
+
+// bareURL links a URL written without angle brackets. Trailing
+// punctuation and an unbalanced closing parenthesis are left out, so
+// "see https://example.com." links without the full stop.
+func bareURL(b *strings.Builder, s string, i int) int {
+    j := i
+    for j < len(s) && s[j] != ' ' && s[j] != '\n' && s[j] != '<' {
+        j++
+    }
+    url := s[i:j]
+    for len(url) > 0 {
+        last := url[len(url)-1]
+        if strings.IndexByte(".,:;!?'\"*_~", last) >= 0 {
+            url = url[:len(url)-1]
+            continue
+        }
+        if last == ')' && strings.Count(url, "(") < strings.Count(url, ")") {
+            url = url[:len(url)-1]
+            continue
+        }
+        break
+    }
+    b.WriteString(`<a href="` + html.EscapeString(url) + `">` + html.EscapeString(url) + "</a>")
+    return i + len(url)
+}
+
+// min returns the smaller of two ints.
+func min(a, b int) int {
+    if a < b {
+        return a
+    }
+    return b
+}
+
+// emphasis renders `*em*`, `_em_`, `**strong**`, `__strong__`,
+// `***both***` and `~~strikethrough~~` starting at s[i]. An opening
+// run must be followed by a non-space character and is closed by the
+// next run of the same length that follows a non-space character.
+// Underscores do not open or close inside words, so snake_case names
+// stay intact. Unmatched runs are printed literally.
+func emphasis(b *strings.Builder, s string, i int, links bool, d *delimiters, depth int) int {
+    c := s[i]
+    n := 0
+    for i+n < len(s) && s[i+n] == c {
+        n++
+    }
+    run := s[i : i+n]
+    literal := func() int {
+        b.WriteString(html.EscapeString(run))
+        return i + n
+    }
+    if c == '~' && n != 2 || n > 3 {
+        return literal()
+    }
+    // The opener must be left-flanking.
+    if i+n >= len(s) || isSpace(s[i+n]) {
+        return literal()
+    }
+    if c == '_' && i > 0 && isWordByte(s[i-1]) {
+        return literal()
+    }
+    // Look for a closing run of the same length.
+    if !d.runs[i] {
+        return literal()
+    }
+    j := d.closer(c, n, i+n)
+    if j < 0 {
+        return literal()
+    }
+    var open, close string
+    switch {
+    case c == '~':
+        open, close = "<del>", "</del>"
+    case n == 1:
+        open, close = "<em>", "</em>"
+    case n == 2:
+        open, close = "<strong>", "</strong>"
+    default:
+        open, close = "<em><strong>", "</strong></em>"
+    }
+    b.WriteString(open)
+    inline(b, s[i+n:j], links, depth+1)
+    b.WriteString(close)
+    return j + n
+}
+
+// isSpace reports whether c is ASCII whitespace.
+func isSpace(c byte) bool {
+    return c == ' ' || c == '\n' || c == '\t'
+}
+
+// isWordByte reports whether c continues a word for the purpose of
+// intraword underscores. Bytes of multi-byte characters count as word
+// characters.
+func isWordByte(c byte) bool {
+    return c >= 0x80 || c == '_' || (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
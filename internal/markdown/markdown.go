@@ -0,0 +1,350 @@
+package markdown
+
+// This package turns the Markdown source of posts and comments
+// into HTML. It implements the commonly used subset of CommonMark:
+// paragraphs, ATX and setext headings, fenced and indented code
+// blocks, block quotes, nested ordered and unordered lists, thematic
+// breaks and the inline syntax handled in inline.go. Raw HTML in the
+// source is never passed through; it is escaped like any other text.
+// The generated HTML is additionally run through the allowlist
+// sanitiser in sanitize.go before it reaches a template, so a bug in
+// the renderer cannot be turned into script injection.
+//
+// The source itself is stored unchanged in the database; rendering
+// happens on display. Since that is on every page view, the time taken
+// must not grow faster than the source: each level of quote or list
+// nesting renders its content again, so nesting is limited to
+// maxBlockDepth levels, and the inline syntax is parsed in linear time
+// (see inline.go).
+
+import (
+    "html"
+    "html/template"
+    "regexp"
+    "strconv"
+    "strings"
+)
+
+// Render converts Markdown source to sanitised HTML that is safe to
+// embed in a template.
+func Render(src string) template.HTML {
+    return template.HTML(Sanitize(renderHTML(src)))
+}
+
+// renderHTML converts Markdown source to HTML without sanitising it.
+func renderHTML(src string) string {
+    src = strings.ReplaceAll(src, "\r\n", "\n")
+    src = strings.ReplaceAll(src, "\r", "\n")
+    src = strings.ReplaceAll(src, "\t", "    ")
+    var b strings.Builder
+    renderBlocks(&b, strings.Split(src, "\n"), false, 0)
+    return b.String()
+}
+
+// maxBlockDepth is how deeply block quotes and lists may nest. Deeper
+// markers are shown as text.
+const maxBlockDepth = 16
+
+// Block level patterns. Up to three spaces of indentation are allowed
+// before a block marker; four or more start an indented code block.
+var (
+    headingRe   = regexp.MustCompile(`^ {0,3}(#{1,6})(?:[ ]+(.*?))?(?:[ ]+#+)?[ ]*$`)
+    fenceRe     = regexp.MustCompile("^( {0,3})(`{3,}|~{3,})[ ]*([^`]*)$")
+    hrRe        = regexp.MustCompile(`^ {0,3}(?:(?:-[ ]*){3,}|(?:\*[ ]*){3,}|(?:_[ ]*){3,})$`)
+    quoteRe     = regexp.MustCompile(`^ {0,3}> ?(.*)$`)
+    listRe      = regexp.MustCompile(`^( {0,3})([-*+]|\d{1,9}[.)])( +|$)(.*)$`)
+    setextH1Re  = regexp.MustCompile(`^ {0,3}=+[ ]*$`)
+    setextH2Re  = regexp.MustCompile(`^ {0,3}-+[ ]*$`)
+)
+
+// isBlank reports whether a line contains only whitespace.
+func isBlank(line string) bool {
+    return strings.TrimSpace(line) == ""
+}
+
+// indentOf returns the number of leading spaces of a line.
+func indentOf(line string) int {
+    return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+// listMarker describes the marker that starts a list item.
+type listMarker struct {
+    ordered bool
+    // delim is the bullet character or the ordered list delimiter
+    // ('.' or ')'). Items of one list share the same delim.
+    delim  byte
+    start  int
+    indent int // indentation of the marker itself
+    width  int // columns from the line start to the item content
+    rest   string
+}
+
+// parseListMarker recognises a list item line.
+func parseListMarker(line string) (listMarker, bool) {
+    m := listRe.FindStringSubmatch(line)
+    if m == nil {
+        return listMarker{}, false
+    }
+    lm := listMarker{indent: len(m[1]), rest: m[4]}
+    marker := m[2]
+    spaces := len(m[3])
+    // Content indented by five or more spaces is an indented code
+    // block inside the item; the item content starts after one space.
+    if spaces > 4 {
+        lm.rest = strings.Repeat(" ", spaces-1) + lm.rest
+        spaces = 1
+    }
+    if spaces == 0 {
+        spaces = 1
+    }
+    lm.width = lm.indent + len(marker) + spaces
+    if marker[0] >= '0' && marker[0] <= '9' {
+        lm.ordered = true
+        lm.delim = marker[len(marker)-1]
+        lm.start, _ = strconv.Atoi(marker[:len(marker)-1])
+    } else {
+        lm.delim = marker[0]
+    }
+    return lm, true
+}
+
+// startsBlock reports whether line begins a block that interrupts a
+// paragraph. Ordered lists only interrupt a paragraph when they start
+// at 1, so that a sentence like "2024. was a good year" wrapped onto
+// a new line stays part of the paragraph.
+func startsBlock(line string) bool {
+    if headingRe.MatchString(line) || fenceRe.MatchString(line) || hrRe.MatchString(line) || quoteRe.MatchString(line) {
+        return true
+    }
+    if lm, ok := parseListMarker(line); ok && strings.TrimSpace(lm.rest) != "" {
+        return !lm.ordered || lm.start == 1
+    }
+    return false
+}
+
+// renderBlocks renders a sequence of lines as block content. tight is
+// set for the items of tight lists, whose paragraphs are rendered
+// without <p> tags. depth counts the enclosing quotes and lists.
+func renderBlocks(b *strings.Builder, lines []string, tight bool, depth int) {
+    i := 0
+    for i < len(lines) {
+        line := lines[i]
+        switch {
+        case isBlank(line):
+            i++
+        case indentOf(line) >= 4:
+            i = renderIndentedCode(b, lines, i)
+        case fenceRe.MatchString(line):
+            i = renderFencedCode(b, lines, i)
+        case headingRe.MatchString(line):
+            m := headingRe.FindStringSubmatch(line)
+            level := strconv.Itoa(len(m[1]))
+            b.WriteString("<h" + level + ">" + renderInline(strings.TrimSpace(m[2])) + "</h" + level + ">\n")
+            i++
+        case hrRe.MatchString(line):
+            b.WriteString("<hr />\n")
+            i++
+        case depth < maxBlockDepth && quoteRe.MatchString(line):
+            i = renderQuote(b, lines, i, depth)
+        default:
+            if _, ok := parseListMarker(line); ok && depth < maxBlockDepth {
+                i = renderList(b, lines, i, depth)
+                continue
+            }
+            i = renderParagraph(b, lines, i, tight)
+        }
+    }
+}
+
+// renderIndentedCode renders a code block whose lines are indented by
+// four spaces, returning the index of the first line after it.
+func renderIndentedCode(b *strings.Builder, lines []string, i int) int {
+    var code []string
+    for i < len(lines) && (isBlank(lines[i]) || indentOf(lines[i]) >= 4) {
+        if isBlank(lines[i]) {
+            code = append(code, "")
+        } else {
+            code = append(code, lines[i][4:])
+        }
+        i++
+    }
+    for len(code) > 0 && code[len(code)-1] == "" {
+        code = code[:len(code)-1]
+    }
+    b.WriteString("<pre><code>" + html.EscapeString(strings.Join(code, "\n")) + "\n</code></pre>\n")
+    return i
+}
+
+// renderFencedCode renders a ``` or ~~~ code block. The first word of
+// the info string names the language and becomes a language-* class
+// for client-side highlighters. An unclosed fence runs to the end.
+func renderFencedCode(b *strings.Builder, lines []string, i int) int {
+    m := fenceRe.FindStringSubmatch(lines[i])
+    indent, fence := len(m[1]), m[2]
+    lang := ""
+    if f := strings.Fields(m[3]); len(f) > 0 {
+        lang = f[0]
+    }
+    i++
+    var code []string
+    for i < len(lines) {
+        t := strings.TrimSpace(lines[i])
+        if indentOf(lines[i]) < 4 && strings.HasPrefix(t, fence[:1]) && len(t) >= len(fence) && strings.Trim(t, fence[:1]) == "" {
+            i++
+            break
+        }
+        // Remove up to the fence's own indentation from each line.
+        line := lines[i]
+        strip := indentOf(line)
+        if strip > indent {
+            strip = indent
+        }
+        code = append(code, line[strip:])
+        i++
+    }
+    b.WriteString("<pre><code")
+    if lang != "" {
+        b.WriteString(` class="language-` + html.EscapeString(lang) + `"`)
+    }
+    b.WriteString(">")
+    if len(code) > 0 {
+        b.WriteString(html.EscapeString(strings.Join(code, "\n")) + "\n")
+    }
+    b.WriteString("</code></pre>\n")
+    return i
+}
+
+// renderQuote renders consecutive `>` lines as a block quote. Lines
+// without the marker continue the quote while they continue one of its
+// paragraphs.
+func renderQuote(b *strings.Builder, lines []string, i, depth int) int {
+    var inner []string
+    for i < len(lines) {
+        if m := quoteRe.FindStringSubmatch(lines[i]); m != nil {
+            inner = append(inner, m[1])
+        } else if !isBlank(lines[i]) && len(inner) > 0 && !isBlank(inner[len(inner)-1]) && !startsBlock(lines[i]) {
+            inner = append(inner, lines[i])
+        } else {
+            break
+        }
+        i++
+    }
+    b.WriteString("<blockquote>\n")
+    renderBlocks(b, inner, false, depth+1)
+    b.WriteString("</blockquote>\n")
+    return i
+}
+
+// renderList renders a list starting at line i together with its
+// nested content. A list is loose, and its items wrapped in
+// paragraphs, when blank lines separate its items or blocks.
+func renderList(b *strings.Builder, lines []string, i, depth int) int {
+    first, _ := parseListMarker(lines[i])
+    var items [][]string
+    loose := false
+    var cur []string
+    width := first.width
+    pendingBlank := false
+    for i < len(lines) {
+        line := lines[i]
+        if isBlank(line) {
+            pendingBlank = true
+            cur = append(cur, "")
+            i++
+            continue
+        }
+        if hrRe.MatchString(line) && indentOf(line) < width {
+            break
+        }
+        if lm, ok := parseListMarker(line); ok && lm.indent < width && lm.ordered == first.ordered && lm.delim == first.delim {
+            // A new item of this list.
+            if cur != nil {
+                items = append(items, cur)
+                if pendingBlank {
+                    loose = true
+                }
+            }
+            cur = []string{lm.rest}
+            width = lm.width
+            pendingBlank = false
+            i++
+            continue
+        }
+        if indentOf(line) >= width {
+            // Content belonging to the current item.
+            if pendingBlank {
+                loose = true
+            }
+            cur = append(cur, line[width:])
+            pendingBlank = false
+            i++
+            continue
+        }
+        if !pendingBlank && !startsBlock(line) {
+            // Lazy continuation of the item's last paragraph.
+            cur = append(cur, strings.TrimLeft(line, " "))
+            i++
+            continue
+        }
+        break
+    }
+    items = append(items, cur)
+
+    tag := "ul"
+    if first.ordered {
+        tag = "ol"
+    }
+    b.WriteString("<" + tag)
+    if first.ordered && first.start != 1 {
+        b.WriteString(` start="` + strconv.Itoa(first.start) + `"`)
+    }
+    b.WriteString(">\n")
+    for _, item := range items {
+        // Blank lines at the end of an item belong to the gap between
+        // items, not to the item itself.
+        for len(item) > 0 && isBlank(item[len(item)-1]) {
+            item = item[:len(item)-1]
+        }
+        b.WriteString("<li>")
+        var inner strings.Builder
+        renderBlocks(&inner, item, !loose, depth+1)
+        b.WriteString(strings.TrimSuffix(inner.String(), "\n"))
+        b.WriteString("</li>\n")
+    }
+    b.WriteString("</" + tag + ">\n")
+    return i
+}
+
+// renderParagraph renders a paragraph starting at line i. A following
+// line of `=` or `-` turns the paragraph into a setext heading.
+func renderParagraph(b *strings.Builder, lines []string, i int, tight bool) int {
+    var text []string
+    for i < len(lines) {
+        line := lines[i]
+        if isBlank(line) {
+            break
+        }
+        if len(text) > 0 {
+            if setextH1Re.MatchString(line) {
+                b.WriteString("<h1>" + renderInline(strings.Join(text, "\n")) + "</h1>\n")
+                return i + 1
+            }
+            if setextH2Re.MatchString(line) {
+                b.WriteString("<h2>" + renderInline(strings.Join(text, "\n")) + "</h2>\n")
+                return i + 1
+            }
+            if startsBlock(line) {
+                break
+            }
+        }
+        text = append(text, strings.TrimLeft(line, " "))
+        i++
+    }
+    content := renderInline(strings.Join(text, "\n"))
+    if tight {
+        b.WriteString(content + "\n")
+    } else {
+        b.WriteString("<p>" + content + "</p>\n")
+    }
+    return i
+}
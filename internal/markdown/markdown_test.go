@@ -0,0 +1,103 @@
+package markdown
+
+// Tests of the limits that keep rendering time proportional to the
+// length of the source, whatever its structure.
+
+import (
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestNestingIsLimited(t *testing.T) {
+    tests := []struct {
+        in, tag string
+    }{
+        {strings.Repeat("> ", 100) + "x", "<blockquote>"},
+        {strings.Repeat("- ", 100) + "x", "<ul>"},
+        {strings.Repeat("1. ", 100) + "x", "<ol>"},
+    }
+    for _, tt := range tests {
+        out := renderHTML(tt.in)
+        if n := strings.Count(out, tt.tag); n != maxBlockDepth {
+            t.Errorf("%.10q...: %d levels of %s, want %d", tt.in, n, tt.tag, maxBlockDepth)
+        }
+        // The markers beyond the limit are kept as text.
+        if !strings.Contains(out, "x") {
+            t.Errorf("%.10q...: content lost", tt.in)
+        }
+    }
+
+    // Images inside image descriptions.
+    in := strings.Repeat("![", 100) + "x" + strings.Repeat("](u)", 100)
+    if out := renderHTML(in); strings.Count(out, "<img") != 1 || !strings.Contains(out, "x") {
+        t.Errorf("nested images rendered as %q", out)
+    }
+}
+
+func TestDelimitersMatchLikeScanning(t *testing.T) {
+    tests := []struct {
+        in, want string
+    }{
+        {"[a [b] c](u)", `<p><a href="u">a [b] c</a></p>` + "\n"},
+        {"[a `]` b](u)", `<p><a href="u">a <code>]</code> b</a></p>` + "\n"},
+        {"[a \\] b](u)", `<p><a href="u">a ] b</a></p>` + "\n"},
+        {"[[a](u)", `<p>[<a href="u">a</a></p>` + "\n"},
+        {"[a]] [b](u)", `<p>[a]] <a href="u">b</a></p>` + "\n"},
+        {"*a `*` b*", "<p><em>a <code>*</code> b</em></p>\n"},
+        {"*a \\* b*", "<p><em>a * b</em></p>\n"},
+        {"*a **b** c*", "<p><em>a <strong>b</strong> c</em></p>\n"},
+        {"*a *b* c*", "<p><em>a *b</em> c*</p>\n"},
+        {"2*3 and 4*5 *x*", "<p>2<em>3 and 4</em>5 <em>x</em></p>\n"},
+        {"snake_case_name _x_", "<p>snake_case_name <em>x</em></p>\n"},
+        {"~~a~~ ~~ b~~", "<p><del>a</del> ~~ b~~</p>\n"},
+        {"[a](<u v>) [b](<u<v>)", `<p><a href="u v">a</a> [b](&lt;u&lt;v&gt;)</p>` + "\n"},
+        {"[a](" + strings.Repeat("(", maxDestParens) + strings.Repeat(")", maxDestParens) + ")", `<p><a href="` + strings.Repeat("(", maxDestParens) + strings.Repeat(")", maxDestParens) + `">a</a></p>` + "\n"},
+    }
+    for _, tt := range tests {
+        if got := renderHTML(tt.in); got != tt.want {
+            t.Errorf("renderHTML(%q)\n got %q\nwant %q", tt.in, got, tt.want)
+        }
+    }
+}
+
+func TestRenderTimeIsLinear(t *testing.T) {
+    // Each of these took seconds at 16 KB when every opener scanned the
+    // rest of the text for its partner. Rather than an absolute limit,
+    // which depends on the machine, check that four times the input
+    // takes about four times as long; quadratic growth would make it
+    // sixteen. The quotes are one long line, long enough at either size
+    // that the regexp package uses the same matcher for both.
+    inputs := map[string]func(k int) string{
+        "lists":      func(k int) string { return strings.Repeat("- ", k) + "x" },
+        "quotes":     func(k int) string { return strings.Repeat(">", 4*k) },
+        "links":      func(k int) string { return strings.Repeat("[a](", k) },
+        "brackets":   func(k int) string { return strings.Repeat("[", 4*k) },
+        "nested":     func(k int) string { return strings.Repeat("[", 2*k) + strings.Repeat("]", 2*k) },
+        "emphasis":   func(k int) string { return strings.Repeat("*a ", k) },
+        "underscore": func(k int) string { return strings.Repeat("_a ", k) },
+        "strike":     func(k int) string { return strings.Repeat("~~a ", k) },
+        "angle":      func(k int) string { return strings.Repeat("[x](<", k) },
+        "images":     func(k int) string { return strings.Repeat("![", k/2) + strings.Repeat("](u)", k/2) },
+    }
+    // render returns the shortest of three runs, which is the least
+    // disturbed by other work on the machine.
+    render := func(in string) time.Duration {
+        best := time.Duration(1<<63 - 1)
+        for i := 0; i < 3; i++ {
+            start := time.Now()
+            Render(in)
+            Excerpt(in, 200)
+            if d := time.Since(start); d < best {
+                best = d
+            }
+        }
+        return best
+    }
+    for name, input := range inputs {
+        small, large := render(input(4000)), render(input(16000))
+        if large > 8*small+10*time.Millisecond {
+            t.Errorf("%s: %v for 4000 units but %v for 16000", name, small, large)
+        }
+    }
+}
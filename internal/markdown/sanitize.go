@@ -0,0 +1,277 @@
+package markdown
+
+// This file implements a strict allowlist HTML sanitiser and a plain
+// text extractor. The sanitiser rebuilds every tag it keeps from
+// scratch: only the elements and attributes listed below survive,
+// URLs must use a safe scheme, entities are normalised and unclosed
+// elements are closed. Anything else is dropped or escaped. Render
+// passes all of its output through Sanitize.
+
+import (
+    "html"
+    "regexp"
+    "strings"
+    "unicode/utf8"
+)
+
+// allowedTags maps each permitted element to its permitted
+// attributes.
+var allowedTags = map[string][]string{
+    "p": nil, "br": nil, "hr": nil,
+    "h1": nil, "h2": nil, "h3": nil, "h4": nil, "h5": nil, "h6": nil,
+    "strong": nil, "em": nil, "del": nil, "code": {"class"}, "pre": nil,
+    "blockquote": nil, "ul": nil, "ol": {"start"}, "li": nil,
+    "a":   {"href", "title"},
+    "img": {"src", "alt", "title"},
+}
+
+// voidTags are elements without content or closing tag.
+var voidTags = map[string]bool{"br": true, "hr": true, "img": true}
+
+// droppedContent lists elements whose content is removed along with
+// the tags, because it is not meant to be shown as text.
+var droppedContent = map[string]bool{"script": true, "style": true, "iframe": true, "object": true, "textarea": true, "title": true}
+
+// blockTags end a line of text in PlainText.
+var blockTags = map[string]bool{
+    "p": true, "br": true, "hr": true, "h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+    "pre": true, "blockquote": true, "ul": true, "ol": true, "li": true,
+}
+
+var (
+    tagRe      = regexp.MustCompile(`^<(/?)([a-zA-Z][a-zA-Z0-9]*)((?:\s+[^\s"'>/=]+(?:\s*=\s*(?:"[^"]*"|'[^']*'|[^\s"'=<>` + "`" + `]+))?)*)\s*/?>`)
+    attrRe     = regexp.MustCompile(`([^\s"'>/=]+)(?:\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'=<>` + "`" + `]+)))?`)
+    langRe     = regexp.MustCompile(`^language-[A-Za-z0-9_+#.-]{1,32}$`)
+    startRe    = regexp.MustCompile(`^[0-9]{1,9}$`)
+    schemeRe   = regexp.MustCompile(`^([a-zA-Z][a-zA-Z0-9+.-]*):`)
+)
+
+// Sanitize returns s reduced to the allowed elements and attributes.
+// Text is re-escaped, links get rel="nofollow ugc" and every opened
+// element is closed.
+func Sanitize(s string) string {
+    var b strings.Builder
+    var open []string
+    for len(s) > 0 {
+        lt := strings.IndexByte(s, '<')
+        if lt < 0 {
+            b.WriteString(escapeText(s))
+            break
+        }
+        b.WriteString(escapeText(s[:lt]))
+        s = s[lt:]
+        if strings.HasPrefix(s, "<!--") {
+            end := strings.Index(s, "-->")
+            if end < 0 {
+                break
+            }
+            s = s[end+3:]
+            continue
+        }
+        m := tagRe.FindStringSubmatch(s)
+        if m == nil {
+            b.WriteString("&lt;")
+            s = s[1:]
+            continue
+        }
+        s = s[len(m[0]):]
+        closing, name := m[1] == "/", strings.ToLower(m[2])
+        if droppedContent[name] && !closing {
+            // Skip everything up to the matching closing tag.
+            end := indexFold(s, "</"+name)
+            if end < 0 {
+                break
+            }
+            s = s[end:]
+            if gt := strings.IndexByte(s, '>'); gt >= 0 {
+                s = s[gt+1:]
+            } else {
+                s = ""
+            }
+            continue
+        }
+        attrs, ok := allowedTags[name]
+        if !ok {
+            continue
+        }
+        if closing {
+            // Close the element and any still open inside it; stray
+            // closing tags are dropped.
+            for k := len(open) - 1; k >= 0; k-- {
+                if open[k] == name {
+                    for len(open) > k {
+                        b.WriteString("</" + open[len(open)-1] + ">")
+                        open = open[:len(open)-1]
+                    }
+                    break
+                }
+            }
+            continue
+        }
+        b.WriteString("<" + name)
+        kept := sanitizeAttrs(name, attrs, m[3])
+        for _, kv := range kept {
+            b.WriteString(" " + kv[0] + `="` + html.EscapeString(kv[1]) + `"`)
+        }
+        if name == "a" {
+            b.WriteString(` rel="nofollow ugc"`)
+        }
+        if voidTags[name] {
+            b.WriteString(" />")
+            continue
+        }
+        b.WriteString(">")
+        open = append(open, name)
+    }
+    for k := len(open) - 1; k >= 0; k-- {
+        b.WriteString("</" + open[k] + ">")
+    }
+    return b.String()
+}
+
+// escapeText normalises a run of text: entities are decoded and the
+// result escaped again, so stray `<` or `&` cannot start markup.
+func escapeText(s string) string {
+    return html.EscapeString(html.UnescapeString(s))
+}
+
+// sanitizeAttrs returns the permitted attributes of an element as
+// name/value pairs with decoded values. Attributes carrying URLs or
+// constrained values are dropped when the value is unsafe.
+func sanitizeAttrs(tag string, allowed []string, raw string) [][2]string {
+    var out [][2]string
+    seen := map[string]bool{}
+    for _, m := range attrRe.FindAllStringSubmatch(raw, -1) {
+        name := strings.ToLower(m[1])
+        if seen[name] || !contains(allowed, name) {
+            continue
+        }
+        value := html.UnescapeString(m[2] + m[3] + m[4])
+        switch {
+        case name == "href" && !safeURL(value, false):
+            continue
+        case name == "src" && !safeURL(value, true):
+            continue
+        case tag == "code" && name == "class" && !langRe.MatchString(value):
+            continue
+        case name == "start" && !startRe.MatchString(value):
+            continue
+        }
+        seen[name] = true
+        out = append(out, [2]string{name, value})
+    }
+    return out
+}
+
+// contains reports whether list holds s.
+func contains(list []string, s string) bool {
+    for _, v := range list {
+        if v == s {
+            return true
+        }
+    }
+    return false
+}
+
+// safeURL reports whether a link target may be used. Relative URLs and
+// http(s) are always allowed; links may also use mailto. Control
+// characters are rejected outright since browsers ignore some of them
+// when parsing the scheme.
+func safeURL(u string, image bool) bool {
+    u = strings.TrimSpace(u)
+    if u == "" {
+        return false
+    }
+    for _, r := range u {
+        if r < 0x20 || r == 0x7f {
+            return false
+        }
+    }
+    m := schemeRe.FindStringSubmatch(u)
+    if m == nil {
+        // No scheme: a relative reference such as /post?id=1 or #top.
+        return true
+    }
+    switch strings.ToLower(m[1]) {
+    case "http", "https":
+        return true
+    case "mailto":
+        return !image
+    }
+    return false
+}
+
+// PlainText returns the text content of an HTML fragment with tags
+// removed, entities decoded and whitespace collapsed. Block elements
+// are separated by a space so words do not run together.
+func PlainText(s string) string {
+    var b strings.Builder
+    for len(s) > 0 {
+        lt := strings.IndexByte(s, '<')
+        if lt < 0 {
+            b.WriteString(html.UnescapeString(s))
+            break
+        }
+        b.WriteString(html.UnescapeString(s[:lt]))
+        s = s[lt:]
+        m := tagRe.FindStringSubmatch(s)
+        if m == nil {
+            b.WriteString("<")
+            s = s[1:]
+            continue
+        }
+        s = s[len(m[0]):]
+        if blockTags[strings.ToLower(m[2])] {
+            b.WriteString(" ")
+        }
+        if name := strings.ToLower(m[2]); name == "img" && m[1] == "" {
+            for _, a := range attrRe.FindAllStringSubmatch(m[3], -1) {
+                if strings.ToLower(a[1]) == "alt" {
+                    b.WriteString(html.UnescapeString(a[2] + a[3] + a[4]))
+                }
+            }
+        }
+    }
+    return strings.Join(strings.Fields(b.String()), " ")
+}
+
+// indexFold returns the index of the first instance of sub in s,
+// ignoring the case of ASCII letters, or -1. sub must be lower case.
+// Unlike searching strings.ToLower(s), the index is always one into s,
+// whose other characters may change length when lowered, and nothing
+// is copied.
+func indexFold(s, sub string) int {
+    for i := 0; i+len(sub) <= len(s); i++ {
+        j := 0
+        for j < len(sub) {
+            c := s[i+j]
+            if 'A' <= c && c <= 'Z' {
+                c += 'a' - 'A'
+            }
+            if c != sub[j] {
+                break
+            }
+            j++
+        }
+        if j == len(sub) {
+            return i
+        }
+    }
+    return -1
+}
+
+// Excerpt renders Markdown source and returns at most max runes of its
+// plain text, cut at a word boundary where possible and followed by
+// "..." when shortened. It is used for post previews.
+func Excerpt(src string, max int) string {
+    text := PlainText(string(Render(src)))
+    if utf8.RuneCountInString(text) <= max {
+        return text
+    }
+    runes := []rune(text)
+    cut := string(runes[:max])
+    if sp := strings.LastIndexByte(cut, ' '); sp > len(cut)/2 {
+        cut = cut[:sp]
+    }
+    return strings.TrimRight(cut, " .,;:") + "..."
+}
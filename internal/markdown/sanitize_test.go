@@ -0,0 +1,183 @@
+package markdown
+
+// Tests of the HTML sanitiser, which stands between user input and the
+// page. Besides exact expectations for known attacks, every output is
+// run through checkSafe, which checks the result independently of the
+// sanitiser's own tables: each `<` starts a tag of the allowlist, only
+// allowlisted attributes appear, and links and images point nowhere
+// but http(s), mailto for links, or a relative URL. FuzzRender applies
+// the same check to arbitrary input (`go test -fuzz FuzzRender`).
+
+import (
+    "html"
+    "regexp"
+    "strings"
+    "testing"
+)
+
+var (
+    // outTagRe matches a tag as Sanitize writes it.
+    outTagRe  = regexp.MustCompile(`^<(/?)([a-z0-9]+)((?: [a-z]+="[^"<>]*")*)( /)?>`)
+    outAttrRe = regexp.MustCompile(` ([a-z]+)="([^"]*)"`)
+    // outSchemeRe finds the scheme of a URL the way browsers do,
+    // ignoring leading whitespace and control characters.
+    outSchemeRe = regexp.MustCompile(`^[\x00-\x20]*([a-zA-Z][a-zA-Z0-9+.\-\t\n\r]*):`)
+)
+
+// checkSafe fails the test if out contains markup the sanitiser should
+// not let through.
+func checkSafe(t *testing.T, in, out string) {
+    t.Helper()
+    permitted := map[string]string{
+        "p": "", "br": "", "hr": "", "h1": "", "h2": "", "h3": "", "h4": "", "h5": "", "h6": "",
+        "strong": "", "em": "", "del": "", "pre": "", "blockquote": "", "ul": "", "li": "",
+        "code": "class", "ol": "start", "a": "href title rel", "img": "src alt title",
+    }
+    for i := strings.IndexByte(out, '<'); i >= 0; i = strings.IndexByte(out, '<') {
+        out = out[i:]
+        m := outTagRe.FindStringSubmatch(out)
+        if m == nil {
+            t.Fatalf("%q: output has a stray or malformed tag at %q", in, out)
+        }
+        out = out[len(m[0]):]
+        attrs, ok := permitted[m[2]]
+        if !ok {
+            t.Fatalf("%q: output has a <%s> element", in, m[2])
+        }
+        for _, a := range outAttrRe.FindAllStringSubmatch(m[3], -1) {
+            name, value := a[1], html.UnescapeString(a[2])
+            if !strings.Contains(" "+attrs+" ", " "+name+" ") {
+                t.Fatalf("%q: output has attribute %s on <%s>", in, name, m[2])
+            }
+            if name != "href" && name != "src" {
+                continue
+            }
+            if s := outSchemeRe.FindStringSubmatch(value); s != nil {
+                scheme := strings.ToLower(strings.NewReplacer("\t", "", "\n", "", "\r", "").Replace(s[1]))
+                if scheme != "http" && scheme != "https" && !(scheme == "mailto" && name == "href") {
+                    t.Fatalf("%q: output has %s=%q", in, name, value)
+                }
+            }
+        }
+    }
+}
+
+func TestSanitize(t *testing.T) {
+    tests := []struct {
+        in, want string
+    }{
+        // Script and other elements whose content is not text.
+        {`<script>alert(1)</script>ok`, `ok`},
+        {`<SCRIPT type="text/javascript">alert(1)</SCRIPT >ok`, `ok`},
+        {`a<script src="//evil.example/x.js">`, `a`},
+        {`<style>body{display:none}</style><iframe src="https://evil.example"></iframe>ok`, `ok`},
+        {`<scr<script>ipt>alert(1)</script>`, `&lt;scr`},
+        {`<script>a</script><p>kept</p>`, `<p>kept</p>`},
+        // Characters that change length when lowered, before the
+        // closing tag.
+        {"<sCript>\xb2\xa6\x84\xfb\xc0</sCript>ok", `ok`},
+        {"<script>\u212a\u212a\u212a</SCRIPT>ok", `ok`},
+
+        // Dangerous link and image targets.
+        {`<a href="javascript:alert(1)">x</a>`, `<a rel="nofollow ugc">x</a>`},
+        {`<a href=" JaVaScRiPt:alert(1)">x</a>`, `<a rel="nofollow ugc">x</a>`},
+        {`<a href="&#106;avascript:alert(1)">x</a>`, `<a rel="nofollow ugc">x</a>`},
+        {`<a href="java&#x09;script:alert(1)">x</a>`, `<a rel="nofollow ugc">x</a>`},
+        {`<a href="jav&#10;ascript:alert(1)">x</a>`, `<a rel="nofollow ugc">x</a>`},
+        {`<a href="vbscript:msgbox(1)">x</a>`, `<a rel="nofollow ugc">x</a>`},
+        {`<a href="data:text/html;base64,PHNjcmlwdD5hbGVydCgxKTwvc2NyaXB0Pg==">x</a>`, `<a rel="nofollow ugc">x</a>`},
+        {`<img src="data:image/svg+xml,&lt;svg onload=alert(1)&gt;">`, `<img />`},
+        {`<img src="javascript:alert(1)" alt="a">`, `<img alt="a" />`},
+        {`<img src="mailto:a@example.com">`, `<img />`},
+        {`<a href="mailto:a@example.com">mail</a>`, `<a href="mailto:a@example.com" rel="nofollow ugc">mail</a>`},
+        {`<a href="/post?id=1&amp;x=2">x</a>`, `<a href="/post?id=1&amp;x=2" rel="nofollow ugc">x</a>`},
+
+        // Event handlers and other attributes.
+        {`<img src="x.png" onerror="alert(1)">`, `<img src="x.png" />`},
+        {`<img src=x.png onerror=alert(1)>`, `<img src="x.png" />`},
+        {`<img/src=x onerror=alert(1)>`, `&lt;img/src=x onerror=alert(1)&gt;`},
+        {`<p onclick="alert(1)" style="color:red" class="x">a</p>`, `<p>a</p>`},
+        {`<a href="x" ONMOUSEOVER="alert(1)">a</a>`, `<a href="x" rel="nofollow ugc">a</a>`},
+        {`<a href="x" title='"><script>alert(1)</script>'>a</a>`, `<a href="x" title="&#34;&gt;&lt;script&gt;alert(1)&lt;/script&gt;" rel="nofollow ugc">a</a>`},
+        {`<a href="x" rel="opener">a</a>`, `<a href="x" rel="nofollow ugc">a</a>`},
+        {`<code class="language-go">x</code>`, `<code class="language-go">x</code>`},
+        {`<code class="language-go onload=x">x</code>`, `<code>x</code>`},
+        {`<ol start="3 onclick">`, `<ol></ol>`},
+        {`<a href="a" href="javascript:alert(1)">x</a>`, `<a href="a" rel="nofollow ugc">x</a>`},
+
+        // Nested and malformed markup.
+        {`<strong><em>x</strong> y`, `<strong><em>x</em></strong> y`},
+        {`</p></strong>text`, `text`},
+        {`<p>unclosed <em>too`, `<p>unclosed <em>too</em></p>`},
+        {`<div><p>x</div></p>`, `<p>x</p>`},
+        {`<p>a <!-- <script>alert(1)</script> --> b</p>`, `<p>a  b</p>`},
+        {`<p>a <!-- never closed <script>`, `<p>a </p>`},
+        {`<p>1 < 2 && 3 > 2</p>`, `<p>1 &lt; 2 &amp;&amp; 3 &gt; 2</p>`},
+        {`<p>&lt;script&gt;</p>`, `<p>&lt;script&gt;</p>`},
+        {`<a href="x"<script>alert(1)</script>>`, `&lt;a href=&#34;x&#34;&gt;`},
+        {`<<script>script>alert(1)</script>`, `&lt;`},
+    }
+    for _, tt := range tests {
+        got := Sanitize(tt.in)
+        if got != tt.want {
+            t.Errorf("Sanitize(%q)\n got %q\nwant %q", tt.in, got, tt.want)
+        }
+        checkSafe(t, tt.in, got)
+    }
+}
+
+func TestRenderEscapesHTML(t *testing.T) {
+    // Raw HTML in Markdown is shown as text, and Markdown syntax
+    // cannot produce dangerous markup either.
+    tests := []struct {
+        in, want string
+    }{
+        {`<script>alert(1)</script>`, "<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>\n"},
+        {`<img src=x onerror=alert(1)>`, "<p>&lt;img src=x onerror=alert(1)&gt;</p>\n"},
+        {`**<b onclick=x>bold</b>**`, "<p><strong>&lt;b onclick=x&gt;bold&lt;/b&gt;</strong></p>\n"},
+        {"> <iframe src=x>\n> **quoted**", "<blockquote>\n<p>&lt;iframe src=x&gt;\n<strong>quoted</strong></p>\n</blockquote>\n"},
+        {"- <script>\n- [y](vbscript:x)", "<ul>\n<li>&lt;script&gt;</li>\n<li>y</li>\n</ul>\n"},
+        {"`<script>`", "<p><code>&lt;script&gt;</code></p>\n"},
+        {"```html\n<script>alert(1)</script>\n```", "<pre><code class=\"language-html\">&lt;script&gt;alert(1)&lt;/script&gt;\n</code></pre>\n"},
+        {`[x](javascript:alert(1))`, "<p>x</p>\n"},
+        {`[x](JaVaScRiPt:alert(1))`, "<p>x</p>\n"},
+        {`[x](data:text/html;base64,PHNjcmlwdD4=)`, "<p>x</p>\n"},
+        {`*[x](javascript:alert(1))*`, "<p><em>x</em></p>\n"},
+        {`![x](javascript:alert(1))`, "<p>x</p>\n"},
+        {`<javascript:alert(1)>`, "<p>&lt;javascript:alert(1)&gt;</p>\n"},
+        {`[a](http://a.example"onmouseover="alert(1))`, "<p><a href=\"http://a.example&#34;onmouseover=&#34;alert(1)\" rel=\"nofollow ugc\">a</a></p>\n"},
+        {`![a"onerror="alert(1)](x.png)`, "<p><img src=\"x.png\" alt=\"a&#34;onerror=&#34;alert(1)\" /></p>\n"},
+        {`http://a.example/<script>`, "<p><a href=\"http://a.example/\" rel=\"nofollow ugc\">http://a.example/</a>&lt;script&gt;</p>\n"},
+    }
+    for _, tt := range tests {
+        got := string(Render(tt.in))
+        if got != tt.want {
+            t.Errorf("Render(%q)\n got %q\nwant %q", tt.in, got, tt.want)
+        }
+        checkSafe(t, tt.in, got)
+    }
+}
+
+func TestPlainTextDropsMarkup(t *testing.T) {
+    got := PlainText(Sanitize(`<p>Hello <strong>world</strong></p><script>alert(1)</script><img src="x.png" alt="a cat">`))
+    if got != "Hello world a cat" {
+        t.Fatalf("PlainText returned %q", got)
+    }
+}
+
+func FuzzRender(f *testing.F) {
+    for _, seed := range []string{
+        `<script>alert(1)</script>`,
+        `<a href="javascript:alert(1)">x</a>`,
+        `<img src=x onerror=alert(1)>`,
+        `[x](javascript:alert(1)) ![y](data:image/png;base64,AAAA)`,
+        "**<em>x</strong>** `<b>` <!-- c",
+        "> - [a](<javascript:x>)\n>   ```\n>   </code></pre><script>",
+    } {
+        f.Add(seed)
+    }
+    f.Fuzz(func(t *testing.T, in string) {
+        checkSafe(t, in, string(Render(in)))
+        checkSafe(t, in, Sanitize(in))
+    })
+}
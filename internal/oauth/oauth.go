@@ -0,0 +1,463 @@
+package oauth
+
+// This package implements the client side of the OAuth 2.0
+// authorization code flow with PKCE (RFC 7636) and the parts of OpenID
+// Connect needed to log users in with an external identity provider.
+//
+// Providers are configured in a JSON file, so new ones can be added
+// without code changes:
+//
+//   {"providers": [
+//     {"name": "github", "type": "github", "client_id": "...", "client_secret_env": "GITHUB_SECRET"},
+//     {"name": "google", "type": "google", "client_id": "...", "client_secret_env": "GOOGLE_SECRET"},
+//     {"name": "corp", "title": "Corp SSO", "type": "oidc", "issuer": "https://sso.example.com",
+//      "client_id": "...", "client_secret_env": "CORP_SECRET"}
+//   ]}
+//
+// "github" and "google" come with their endpoints preset; "oidc" works
+// with any OpenID Connect provider, whose endpoints are read from the
+// issuer's discovery document the first time they are needed. Each
+// endpoint can also be set by hand, for example to point a provider at
+// a local test server such as cmd/mockoidc or the oauthtest package.
+//
+// The identity of the user is taken from the ID token returned by the
+// token endpoint, optionally completed by the userinfo endpoint. The
+// token is received directly from the provider over the back channel,
+// so as permitted by OpenID Connect Core 3.1.3.7 its issuer, audience,
+// expiry and nonce are checked but not its signature.
+
+import (
+    "bytes"
+    "context"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "net/url"
+    "os"
+    "regexp"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Provider types.
+const (
+    TypeGitHub = "github"
+    TypeGoogle = "google"
+    TypeOIDC   = "oidc"
+)
+
+// Provider is one configured identity provider.
+type Provider struct {
+    // Name identifies the provider in URLs and in the identities
+    // table. It must not change once users have linked accounts.
+    Name string `json:"name"`
+    // Title is shown on the login button, e.g. "GitHub".
+    Title string `json:"title"`
+    // Type is TypeGitHub, TypeGoogle or TypeOIDC.
+    Type string `json:"type"`
+
+    ClientID     string `json:"client_id"`
+    ClientSecret string `json:"client_secret"`
+    // ClientSecretEnv names an environment variable holding the client
+    // secret, which keeps secrets out of the configuration file.
+    ClientSecretEnv string `json:"client_secret_env"`
+
+    // Issuer is the OpenID Connect issuer. Its discovery document
+    // supplies any endpoint left empty below.
+    Issuer      string   `json:"issuer"`
+    AuthURL     string   `json:"auth_url"`
+    TokenURL    string   `json:"token_url"`
+    UserInfoURL string   `json:"userinfo_url"`
+    Scopes      []string `json:"scopes"`
+
+    // Client is used for all requests to the provider. A client with
+    // a timeout is set by LoadConfig.
+    Client *http.Client `json:"-"`
+
+    mu         sync.Mutex
+    discovered bool
+}
+
+// Token is the response of the token endpoint.
+type Token struct {
+    AccessToken string `json:"access_token"`
+    TokenType   string `json:"token_type"`
+    IDToken     string `json:"id_token"`
+}
+
+// Identity describes the user as reported by the provider.
+type Identity struct {
+    // Subject is the provider's stable identifier of the user.
+    Subject       string
+    Email         string
+    EmailVerified bool
+    // Username is the provider's user name, if it has one, such as
+    // the GitHub login. It is only a suggestion for new accounts.
+    Username string
+    Name     string
+}
+
+var nameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+// LoadConfig reads the provider configuration from a JSON file and
+// checks it. Presets are applied for the github and google types.
+func LoadConfig(path string) ([]*Provider, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    var cfg struct {
+        Providers []*Provider `json:"providers"`
+    }
+    dec := json.NewDecoder(bytes.NewReader(data))
+    dec.DisallowUnknownFields()
+    if err := dec.Decode(&cfg); err != nil {
+        return nil, fmt.Errorf("oauth config: %w", err)
+    }
+    seen := map[string]bool{}
+    for _, p := range cfg.Providers {
+        if err := p.init(); err != nil {
+            return nil, fmt.Errorf("oauth config: provider %q: %w", p.Name, err)
+        }
+        if seen[p.Name] {
+            return nil, fmt.Errorf("oauth config: provider %q defined twice", p.Name)
+        }
+        seen[p.Name] = true
+    }
+    return cfg.Providers, nil
+}
+
+// init validates p and fills in defaults.
+func (p *Provider) init() error {
+    if !nameRe.MatchString(p.Name) {
+        return errors.New("name must be lower case letters, digits, '-' or '_'")
+    }
+    if p.ClientID == "" {
+        return errors.New("client_id is required")
+    }
+    if p.ClientSecret == "" && p.ClientSecretEnv != "" {
+        p.ClientSecret = os.Getenv(p.ClientSecretEnv)
+    }
+    switch p.Type {
+    case TypeGitHub:
+        setDefault(&p.Title, "GitHub")
+        setDefault(&p.AuthURL, "https://github.com/login/oauth/authorize")
+        setDefault(&p.TokenURL, "https://github.com/login/oauth/access_token")
+        setDefault(&p.UserInfoURL, "https://api.github.com/user")
+        if p.Scopes == nil {
+            p.Scopes = []string{"read:user", "user:email"}
+        }
+    case TypeGoogle:
+        setDefault(&p.Title, "Google")
+        setDefault(&p.Issuer, "https://accounts.google.com")
+    case TypeOIDC:
+        if p.Issuer == "" {
+            return errors.New("issuer is required for oidc providers")
+        }
+    default:
+        return fmt.Errorf("unknown type %q", p.Type)
+    }
+    if p.Type != TypeGitHub && p.Scopes == nil {
+        p.Scopes = []string{"openid", "email", "profile"}
+    }
+    setDefault(&p.Title, p.Name)
+    p.Issuer = strings.TrimSuffix(p.Issuer, "/")
+    if p.Client == nil {
+        p.Client = &http.Client{Timeout: 10 * time.Second}
+    }
+    return nil
+}
+
+func setDefault(s *string, v string) {
+    if *s == "" {
+        *s = v
+    }
+}
+
+// OIDC reports whether the provider speaks OpenID Connect.
+func (p *Provider) OIDC() bool {
+    return p.Type != TypeGitHub
+}
+
+// discover fetches the endpoints that are not configured from the
+// issuer's discovery document. It runs once per provider; a failed
+// attempt is retried on the next call.
+func (p *Provider) discover(ctx context.Context) error {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    if p.discovered || !p.OIDC() || (p.AuthURL != "" && p.TokenURL != "") {
+        return nil
+    }
+    var doc struct {
+        Issuer           string `json:"issuer"`
+        AuthEndpoint     string `json:"authorization_endpoint"`
+        TokenEndpoint    string `json:"token_endpoint"`
+        UserInfoEndpoint string `json:"userinfo_endpoint"`
+    }
+    if err := p.getJSON(ctx, p.Issuer+"/.well-known/openid-configuration", "", &doc); err != nil {
+        return fmt.Errorf("oauth: discovery for %s: %w", p.Name, err)
+    }
+    if strings.TrimSuffix(doc.Issuer, "/") != p.Issuer {
+        return fmt.Errorf("oauth: discovery for %s: issuer %q does not match", p.Name, doc.Issuer)
+    }
+    setDefault(&p.AuthURL, doc.AuthEndpoint)
+    setDefault(&p.TokenURL, doc.TokenEndpoint)
+    setDefault(&p.UserInfoURL, doc.UserInfoEndpoint)
+    if p.AuthURL == "" || p.TokenURL == "" {
+        return fmt.Errorf("oauth: discovery for %s: endpoints missing", p.Name)
+    }
+    p.discovered = true
+    return nil
+}
+
+// NewVerifier returns a random PKCE code verifier.
+func NewVerifier() (string, error) {
+    return randomString(32)
+}
+
+// Challenge returns the S256 PKCE code challenge for verifier.
+func Challenge(verifier string) string {
+    sum := sha256.Sum256([]byte(verifier))
+    return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// NewState returns a random value suitable for the state and nonce
+// parameters.
+func NewState() (string, error) {
+    return randomString(24)
+}
+
+func randomString(n int) (string, error) {
+    b := make([]byte, n)
+    if _, err := rand.Read(b); err != nil {
+        return "", err
+    }
+    return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// AuthCodeURL returns the URL of the provider's consent page that
+// starts the flow. verifier is the PKCE verifier kept by the caller;
+// nonce is only sent to OpenID Connect providers.
+func (p *Provider) AuthCodeURL(ctx context.Context, redirectURI, state, verifier, nonce string) (string, error) {
+    if err := p.discover(ctx); err != nil {
+        return "", err
+    }
+    v := url.Values{}
+    v.Set("response_type", "code")
+    v.Set("client_id", p.ClientID)
+    v.Set("redirect_uri", redirectURI)
+    v.Set("scope", strings.Join(p.Scopes, " "))
+    v.Set("state", state)
+    v.Set("code_challenge", Challenge(verifier))
+    v.Set("code_challenge_method", "S256")
+    if p.OIDC() {
+        v.Set("nonce", nonce)
+    }
+    sep := "?"
+    if strings.Contains(p.AuthURL, "?") {
+        sep = "&"
+    }
+    return p.AuthURL + sep + v.Encode(), nil
+}
+
+// Exchange trades an authorization code for tokens.
+func (p *Provider) Exchange(ctx context.Context, code, redirectURI, verifier string) (*Token, error) {
+    if err := p.discover(ctx); err != nil {
+        return nil, err
+    }
+    form := url.Values{}
+    form.Set("grant_type", "authorization_code")
+    form.Set("code", code)
+    form.Set("redirect_uri", redirectURI)
+    form.Set("code_verifier", verifier)
+    form.Set("client_id", p.ClientID)
+    form.Set("client_secret", p.ClientSecret)
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.TokenURL, strings.NewReader(form.Encode()))
+    if err != nil {
+        return nil, err
+    }
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    // GitHub answers with form encoding unless JSON is asked for.
+    req.Header.Set("Accept", "application/json")
+    var tok struct {
+        Token
+        Error     string `json:"error"`
+        ErrorDesc string `json:"error_description"`
+    }
+    if err := p.doJSON(req, &tok); err != nil {
+        return nil, fmt.Errorf("oauth: token exchange with %s: %w", p.Name, err)
+    }
+    if tok.Error != "" {
+        return nil, fmt.Errorf("oauth: token exchange with %s: %s %s", p.Name, tok.Error, tok.ErrorDesc)
+    }
+    if tok.AccessToken == "" {
+        return nil, fmt.Errorf("oauth: token exchange with %s: no access token", p.Name)
+    }
+    if p.OIDC() && tok.IDToken == "" {
+        return nil, fmt.Errorf("oauth: token exchange with %s: no id token", p.Name)
+    }
+    return &tok.Token, nil
+}
+
+// Identity returns the user the token belongs to. For OpenID Connect
+// providers nonce must be the value sent with AuthCodeURL.
+func (p *Provider) Identity(ctx context.Context, tok *Token, nonce string) (*Identity, error) {
+    if p.Type == TypeGitHub {
+        return p.githubIdentity(ctx, tok)
+    }
+    claims, err := p.checkIDToken(tok.IDToken, nonce)
+    if err != nil {
+        return nil, err
+    }
+    id := claims.identity()
+    // The userinfo endpoint often knows more than the ID token, such
+    // as the email address. It must describe the same subject.
+    if p.UserInfoURL != "" {
+        var info idClaims
+        if err := p.getJSON(ctx, p.UserInfoURL, tok.AccessToken, &info); err == nil && info.Subject == claims.Subject {
+            more := info.identity()
+            if more.Email != "" {
+                id.Email, id.EmailVerified = more.Email, more.EmailVerified
+            }
+            setDefault(&id.Username, more.Username)
+            setDefault(&id.Name, more.Name)
+        }
+    }
+    return id, nil
+}
+
+// idClaims are the ID token and userinfo claims the forum uses.
+type idClaims struct {
+    Issuer        string          `json:"iss"`
+    Subject       string          `json:"sub"`
+    Audience      json.RawMessage `json:"aud"`
+    Expiry        int64           `json:"exp"`
+    Nonce         string          `json:"nonce"`
+    Email         string          `json:"email"`
+    EmailVerified json.RawMessage `json:"email_verified"`
+    Username      string          `json:"preferred_username"`
+    Name          string          `json:"name"`
+}
+
+func (c *idClaims) identity() *Identity {
+    // Some providers send email_verified as a string.
+    verified := string(c.EmailVerified) == "true" || string(c.EmailVerified) == `"true"`
+    return &Identity{Subject: c.Subject, Email: c.Email, EmailVerified: verified, Username: c.Username, Name: c.Name}
+}
+
+// checkIDToken decodes an ID token and checks its issuer, audience,
+// expiry and nonce.
+func (p *Provider) checkIDToken(raw, nonce string) (*idClaims, error) {
+    parts := strings.Split(raw, ".")
+    if len(parts) != 3 {
+        return nil, errors.New("oauth: malformed id token")
+    }
+    payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+    if err != nil {
+        return nil, errors.New("oauth: malformed id token")
+    }
+    var c idClaims
+    if err := json.Unmarshal(payload, &c); err != nil {
+        return nil, errors.New("oauth: malformed id token")
+    }
+    if strings.TrimSuffix(c.Issuer, "/") != p.Issuer {
+        return nil, fmt.Errorf("oauth: id token issued by %q, want %q", c.Issuer, p.Issuer)
+    }
+    var aud []string
+    if err := json.Unmarshal(c.Audience, &aud); err != nil {
+        var one string
+        if json.Unmarshal(c.Audience, &one) != nil {
+            return nil, errors.New("oauth: id token without audience")
+        }
+        aud = []string{one}
+    }
+    found := false
+    for _, a := range aud {
+        found = found || a == p.ClientID
+    }
+    if !found {
+        return nil, errors.New("oauth: id token is for another client")
+    }
+    if time.Now().Unix() > c.Expiry {
+        return nil, errors.New("oauth: id token expired")
+    }
+    if c.Nonce != nonce {
+        return nil, errors.New("oauth: id token nonce mismatch")
+    }
+    if c.Subject == "" {
+        return nil, errors.New("oauth: id token without subject")
+    }
+    return &c, nil
+}
+
+// githubIdentity reads the user from the GitHub API. GitHub is not an
+// OpenID Connect provider; the numeric user id serves as the subject
+// and the primary address from /user/emails tells whether the email
+// is verified.
+func (p *Provider) githubIdentity(ctx context.Context, tok *Token) (*Identity, error) {
+    var u struct {
+        ID    int64  `json:"id"`
+        Login string `json:"login"`
+        Name  string `json:"name"`
+        Email string `json:"email"`
+    }
+    if err := p.getJSON(ctx, p.UserInfoURL, tok.AccessToken, &u); err != nil {
+        return nil, fmt.Errorf("oauth: github user: %w", err)
+    }
+    if u.ID == 0 {
+        return nil, errors.New("oauth: github user without id")
+    }
+    id := &Identity{Subject: fmt.Sprint(u.ID), Username: u.Login, Name: u.Name, Email: u.Email}
+    var emails []struct {
+        Email    string `json:"email"`
+        Primary  bool   `json:"primary"`
+        Verified bool   `json:"verified"`
+    }
+    if err := p.getJSON(ctx, strings.TrimSuffix(p.UserInfoURL, "/user")+"/user/emails", tok.AccessToken, &emails); err == nil {
+        for _, e := range emails {
+            if e.Primary {
+                id.Email, id.EmailVerified = e.Email, e.Verified
+            }
+        }
+    }
+    return id, nil
+}
+
+// getJSON fetches url, authenticated with a bearer token when one is
+// given, and decodes the JSON response into v.
+func (p *Provider) getJSON(ctx context.Context, url, token string, v any) error {
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Accept", "application/json")
+    if token != "" {
+        req.Header.Set("Authorization", "Bearer "+token)
+    }
+    return p.doJSON(req, v)
+}
+
+// doJSON sends req and decodes a JSON response. Responses are limited
+// to 1 MiB. Error statuses are reported unless the body is a JSON
+// error object, which the caller inspects.
+func (p *Provider) doJSON(req *http.Request, v any) error {
+    resp, err := p.Client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+    if err != nil {
+        return err
+    }
+    if resp.StatusCode != http.StatusOK && !(resp.StatusCode == http.StatusBadRequest && strings.Contains(string(body), `"error"`)) {
+        return fmt.Errorf("%s: %s", req.URL.Host, resp.Status)
+    }
+    return json.Unmarshal(body, v)
+}
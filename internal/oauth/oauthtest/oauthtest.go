@@ -0,0 +1,248 @@
+package oauthtest
+
+// This package is a tiny OpenID Connect provider for testing the
+// forum's "log in with ..." support without registering an application
+// anywhere. It is NOT secure: anyone can log in as any email address,
+// and ID tokens are unsigned (the forum receives them straight from the
+// token endpoint over its own connection, so it does not check
+// signatures). It does check what a real provider checks of the client:
+// the client credentials, the redirect URI and the PKCE verifier, and
+// each code can be exchanged once. Tests serve it with
+// net/http/httptest; cmd/mockoidc runs it as a server for trying the
+// forum out by hand.
+
+import (
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/json"
+    "html/template"
+    "net/http"
+    "net/url"
+    "strings"
+    "sync"
+    "time"
+)
+
+// grant is an authorization code waiting to be exchanged.
+type grant struct {
+    redirectURI string
+    challenge   string
+    nonce       string
+    email       string
+    verified    bool
+    expires     time.Time
+}
+
+// user is who an access token was issued for.
+type user struct {
+    email    string
+    verified bool
+}
+
+// Provider is the fake identity provider, an http.Handler. It holds
+// the issued codes and access tokens in memory.
+type Provider struct {
+    // Issuer is the provider's URL, without a trailing slash. It must
+    // be set before the first request.
+    Issuer       string
+    ClientID     string
+    ClientSecret string
+
+    mu     sync.Mutex
+    mux    *http.ServeMux
+    codes  map[string]grant
+    tokens map[string]user // keyed by access token
+}
+
+// New returns a provider accepting the given client credentials.
+func New(clientID, clientSecret string) *Provider {
+    p := &Provider{
+        ClientID:     clientID,
+        ClientSecret: clientSecret,
+        mux:          http.NewServeMux(),
+        codes:        make(map[string]grant),
+        tokens:       make(map[string]user),
+    }
+    p.mux.HandleFunc("/.well-known/openid-configuration", p.handleDiscovery)
+    p.mux.HandleFunc("/authorize", p.handleAuthorize)
+    p.mux.HandleFunc("/token", p.handleToken)
+    p.mux.HandleFunc("/userinfo", p.handleUserInfo)
+    return p
+}
+
+// ServeHTTP handles a request to one of the provider's endpoints.
+func (p *Provider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    p.mux.ServeHTTP(w, r)
+}
+
+// Subject returns the subject identifier the provider reports for
+// email. It is derived from the address, so that logging in as the same
+// address twice yields the same identity.
+func Subject(email string) string {
+    sum := sha256.Sum256([]byte(strings.ToLower(email)))
+    return hex.EncodeToString(sum[:8])
+}
+
+var authorizeTmpl = template.Must(template.New("authorize").Parse(`<!DOCTYPE html>
+<title>Mock OpenID provider</title>
+<h1>Mock OpenID provider</h1>
+<p>Log in to <code>{{.ClientID}}</code> as:</p>
+<form method="post">
+  {{range $k, $v := .Query}}<input type="hidden" name="{{$k}}" value="{{index $v 0}}">{{end}}
+  <input name="email" type="email" placeholder="someone@example.com" required autofocus>
+  <select name="verified"><option value="1">verified</option><option value="0">unverified</option></select>
+  <button type="submit">Log in</button>
+</form>
+`))
+
+func (p *Provider) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+    writeJSON(w, http.StatusOK, map[string]any{
+        "issuer":                                p.Issuer,
+        "authorization_endpoint":                p.Issuer + "/authorize",
+        "token_endpoint":                        p.Issuer + "/token",
+        "userinfo_endpoint":                     p.Issuer + "/userinfo",
+        "response_types_supported":              []string{"code"},
+        "subject_types_supported":               []string{"public"},
+        "id_token_signing_alg_values_supported": []string{"none"},
+        "code_challenge_methods_supported":      []string{"S256"},
+    })
+}
+
+// handleAuthorize shows a form asking which email address to log in
+// as on GET and issues a code for it on POST. Setting `email` (and
+// optionally `verified=0`) in the query string skips the form, which is
+// handy from scripts and tests.
+func (p *Provider) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+    if err := r.ParseForm(); err != nil {
+        http.Error(w, "bad request", http.StatusBadRequest)
+        return
+    }
+    q := r.Form
+    if q.Get("client_id") != p.ClientID || q.Get("response_type") != "code" || q.Get("redirect_uri") == "" {
+        http.Error(w, "invalid authorization request", http.StatusBadRequest)
+        return
+    }
+    if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+        http.Error(w, "PKCE with S256 is required", http.StatusBadRequest)
+        return
+    }
+    email := q.Get("email")
+    if email == "" {
+        w.Header().Set("Content-Type", "text/html; charset=utf-8")
+        authorizeTmpl.Execute(w, map[string]any{"ClientID": p.ClientID, "Query": r.URL.Query()})
+        return
+    }
+    target, err := url.Parse(q.Get("redirect_uri"))
+    if err != nil {
+        http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+        return
+    }
+    code := randomHex()
+    p.mu.Lock()
+    p.codes[code] = grant{
+        redirectURI: q.Get("redirect_uri"),
+        challenge:   q.Get("code_challenge"),
+        nonce:       q.Get("nonce"),
+        email:       email,
+        verified:    q.Get("verified") != "0",
+        expires:     time.Now().Add(time.Minute),
+    }
+    p.mu.Unlock()
+    v := target.Query()
+    v.Set("code", code)
+    v.Set("state", q.Get("state"))
+    target.RawQuery = v.Encode()
+    http.Redirect(w, r, target.String(), http.StatusFound)
+}
+
+// handleToken exchanges a code for tokens after checking the client
+// credentials, the redirect URI and the PKCE verifier.
+func (p *Provider) handleToken(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    id, secret, ok := r.BasicAuth()
+    if !ok {
+        id, secret = r.FormValue("client_id"), r.FormValue("client_secret")
+    }
+    if id != p.ClientID || secret != p.ClientSecret {
+        writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+        return
+    }
+    // A code is gone after the first attempt, successful or not.
+    code := r.FormValue("code")
+    p.mu.Lock()
+    g, found := p.codes[code]
+    delete(p.codes, code)
+    p.mu.Unlock()
+    sum := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+    switch {
+    case r.FormValue("grant_type") != "authorization_code", !found, time.Now().After(g.expires),
+        g.redirectURI != r.FormValue("redirect_uri"),
+        base64.RawURLEncoding.EncodeToString(sum[:]) != g.challenge:
+        writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+        return
+    }
+    access := randomHex()
+    p.mu.Lock()
+    p.tokens[access] = user{g.email, g.verified}
+    p.mu.Unlock()
+    claims := map[string]any{
+        "iss":            p.Issuer,
+        "aud":            p.ClientID,
+        "sub":            Subject(g.email),
+        "email":          g.email,
+        "email_verified": g.verified,
+        "iat":            time.Now().Unix(),
+        "exp":            time.Now().Add(5 * time.Minute).Unix(),
+    }
+    if g.nonce != "" {
+        claims["nonce"] = g.nonce
+    }
+    writeJSON(w, http.StatusOK, map[string]any{
+        "access_token": access,
+        "token_type":   "Bearer",
+        "expires_in":   3600,
+        "id_token":     unsignedJWT(claims),
+    })
+}
+
+func (p *Provider) handleUserInfo(w http.ResponseWriter, r *http.Request) {
+    access := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+    p.mu.Lock()
+    u, ok := p.tokens[access]
+    p.mu.Unlock()
+    if !ok {
+        writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_token"})
+        return
+    }
+    writeJSON(w, http.StatusOK, map[string]any{
+        "sub":            Subject(u.email),
+        "email":          u.email,
+        "email_verified": u.verified,
+        "name":           strings.SplitN(u.email, "@", 2)[0],
+    })
+}
+
+func unsignedJWT(claims map[string]any) string {
+    header, _ := json.Marshal(map[string]string{"alg": "none", "typ": "JWT"})
+    payload, _ := json.Marshal(claims)
+    return base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload) + "."
+}
+
+func randomHex() string {
+    b := make([]byte, 16)
+    if _, err := rand.Read(b); err != nil {
+        panic(err)
+    }
+    return hex.EncodeToString(b)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(v)
+}
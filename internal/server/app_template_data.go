@@ -1,10 +1,10 @@
 package server
 
 // This file defines a helper for constructing the common data passed to
-// all HTML templates. It extracts the current logged‑in user from the
-// request via the App and fetches the list of categories from the
-// database. Individual handlers can embed additional fields into
-// the returned map before executing a template.
+// all HTML templates. It delegates to the App so that pages rendered by
+// the middleware (such as error pages) see exactly the same context as
+// pages rendered by handlers. Individual handlers can embed additional
+// fields into the returned map before executing a template.
 
 import (
     "net/http"
@@ -13,18 +13,18 @@ import (
 )
 
 // AppTemplateData builds the common template data including the
-// logged‑in user and category list. It is meant to be called at the
-// beginning of each handler to ensure consistent data across pages.
-// Errors fetching the categories are ignored; in that case the
-// Categories field will be nil. Handlers can override these values
-// by writing into the returned map before passing it to ExecuteTemplate.
+// logged‑in user, their role and the category records. Errors fetching
+// the categories are ignored; in that case the Categories field will
+// be nil. Error pages are rendered outside WithCSRF, so the CSRF token
+// is derived from the cookies here when the context lacks it. Callers
+// can override these values by writing into the returned map before
+// passing it to ExecuteTemplate.
 func AppTemplateData(r *http.Request, app *app.App) map[string]any {
-    uid, uname, logged := app.CurrentUser(r)
-    cats, _ := app.AllCategories()
-    return map[string]any{
-        "LoggedIn":   logged,
-        "UserID":     uid,
-        "Username":   uname,
-        "Categories": cats,
+    data := app.BaseData(r)
+    if data["CSRFToken"] == "" {
+        if key := csrfKey(r, app); key != "" {
+            data["CSRFToken"] = csrfToken(key)
+        }
     }
-}
\ No newline at end of file
+    return data
+}
@@ -0,0 +1,125 @@
+package server
+
+// This middleware protects every state-changing request against
+// cross-site request forgery. Each browser session gets a token that
+// forms must echo back in a hidden `csrf_token` field (or scripts in
+// an `X-CSRF-Token` header). The token is an HMAC keyed by the
+// session cookie, so it changes whenever the user logs in or out and
+// cannot be computed by another site. Visitors without a session,
+// who still need tokens for the login and registration forms, are
+// given a random pre-session cookie to key the HMAC instead.
+
+import (
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/base64"
+    "net/http"
+    "strings"
+
+    "forum/internal/app"
+)
+
+// csrfCookieName is the cookie holding the pre-session key of
+// visitors that are not logged in.
+const csrfCookieName = "forum_csrf"
+
+// WithCSRF issues CSRF tokens and verifies them on POST, PUT, PATCH
+// and DELETE requests. The token for the current request is attached
+// to the request context, from where App.BaseData hands it to the
+// templates as `CSRFToken`. Requests with a missing or wrong token
+// receive 400 Bad Request, which WithCustomErrors turns into the
+// regular 400 page.
+//
+// API requests are only checked when they rely on the session
+// cookie. Bearer tokens are never sent by the browser on its own, so
+// requests authenticated that way cannot be forged; the same holds
+// for anonymous API calls such as exchanging a password for a token.
+func WithCSRF(next http.Handler, a *app.App) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        key := csrfKey(r, a)
+        if key == "" {
+            // First visit: issue the pre-session cookie and add it to
+            // the request so this response already carries a token.
+            key = randomKey()
+            c := &http.Cookie{
+                Name:     csrfCookieName,
+                Value:    key,
+                Path:     "/",
+                HttpOnly: true,
+                SameSite: http.SameSiteLaxMode,
+            }
+            http.SetCookie(w, c)
+            r.AddCookie(c)
+        }
+        token := csrfToken(key)
+        r = r.WithContext(app.WithCSRFToken(r.Context(), token))
+
+        if csrfExempt(r, a) {
+            next.ServeHTTP(w, r)
+            return
+        }
+        sent := r.Header.Get("X-CSRF-Token")
+        if sent == "" {
+            sent = r.PostFormValue("csrf_token")
+        }
+        if !hmac.Equal([]byte(sent), []byte(token)) {
+            if strings.HasPrefix(r.URL.Path, "/api/") {
+                w.Header().Set("Content-Type", "application/json; charset=utf-8")
+                w.WriteHeader(http.StatusBadRequest)
+                w.Write([]byte(`{"error":{"code":"invalid_csrf_token","message":"missing or invalid X-CSRF-Token header"}}` + "\n"))
+                return
+            }
+            http.Error(w, "invalid CSRF token", http.StatusBadRequest)
+            return
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// csrfExempt reports whether r needs no token: safe methods, bearer
+// authenticated API calls and API calls without a session cookie.
+func csrfExempt(r *http.Request, a *app.App) bool {
+    switch r.Method {
+    case http.MethodGet, http.MethodHead, http.MethodOptions:
+        return true
+    }
+    if strings.HasPrefix(r.URL.Path, "/api/") {
+        if strings.HasPrefix(strings.ToLower(r.Header.Get("Authorization")), "bearer ") {
+            return true
+        }
+        if _, err := r.Cookie(a.CookieName); err != nil {
+            return true
+        }
+    }
+    return false
+}
+
+// csrfKey returns the value the token is derived from: the session
+// cookie when present, otherwise the pre-session cookie. An empty
+// string means the visitor has neither yet.
+func csrfKey(r *http.Request, a *app.App) string {
+    if c, err := r.Cookie(a.CookieName); err == nil && c.Value != "" {
+        return c.Value
+    }
+    if c, err := r.Cookie(csrfCookieName); err == nil && c.Value != "" {
+        return c.Value
+    }
+    return ""
+}
+
+// csrfToken derives the token for a key.
+func csrfToken(key string) string {
+    mac := hmac.New(sha256.New, []byte(key))
+    mac.Write([]byte("forum csrf"))
+    return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// randomKey returns 32 random bytes encoded for use in a cookie.
+func randomKey() string {
+    b := make([]byte, 32)
+    if _, err := rand.Read(b); err != nil {
+        panic("csrf: unable to read random bytes: " + err.Error())
+    }
+    return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,123 @@
+package server
+
+// Tests of the CSRF middleware: which requests need a token, which
+// tokens are accepted, and when the API is exempt.
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "strings"
+    "testing"
+
+    "forum/internal/app"
+)
+
+func TestCSRF(t *testing.T) {
+    a := &app.App{CookieName: "forum_session"}
+    var seen string
+    h := WithCSRF(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        seen = app.CSRFToken(r)
+        w.WriteHeader(http.StatusNoContent)
+    }), a)
+    // do sends a request with the given cookies, form token and
+    // headers, the latter two when not empty.
+    do := func(method, path string, cookies map[string]string, field string, header http.Header) *httptest.ResponseRecorder {
+        var body *strings.Reader
+        if field != "" {
+            body = strings.NewReader(url.Values{"csrf_token": {field}}.Encode())
+        } else {
+            body = strings.NewReader("")
+        }
+        req := httptest.NewRequest(method, path, body)
+        req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+        for k, v := range header {
+            req.Header[k] = v
+        }
+        for name, value := range cookies {
+            req.AddCookie(&http.Cookie{Name: name, Value: value})
+        }
+        seen = ""
+        rec := httptest.NewRecorder()
+        h.ServeHTTP(rec, req)
+        return rec
+    }
+    session := map[string]string{"forum_session": "session-a"}
+    token := csrfToken("session-a")
+
+    // A first visit gets a pre-session cookie, and the page a token
+    // derived from it.
+    rec := do("GET", "/login", nil, "", nil)
+    if rec.Code != http.StatusNoContent {
+        t.Fatalf("GET: status %d", rec.Code)
+    }
+    var pre string
+    for _, c := range rec.Result().Cookies() {
+        if c.Name == csrfCookieName {
+            pre = c.Value
+        }
+    }
+    if pre == "" || seen != csrfToken(pre) {
+        t.Fatalf("first visit: cookie %q, token %q", pre, seen)
+    }
+    // That token works for the login form, and no other does.
+    preCookie := map[string]string{csrfCookieName: pre}
+    if rec := do("POST", "/login", preCookie, csrfToken(pre), nil); rec.Code != http.StatusNoContent {
+        t.Fatalf("login with the pre-session token: status %d", rec.Code)
+    }
+    if rec := do("POST", "/login", preCookie, csrfToken("other"), nil); rec.Code != http.StatusBadRequest {
+        t.Fatalf("login with another key's token: status %d", rec.Code)
+    }
+    // Once logged in, the session cookie takes over.
+    both := map[string]string{csrfCookieName: pre, "forum_session": "session-a"}
+    if rec := do("POST", "/post/new", both, csrfToken(pre), nil); rec.Code != http.StatusBadRequest {
+        t.Fatalf("pre-session token with a session: status %d", rec.Code)
+    }
+    if rec := do("GET", "/", both, "", nil); rec.Code != http.StatusNoContent || seen != token {
+        t.Fatalf("GET with a session: status %d, token %q", rec.Code, seen)
+    }
+
+    for _, tt := range []struct {
+        name    string
+        method  string
+        path    string
+        cookies map[string]string
+        field   string
+        header  http.Header
+        want    int
+    }{
+        {"no token", "POST", "/post/new", session, "", nil, http.StatusBadRequest},
+        {"another session's token", "POST", "/post/new", session, csrfToken("session-b"), nil, http.StatusBadRequest},
+        {"form field", "POST", "/post/new", session, token, nil, http.StatusNoContent},
+        {"header", "POST", "/post/new", session, "", http.Header{"X-Csrf-Token": {token}}, http.StatusNoContent},
+        {"wrong header over a right field", "POST", "/post/new", session, token, http.Header{"X-Csrf-Token": {"x"}}, http.StatusBadRequest},
+        {"DELETE", "DELETE", "/post", session, "", nil, http.StatusBadRequest},
+        {"HEAD", "HEAD", "/post", session, "", nil, http.StatusNoContent},
+        // Outside the API a missing session cookie is no excuse.
+        {"form without session", "POST", "/comment/new", nil, "", nil, http.StatusBadRequest},
+
+        // The API is exempt with a bearer token or without a session
+        // cookie, and only then.
+        {"API with session", "POST", "/api/v1/posts", session, "", nil, http.StatusBadRequest},
+        {"API with session and header", "POST", "/api/v1/posts", session, "", http.Header{"X-Csrf-Token": {token}}, http.StatusNoContent},
+        {"API with bearer token", "POST", "/api/v1/posts", session, "", http.Header{"Authorization": {"Bearer abc"}}, http.StatusNoContent},
+        {"API with lower-case bearer", "POST", "/api/v1/posts", session, "", http.Header{"Authorization": {"bearer abc"}}, http.StatusNoContent},
+        {"API with basic auth", "POST", "/api/v1/posts", session, "", http.Header{"Authorization": {"Basic YTpi"}}, http.StatusBadRequest},
+        {"API without session", "POST", "/api/v1/tokens", nil, "", nil, http.StatusNoContent},
+        {"API with only the pre-session cookie", "POST", "/api/v1/tokens", preCookie, "", nil, http.StatusNoContent},
+    } {
+        if rec := do(tt.method, tt.path, tt.cookies, tt.field, tt.header); rec.Code != tt.want {
+            t.Errorf("%s: status %d, want %d", tt.name, rec.Code, tt.want)
+        }
+    }
+
+    // API refusals are JSON like every other API error.
+    rec = do("POST", "/api/v1/posts", session, "", nil)
+    var body struct {
+        Error struct{ Code string }
+    }
+    if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Error.Code != "invalid_csrf_token" {
+        t.Fatalf("API error body %q", rec.Body)
+    }
+}
@@ -2,20 +2,23 @@ package server
 
 // This middleware decorates a ServeMux with friendly error pages.
 // It intercepts panics to return a 500 page and records the status
-// code of responses so that 404 and 400 pages can be rendered via
-// templates. Other status codes pass through unchanged.
+// code of responses so that 404, 400, 413 and 429 pages can be rendered via
+// templates. Other status codes pass through unchanged, as do JSON
+// responses so that API clients receive their own error bodies.
 
 import (
     "net/http"
+    "strings"
+
     "forum/internal/app"
 )
 
-// WithCustomErrors wraps the provided ServeMux and uses the
+// WithCustomErrors wraps the provided handler and uses the
 // templates stored on the App to render custom error pages. If a
 // panic occurs during request handling a 500 page is shown. If the
-// handler writes a 404 or 400 status code the corresponding error
+// handler writes a 404, 400, 413 or 429 status code the corresponding error
 // page is rendered. All other responses are passed through.
-func WithCustomErrors(next *http.ServeMux, app *app.App) http.Handler {
+func WithCustomErrors(next http.Handler, app *app.App) http.Handler {
     return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
         defer func() {
             if err := recover(); err != nil {
@@ -25,7 +28,7 @@ func WithCustomErrors(next *http.ServeMux, app *app.App) http.Handler {
                 w.Header().Set("Content-Type", "text/html; charset=utf-8")
                 w.Header().Set("Cache-Control", "no-store")
                 w.WriteHeader(http.StatusInternalServerError)
-                if tpl, ok := app.Templates["500.html"]; ok {
+                if tpl := app.Templates.Lookup("500.html"); tpl != nil {
                     tpl.ExecuteTemplate(w, "500.html", AppTemplateData(r, app))
                 } else {
                     http.Error(w, "Internal Server Error", http.StatusInternalServerError)
@@ -39,39 +42,78 @@ func WithCustomErrors(next *http.ServeMux, app *app.App) http.Handler {
         rw := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
         next.ServeHTTP(rw, r)
 
-        // Render custom pages for 404 and 400 codes. The handler
-        // might have already written some body, but we'll ignore it
-        // and replace with our own template.
+        // Render custom pages for 404, 400, 413 and 429 codes. Whatever body the
+        // handler produced was discarded by the wrapper, so the
+        // template is the only content sent to the browser.
+        if !rw.intercepted {
+            return
+        }
         switch rw.statusCode {
         case http.StatusNotFound:
-            if tpl, ok := app.Templates["404.html"]; ok {
-                w.Header().Set("Content-Type", "text/html; charset=utf-8")
-                w.Header().Set("Cache-Control", "no-store")
+            if tpl := app.Templates.Lookup("404.html"); tpl != nil {
                 tpl.ExecuteTemplate(w, "404.html", AppTemplateData(r, app))
             } else {
-                http.NotFound(w, r)
+                w.Write([]byte("404 page not found\n"))
             }
         case http.StatusBadRequest:
-            if tpl, ok := app.Templates["400.html"]; ok {
-                w.Header().Set("Content-Type", "text/html; charset=utf-8")
-                w.Header().Set("Cache-Control", "no-store")
+            if tpl := app.Templates.Lookup("400.html"); tpl != nil {
                 tpl.ExecuteTemplate(w, "400.html", AppTemplateData(r, app))
             } else {
-                http.Error(w, "Bad Request", http.StatusBadRequest)
+                w.Write([]byte("Bad Request\n"))
+            }
+        case http.StatusRequestEntityTooLarge:
+            if tpl := app.Templates.Lookup("413.html"); tpl != nil {
+                tpl.ExecuteTemplate(w, "413.html", AppTemplateData(r, app))
+            } else {
+                w.Write([]byte("Request Entity Too Large\n"))
+            }
+        case http.StatusTooManyRequests:
+            if tpl := app.Templates.Lookup("429.html"); tpl != nil {
+                data := AppTemplateData(r, app)
+                data["RetryAfter"] = w.Header().Get("Retry-After")
+                tpl.ExecuteTemplate(w, "429.html", data)
+            } else {
+                w.Write([]byte("Too Many Requests\n"))
             }
         }
     })
 }
 
 // responseWriter wraps an http.ResponseWriter and records the status
-// code written. It forwards Write and WriteHeader calls to the
-// underlying writer.
+// code written. When the code has a custom error page and the
+// response is not JSON, the HTML headers are set before the status is
+// sent and the handler's own body (typically the plain text written
+// by http.Error) is dropped so the page can replace it.
 type responseWriter struct {
     http.ResponseWriter
-    statusCode int
+    statusCode  int
+    intercepted bool
 }
 
 func (rw *responseWriter) WriteHeader(code int) {
     rw.statusCode = code
+    switch code {
+    case http.StatusNotFound, http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusTooManyRequests:
+        if !strings.HasPrefix(rw.Header().Get("Content-Type"), "application/json") {
+            rw.intercepted = true
+            rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+            rw.Header().Set("Cache-Control", "no-store")
+            rw.Header().Del("X-Content-Type-Options")
+        }
+    }
     rw.ResponseWriter.WriteHeader(code)
-}
\ No newline at end of file
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, so
+// that streaming handlers such as the live post events can flush
+// through this wrapper.
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+    return rw.ResponseWriter
+}
+
+func (rw *responseWriter) Write(b []byte) (int, error) {
+    if rw.intercepted {
+        return len(b), nil
+    }
+    return rw.ResponseWriter.Write(b)
+}
@@ -0,0 +1,83 @@
+package server
+
+// This file answers the health checks of process supervisors, container
+// orchestrators and load balancers. /healthz reports that the process
+// is up and serving; /readyz reports whether it should be sent new
+// traffic. The two differ while the server shuts down: it keeps
+// answering requests it already has, and those a load balancer sends
+// before noticing, but asks for no more by failing /readyz. The probes
+// are mounted ahead of the middleware so that they are not logged,
+// rate limited or given CSRF cookies.
+
+import (
+    "context"
+    "database/sql"
+    "net/http"
+    "sync/atomic"
+    "time"
+)
+
+// readyTimeout bounds the database check of /readyz.
+const readyTimeout = 2 * time.Second
+
+// Health holds the state the probes report. The zero value with DB set
+// is ready.
+type Health struct {
+    // DB is pinged by /readyz; a database that cannot be reached makes
+    // the server unready.
+    DB *sql.DB
+
+    draining atomic.Bool
+}
+
+// Drain makes /readyz fail from now on. It is called when shutdown
+// begins.
+func (h *Health) Drain() {
+    h.draining.Store(true)
+}
+
+// Draining reports whether Drain was called.
+func (h *Health) Draining() bool {
+    return h.draining.Load()
+}
+
+// Handler serves /healthz and /readyz and passes every other request
+// to next.
+func (h *Health) Handler(next http.Handler) http.Handler {
+    mux := http.NewServeMux()
+    mux.HandleFunc("/healthz", h.HandleLive)
+    mux.HandleFunc("/readyz", h.HandleReady)
+    mux.Handle("/", next)
+    return mux
+}
+
+// HandleLive answers 200 OK for as long as the server handles requests.
+func (h *Health) HandleLive(w http.ResponseWriter, r *http.Request) {
+    writeProbe(w, http.StatusOK, "ok")
+}
+
+// HandleReady answers 200 OK when the server takes new requests and
+// 503 Service Unavailable while it drains or cannot reach the database.
+func (h *Health) HandleReady(w http.ResponseWriter, r *http.Request) {
+    if h.Draining() {
+        writeProbe(w, http.StatusServiceUnavailable, "draining")
+        return
+    }
+    if h.DB != nil {
+        ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+        defer cancel()
+        if err := h.DB.PingContext(ctx); err != nil {
+            writeProbe(w, http.StatusServiceUnavailable, "database unavailable")
+            return
+        }
+    }
+    writeProbe(w, http.StatusOK, "ready")
+}
+
+// writeProbe writes a short plain text answer that is never cached.
+func writeProbe(w http.ResponseWriter, status int, msg string) {
+    w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+    w.Header().Set("Cache-Control", "no-store")
+    w.WriteHeader(status)
+    w.Write([]byte(msg + "\n"))
+}
@@ -1,38 +1,150 @@
 package server
 
-// This file provides a helper function for loading HTML templates from
-// disk. Each page template is parsed alongside the shared layout so
-// that all pages inherit the same header and footer. The function
-// returns a map keyed by filename for convenient lookup in handlers.
+// This file provides the helpers for loading HTML templates. Each page
+// template is parsed alongside the shared layout so that all pages
+// inherit the same header and footer. LoadTemplates parses every page
+// once, from the templates embedded in the binary or from a directory;
+// ReloadingTemplates reads a directory on disk and parses pages again
+// when their files change, for working on the theme without restarting
+// the server.
 
 import (
+    "fmt"
     "html/template"
+    "io/fs"
+    "log"
+    "net/url"
+    "os"
     "path/filepath"
+    "sync"
 )
 
-// LoadTemplates walks the provided directory and parses every HTML
-// template found within it, excluding the layout itself. Each page
-// template is parsed together with the layout so that the templates
-// share a common base. The returned map is keyed by the basename of
-// the template file (e.g. "index.html"). If any template fails to
-// parse, an error is returned.
-func LoadTemplates(dir string) (map[string]*template.Template, error) {
-    layout := filepath.Join(dir, "layout.html")
-    pages, err := filepath.Glob(filepath.Join(dir, "*.html"))
+// layoutName is the shared layout every page is parsed with.
+const layoutName = "layout.html"
+
+// templateFuncs are the helper functions available in every template.
+var templateFuncs = template.FuncMap{
+    // userURL links to a user's profile page. Usernames may contain
+    // characters with a meaning in URLs, so the name is escaped as a
+    // path segment.
+    "userURL": func(username string) string {
+        return "/user/" + url.PathEscape(username)
+    },
+}
+
+// Pages is a set of parsed page templates keyed by the basename of the
+// template file (e.g. "index.html"). It implements app.TemplateSet.
+type Pages map[string]*template.Template
+
+// Lookup returns the page called name, or nil if there is none.
+func (p Pages) Lookup(name string) *template.Template {
+    return p[name]
+}
+
+// LoadTemplates parses every HTML template at the root of fsys,
+// excluding the layout itself. Each page template is parsed together
+// with the layout so that the templates share a common base. If any
+// template fails to parse, or the layout is missing, an error is
+// returned.
+func LoadTemplates(fsys fs.FS) (Pages, error) {
+    // Catches a wrong directory, which would otherwise yield no pages.
+    if _, err := fs.Stat(fsys, layoutName); err != nil {
+        return nil, err
+    }
+    names, err := fs.Glob(fsys, "*.html")
     if err != nil {
         return nil, err
     }
-    m := make(map[string]*template.Template)
-    for _, page := range pages {
+    m := make(Pages)
+    for _, name := range names {
         // Skip the layout itself. Each page will include it when parsing.
-        if filepath.Base(page) == "layout.html" {
+        if name == layoutName {
             continue
         }
-        t, err := template.ParseFiles(layout, page)
+        t, err := parsePage(fsys, name)
         if err != nil {
             return nil, err
         }
-        m[filepath.Base(page)] = t
+        m[name] = t
     }
     return m, nil
-}
\ No newline at end of file
+}
+
+// parsePage parses the page called name of fsys with the layout.
+func parsePage(fsys fs.FS, name string) (*template.Template, error) {
+    return template.New(layoutName).Funcs(templateFuncs).ParseFS(fsys, layoutName, name)
+}
+
+// ReloadingTemplates is a set of page templates read from a directory
+// on disk. Every Lookup checks the page and layout files and parses the
+// page again when either changed, so edits show on the next request.
+// A page that no longer parses is logged and its last good version
+// kept. This costs two file system calls per page rendered and is
+// meant for development.
+type ReloadingTemplates struct {
+    dir  string
+    fsys fs.FS
+
+    mu    sync.Mutex
+    pages map[string]*reloadedPage
+}
+
+// reloadedPage is a parsed page and the state of its files when it was
+// parsed.
+type reloadedPage struct {
+    t     *template.Template
+    stamp string
+}
+
+// NewReloadingTemplates returns the templates in dir. Every page is
+// parsed once up front, so that mistakes are reported at startup like
+// with LoadTemplates.
+func NewReloadingTemplates(dir string) (*ReloadingTemplates, error) {
+    fsys := os.DirFS(dir)
+    if _, err := LoadTemplates(fsys); err != nil {
+        return nil, err
+    }
+    return &ReloadingTemplates{dir: dir, fsys: fsys, pages: make(map[string]*reloadedPage)}, nil
+}
+
+// Lookup returns the current version of the page called name, or nil
+// if there is no such page.
+func (rt *ReloadingTemplates) Lookup(name string) *template.Template {
+    if name == layoutName || !fs.ValidPath(name) {
+        return nil
+    }
+    stamp, err := rt.stamp(name)
+    if err != nil {
+        return nil
+    }
+    rt.mu.Lock()
+    defer rt.mu.Unlock()
+    p := rt.pages[name]
+    if p != nil && p.stamp == stamp {
+        return p.t
+    }
+    t, err := parsePage(rt.fsys, name)
+    if err != nil {
+        log.Printf("reloading template %s: %v", name, err)
+        if p != nil {
+            return p.t
+        }
+        return nil
+    }
+    rt.pages[name] = &reloadedPage{t: t, stamp: stamp}
+    return t
+}
+
+// stamp describes the modification times and sizes of the layout and
+// the page called name. It changes whenever one of them is saved.
+func (rt *ReloadingTemplates) stamp(name string) (string, error) {
+    var s string
+    for _, n := range []string{layoutName, name} {
+        fi, err := os.Stat(filepath.Join(rt.dir, n))
+        if err != nil {
+            return "", err
+        }
+        s += fmt.Sprintf("%d/%d ", fi.ModTime().UnixNano(), fi.Size())
+    }
+    return s, nil
+}
@@ -0,0 +1,224 @@
+package server
+
+// This middleware limits how fast a single client can create content
+// or have the forum send mail. Every limited route has a token bucket
+// per logged-in user, or per IP address for anonymous clients: the
+// bucket holds up to Limit.Requests tokens, each request takes one,
+// and tokens flow back evenly over Limit.Per. A client with an empty
+// bucket gets 429 Too Many Requests with a Retry-After header saying
+// when the next token arrives. HTML requests see the 429 page rendered
+// by WithCustomErrors, API requests the usual JSON error.
+//
+// Buckets live in memory, so limits reset when the server restarts;
+// unlike login lockouts nothing is lost by that.
+
+import (
+    "fmt"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "forum/internal/app"
+)
+
+// Limit allows Requests requests per Per duration, all of which may be
+// used at once.
+type Limit struct {
+    Requests int
+    Per      time.Duration
+}
+
+// RateRule limits state-changing requests to a group of paths. In a
+// path "*" matches any single segment, so "/api/v1/posts/*/comments"
+// covers comments on every post. Rules with the same Name share their
+// buckets, which is how the HTML form and the API endpoint doing the
+// same thing are counted together.
+type RateRule struct {
+    Name  string
+    Paths []string
+    Limit Limit
+}
+
+// DefaultRateRules are the limits used unless configured otherwise.
+var DefaultRateRules = []RateRule{
+    {Name: "post", Paths: []string{"/post/new", "/api/v1/posts"}, Limit: Limit{5, 10 * time.Minute}},
+    {Name: "comment", Paths: []string{"/comment/new", "/api/v1/posts/*/comments"}, Limit: Limit{20, 10 * time.Minute}},
+    {Name: "reaction", Paths: []string{"/like", "/api/v1/reactions"}, Limit: Limit{60, time.Minute}},
+    {Name: "upload", Paths: []string{"/account/uploads", "/account/avatar", "/api/v1/uploads"}, Limit: Limit{20, time.Hour}},
+    {Name: "forgot", Paths: []string{"/password/forgot"}, Limit: Limit{5, time.Hour}},
+}
+
+// ParseRateLimits applies a specification such as
+// "post=10/1h,reaction=off" to a copy of rules. Each entry names a rule
+// and gives its number of requests and the duration they refill over;
+// "off" removes the rule.
+func ParseRateLimits(spec string, rules []RateRule) ([]RateRule, error) {
+    out := append([]RateRule(nil), rules...)
+    for _, entry := range strings.Split(spec, ",") {
+        entry = strings.TrimSpace(entry)
+        if entry == "" {
+            continue
+        }
+        name, value, ok := strings.Cut(entry, "=")
+        if !ok {
+            return nil, fmt.Errorf("rate limit %q: want name=requests/duration", entry)
+        }
+        i := -1
+        for j := range out {
+            if out[j].Name == name {
+                i = j
+            }
+        }
+        if i < 0 {
+            return nil, fmt.Errorf("rate limit %q: unknown route %q", entry, name)
+        }
+        if value == "off" {
+            out = append(out[:i], out[i+1:]...)
+            continue
+        }
+        n, per, ok := strings.Cut(value, "/")
+        requests, err := strconv.Atoi(n)
+        if !ok || err != nil || requests < 1 {
+            return nil, fmt.Errorf("rate limit %q: want name=requests/duration", entry)
+        }
+        d, err := time.ParseDuration(per)
+        if err != nil || d <= 0 {
+            return nil, fmt.Errorf("rate limit %q: invalid duration %q", entry, per)
+        }
+        out[i].Limit = Limit{requests, d}
+    }
+    return out, nil
+}
+
+// bucket is the state of one client on one route.
+type bucket struct {
+    tokens float64
+    last   time.Time
+}
+
+// RateLimiter holds the buckets of every client.
+type RateLimiter struct {
+    rules []RateRule
+
+    mu        sync.Mutex
+    buckets   map[string]*bucket
+    lastSweep time.Time
+}
+
+// NewRateLimiter returns a limiter enforcing rules.
+func NewRateLimiter(rules []RateRule) *RateLimiter {
+    return &RateLimiter{rules: rules, buckets: make(map[string]*bucket), lastSweep: time.Now()}
+}
+
+// sweepInterval is how often buckets that have filled up again, and
+// so carry no information, are dropped.
+const sweepInterval = 5 * time.Minute
+
+// allow takes a token from the bucket under key and reports whether
+// there was one. Otherwise it returns how long until the next token.
+func (l *RateLimiter) allow(key string, lim Limit, now time.Time) (bool, time.Duration) {
+    rate := float64(lim.Requests) / lim.Per.Seconds()
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if now.Sub(l.lastSweep) > sweepInterval {
+        l.sweep(now)
+    }
+    b, ok := l.buckets[key]
+    if !ok {
+        b = &bucket{tokens: float64(lim.Requests), last: now}
+        l.buckets[key] = b
+    }
+    b.tokens += now.Sub(b.last).Seconds() * rate
+    if max := float64(lim.Requests); b.tokens > max {
+        b.tokens = max
+    }
+    b.last = now
+    if b.tokens >= 1 {
+        b.tokens--
+        return true, 0
+    }
+    return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// sweep drops the buckets that would be full by now. The caller holds
+// l.mu.
+func (l *RateLimiter) sweep(now time.Time) {
+    longest := time.Duration(0)
+    for _, rule := range l.rules {
+        if rule.Limit.Per > longest {
+            longest = rule.Limit.Per
+        }
+    }
+    for key, b := range l.buckets {
+        if now.Sub(b.last) > longest {
+            delete(l.buckets, key)
+        }
+    }
+    l.lastSweep = now
+}
+
+// rule returns the rule covering r, or nil. Safe methods are never
+// limited; GET /post/new only shows the form.
+func (l *RateLimiter) rule(r *http.Request) *RateRule {
+    switch r.Method {
+    case http.MethodGet, http.MethodHead, http.MethodOptions:
+        return nil
+    }
+    for i := range l.rules {
+        for _, p := range l.rules[i].Paths {
+            if pathMatches(p, r.URL.Path) {
+                return &l.rules[i]
+            }
+        }
+    }
+    return nil
+}
+
+// pathMatches reports whether path matches pattern, where "*" stands
+// for one path segment. A trailing slash on path is ignored.
+func pathMatches(pattern, path string) bool {
+    ps := strings.Split(pattern, "/")
+    ss := strings.Split(strings.TrimSuffix(path, "/"), "/")
+    if len(ps) != len(ss) {
+        return false
+    }
+    for i := range ps {
+        if ps[i] != "*" && ps[i] != ss[i] {
+            return false
+        }
+    }
+    return true
+}
+
+// WithRateLimit enforces the limiter's rules. Clients are told apart
+// by user ID when logged in, with a session or a bearer token, and by
+// IP address otherwise.
+func WithRateLimit(next http.Handler, a *app.App, l *RateLimiter) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        rule := l.rule(r)
+        if rule == nil {
+            next.ServeHTTP(w, r)
+            return
+        }
+        client := "ip:" + a.ClientIP(r)
+        if uid, _, ok := a.CurrentUser(r); ok {
+            client = "user:" + strconv.FormatInt(uid, 10)
+        }
+        ok, wait := l.allow(rule.Name+" "+client, rule.Limit, time.Now())
+        if ok {
+            next.ServeHTTP(w, r)
+            return
+        }
+        seconds := int((wait + time.Second - 1) / time.Second)
+        w.Header().Set("Retry-After", strconv.Itoa(seconds))
+        if strings.HasPrefix(r.URL.Path, "/api/") {
+            w.Header().Set("Content-Type", "application/json; charset=utf-8")
+            w.WriteHeader(http.StatusTooManyRequests)
+            fmt.Fprintf(w, `{"error":{"code":"rate_limited","message":"too many requests; try again in %d seconds"}}`+"\n", seconds)
+            return
+        }
+        http.Error(w, "too many requests", http.StatusTooManyRequests)
+    })
+}
@@ -0,0 +1,205 @@
+package server
+
+// Tests of the rate limiter: the token bucket itself, driven by
+// explicit times, the 429 responses of the middleware, and parsing of
+// the -rate-limits flag.
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+
+    "forum/internal/app"
+)
+
+func TestBucketRefills(t *testing.T) {
+    l := NewRateLimiter(nil)
+    lim := Limit{3, time.Minute}
+    start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+    // A full bucket allows a burst of three.
+    for i := 0; i < 3; i++ {
+        if ok, _ := l.allow("k", lim, start); !ok {
+            t.Fatalf("request %d of the burst refused", i+1)
+        }
+    }
+    ok, wait := l.allow("k", lim, start)
+    if ok {
+        t.Fatal("fourth request allowed")
+    }
+    if wait != 20*time.Second {
+        t.Fatalf("told to wait %v, want 20s", wait)
+    }
+
+    // A token comes back every 20 seconds.
+    if ok, wait := l.allow("k", lim, start.Add(15*time.Second)); ok || wait != 5*time.Second {
+        t.Fatalf("after 15s: ok=%v wait=%v, want a refusal for 5s", ok, wait)
+    }
+    if ok, _ := l.allow("k", lim, start.Add(20*time.Second)); !ok {
+        t.Fatal("no token after 20s")
+    }
+    if ok, _ := l.allow("k", lim, start.Add(21*time.Second)); ok {
+        t.Fatal("second token after 21s")
+    }
+
+    // A long pause refills the bucket, but not beyond its size.
+    later := start.Add(time.Hour)
+    for i := 0; i < 3; i++ {
+        if ok, _ := l.allow("k", lim, later); !ok {
+            t.Fatalf("request %d after an hour refused", i+1)
+        }
+    }
+    if ok, _ := l.allow("k", lim, later); ok {
+        t.Fatal("bucket filled beyond its size")
+    }
+
+    // Keys have buckets of their own.
+    if ok, _ := l.allow("other", lim, later); !ok {
+        t.Fatal("another key was limited")
+    }
+}
+
+func TestBucketSweep(t *testing.T) {
+    l := NewRateLimiter([]RateRule{{Name: "post", Limit: Limit{1, time.Minute}}})
+    start := l.lastSweep
+    l.allow("old", Limit{1, time.Minute}, start)
+    l.allow("new", Limit{1, time.Minute}, start.Add(sweepInterval))
+    l.allow("now", Limit{1, time.Minute}, start.Add(sweepInterval+time.Second))
+    if _, ok := l.buckets["old"]; ok {
+        t.Error("the refilled bucket was kept")
+    }
+    if _, ok := l.buckets["new"]; !ok {
+        t.Error("a recent bucket was dropped")
+    }
+}
+
+func TestWithRateLimit(t *testing.T) {
+    a := &app.App{CookieName: "session"}
+    l := NewRateLimiter([]RateRule{
+        {Name: "post", Paths: []string{"/post/new", "/api/v1/posts"}, Limit: Limit{2, time.Hour}},
+    })
+    h := WithRateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.WriteHeader(http.StatusNoContent)
+    }), a, l)
+    do := func(method, path, ip string) *httptest.ResponseRecorder {
+        req := httptest.NewRequest(method, path, nil)
+        req.RemoteAddr = ip + ":1234"
+        rec := httptest.NewRecorder()
+        h.ServeHTTP(rec, req)
+        return rec
+    }
+
+    // The form and the API share a bucket.
+    if rec := do("POST", "/post/new", "192.0.2.1"); rec.Code != http.StatusNoContent {
+        t.Fatalf("first post: status %d", rec.Code)
+    }
+    if rec := do("POST", "/api/v1/posts", "192.0.2.1"); rec.Code != http.StatusNoContent {
+        t.Fatalf("second post: status %d", rec.Code)
+    }
+
+    rec := do("POST", "/post/new", "192.0.2.1")
+    if rec.Code != http.StatusTooManyRequests {
+        t.Fatalf("third post: status %d, want 429", rec.Code)
+    }
+    // Half an hour until the next of two tokens an hour, give or take
+    // the time the test took.
+    if s, err := strconv.Atoi(rec.Header().Get("Retry-After")); err != nil || s < 1790 || s > 1800 {
+        t.Fatalf("Retry-After %q, want about 1800", rec.Header().Get("Retry-After"))
+    }
+
+    rec = do("POST", "/api/v1/posts", "192.0.2.1")
+    if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+        t.Fatalf("API: status %d, Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+    }
+    if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+        t.Fatalf("API error has Content-Type %q", ct)
+    }
+    var body struct {
+        Error struct{ Code string }
+    }
+    if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Error.Code != "rate_limited" {
+        t.Fatalf("API error body %q", rec.Body)
+    }
+
+    // Reading is never limited, nor are other routes or other clients.
+    if rec := do("GET", "/post/new", "192.0.2.1"); rec.Code != http.StatusNoContent {
+        t.Fatalf("GET: status %d", rec.Code)
+    }
+    if rec := do("POST", "/comment/new", "192.0.2.1"); rec.Code != http.StatusNoContent {
+        t.Fatalf("unlimited route: status %d", rec.Code)
+    }
+    if rec := do("POST", "/post/new", "192.0.2.2"); rec.Code != http.StatusNoContent {
+        t.Fatalf("another address: status %d", rec.Code)
+    }
+}
+
+func TestParseRateLimits(t *testing.T) {
+    rules, err := ParseRateLimits("post=10/1h, reaction=off", DefaultRateRules)
+    if err != nil {
+        t.Fatal(err)
+    }
+    byName := map[string]RateRule{}
+    for _, r := range rules {
+        byName[r.Name] = r
+    }
+    if got := byName["post"].Limit; got != (Limit{10, time.Hour}) {
+        t.Errorf("post limit %+v", got)
+    }
+    if _, ok := byName["reaction"]; ok {
+        t.Error("reaction is still limited")
+    }
+    if len(rules) != len(DefaultRateRules)-1 || byName["comment"].Limit != DefaultRateRules[1].Limit {
+        t.Errorf("other rules changed: %+v", rules)
+    }
+    // The defaults are left alone.
+    if DefaultRateRules[0].Limit != (Limit{5, 10 * time.Minute}) || DefaultRateRules[2].Name != "reaction" {
+        t.Fatalf("ParseRateLimits modified the defaults: %+v", DefaultRateRules)
+    }
+
+    if rules, err := ParseRateLimits("", DefaultRateRules); err != nil || len(rules) != len(DefaultRateRules) {
+        t.Errorf("empty spec: %d rules, %v", len(rules), err)
+    }
+
+    for _, spec := range []string{
+        "post",
+        "post=10",
+        "post=/1h",
+        "post=0/1h",
+        "post=-1/1h",
+        "post=x/1h",
+        "post=10/",
+        "post=10/1",
+        "post=10/-1h",
+        "post=10/0s",
+        "posts=10/1h",
+        "post=10/1h,bogus=off",
+    } {
+        if _, err := ParseRateLimits(spec, DefaultRateRules); err == nil {
+            t.Errorf("%q: no error", spec)
+        }
+    }
+}
+
+func TestPathMatches(t *testing.T) {
+    tests := []struct {
+        pattern, path string
+        want          bool
+    }{
+        {"/post/new", "/post/new", true},
+        {"/post/new", "/post/new/", true},
+        {"/post/new", "/post/newer", false},
+        {"/post/new", "/post", false},
+        {"/api/v1/posts/*/comments", "/api/v1/posts/42/comments", true},
+        {"/api/v1/posts/*/comments", "/api/v1/posts/42/comments/7", false},
+        {"/api/v1/posts/*/comments", "/api/v1/posts/comments", false},
+    }
+    for _, tt := range tests {
+        if got := pathMatches(tt.pattern, tt.path); got != tt.want {
+            t.Errorf("pathMatches(%q, %q) = %v", tt.pattern, tt.path, got)
+        }
+    }
+}
@@ -0,0 +1,94 @@
+package storage
+
+// Local stores objects as files below a directory. The content type is
+// not kept separately; it is derived from the extension of the key,
+// which the forum always sets.
+
+import (
+    "context"
+    "errors"
+    "io/fs"
+    "mime"
+    "os"
+    "path/filepath"
+)
+
+// Local is a Storage backed by the local filesystem.
+type Local struct {
+    Dir string
+}
+
+// path returns the file name for key.
+func (l *Local) path(key string) (string, error) {
+    if !ValidKey(key) {
+        return "", ErrInvalidKey
+    }
+    return filepath.Join(l.Dir, filepath.FromSlash(key)), nil
+}
+
+// Put writes data to a temporary file and renames it into place, so
+// readers never see a partly written object.
+func (l *Local) Put(ctx context.Context, key, contentType string, data []byte) error {
+    p, err := l.path(key)
+    if err != nil {
+        return err
+    }
+    if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+        return err
+    }
+    f, err := os.CreateTemp(filepath.Dir(p), ".upload-*")
+    if err != nil {
+        return err
+    }
+    if _, err := f.Write(data); err != nil {
+        f.Close()
+        os.Remove(f.Name())
+        return err
+    }
+    if err := f.Close(); err != nil {
+        os.Remove(f.Name())
+        return err
+    }
+    if err := os.Chmod(f.Name(), 0o644); err != nil {
+        os.Remove(f.Name())
+        return err
+    }
+    return os.Rename(f.Name(), p)
+}
+
+// Get opens the file stored under key.
+func (l *Local) Get(ctx context.Context, key string) (*Object, error) {
+    p, err := l.path(key)
+    if err != nil {
+        return nil, err
+    }
+    f, err := os.Open(p)
+    if errors.Is(err, fs.ErrNotExist) {
+        return nil, ErrNotFound
+    }
+    if err != nil {
+        return nil, err
+    }
+    info, err := f.Stat()
+    if err != nil {
+        f.Close()
+        return nil, err
+    }
+    ct := mime.TypeByExtension(filepath.Ext(p))
+    if ct == "" {
+        ct = "application/octet-stream"
+    }
+    return &Object{Body: f, ContentType: ct, Size: info.Size()}, nil
+}
+
+// Delete removes the file stored under key.
+func (l *Local) Delete(ctx context.Context, key string) error {
+    p, err := l.path(key)
+    if err != nil {
+        return err
+    }
+    if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+        return err
+    }
+    return nil
+}
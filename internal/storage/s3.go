@@ -0,0 +1,257 @@
+package storage
+
+// S3 stores objects in a bucket of Amazon S3 or a compatible service
+// such as MinIO, Ceph or Garage. Only the three object calls the forum
+// needs are implemented, signed with AWS Signature Version 4 by hand so
+// the forum does not pull in an SDK. The s3test package is a local
+// stand-in that checks the signatures, used by the tests and, through
+// cmd/fakes3, for trying the backend out without an account anywhere.
+
+import (
+    "bytes"
+    "context"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "fmt"
+    "io"
+    "net/http"
+    "net/url"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// S3 is a Storage backed by an S3-compatible bucket.
+type S3 struct {
+    // Endpoint is the base URL of the service, for example
+    // "https://s3.eu-central-1.amazonaws.com" or "http://localhost:9001".
+    Endpoint string
+    // Region is the signing region. Most non-AWS services accept
+    // "us-east-1".
+    Region    string
+    Bucket    string
+    AccessKey string
+    SecretKey string
+    // PathStyle addresses objects as Endpoint/Bucket/key instead of
+    // Bucket.host/key. Most self-hosted services need it.
+    PathStyle bool
+    // Client sends the requests. Nil uses a client with a 30 second
+    // timeout.
+    Client *http.Client
+}
+
+// defaultS3Client is used when S3.Client is nil.
+var defaultS3Client = &http.Client{Timeout: 30 * time.Second}
+
+// emptySHA256 is the hex SHA-256 of an empty payload.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// objectURL returns the URL of the object under key.
+func (s *S3) objectURL(key string) (*url.URL, error) {
+    if !ValidKey(key) {
+        return nil, ErrInvalidKey
+    }
+    u, err := url.Parse(strings.TrimSuffix(s.Endpoint, "/"))
+    if err != nil {
+        return nil, err
+    }
+    if s.PathStyle {
+        u.Path += "/" + s.Bucket + "/" + key
+    } else {
+        u.Host = s.Bucket + "." + u.Host
+        u.Path += "/" + key
+    }
+    return u, nil
+}
+
+// do sends a signed request for key and returns the response, which
+// the caller must close.
+func (s *S3) do(ctx context.Context, method, key, contentType string, body []byte) (*http.Response, error) {
+    u, err := s.objectURL(key)
+    if err != nil {
+        return nil, err
+    }
+    req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+    if err != nil {
+        return nil, err
+    }
+    if body == nil {
+        req.Body = nil
+        req.ContentLength = 0
+    }
+    if contentType != "" {
+        req.Header.Set("Content-Type", contentType)
+    }
+    Sign(req, body, s.AccessKey, s.SecretKey, s.Region, time.Now())
+    client := s.Client
+    if client == nil {
+        client = defaultS3Client
+    }
+    return client.Do(req)
+}
+
+// s3Error turns an unexpected response into an error carrying the
+// status and the start of the body, where S3 explains itself.
+func s3Error(op string, resp *http.Response) error {
+    msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+    return fmt.Errorf("storage: s3 %s: %s: %s", op, resp.Status, strings.TrimSpace(string(msg)))
+}
+
+// Put uploads data with a PUT Object request.
+func (s *S3) Put(ctx context.Context, key, contentType string, data []byte) error {
+    if data == nil {
+        data = []byte{}
+    }
+    resp, err := s.do(ctx, http.MethodPut, key, contentType, data)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return s3Error("put", resp)
+    }
+    return nil
+}
+
+// Get downloads an object with a GET Object request.
+func (s *S3) Get(ctx context.Context, key string) (*Object, error) {
+    resp, err := s.do(ctx, http.MethodGet, key, "", nil)
+    if err != nil {
+        return nil, err
+    }
+    switch resp.StatusCode {
+    case http.StatusOK:
+        return &Object{Body: resp.Body, ContentType: resp.Header.Get("Content-Type"), Size: resp.ContentLength}, nil
+    case http.StatusNotFound:
+        resp.Body.Close()
+        return nil, ErrNotFound
+    }
+    defer resp.Body.Close()
+    return nil, s3Error("get", resp)
+}
+
+// Delete removes an object with a DELETE Object request. S3 answers
+// 204 whether or not the object existed.
+func (s *S3) Delete(ctx context.Context, key string) error {
+    resp, err := s.do(ctx, http.MethodDelete, key, "", nil)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    switch resp.StatusCode {
+    case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+        return nil
+    }
+    return s3Error("delete", resp)
+}
+
+// Sign adds AWS Signature Version 4 headers to req, whose body is
+// payload. The host, every x-amz-* header and Content-Type are signed.
+func Sign(req *http.Request, payload []byte, accessKey, secretKey, region string, t time.Time) {
+    t = t.UTC()
+    hash := sha256.Sum256(payload)
+    req.Header.Set("X-Amz-Date", t.Format("20060102T150405Z"))
+    req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(hash[:]))
+    signed := signedHeaders(req)
+    scope := t.Format("20060102") + "/" + region + "/s3/aws4_request"
+    sig := Signature(req, signed, secretKey, region, t)
+    req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+
+        ", SignedHeaders="+strings.Join(signed, ";")+", Signature="+sig)
+}
+
+// signedHeaders lists the lowercase names of the headers Sign covers,
+// sorted as the signature requires.
+func signedHeaders(req *http.Request) []string {
+    names := []string{"host"}
+    for name := range req.Header {
+        l := strings.ToLower(name)
+        if strings.HasPrefix(l, "x-amz-") || l == "content-type" || l == "content-md5" {
+            names = append(names, l)
+        }
+    }
+    sort.Strings(names)
+    return names
+}
+
+// Signature computes the Signature Version 4 signature of req over the
+// given lowercase header names, at time t, for the S3 service. The
+// payload hash is taken from the X-Amz-Content-Sha256 header. A server
+// checks a request by computing the signature over the headers listed
+// in its Authorization header and comparing.
+func Signature(req *http.Request, signed []string, secretKey, region string, t time.Time) string {
+    t = t.UTC()
+    var canon strings.Builder
+    canon.WriteString(req.Method + "\n")
+    path := req.URL.EscapedPath()
+    if path == "" {
+        path = "/"
+    }
+    canon.WriteString(path + "\n")
+    canon.WriteString(canonicalQuery(req.URL.Query()) + "\n")
+    for _, name := range signed {
+        var value string
+        if name == "host" {
+            value = req.Host
+            if value == "" {
+                value = req.URL.Host
+            }
+        } else {
+            value = strings.Join(req.Header.Values(name), ",")
+        }
+        canon.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+    }
+    canon.WriteString("\n" + strings.Join(signed, ";") + "\n")
+    payloadHash := req.Header.Get("X-Amz-Content-Sha256")
+    if payloadHash == "" {
+        payloadHash = emptySHA256
+    }
+    canon.WriteString(payloadHash)
+
+    date := t.Format("20060102")
+    scope := date + "/" + region + "/s3/aws4_request"
+    canonHash := sha256.Sum256([]byte(canon.String()))
+    toSign := "AWS4-HMAC-SHA256\n" + t.Format("20060102T150405Z") + "\n" + scope + "\n" + hex.EncodeToString(canonHash[:])
+
+    key := hmacSHA256([]byte("AWS4"+secretKey), date)
+    key = hmacSHA256(key, region)
+    key = hmacSHA256(key, "s3")
+    key = hmacSHA256(key, "aws4_request")
+    return hex.EncodeToString(hmacSHA256(key, toSign))
+}
+
+// canonicalQuery encodes query parameters sorted by name, escaping
+// everything but unreserved characters as SigV4 demands.
+func canonicalQuery(q url.Values) string {
+    var parts []string
+    for name, values := range q {
+        for _, v := range values {
+            parts = append(parts, awsEscape(name)+"="+awsEscape(v))
+        }
+    }
+    sort.Strings(parts)
+    return strings.Join(parts, "&")
+}
+
+// awsEscape percent-encodes s, leaving only A-Z, a-z, 0-9, "-", "_",
+// "." and "~".
+func awsEscape(s string) string {
+    var b strings.Builder
+    for i := 0; i < len(s); i++ {
+        c := s[i]
+        if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-' || c == '_' || c == '.' || c == '~' {
+            b.WriteByte(c)
+        } else {
+            b.WriteString("%" + strings.ToUpper(strconv.FormatInt(int64(c)|0x100, 16)[1:]))
+        }
+    }
+    return b.String()
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of data under key.
+func hmacSHA256(key []byte, data string) []byte {
+    m := hmac.New(sha256.New, key)
+    m.Write([]byte(data))
+    return m.Sum(nil)
+}
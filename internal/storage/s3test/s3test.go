@@ -0,0 +1,167 @@
+package s3test
+
+// This package is a tiny stand-in for an S3-compatible object store,
+// for testing the forum's S3 upload storage without an account
+// anywhere. It keeps objects in memory, understands path-style PUT,
+// GET, HEAD and DELETE object requests and nothing else, and checks
+// their Signature Version 4 signatures against a single access key, so
+// signing mistakes show up just as they would against the real thing.
+// Tests serve it with net/http/httptest; cmd/fakes3 runs it as a
+// server for trying the forum out by hand.
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/xml"
+    "io"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "forum/internal/storage"
+)
+
+// maxSkew is how far the request time may be from the clock, as in S3.
+const maxSkew = 15 * time.Minute
+
+// object is a stored object.
+type object struct {
+    data        []byte
+    contentType string
+    modified    time.Time
+}
+
+// Fake is the fake object store, an http.Handler. It holds the objects
+// of every bucket.
+type Fake struct {
+    AccessKey string
+    SecretKey string
+    Region    string
+    // Logf, when set, is called for every change to the store.
+    Logf func(format string, args ...any)
+
+    mu      sync.Mutex
+    objects map[string]object
+}
+
+// New returns an empty store accepting requests signed with the given
+// key pair for region.
+func New(accessKey, secretKey, region string) *Fake {
+    return &Fake{AccessKey: accessKey, SecretKey: secretKey, Region: region, objects: make(map[string]object)}
+}
+
+// Len returns the number of stored objects.
+func (f *Fake) Len() int {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    return len(f.objects)
+}
+
+// logf logs through Logf when it is set.
+func (f *Fake) logf(format string, args ...any) {
+    if f.Logf != nil {
+        f.Logf(format, args...)
+    }
+}
+
+// ServeHTTP handles an object request.
+func (f *Fake) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    path := strings.TrimPrefix(r.URL.Path, "/")
+    bucket, key, ok := strings.Cut(path, "/")
+    if !ok || bucket == "" || key == "" {
+        s3Error(w, http.StatusBadRequest, "InvalidRequest", "only path-style object requests are supported")
+        return
+    }
+    body, err := io.ReadAll(r.Body)
+    if err != nil {
+        s3Error(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+        return
+    }
+    if code, msg := f.authenticate(r, body); code != "" {
+        s3Error(w, http.StatusForbidden, code, msg)
+        return
+    }
+    id := bucket + "/" + key
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    switch r.Method {
+    case http.MethodPut:
+        f.objects[id] = object{data: body, contentType: r.Header.Get("Content-Type"), modified: time.Now()}
+        f.logf("PUT %s (%d bytes)", id, len(body))
+        w.WriteHeader(http.StatusOK)
+    case http.MethodGet, http.MethodHead:
+        obj, ok := f.objects[id]
+        if !ok {
+            s3Error(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+            return
+        }
+        ct := obj.contentType
+        if ct == "" {
+            ct = "binary/octet-stream"
+        }
+        w.Header().Set("Content-Type", ct)
+        w.Header().Set("Content-Length", strconv.Itoa(len(obj.data)))
+        w.Header().Set("Last-Modified", obj.modified.UTC().Format(http.TimeFormat))
+        w.WriteHeader(http.StatusOK)
+        if r.Method == http.MethodGet {
+            w.Write(obj.data)
+        }
+    case http.MethodDelete:
+        delete(f.objects, id)
+        f.logf("DELETE %s", id)
+        w.WriteHeader(http.StatusNoContent)
+    default:
+        s3Error(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource.")
+    }
+}
+
+// authenticate checks the Signature Version 4 Authorization header of
+// r, whose body is body. It returns an S3 error code and message when
+// the request is not properly signed.
+func (f *Fake) authenticate(r *http.Request, body []byte) (string, string) {
+    auth := r.Header.Get("Authorization")
+    if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 ") {
+        return "AccessDenied", "missing or unsupported Authorization header"
+    }
+    fields := map[string]string{}
+    for _, part := range strings.Split(strings.TrimPrefix(auth, "AWS4-HMAC-SHA256 "), ",") {
+        k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+        fields[k] = v
+    }
+    cred := strings.Split(fields["Credential"], "/")
+    if len(cred) != 5 || cred[0] != f.AccessKey {
+        return "InvalidAccessKeyId", "The AWS Access Key Id you provided does not exist in our records."
+    }
+    t, err := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date"))
+    if err != nil || cred[1] != t.Format("20060102") || cred[2] != f.Region || cred[3] != "s3" || cred[4] != "aws4_request" {
+        return "AuthorizationHeaderMalformed", "The credential scope does not match the request."
+    }
+    if d := time.Since(t); d > maxSkew || d < -maxSkew {
+        return "RequestTimeTooSkewed", "The difference between the request time and the current time is too large."
+    }
+    // The payload must be what the client says it signed.
+    sum := sha256.Sum256(body)
+    if hex.EncodeToString(sum[:]) != r.Header.Get("X-Amz-Content-Sha256") {
+        return "XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed."
+    }
+    signed := strings.Split(fields["SignedHeaders"], ";")
+    want := storage.Signature(r, signed, f.SecretKey, f.Region, t)
+    if !hmac.Equal([]byte(want), []byte(fields["Signature"])) {
+        return "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided."
+    }
+    return "", ""
+}
+
+// s3Error writes an error in the XML format S3 uses.
+func s3Error(w http.ResponseWriter, status int, code, msg string) {
+    w.Header().Set("Content-Type", "application/xml")
+    w.WriteHeader(status)
+    xml.NewEncoder(w).Encode(struct {
+        XMLName xml.Name `xml:"Error"`
+        Code    string
+        Message string
+    }{Code: code, Message: msg})
+}
@@ -0,0 +1,67 @@
+package storage
+
+// This package stores uploaded files. Handlers talk to the Storage
+// interface so the backend can be chosen at startup: Local keeps files
+// in a directory next to the database, while S3 puts them in a bucket
+// of Amazon S3 or any service speaking the same protocol, such as
+// MinIO. Either way the forum serves the files itself, so links do not
+// depend on the backend and buckets can stay private.
+//
+// Objects are addressed by keys made of lowercase letters, digits and
+// the characters "/", "_", "-" and ".", such as
+// "images/0f3a….jpg". The forum generates all keys, so the strict
+// alphabet costs nothing and keeps keys safe as file names and in
+// URLs.
+
+import (
+    "context"
+    "errors"
+    "io"
+    "strings"
+)
+
+// ErrNotFound is returned by Get for keys that hold no object.
+var ErrNotFound = errors.New("storage: object not found")
+
+// ErrInvalidKey is returned for keys outside the allowed alphabet.
+var ErrInvalidKey = errors.New("storage: invalid key")
+
+// Object is a stored file being read. The caller must close Body.
+type Object struct {
+    Body        io.ReadCloser
+    ContentType string
+    Size        int64
+}
+
+// Storage keeps objects under keys. Implementations must be safe for
+// concurrent use.
+type Storage interface {
+    // Put stores data under key, replacing any previous object.
+    Put(ctx context.Context, key, contentType string, data []byte) error
+    // Get opens the object stored under key.
+    Get(ctx context.Context, key string) (*Object, error)
+    // Delete removes the object under key. Deleting a missing object
+    // is not an error.
+    Delete(ctx context.Context, key string) error
+}
+
+// ValidKey reports whether key may be used with a Storage.
+func ValidKey(key string) bool {
+    if key == "" || len(key) > 200 || key[0] == '/' || strings.HasSuffix(key, "/") {
+        return false
+    }
+    for _, part := range strings.Split(key, "/") {
+        if part == "" || part == "." || part == ".." {
+            return false
+        }
+    }
+    for _, r := range key {
+        switch {
+        case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+        case r == '/', r == '_', r == '-', r == '.':
+        default:
+            return false
+        }
+    }
+    return true
+}
@@ -0,0 +1,160 @@
+package storage_test
+
+// Tests of the Storage contract. The same checks run against every
+// backend: Local in a temporary directory and S3 against the in-memory
+// stand-in of the s3test package, served by net/http/httptest, which
+// also checks the request signatures.
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "io"
+    "net/http/httptest"
+    "testing"
+
+    "forum/internal/storage"
+    "forum/internal/storage/s3test"
+)
+
+// backends returns a fresh instance of every Storage implementation.
+func backends(t *testing.T) map[string]storage.Storage {
+    fake := s3test.New("forum", "secret", "us-east-1")
+    srv := httptest.NewServer(fake)
+    t.Cleanup(srv.Close)
+    return map[string]storage.Storage{
+        "local": &storage.Local{Dir: t.TempDir()},
+        "s3": &storage.S3{
+            Endpoint:  srv.URL,
+            Region:    "us-east-1",
+            Bucket:    "forum",
+            AccessKey: "forum",
+            SecretKey: "secret",
+            PathStyle: true,
+            Client:    srv.Client(),
+        },
+    }
+}
+
+// read returns the contents of the object under key.
+func read(t *testing.T, s storage.Storage, key string) (*storage.Object, []byte) {
+    t.Helper()
+    obj, err := s.Get(context.Background(), key)
+    if err != nil {
+        t.Fatalf("Get(%q): %v", key, err)
+    }
+    defer obj.Body.Close()
+    data, err := io.ReadAll(obj.Body)
+    if err != nil {
+        t.Fatalf("reading %q: %v", key, err)
+    }
+    return obj, data
+}
+
+func TestStorageContract(t *testing.T) {
+    ctx := context.Background()
+    for name, s := range backends(t) {
+        t.Run(name, func(t *testing.T) {
+            key := "images/0f3a/photo.jpg"
+            data := []byte("\xff\xd8\xff not really a jpeg")
+            if err := s.Put(ctx, key, "image/jpeg", data); err != nil {
+                t.Fatalf("Put: %v", err)
+            }
+            obj, got := read(t, s, key)
+            if !bytes.Equal(got, data) {
+                t.Fatalf("Get returned %q, want %q", got, data)
+            }
+            if obj.ContentType != "image/jpeg" || obj.Size != int64(len(data)) {
+                t.Fatalf("Get returned type %q and size %d", obj.ContentType, obj.Size)
+            }
+
+            // Put replaces the object.
+            if err := s.Put(ctx, key, "image/jpeg", []byte("second")); err != nil {
+                t.Fatalf("second Put: %v", err)
+            }
+            if _, got := read(t, s, key); string(got) != "second" {
+                t.Fatalf("after replacing, Get returned %q", got)
+            }
+
+            // Empty objects are objects too.
+            if err := s.Put(ctx, "empty.png", "image/png", nil); err != nil {
+                t.Fatalf("Put of an empty object: %v", err)
+            }
+            if obj, got := read(t, s, "empty.png"); len(got) != 0 || obj.Size != 0 {
+                t.Fatalf("empty object came back as %q", got)
+            }
+
+            if _, err := s.Get(ctx, "images/missing.jpg"); !errors.Is(err, storage.ErrNotFound) {
+                t.Fatalf("Get of a missing key returned %v, want ErrNotFound", err)
+            }
+
+            if err := s.Delete(ctx, key); err != nil {
+                t.Fatalf("Delete: %v", err)
+            }
+            if _, err := s.Get(ctx, key); !errors.Is(err, storage.ErrNotFound) {
+                t.Fatalf("Get after Delete returned %v, want ErrNotFound", err)
+            }
+            if err := s.Delete(ctx, key); err != nil {
+                t.Fatalf("Delete of a missing key returned %v", err)
+            }
+
+            for _, bad := range []string{"", "../secret", "images/../x.jpg", "/abs.jpg", "Upper.jpg", "a b.jpg"} {
+                if err := s.Put(ctx, bad, "image/jpeg", data); !errors.Is(err, storage.ErrInvalidKey) {
+                    t.Errorf("Put(%q) returned %v, want ErrInvalidKey", bad, err)
+                }
+                if _, err := s.Get(ctx, bad); !errors.Is(err, storage.ErrInvalidKey) {
+                    t.Errorf("Get(%q) returned %v, want ErrInvalidKey", bad, err)
+                }
+                if err := s.Delete(ctx, bad); !errors.Is(err, storage.ErrInvalidKey) {
+                    t.Errorf("Delete(%q) returned %v, want ErrInvalidKey", bad, err)
+                }
+            }
+        })
+    }
+}
+
+func TestS3RejectsWrongSecret(t *testing.T) {
+    fake := s3test.New("forum", "secret", "us-east-1")
+    srv := httptest.NewServer(fake)
+    defer srv.Close()
+    s := &storage.S3{Endpoint: srv.URL, Region: "us-east-1", Bucket: "forum", AccessKey: "forum", SecretKey: "wrong", PathStyle: true}
+    err := s.Put(context.Background(), "a.png", "image/png", []byte("x"))
+    if err == nil {
+        t.Fatal("Put with the wrong secret succeeded")
+    }
+    if fake.Len() != 0 {
+        t.Fatal("the fake stored an object from a badly signed request")
+    }
+    if _, err := s.Get(context.Background(), "a.png"); err == nil || errors.Is(err, storage.ErrNotFound) {
+        t.Fatalf("Get with the wrong secret returned %v, want an access error", err)
+    }
+}
+
+func TestValidKey(t *testing.T) {
+    tests := []struct {
+        key string
+        ok  bool
+    }{
+        {"images/0f3a.jpg", true},
+        {"avatars/12/thumb_0f3a-1.png", true},
+        {"a", true},
+        {"", false},
+        {"/images/a.jpg", false},
+        {"images/", false},
+        {"images//a.jpg", false},
+        {"images/./a.jpg", false},
+        {"images/../a.jpg", false},
+        {"..", false},
+        {"Images/a.jpg", false},
+        {"images/a b.jpg", false},
+        {"images/a%2f.jpg", false},
+        {`images\a.jpg`, false},
+        {"images/ä.jpg", false},
+        {string(bytes.Repeat([]byte("a"), 201)), false},
+    }
+    for _, tt := range tests {
+        if got := storage.ValidKey(tt.key); got != tt.ok {
+            t.Errorf("ValidKey(%q) = %v, want %v", tt.key, got, tt.ok)
+        }
+    }
+}
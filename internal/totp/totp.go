@@ -0,0 +1,109 @@
+package totp
+
+// This package implements time-based one-time passwords as described
+// in RFC 6238, the scheme used by authenticator apps such as Google
+// Authenticator, Aegis or 1Password. Codes are six digits derived from
+// a shared secret and the current 30 second time step with HMAC-SHA1.
+// Secrets are exchanged as base32 text, usually inside an otpauth://
+// URI that the app imports by scanning it as a QR code or opening it
+// as a link.
+
+import (
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha1"
+    "crypto/subtle"
+    "encoding/base32"
+    "encoding/binary"
+    "fmt"
+    "net/url"
+    "strings"
+    "time"
+)
+
+const (
+    // Period is the length of a time step.
+    Period = 30 * time.Second
+    // Digits is the number of digits in a code.
+    Digits = 6
+    // Skew is the number of time steps before and after the current
+    // one that are also accepted, to allow for clock drift and slow
+    // typing.
+    Skew = 1
+)
+
+// encoding is base32 without padding, as expected by authenticator
+// apps.
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewSecret returns a random 160-bit secret in base32, the size
+// recommended by RFC 4226.
+func NewSecret() (string, error) {
+    b := make([]byte, 20)
+    if _, err := rand.Read(b); err != nil {
+        return "", err
+    }
+    return encoding.EncodeToString(b), nil
+}
+
+// Step returns the time step that t falls into.
+func Step(t time.Time) int64 {
+    return t.Unix() / int64(Period/time.Second)
+}
+
+// Code returns the code for secret at time step step.
+func Code(secret string, step int64) (string, error) {
+    key, err := encoding.DecodeString(strings.ToUpper(secret))
+    if err != nil {
+        return "", fmt.Errorf("totp: invalid secret: %w", err)
+    }
+    var msg [8]byte
+    binary.BigEndian.PutUint64(msg[:], uint64(step))
+    mac := hmac.New(sha1.New, key)
+    mac.Write(msg[:])
+    sum := mac.Sum(nil)
+    // Dynamic truncation (RFC 4226 section 5.3).
+    off := sum[len(sum)-1] & 0x0f
+    n := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+    return fmt.Sprintf("%0*d", Digits, n%1000000), nil
+}
+
+// Validate checks code against secret at time t, accepting Skew steps
+// on either side. It returns the matched time step, which callers
+// should remember so that a code cannot be used twice: a code is only
+// accepted when its step is later than after. Spaces in code are
+// ignored.
+func Validate(secret, code string, t time.Time, after int64) (int64, bool) {
+    code = strings.ReplaceAll(code, " ", "")
+    if len(code) != Digits {
+        return 0, false
+    }
+    now := Step(t)
+    for s := now - Skew; s <= now+Skew; s++ {
+        if s <= after {
+            continue
+        }
+        want, err := Code(secret, s)
+        if err != nil {
+            return 0, false
+        }
+        if subtle.ConstantTimeCompare([]byte(want), []byte(code)) == 1 {
+            return s, true
+        }
+    }
+    return 0, false
+}
+
+// URI returns the otpauth:// URI that enrolls secret in an
+// authenticator app. issuer names the site and account the user, and
+// both are shown in the app's list of codes.
+func URI(issuer, account, secret string) string {
+    v := url.Values{}
+    v.Set("secret", secret)
+    v.Set("issuer", issuer)
+    v.Set("algorithm", "SHA1")
+    v.Set("digits", fmt.Sprint(Digits))
+    v.Set("period", fmt.Sprint(int(Period/time.Second)))
+    label := url.PathEscape(issuer + ":" + account)
+    return "otpauth://totp/" + label + "?" + v.Encode()
+}
@@ -0,0 +1,138 @@
+package totp
+
+// Tests against the SHA-1 test vectors of RFC 6238, appendix B. The
+// RFC lists eight digit codes; six digit codes are their last six
+// digits, since both come from the same truncated value.
+
+import (
+    "net/url"
+    "strings"
+    "testing"
+    "time"
+)
+
+// rfcSecret is the ASCII key "12345678901234567890" in base32.
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+var rfcVectors = []struct {
+    unix int64
+    code string
+}{
+    {59, "94287082"},
+    {1111111109, "07081804"},
+    {1111111111, "14050471"},
+    {1234567890, "89005924"},
+    {2000000000, "69279037"},
+    {20000000000, "65353130"},
+}
+
+func TestCodeRFC6238(t *testing.T) {
+    for _, v := range rfcVectors {
+        got, err := Code(rfcSecret, Step(time.Unix(v.unix, 0)))
+        if err != nil {
+            t.Fatal(err)
+        }
+        if want := v.code[2:]; got != want {
+            t.Errorf("code at %d is %s, want %s", v.unix, got, want)
+        }
+    }
+    // Secrets are accepted in lower case, as some apps show them.
+    if got, _ := Code(strings.ToLower(rfcSecret), 1); got != "287082" {
+        t.Errorf("lower-case secret gave %s", got)
+    }
+    if _, err := Code("not base32!", 1); err == nil {
+        t.Error("Code accepted an invalid secret")
+    }
+}
+
+func TestValidate(t *testing.T) {
+    at := time.Unix(1111111111, 0)
+    step := Step(at)
+    code, _ := Code(rfcSecret, step)
+
+    got, ok := Validate(rfcSecret, code, at, 0)
+    if !ok || got != step {
+        t.Fatalf("Validate = %d, %v; want %d, true", got, ok, step)
+    }
+    // Spaces, as in "123 456", are ignored.
+    if _, ok := Validate(rfcSecret, code[:3]+" "+code[3:], at, 0); !ok {
+        t.Error("code with a space was rejected")
+    }
+
+    // One step of clock drift either way is tolerated, two are not.
+    for _, tt := range []struct {
+        offset time.Duration
+        ok     bool
+    }{
+        {-Period, true},
+        {Period, true},
+        {-2 * Period, false},
+        {2 * Period, false},
+    } {
+        if _, ok := Validate(rfcSecret, code, at.Add(tt.offset), 0); ok != tt.ok {
+            t.Errorf("code checked %v away: accepted = %v, want %v", tt.offset, ok, tt.ok)
+        }
+    }
+
+    for _, bad := range []string{"", "12345", "1234567", "abcdef", "000000"} {
+        if _, ok := Validate(rfcSecret, bad, at, 0); ok {
+            t.Errorf("Validate accepted %q", bad)
+        }
+    }
+}
+
+func TestValidateRejectsReuse(t *testing.T) {
+    at := time.Unix(1234567890, 0)
+    code, _ := Code(rfcSecret, Step(at))
+    step, ok := Validate(rfcSecret, code, at, 0)
+    if !ok {
+        t.Fatal("first use rejected")
+    }
+    // The same code again, within the same time step or within the
+    // skew of the next, is refused once its step has been used.
+    for _, later := range []time.Duration{0, time.Second, Period} {
+        if _, ok := Validate(rfcSecret, code, at.Add(later), step); ok {
+            t.Errorf("code reused %v later was accepted", later)
+        }
+    }
+    // So is the code of the step before.
+    prev, _ := Code(rfcSecret, step-1)
+    if _, ok := Validate(rfcSecret, prev, at, step); ok {
+        t.Error("code of an earlier step was accepted after a later one")
+    }
+    // The code of the next step is still fine.
+    next, _ := Code(rfcSecret, step+1)
+    if got, ok := Validate(rfcSecret, next, at.Add(Period), step); !ok || got != step+1 {
+        t.Errorf("next code: %d, %v", got, ok)
+    }
+}
+
+func TestNewSecret(t *testing.T) {
+    s, err := NewSecret()
+    if err != nil {
+        t.Fatal(err)
+    }
+    key, err := encoding.DecodeString(s)
+    if err != nil || len(key) != 20 {
+        t.Fatalf("secret %q decodes to %d bytes (%v)", s, len(key), err)
+    }
+    if other, _ := NewSecret(); other == s {
+        t.Fatal("two secrets are equal")
+    }
+}
+
+func TestURI(t *testing.T) {
+    u, err := url.Parse(URI("My Forum", "alice@example.com", rfcSecret))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/My Forum:alice@example.com" {
+        t.Fatalf("URI %s", u)
+    }
+    q := u.Query()
+    for k, want := range map[string]string{"secret": rfcSecret, "issuer": "My Forum", "algorithm": "SHA1", "digits": "6", "period": "30"} {
+        if q.Get(k) != want {
+            t.Errorf("%s = %q, want %q", k, q.Get(k), want)
+        }
+    }
+}
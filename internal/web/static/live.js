@@ -0,0 +1,122 @@
+// live.js keeps a post page up to date while it is open. It listens to
+// the post's event stream (/post/events, see internal/app/live.go) and
+// adds comments and reaction counts as they change. The page works
+// the same without it: forms post and reload as usual, and readers
+// reload to see what others wrote.
+//
+// New comments arrive rendered by the server, with the reply and
+// reaction forms of the reader. Top-level comments go to the end of
+// the list and replies below their parent. Replies that would be
+// nested deeper than the page shows, like those behind "continue this
+// thread" links, are announced with a link instead.
+(function () {
+  "use strict";
+
+  var section = document.querySelector("section[data-live]");
+  if (!section || !window.EventSource) {
+    return;
+  }
+  var maxDepth = parseInt(section.getAttribute("data-max-depth"), 10) || 5;
+  var inThread = section.hasAttribute("data-thread");
+  var list = section.querySelector(".comment-list");
+  var count = section.querySelector(".comment-count");
+  var notice = null;
+
+  // element turns the HTML of one comment into a DOM node.
+  function element(html) {
+    var t = document.createElement("template");
+    t.innerHTML = html.trim();
+    return t.content.firstElementChild;
+  }
+
+  // child returns the direct child of parent matching selector.
+  function child(parent, selector) {
+    for (var i = 0; i < parent.children.length; i++) {
+      if (parent.children[i].matches(selector)) {
+        return parent.children[i];
+      }
+    }
+    return null;
+  }
+
+  // announce points the reader to a reply that cannot be shown here.
+  function announce(c) {
+    if (!notice) {
+      notice = document.createElement("p");
+      notice.className = "notice live-notice";
+      section.insertBefore(notice, list);
+    }
+    var url = new URL(window.location.href);
+    url.searchParams.set("thread", String(c.parent_id));
+    url.hash = "c" + c.id;
+    notice.textContent = "There are new replies further down a thread. ";
+    var link = document.createElement("a");
+    link.href = url.pathname + url.search + url.hash;
+    link.textContent = "Show the newest";
+    notice.appendChild(link);
+  }
+
+  function addComment(c) {
+    if (document.getElementById("c" + c.id)) {
+      return;
+    }
+    if (count) {
+      count.textContent = String((parseInt(count.textContent, 10) || 0) + 1);
+    }
+    var node = element(c.html);
+    if (!node) {
+      return;
+    }
+    var depth = 0;
+    var container = list;
+    if (c.parent_id === null) {
+      // A thread view only shows one branch.
+      if (inThread) {
+        return;
+      }
+    } else {
+      var parent = document.getElementById("c" + c.parent_id);
+      if (!parent) {
+        return;
+      }
+      depth = (parseInt(parent.getAttribute("data-depth"), 10) || 0) + 1;
+      if (depth >= maxDepth) {
+        announce(c);
+        return;
+      }
+      var details = child(parent, "details");
+      container = child(details, ".replies");
+      if (!container) {
+        container = document.createElement("div");
+        container.className = "replies";
+        details.insertBefore(container, child(details, ".continue-thread"));
+      }
+    }
+    var empty = child(list, ".no-comments");
+    if (empty) {
+      empty.remove();
+    }
+    node.setAttribute("data-depth", String(depth));
+    node.classList.add("live-new");
+    container.appendChild(node);
+  }
+
+  function updateReactions(r) {
+    var box = document.querySelector('[data-reactions="' + r.type + "-" + r.id + '"]');
+    if (!box) {
+      return;
+    }
+    box.querySelector(".like-count").textContent = String(r.likes);
+    box.querySelector(".dislike-count").textContent = String(r.dislikes);
+  }
+
+  // The browser reconnects by itself after network trouble, sending
+  // the ID of the last comment it received so that none are missed.
+  var source = new EventSource(section.getAttribute("data-live"));
+  source.addEventListener("comment", function (e) {
+    addComment(JSON.parse(e.data));
+  });
+  source.addEventListener("reactions", function (e) {
+    updateReactions(JSON.parse(e.data));
+  });
+})();
@@ -0,0 +1,40 @@
+package web
+
+// This package bundles the HTML templates and static files (styles,
+// scripts and images) into the binary, so that the forum runs from any
+// working directory without a copy of the source tree. The migrations
+// are embedded the same way by the db package. For theme work main can
+// read both directories from disk instead; see the -dev flag.
+
+import (
+    "embed"
+    "io/fs"
+)
+
+//go:embed templates/*.html
+var templateFiles embed.FS
+
+//go:embed static
+var staticFiles embed.FS
+
+// Templates returns the embedded templates directory, with the files
+// at its root.
+func Templates() fs.FS {
+    return sub(templateFiles, "templates")
+}
+
+// Static returns the embedded static directory, with the files at its
+// root.
+func Static() fs.FS {
+    return sub(staticFiles, "static")
+}
+
+// sub returns the directory dir of fsys. The directories are fixed by
+// the embed patterns above, so failing is a programming error.
+func sub(fsys fs.FS, dir string) fs.FS {
+    s, err := fs.Sub(fsys, dir)
+    if err != nil {
+        panic(err)
+    }
+    return s
+}
@@ -0,0 +1,116 @@
+package webhook
+
+// This package sends the forum's outgoing webhooks and lets receivers
+// check them. A webhook is an HTTP POST of a JSON document to a URL
+// chosen by an admin, made when something happens on the forum, such
+// as a new post. The queue that decides what to send and retries
+// failed deliveries lives in the app package; this package only knows
+// how a single delivery looks on the wire.
+//
+// Every request carries these headers:
+//
+//   X-Forum-Event      the event name, such as "post.created"
+//   X-Forum-Delivery   the delivery ID, the same on every retry
+//   X-Forum-Timestamp  when the request was signed, in Unix seconds
+//   X-Forum-Signature  "sha256=" and the hex HMAC-SHA256, keyed with
+//                      the webhook's secret, of the timestamp, a dot
+//                      and the body
+//
+// Signing the timestamp lets receivers refuse old requests replayed by
+// someone who captured them, and the delivery ID lets them ignore a
+// retry of a request they already handled.
+
+import (
+    "bytes"
+    "context"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "fmt"
+    "io"
+    "net/http"
+    "strconv"
+    "time"
+)
+
+// Header names.
+const (
+    HeaderEvent     = "X-Forum-Event"
+    HeaderDelivery  = "X-Forum-Delivery"
+    HeaderTimestamp = "X-Forum-Timestamp"
+    HeaderSignature = "X-Forum-Signature"
+)
+
+// MaxSkew is how far the timestamp of a request may be from the clock
+// of the receiver for Verify to accept it.
+const MaxSkew = 5 * time.Minute
+
+// maxResponse is how much of a response body Send keeps for the
+// delivery log.
+const maxResponse = 1024
+
+// Sign returns the X-Forum-Signature value for body sent at Unix time
+// ts.
+func Sign(secret string, ts int64, body []byte) string {
+    mac := hmac.New(sha256.New, []byte(secret))
+    mac.Write([]byte(strconv.FormatInt(ts, 10)))
+    mac.Write([]byte("."))
+    mac.Write(body)
+    return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature and timestamp headers of a request whose
+// body is body against secret, at time now.
+func Verify(secret string, h http.Header, body []byte, now time.Time) error {
+    ts, err := strconv.ParseInt(h.Get(HeaderTimestamp), 10, 64)
+    if err != nil {
+        return fmt.Errorf("missing or invalid %s header", HeaderTimestamp)
+    }
+    if d := now.Sub(time.Unix(ts, 0)); d > MaxSkew || d < -MaxSkew {
+        return fmt.Errorf("timestamp is %v away from the clock", d.Round(time.Second))
+    }
+    if !hmac.Equal([]byte(Sign(secret, ts, body)), []byte(h.Get(HeaderSignature))) {
+        return fmt.Errorf("signature does not match")
+    }
+    return nil
+}
+
+// Result describes the response to a delivery. Status is zero when no
+// response arrived, in which case Send also returns an error.
+type Result struct {
+    Status   int
+    Body     string
+    Duration time.Duration
+}
+
+// Send posts body to url as delivery id of event, signed with secret.
+// Responses with a status other than 2xx are returned as errors along
+// with their Result.
+func Send(ctx context.Context, client *http.Client, url, secret, event string, id int64, body []byte) (Result, error) {
+    var res Result
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+    if err != nil {
+        return res, err
+    }
+    ts := time.Now().Unix()
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("User-Agent", "forum-webhooks/1")
+    req.Header.Set(HeaderEvent, event)
+    req.Header.Set(HeaderDelivery, strconv.FormatInt(id, 10))
+    req.Header.Set(HeaderTimestamp, strconv.FormatInt(ts, 10))
+    req.Header.Set(HeaderSignature, Sign(secret, ts, body))
+    start := time.Now()
+    resp, err := client.Do(req)
+    res.Duration = time.Since(start)
+    if err != nil {
+        return res, err
+    }
+    defer resp.Body.Close()
+    data, _ := io.ReadAll(io.LimitReader(resp.Body, maxResponse))
+    res.Status = resp.StatusCode
+    res.Body = string(data)
+    if resp.StatusCode < 200 || resp.StatusCode > 299 {
+        return res, fmt.Errorf("receiver answered %s", resp.Status)
+    }
+    return res, nil
+}
@@ -0,0 +1,128 @@
+package webhook
+
+// Tests of single deliveries against a local receiver. The receiver
+// computes the expected signature itself, straight from the documented
+// format, rather than with Sign.
+
+import (
+    "context"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+)
+
+const testSecret = "s3cret"
+
+func TestSendSignsTheBody(t *testing.T) {
+    body := []byte(`{"event":"post.created","post":{"id":1}}`)
+    var got http.Header
+    var gotBody []byte
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        got = r.Header.Clone()
+        gotBody, _ = io.ReadAll(r.Body)
+        io.WriteString(w, "thanks")
+    }))
+    defer srv.Close()
+
+    res, err := Send(context.Background(), srv.Client(), srv.URL, testSecret, "post.created", 42, body)
+    if err != nil {
+        t.Fatalf("Send: %v", err)
+    }
+    if res.Status != http.StatusOK || res.Body != "thanks" {
+        t.Fatalf("got result %+v", res)
+    }
+    if string(gotBody) != string(body) {
+        t.Fatalf("receiver got body %q, want %q", gotBody, body)
+    }
+    if got.Get(HeaderEvent) != "post.created" || got.Get(HeaderDelivery) != "42" {
+        t.Fatalf("event %q, delivery %q", got.Get(HeaderEvent), got.Get(HeaderDelivery))
+    }
+    if ct := got.Get("Content-Type"); ct != "application/json" {
+        t.Fatalf("Content-Type %q", ct)
+    }
+    ts, err := strconv.ParseInt(got.Get(HeaderTimestamp), 10, 64)
+    if err != nil || time.Since(time.Unix(ts, 0)) > time.Minute {
+        t.Fatalf("bad timestamp %q", got.Get(HeaderTimestamp))
+    }
+    mac := hmac.New(sha256.New, []byte(testSecret))
+    io.WriteString(mac, got.Get(HeaderTimestamp)+".")
+    mac.Write(body)
+    want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+    if sig := got.Get(HeaderSignature); sig != want {
+        t.Fatalf("signature %q, want %q", sig, want)
+    }
+    if err := Verify(testSecret, got, gotBody, time.Now()); err != nil {
+        t.Fatalf("Verify rejected a genuine request: %v", err)
+    }
+}
+
+func TestSendReportsFailures(t *testing.T) {
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.WriteHeader(http.StatusInternalServerError)
+        io.WriteString(w, strings.Repeat("x", 2*maxResponse))
+    }))
+    defer srv.Close()
+    res, err := Send(context.Background(), srv.Client(), srv.URL, testSecret, "ping", 1, []byte(`{}`))
+    if err == nil {
+        t.Fatal("Send succeeded on a 500 response")
+    }
+    if res.Status != http.StatusInternalServerError {
+        t.Fatalf("status %d, want 500", res.Status)
+    }
+    if len(res.Body) != maxResponse {
+        t.Fatalf("kept %d bytes of the response, want %d", len(res.Body), maxResponse)
+    }
+
+    // No response at all.
+    srv.Close()
+    res, err = Send(context.Background(), http.DefaultClient, srv.URL, testSecret, "ping", 1, []byte(`{}`))
+    if err == nil || res.Status != 0 {
+        t.Fatalf("got %+v, %v; want an error without status", res, err)
+    }
+}
+
+func TestVerify(t *testing.T) {
+    body := []byte(`{"event":"ping"}`)
+    now := time.Now()
+    signed := func(secret string, at time.Time, body []byte) http.Header {
+        h := http.Header{}
+        ts := at.Unix()
+        h.Set(HeaderTimestamp, strconv.FormatInt(ts, 10))
+        h.Set(HeaderSignature, Sign(secret, ts, body))
+        return h
+    }
+    tests := []struct {
+        name string
+        h    http.Header
+        body []byte
+        ok   bool
+    }{
+        {"genuine", signed(testSecret, now, body), body, true},
+        {"slightly skewed clock", signed(testSecret, now.Add(-time.Minute), body), body, true},
+        {"changed body", signed(testSecret, now, body), []byte(`{"event":"pong"}`), false},
+        {"other secret", signed("other", now, body), body, false},
+        {"too old", signed(testSecret, now.Add(-MaxSkew-time.Minute), body), body, false},
+        {"from the future", signed(testSecret, now.Add(MaxSkew+time.Minute), body), body, false},
+        {"no headers", http.Header{}, body, false},
+    }
+    for _, tt := range tests {
+        err := Verify(testSecret, tt.h, tt.body, now)
+        if (err == nil) != tt.ok {
+            t.Errorf("%s: Verify returned %v", tt.name, err)
+        }
+    }
+
+    // Changing the timestamp breaks the signature.
+    h := signed(testSecret, now, body)
+    h.Set(HeaderTimestamp, strconv.FormatInt(now.Unix()+1, 10))
+    if Verify(testSecret, h, body, now) == nil {
+        t.Error("Verify accepted a changed timestamp")
+    }
+}